@@ -5,38 +5,67 @@ import (
 	"strconv"
 	"subframe/server/database"
 	"subframe/server/jobqueue"
+	"subframe/server/lifecycle"
 	"subframe/server/logger"
 	"subframe/server/networking"
 	"subframe/server/settings"
 	. "subframe/status"
 	"subframe/structs/node"
+	"sync/atomic"
 )
 
 var log = logger.Logger{Prefix: "bootstrapper/Main"}
 
+//Bootstrapper pulls the known nodes of settings.BootstrapNode into its NodeStore
+type Bootstrapper struct {
+	nodes        database.NodeStore
+	bootstrapped atomic.Bool
+}
+
+//New returns a Bootstrapper adding the nodes it pulls to nodes
+func New(nodes database.NodeStore) *Bootstrapper {
+	return &Bootstrapper{nodes: nodes}
+}
+
 //Bootstrap bootstraps the local node, if settings.BootstrapNode is set
-func Bootstrap() {
-	bootstrapNode := settings.BootstrapNode
+func (b *Bootstrapper) Bootstrap() {
+	networking.RegisterReadinessCheck("bootstrap", func() string {
+		if !b.bootstrapped.Load() {
+			return "node has not been bootstrapped yet"
+		}
+		return ""
+	})
+
+	bootstrapNode := settings.Get().BootstrapNode
 	if bootstrapNode == "" {
 		log.Info(OK, "No BootstrapNode set. Skipping Bootstrapping.")
+		b.bootstrapped.Store(true)
 		return
 	}
 
-	log.Info(InProgress, "Bootstrapping with Node "+settings.BootstrapNode+"...")
+	log.Info(InProgress, "Bootstrapping with Node "+bootstrapNode+"...")
 
-	if database.ClearNodeTables() != 200 {
+	if b.nodes.ClearNodeTables() != OK {
 		log.Fatal(DBWriteError, "Could not clear databases before bootstrapping.")
 	}
-	pullStorageNodes()
-	pullCoordinatorNodes()
+	//Requests fail once the server is shutting down, which interrupts bootstrapping instead of failing it
+	if !b.pullStorageNodes(bootstrapNode) || !b.pullCoordinatorNodes(bootstrapNode) {
+		return
+	}
+	b.bootstrapped.Store(true)
 }
 
-func pullStorageNodes() {
+//pullStorageNodes adds the StorageNodes known to bootstrapNode, and returns false if it was interrupted by a shutdown
+func (b *Bootstrapper) pullStorageNodes(bootstrapNode string) (pulled bool) {
 	log.Info(InProgress, "Pulling StorageNodes...")
-	status, response := networking.SendNodeRequest(networking.NODE_STORAGE, settings.BootstrapNode, "/control/get-storage-nodes", "")
+	status, response := networking.SendNodeRequest(networking.NODE_STORAGE, bootstrapNode, "/control/get-storage-nodes", "")
 	var storageNodes []node.Node
 	err := json.Unmarshal([]byte(response), &storageNodes)
 
+	if status != OK && lifecycle.ShuttingDown() {
+		log.Warn(status, "Stopped pulling StorageNodes, as the server is shutting down.")
+		return false
+	}
 	if status != OK {
 		log.Fatal(status, "Error getting StorageNodes")
 	}
@@ -54,7 +83,9 @@ func pullStorageNodes() {
 		}
 		for _, node := range storageNodes {
 			node.Ping = networking.Ping(node.Address)
-			database.AddStorageNode(node)
+			//The identity key is taken from the node itself rather than the listing, as it raises the rate limits of its requests
+			_, node.IdentityKey = networking.FetchIdentityKey(node.Address)
+			b.nodes.AddStorageNode(node)
 			log.Info(OK, "Added StorageNode "+node.Address+" with Ping "+strconv.Itoa(node.Ping)+" to Database")
 		}
 	}
@@ -62,18 +93,22 @@ func pullStorageNodes() {
 		Task: task,
 		Data: storageNodes,
 	}
-	select {
-	case jobqueue.Queue <- job:
-	}
+	jobqueue.Enqueue(job)
 	log.Info(OK, "Pulled StorageNodes.")
+	return true
 }
 
-func pullCoordinatorNodes() {
+//pullCoordinatorNodes adds the CoordinatorNodes known to bootstrapNode, and returns false if it was interrupted by a shutdown
+func (b *Bootstrapper) pullCoordinatorNodes(bootstrapNode string) (pulled bool) {
 	log.Info(InProgress, "Pulling CoordinatorNodes...")
-	status, response := networking.SendNodeRequest(networking.NODE_STORAGE, settings.BootstrapNode, "/control/get-coordinator-nodes", "")
+	status, response := networking.SendNodeRequest(networking.NODE_STORAGE, bootstrapNode, "/control/get-coordinator-nodes", "")
 	var coordinatorNodes []node.Node
 	err := json.Unmarshal([]byte(response), &coordinatorNodes)
 
+	if status != OK && lifecycle.ShuttingDown() {
+		log.Warn(status, "Stopped pulling CoordinatorNodes, as the server is shutting down.")
+		return false
+	}
 	if status != OK {
 		log.Fatal(status, "Error getting Coordinator Nodes")
 	}
@@ -91,7 +126,9 @@ func pullCoordinatorNodes() {
 		}
 		for _, node := range coordinatorNodes {
 			node.Ping = networking.Ping(node.Address)
-			database.AddCoordinatorNode(node)
+			//The identity key is taken from the node itself rather than the listing, as it raises the rate limits of its requests
+			_, node.IdentityKey = networking.FetchIdentityKey(node.Address)
+			b.nodes.AddCoordinatorNode(node)
 			log.Info(OK, "Added CoordinatorNode "+node.Address+" with Ping "+strconv.Itoa(node.Ping)+" to Database")
 		}
 	}
@@ -99,8 +136,7 @@ func pullCoordinatorNodes() {
 		Task: task,
 		Data: coordinatorNodes,
 	}
-	select {
-	case jobqueue.Queue <- job:
-	}
+	jobqueue.Enqueue(job)
 	log.Info(OK, "Pulled CoordinatorNodes.")
+	return true
 }
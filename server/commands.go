@@ -0,0 +1,136 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"subframe/server/database"
+	"subframe/server/keyring"
+	"subframe/server/settings"
+	"subframe/server/snapshot"
+	"subframe/server/storage"
+	. "subframe/status"
+)
+
+var commandUsage = "Usage: [flags] snapshot <file> | [flags] restore <file> | [flags] migrate-layout | [flags] generate-key <file> | [flags] rekey"
+
+//runCommand runs a maintenance command instead of the server and returns the exit code
+func runCommand(args []string) int {
+	withoutFile := args[0] == "migrate-layout" || args[0] == "rekey"
+	if withoutFile != (len(args) == 1) || len(args) > 2 {
+		os.Stderr.WriteString(commandUsage + "\n")
+		return 2
+	}
+	dataPath := settings.Get().DataPath
+
+	switch args[0] {
+	case "generate-key":
+		//The new key becomes active, previous keys are kept below it until all messages are rekeyed
+		previous, err := os.ReadFile(args[1])
+		if err != nil && !os.IsNotExist(err) {
+			log.Error(EncryptionKeyError, "Error reading "+args[1]+": "+err.Error())
+			return 1
+		}
+		file, err := os.CreateTemp(filepath.Dir(args[1]), ".key-")
+		if err != nil {
+			log.Error(EncryptionKeyError, "Error creating "+args[1]+": "+err.Error())
+			return 1
+		}
+		defer os.Remove(file.Name())
+		_, err = file.WriteString(keyring.GenerateKey() + "\n" + string(previous))
+		if err == nil {
+			err = file.Sync()
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(file.Name(), args[1])
+		}
+		if err != nil {
+			log.Error(EncryptionKeyError, "Error writing "+args[1]+": "+err.Error())
+			return 1
+		}
+		log.Info(OK, "Added new active key to "+args[1]+". Run the rekey command to encrypt all messages with it.")
+		return 0
+	case "rekey":
+		config := settings.Get()
+		if keyring.Init(config) != OK {
+			return 1
+		}
+		backend, err := storage.NewBackend(config)
+		if err != nil {
+			log.Error(StorageDirectoryError, "Failed to open storage backend: "+err.Error())
+			return 1
+		}
+		db := database.OpenSQLite(dataPath)
+		defer db.Close()
+		_, status := db.Rekey(func(oldName string, id string, sealed bool) int {
+			return storage.RekeyMessage(backend, oldName, id, sealed)
+		})
+		//Sealed messages take up more space than plain ones
+		if usage, err := backend.Usage(); err == nil {
+			db.SetStorageUsage(usage)
+		}
+		if err = backend.Close(); err != nil {
+			log.Error(StorageWriteError, "Failed to close storage backend: "+err.Error())
+			return 1
+		}
+		if status != OK {
+			return 1
+		}
+		log.Info(OK, "All messages are encrypted with key "+keyring.KeyID()+". Previous keys can be removed from the key file.")
+		return 0
+	case "migrate-layout":
+		//Message IDs are sealed in the database if messages are encrypted
+		if keyring.Init(settings.Get()) != OK {
+			return 1
+		}
+		db := database.OpenSQLite(dataPath)
+		moved, status := storage.MigrateLayout(dataPath, db)
+		db.Close()
+		if status != OK {
+			log.Error(status, "Moved "+strconv.Itoa(moved)+" messages in "+dataPath+" to the sharded layout, others could not be moved.")
+			return 1
+		}
+		log.Info(OK, "Moved "+strconv.Itoa(moved)+" messages in "+dataPath+" to the sharded layout.")
+		return 0
+	case "snapshot":
+		//The snapshot is written next to its destination first, so a failed snapshot never replaces an older one
+		file, err := os.CreateTemp(filepath.Dir(args[1]), ".snapshot-")
+		if err != nil {
+			log.Error(SnapshotWriteError, "Error creating "+args[1]+": "+err.Error())
+			return 1
+		}
+		defer os.Remove(file.Name())
+		db := database.OpenSQLite(dataPath)
+		status := snapshot.Write(file, dataPath, db)
+		db.Close()
+		if status == OK {
+			err = file.Sync()
+		}
+		file.Close()
+		if status == OK && err == nil {
+			err = os.Rename(file.Name(), args[1])
+		}
+		if status != OK || err != nil {
+			log.Error(SnapshotWriteError, "Failed to write snapshot to "+args[1]+".")
+			return 1
+		}
+		log.Info(OK, "Wrote snapshot of "+dataPath+" to "+args[1]+".")
+		return 0
+	case "restore":
+		file, err := os.Open(args[1])
+		if err != nil {
+			log.Error(SnapshotReadError, "Error opening "+args[1]+": "+err.Error())
+			return 1
+		}
+		defer file.Close()
+		if snapshot.Restore(file, dataPath) != OK {
+			return 1
+		}
+		return 0
+	}
+	os.Stderr.WriteString("Unknown command \"" + args[0] + "\". " + commandUsage + "\n")
+	return 2
+}
@@ -2,128 +2,158 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"os"
 	"strconv"
+	"strings"
+	"subframe/server/keyring"
 	"subframe/server/logger"
-	"subframe/server/settings"
+	"subframe/server/metrics"
 	. "subframe/status"
+	"subframe/structs/mailbox"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
 	"subframe/structs/node"
 	"time"
-
-	//Importing SQLite Driver
-	_ "github.com/mattn/go-sqlite3"
 )
 
-var storageDB *sql.DB
-var coordinatorDB *sql.DB
 var log = logger.Logger{Prefix: "database/Main"}
 
-//Init initializes and / or opens the required SuBFraMe Databases
-func Init() {
+//SQLite implements MessageStore, UsageStore, NodeStore and CoordinatorIndex using the SQLite databases in the data directory.
+//If keyring is enabled, messages are stored by the blind index of their ID, and the ID itself is only kept sealed
+type SQLite struct {
+	storageDB     *sql.DB
+	coordinatorDB *sql.DB
+}
+
+//OpenSQLite initializes and / or opens the required SuBFraMe Databases in dataPath/databases
+func OpenSQLite(dataPath string) *SQLite {
 	//Initialize and / or open sqlite databases
 	log.Info(InProgress, "Opening Database Files...")
-	storageDBPath := settings.DataPath + "/databases/storage.db"
-	coordinatorDBPath := settings.DataPath + "/databases/coordinator.db"
+	databasePath := dataPath + "/databases"
+	if err := os.MkdirAll(databasePath, 0755); err != nil {
+		log.Fatal(DBOpenError, "Error creating "+databasePath+": "+err.Error())
+		return nil
+	}
 
+	log.Info(InProgress, "Using SQLite driver "+sqliteDriver+".")
+	s := &SQLite{}
 	var err error
-	storageDB, err = sql.Open("sqlite3", storageDBPath)
+	s.storageDB, err = sql.Open(sqliteDriver, databasePath+"/storage.db"+sqliteOptions)
 	if err != nil {
 		log.Fatal(DBOpenError, "Error opening StorageDatabase: "+err.Error())
-		return
+		return nil
 	}
 
-	coordinatorDB, err = sql.Open("sqlite3", coordinatorDBPath)
+	s.coordinatorDB, err = sql.Open(sqliteDriver, databasePath+"/coordinator.db"+sqliteOptions)
 	if err != nil {
 		log.Fatal(DBOpenError, "Error opening CoordinatorDatabase: "+err.Error())
-		return
-	}
-
-	log.Info(OK, "Successfully openened Database Files. Initializing Table structure if not present...")
-
-	//Create Tables for storageDatabase
-	log.Info(InProgress, "Creating tables for StorageDatabase...")
-	statement := `
-	CREATE TABLE IF NOT EXISTS messages(
-		id varchar(255) not null primary key, 
-		verified tinyint not null default 0,
-		expiresOn timestamp not null, 
-		lastCheck timestamp
-	);
-	`
-	_, err = storageDB.Exec(statement)
-	if err != nil {
-		log.Fatal(DBStructureError, "Failed to create Tables for StorageDatabase: "+err.Error())
-		return
-	}
-
-	log.Info(OK, "Created Tables for StorageDatabase.")
-
-	//Create Tables for coordinatorDatabase
-	log.Info(InProgress, "Creating tables for CoordinatorDatabase...")
-	statement = `
-	CREATE TABLE IF NOT EXISTS storageNodes(
-		address varchar(255) not null primary key, 
-		lastPing timestamp not null,
-		ping int not null
-	);
-	CREATE TABLE IF NOT EXISTS coordinatorNodes(
-		address varchar(255) not null primary key, 
-		lastPing timestamp not null,
-		ping int not null           
-	);
-	CREATE TABLE IF NOT EXISTS messages(
-		id varchar(255) not null, 
-		storageNode varchar(255) not null, 
-		reportedOn timestamp not null, 
-		verified tinyint not null default 0
-	);
-	`
-	_, err = coordinatorDB.Exec(statement)
-	if err != nil {
-		log.Fatal(DBStructureError, "Failed to create Tables for CoordinatorDatabase: "+err.Error())
-		return
-	}
-
-	log.Info(OK, "Created Tables for CoordinatorDatabase.")
+		return nil
+	}
+
+	//Write-ahead logging keeps the databases consistent if the process is killed during a write
+	for _, db := range []*sql.DB{s.storageDB, s.coordinatorDB} {
+		if _, err = db.Exec("PRAGMA journal_mode=WAL"); err != nil {
+			log.Fatal(DBOpenError, "Error enabling write-ahead logging: "+err.Error())
+			return nil
+		}
+	}
+
+	log.Info(OK, "Successfully openened Database Files. Migrating Table structure if required...")
+
+	if status := migrate(s.storageDB, "storage"); status != OK {
+		log.Fatal(status, "Failed to migrate StorageDatabase.")
+		return nil
+	}
+	if status := migrate(s.coordinatorDB, "coordinator"); status != OK {
+		log.Fatal(status, "Failed to migrate CoordinatorDatabase.")
+		return nil
+	}
+
+	s.updatePeerTableSizes()
 	log.Info(OK, "Initialized database connections.")
+	return s
 }
 
-//Close closes all Database connections
-func Close() {
+//Close checkpoints the write-ahead logs and closes all Database connections
+func (s *SQLite) Close() {
 	log.Info(InProgress, "Closing Database connections...")
-	storageDB.Close()
-	coordinatorDB.Close()
+	for name, db := range map[string]*sql.DB{"StorageDatabase": s.storageDB, "CoordinatorDatabase": s.coordinatorDB} {
+		if db == nil {
+			continue
+		}
+		if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+			log.Error(DBCloseError, "Error checkpointing "+name+": "+err.Error())
+		}
+		if err := db.Close(); err != nil {
+			log.Error(DBCloseError, "Error closing "+name+": "+err.Error())
+		}
+	}
 	log.Info(OK, "Closed database connections.")
 }
 
-//LogMessageStorage logs to the StorageNode Database that a message has been received and stored locally
-func LogMessageStorage(id string) (status int) {
-	log.Info(InProgress, "Logging new Message "+id+"...")
-	if _, c := CheckMessageStorage(id); c == true {
-		log.Error(SNDBIdConflict, "Message "+id+" already present in Database.")
+//CheckConnection checks whether both databases are open and reachable
+func (s *SQLite) CheckConnection() (status int) {
+	if s.storageDB == nil || s.coordinatorDB == nil {
+		return DBOpenError
+	}
+	if err := s.storageDB.Ping(); err != nil {
+		log.Error(DBOpenError, "StorageDatabase is not reachable: "+err.Error())
+		return DBOpenError
+	}
+	if err := s.coordinatorDB.Ping(); err != nil {
+		log.Error(DBOpenError, "CoordinatorDatabase is not reachable: "+err.Error())
+		return DBOpenError
+	}
+	return OK
+}
+
+//Snapshot writes consistent copies of storage.db and coordinator.db to dir. Writes to the databases may continue meanwhile
+func (s *SQLite) Snapshot(dir string) (status int) {
+	log.Info(InProgress, "Writing Database Snapshot to "+dir+"...")
+	for name, db := range map[string]*sql.DB{"storage.db": s.storageDB, "coordinator.db": s.coordinatorDB} {
+		//VACUUM INTO reads within a single transaction, so the copy is consistent without blocking writers
+		if _, err := db.Exec("VACUUM INTO ?", dir+"/"+name); err != nil {
+			log.Error(DBSnapshotError, "Error writing Snapshot of "+name+": "+err.Error())
+			return DBSnapshotError
+		}
+	}
+	log.Info(OK, "Wrote Database Snapshot to "+dir+".")
+	return OK
+}
+
+//LogMessageStorage logs to the StorageNode Database that a message described by metadata has been received and stored locally
+func (s *SQLite) LogMessageStorage(id string, metadata message.Metadata) (status int) {
+	defer metrics.ObserveDBQuery("storage", "log_message", time.Now())
+	log.Info(InProgress, "Logging new Message "+keyring.Index(id)+"...")
+	if _, c := s.CheckMessageStorage(id); c == true {
+		log.Error(SNDBIdConflict, "Message "+keyring.Index(id)+" already present in Database.")
 		return SNDBIdConflict
 	}
 
-	query := "INSERT INTO messages(id, expiresOn) VALUES (?, date('now', '+' || ? || ' days'))"
-	stmt, err := storageDB.Prepare(query)
+	query := "INSERT INTO messages(id, sealedId, expiresOn, sha256, size, createdOn, ttl, priority) VALUES (?, ?, datetime(?, 'unixepoch'), ?, ?, ?, ?, ?)"
+	stmt, err := s.storageDB.Prepare(query)
 	if err != nil {
-		log.Error(SNDBPrepareError, "Error logging Message "+id+" to Database: "+err.Error())
+		log.Error(SNDBPrepareError, "Error logging Message "+keyring.Index(id)+" to Database: "+err.Error())
 		return SNDBPrepareError
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(id, settings.MessageMaxStoreTime)
+	index, sealed := sealID(id)
+	_, err = stmt.Exec(index, sealed, unixTime(metadata.ExpiresOn), metadata.SHA256, metadata.Size, unixTime(metadata.CreatedOn), int64(metadata.TTL/time.Second), metadata.Priority)
 	if err != nil {
-		log.Error(SNDBWriteError, "Error logging Message "+id+" to Database: "+err.Error())
+		log.Error(SNDBWriteError, "Error logging Message "+keyring.Index(id)+" to Database: "+err.Error())
 		return SNDBWriteError
 	}
-	log.Info(OK, "Successfully logged Message "+id+" to Database.")
+	log.Info(OK, "Successfully logged Message "+keyring.Index(id)+" to Database.")
 	return OK
 }
 
 //CheckMessageStorage checks whether a message is is present in the local database
-func CheckMessageStorage(id string) (status int, hasMessage bool) {
-	log.Info(InProgress, "Checking whether Message "+id+" is in Database...")
+func (s *SQLite) CheckMessageStorage(id string) (status int, hasMessage bool) {
+	defer metrics.ObserveDBQuery("storage", "check_message", time.Now())
+	log.Info(InProgress, "Checking whether Message "+keyring.Index(id)+" is in Database...")
 	query := "SELECT id FROM messages WHERE id=?"
-	stmt, err := storageDB.Prepare(query)
+	stmt, err := s.storageDB.Prepare(query)
 	if err != nil {
 		log.Error(SNDBReadError, "Error: "+err.Error())
 		return SNDBReadError, false
@@ -131,66 +161,280 @@ func CheckMessageStorage(id string) (status int, hasMessage bool) {
 	defer stmt.Close()
 
 	var res string
-	err = stmt.QueryRow(id).Scan(&res)
+	err = stmt.QueryRow(keyring.Index(id)).Scan(&res)
 	if err != nil {
-		log.Info(OK, "Message "+id+" does not appear to be present in database.")
+		log.Info(OK, "Message "+keyring.Index(id)+" does not appear to be present in database.")
 		return OK, false
 	}
 
-	log.Info(OK, "Message "+id+" is present in database.")
+	log.Info(OK, "Message "+keyring.Index(id)+" is present in database.")
 	return OK, true
 }
 
-//CheckMessageStatusStorage checks the status of a locally stored message against the Coordinator Network and handles it respectively
-func CheckMessageStatusStorage(id string) {
-	//TODO: Check status of message against coordinator network, then delete or keep message and log time of last check
+//GetMessageHash returns the SHA-256 hash recorded for a locally stored message, empty if none has been recorded
+func (s *SQLite) GetMessageHash(id string) (status int, sha256 string) {
+	defer metrics.ObserveDBQuery("storage", "get_message_hash", time.Now())
+	err := s.storageDB.QueryRow("SELECT sha256 FROM messages WHERE id=?", keyring.Index(id)).Scan(&sha256)
+	if err == sql.ErrNoRows {
+		return OK, ""
+	}
+	if err != nil {
+		log.Error(SNDBReadError, "Error getting Hash of Message "+keyring.Index(id)+": "+err.Error())
+		return SNDBReadError, ""
+	}
+	return OK, sha256
+}
+
+//GetMessageMetadataStorage returns the metadata recorded for a locally stored message
+func (s *SQLite) GetMessageMetadataStorage(id string) (status int, metadata message.Metadata, found bool) {
+	defer metrics.ObserveDBQuery("storage", "get_message_metadata", time.Now())
+	query := "SELECT CAST(strftime('%s', expiresOn) AS INTEGER), sha256, size, createdOn, ttl, priority FROM messages WHERE id=?"
+	status, metadata, found = scanMetadata(s.storageDB.QueryRow(query, keyring.Index(id)))
+	if status != OK {
+		log.Error(SNDBReadError, "Error getting Metadata of Message "+keyring.Index(id))
+		return SNDBReadError, metadata, false
+	}
+	return OK, metadata, found
+}
+
+//GetMessagesToScrub returns up to limit messages which have not been scrubbed since before, least recently scrubbed first
+func (s *SQLite) GetMessagesToScrub(before time.Time, limit int) (status int, ids []string) {
+	defer metrics.ObserveDBQuery("storage", "get_messages_to_scrub", time.Now())
+	rows, err := s.storageDB.Query("SELECT id, sealedId FROM messages WHERE lastScrub IS NULL OR lastScrub < ? ORDER BY lastScrub LIMIT ?", before.UTC().Unix(), limit)
+	if err != nil {
+		log.Error(SNDBReadError, "Error getting Messages to scrub: "+err.Error())
+		return SNDBReadError, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var index string
+		var sealed sql.NullString
+		if err = rows.Scan(&index, &sealed); err != nil {
+			log.Error(SNDBReadError, "Error getting Messages to scrub: "+err.Error())
+			return SNDBReadError, nil
+		}
+		id, err := openID(index, sealed)
+		if err != nil {
+			log.Error(EncryptionDecryptError, "Error decrypting ID of Message "+index+": "+err.Error())
+			return EncryptionDecryptError, nil
+		}
+		ids = append(ids, id)
+	}
+	return OK, ids
+}
+
+//GetStoredMessages returns the IDs of all locally stored messages
+func (s *SQLite) GetStoredMessages() (status int, ids []string) {
+	defer metrics.ObserveDBQuery("storage", "get_stored_messages", time.Now())
+	rows, err := s.storageDB.Query("SELECT id, sealedId FROM messages")
+	if err != nil {
+		log.Error(SNDBReadError, "Error getting stored Messages: "+err.Error())
+		return SNDBReadError, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var index string
+		var sealed sql.NullString
+		if err = rows.Scan(&index, &sealed); err != nil {
+			log.Error(SNDBReadError, "Error getting stored Messages: "+err.Error())
+			return SNDBReadError, nil
+		}
+		id, err := openID(index, sealed)
+		if err != nil {
+			log.Error(EncryptionDecryptError, "Error decrypting ID of Message "+index+": "+err.Error())
+			return EncryptionDecryptError, nil
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(SNDBReadError, "Error getting stored Messages: "+err.Error())
+		return SNDBReadError, nil
+	}
+	return OK, ids
+}
+
+//LogMessageScrub records that a message has been verified against sha256, and records sha256 if no hash has been recorded yet
+func (s *SQLite) LogMessageScrub(id string, sha256 string) (status int) {
+	defer metrics.ObserveDBQuery("storage", "log_message_scrub", time.Now())
+	query := "UPDATE messages SET lastScrub=?, sha256=CASE sha256 WHEN '' THEN ? ELSE sha256 END WHERE id=?"
+	if _, err := s.storageDB.Exec(query, time.Now().UTC().Unix(), sha256, keyring.Index(id)); err != nil {
+		log.Error(SNDBWriteError, "Error logging Scrub of Message "+keyring.Index(id)+": "+err.Error())
+		return SNDBWriteError
+	}
+	return OK
+}
+
+//GetStorageUsage returns the recorded number of bytes used by stored messages
+func (s *SQLite) GetStorageUsage() (status int, used int64) {
+	defer metrics.ObserveDBQuery("storage", "get_storage_usage", time.Now())
+	if err := s.storageDB.QueryRow("SELECT usedBytes FROM storageUsage WHERE id=1").Scan(&used); err != nil {
+		log.Error(SNDBReadError, "Error getting Storage Usage: "+err.Error())
+		return SNDBReadError, 0
+	}
+	return OK, used
+}
+
+//AddStorageUsage adds delta bytes, which may be negative, to the recorded usage
+func (s *SQLite) AddStorageUsage(delta int64) (status int) {
+	defer metrics.ObserveDBQuery("storage", "add_storage_usage", time.Now())
+	if _, err := s.storageDB.Exec("UPDATE storageUsage SET usedBytes=MAX(usedBytes + ?, 0) WHERE id=1", delta); err != nil {
+		log.Error(SNDBWriteError, "Error updating Storage Usage: "+err.Error())
+		return SNDBWriteError
+	}
+	return OK
+}
+
+//SetStorageUsage overwrites the recorded usage after it has been reconciled against the storage backend
+func (s *SQLite) SetStorageUsage(used int64) (status int) {
+	defer metrics.ObserveDBQuery("storage", "set_storage_usage", time.Now())
+	if _, err := s.storageDB.Exec("UPDATE storageUsage SET usedBytes=?, reconciledOn=? WHERE id=1", used, time.Now().UTC().Unix()); err != nil {
+		log.Error(SNDBWriteError, "Error setting Storage Usage: "+err.Error())
+		return SNDBWriteError
+	}
+	return OK
+}
+
+//CheckDueMessageStatusStorage returns up to limit locally stored messages which have not been received and whose status has not been
+//checked against the CoordinatorNetwork since before, least recently checked first. The messages are recorded as checked, so a failed
+//check is only repeated after settings.MessageMinCheckDelay
+func (s *SQLite) CheckDueMessageStatusStorage(before time.Time, limit int) (status int, ids []string) {
+	defer metrics.ObserveDBQuery("storage", "check_due_message_status", time.Now())
+	tx, err := s.storageDB.Begin()
+	if err != nil {
+		log.Error(SNDBReadError, "Error getting Messages to check: "+err.Error())
+		return SNDBReadError, nil
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query("SELECT id, sealedId FROM messages WHERE verified < ? AND (lastCheck IS NULL OR lastCheck < ?) ORDER BY lastCheck LIMIT ?", message.StatusReceived, before.UTC().Unix(), limit)
+	if err != nil {
+		log.Error(SNDBReadError, "Error getting Messages to check: "+err.Error())
+		return SNDBReadError, nil
+	}
+	var indexes []string
+	for rows.Next() {
+		var index string
+		var sealed sql.NullString
+		if err = rows.Scan(&index, &sealed); err != nil {
+			rows.Close()
+			log.Error(SNDBReadError, "Error getting Messages to check: "+err.Error())
+			return SNDBReadError, nil
+		}
+		id, err := openID(index, sealed)
+		if err != nil {
+			rows.Close()
+			log.Error(EncryptionDecryptError, "Error decrypting ID of Message "+index+": "+err.Error())
+			return EncryptionDecryptError, nil
+		}
+		indexes = append(indexes, index)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		log.Error(SNDBReadError, "Error getting Messages to check: "+err.Error())
+		return SNDBReadError, nil
+	}
+	now := time.Now().UTC().Unix()
+	for _, index := range indexes {
+		if _, err = tx.Exec("UPDATE messages SET lastCheck=? WHERE id=?", now, index); err != nil {
+			log.Error(SNDBWriteError, "Error logging Check of Message "+index+": "+err.Error())
+			return SNDBWriteError, nil
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error(SNDBWriteError, "Error logging Checks of Messages: "+err.Error())
+		return SNDBWriteError, nil
+	}
+	return OK, ids
+}
+
+//GetExpiredMessagesStorage returns up to limit locally stored messages which expired before now or have been received
+func (s *SQLite) GetExpiredMessagesStorage(now time.Time, limit int) (status int, ids []string) {
+	defer metrics.ObserveDBQuery("storage", "get_expired_messages", time.Now())
+	query := "SELECT id, sealedId FROM messages WHERE CAST(strftime('%s', expiresOn) AS INTEGER) < ? OR verified >= ? LIMIT ?"
+	rows, err := s.storageDB.Query(query, now.UTC().Unix(), message.StatusReceived, limit)
+	if err != nil {
+		log.Error(SNDBReadError, "Error getting expired Messages: "+err.Error())
+		return SNDBReadError, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var index string
+		var sealed sql.NullString
+		if err = rows.Scan(&index, &sealed); err != nil {
+			log.Error(SNDBReadError, "Error getting expired Messages: "+err.Error())
+			return SNDBReadError, nil
+		}
+		id, err := openID(index, sealed)
+		if err != nil {
+			log.Error(EncryptionDecryptError, "Error decrypting ID of Message "+index+": "+err.Error())
+			return EncryptionDecryptError, nil
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(SNDBReadError, "Error getting expired Messages: "+err.Error())
+		return SNDBReadError, nil
+	}
+	return OK, ids
 }
 
-//CheckDueMessageStatusStorage checks the status of all messages checked more that settings.MessageMinCheckDelay ago, removes them if they exceed settings.MessageMaxStoreTime or have been received
-func CheckDueMessageStatusStorage() {
-	//TODO: Run CheckMessageStatusStorage on all messages which have been checked more than settings.MessageMinCheckDelay ago,
-	//remove all messages which have been received before now - settings.MessageMaxStoreTime
+//RemoveMessageStorage removes a message from the local database, once it has been removed from the storage backend
+func (s *SQLite) RemoveMessageStorage(id string) (status int) {
+	defer metrics.ObserveDBQuery("storage", "remove_message", time.Now())
+	if _, err := s.storageDB.Exec("DELETE FROM messages WHERE id=?", keyring.Index(id)); err != nil {
+		log.Error(SNDBWriteError, "Error removing Message "+keyring.Index(id)+" from Database: "+err.Error())
+		return SNDBWriteError
+	}
+	log.Info(OK, "Removed Message "+keyring.Index(id)+" from Database.")
+	return OK
 }
 
+//lastPingSeconds reads lastPing of the node tables as unix timestamp. The cgo driver would return time.Time for the timestamp column,
+//the pure-Go driver the stored integer. Databases created before schema versioning may hold CoordinatorNodes pinged at a time string
+const lastPingSeconds = "CASE typeof(lastPing) WHEN 'integer' THEN lastPing ELSE COALESCE(CAST(strftime('%s', lastPing) AS INTEGER), 0) END"
+
 //AddStorageNode adds a StorageNode to the local database
-func AddStorageNode(n node.Node) (status int) {
+func (s *SQLite) AddStorageNode(n node.Node) (status int) {
+	defer metrics.ObserveDBQuery("coordinator", "add_storage_node", time.Now())
 	log.Info(InProgress, "Adding StorageNode "+n.Address+" to database...")
-	query := "INSERT INTO storageNodes(address, lastPing, ping) VALUES (?,?)"
-	stmt, err := coordinatorDB.Prepare(query)
+	query := "INSERT INTO storageNodes(address, lastPing, ping, identityKey) VALUES (?,?,?,?)"
+	stmt, err := s.coordinatorDB.Prepare(query)
 	if err != nil {
 		log.Error(CNDBPrepareError, "Error adding StorageNode "+n.Address+" to database: "+err.Error())
 		return CNDBPrepareError
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(n.Address, n.LastPing.Unix(), n.Ping)
+	_, err = stmt.Exec(n.Address, n.LastPing.Unix(), n.Ping, n.IdentityKey)
 	if err != nil {
 		log.Error(CNDBWriteError, "Error adding StorageNode "+n.Address+" to database: "+err.Error())
 		return CNDBWriteError
 	}
 	log.Info(OK, "Added StorageNode "+n.Address+" to Database.")
+	s.updatePeerTableSizes()
 	return OK
 }
 
 //GetStorageNodes returns known StorageNodes
-func GetStorageNodes(limit int) (status int, storageNodes []node.Node) {
+func (s *SQLite) GetStorageNodes(limit int) (status int, storageNodes []node.Node) {
+	defer metrics.ObserveDBQuery("coordinator", "get_storage_nodes", time.Now())
 	log.Info(InProgress, "Exporting "+strconv.Itoa(limit)+" StorageNodes...")
 	var nodes []node.Node
-	query := "SELECT address, lastPing FROM storageNodes LIMIT " + strconv.Itoa(limit)
-	rows, err := coordinatorDB.Query(query)
+	query := "SELECT address, " + lastPingSeconds + ", identityKey FROM storageNodes LIMIT " + strconv.Itoa(limit)
+	rows, err := s.coordinatorDB.Query(query)
 	if err != nil {
 		log.Error(CNDBReadError, "Error exporting StorageNodes: "+err.Error())
 		return CNDBReadError, nil
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var address string
+		var address, identityKey string
 		var lastPing int64
-		err = rows.Scan(&address, &lastPing)
+		err = rows.Scan(&address, &lastPing, &identityKey)
 		if err != nil {
 			continue
 		}
 		nodes = append(nodes, node.Node{
-			Address: address, LastPing: time.Unix(lastPing, 0),
+			Address: address, LastPing: time.Unix(lastPing, 0), IdentityKey: identityKey,
 		})
 	}
 	log.Info(OK, "Returning "+strconv.Itoa(len(nodes))+" StorageNodes.")
@@ -198,44 +442,47 @@ func GetStorageNodes(limit int) (status int, storageNodes []node.Node) {
 }
 
 //AddCoordinatorNode adds a CoordinatorNode to the local database
-func AddCoordinatorNode(n node.Node) (status int) {
+func (s *SQLite) AddCoordinatorNode(n node.Node) (status int) {
+	defer metrics.ObserveDBQuery("coordinator", "add_coordinator_node", time.Now())
 	log.Info(InProgress, "Adding CoordinatorNode "+n.Address+" to database...")
-	query := "INSERT INTO coordinatorNodes(address, lastPing, ping) VALUES (?,?)"
-	stmt, err := coordinatorDB.Prepare(query)
+	query := "INSERT INTO coordinatorNodes(address, lastPing, ping, identityKey) VALUES (?,?,?,?)"
+	stmt, err := s.coordinatorDB.Prepare(query)
 	if err != nil {
 		log.Error(CNDBPrepareError, "Error adding CoordinatorNode "+n.Address+" to database: "+err.Error())
 		return CNDBPrepareError
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(n.Address, n.LastPing, n.Ping)
+	_, err = stmt.Exec(n.Address, n.LastPing.Unix(), n.Ping, n.IdentityKey)
 	if err != nil {
 		log.Error(CNDBWriteError, "Error adding CoordinatorNode "+n.Address+" to database: "+err.Error())
 		return CNDBWriteError
 	}
 	log.Info(OK, "Added CoordinatorNode "+n.Address+" to Database.")
+	s.updatePeerTableSizes()
 	return OK
 }
 
 //GetCoordinatorNodes returns known CoordinatorNodes
-func GetCoordinatorNodes() (status int, storageNodes []node.Node) {
+func (s *SQLite) GetCoordinatorNodes() (status int, storageNodes []node.Node) {
+	defer metrics.ObserveDBQuery("coordinator", "get_coordinator_nodes", time.Now())
 	log.Info(InProgress, "Exporting CoordinatorNodes...")
 	var nodes []node.Node
-	query := "SELECT address, lastPing FROM coordinatorNodes"
-	rows, err := coordinatorDB.Query(query)
+	query := "SELECT address, " + lastPingSeconds + ", identityKey FROM coordinatorNodes"
+	rows, err := s.coordinatorDB.Query(query)
 	if err != nil {
 		log.Error(CNDBReadError, "Error exporting CoordinatorNodes: "+err.Error())
 		return CNDBReadError, nil
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var address string
+		var address, identityKey string
 		var lastPing int64
-		err = rows.Scan(&address, &lastPing)
+		err = rows.Scan(&address, &lastPing, &identityKey)
 		if err != nil {
 			continue
 		}
 		nodes = append(nodes, node.Node{
-			Address: address, LastPing: time.Unix(lastPing, 0),
+			Address: address, LastPing: time.Unix(lastPing, 0), IdentityKey: identityKey,
 		})
 	}
 	log.Info(OK, "Returning "+strconv.Itoa(len(nodes))+" CoordinatorNodes.")
@@ -243,58 +490,420 @@ func GetCoordinatorNodes() (status int, storageNodes []node.Node) {
 }
 
 //GetRandomCoordinatorNodes returns max <number> random CoordinatorNodes
-func GetRandomCoordinatorNodes(max int) (status int, nodes []node.Node) {
+func (s *SQLite) GetRandomCoordinatorNodes(max int) (status int, nodes []node.Node) {
+	defer metrics.ObserveDBQuery("coordinator", "get_random_coordinator_nodes", time.Now())
 	log.Info(InProgress, "Getting "+strconv.Itoa(max)+" random CoordinatorNodes...")
-	//TODO: Return random CoordinatorNodes
-
-	result := []node.Node{
-		{
-			Address:  "test1",
-			LastPing: time.Time{},
-		},
-		{
-			Address:  "test2",
-			LastPing: time.Time{},
-		},
-		{
-			Address:  "test3",
-			LastPing: time.Time{},
-		},
+	query := "SELECT address, " + lastPingSeconds + ", ping, identityKey FROM coordinatorNodes ORDER BY RANDOM() LIMIT ?"
+	rows, err := s.coordinatorDB.Query(query, max)
+	if err != nil {
+		log.Error(CNDBReadError, "Error getting random CoordinatorNodes: "+err.Error())
+		return CNDBReadError, nil
 	}
-
-	log.Info(OK, "Returning "+strconv.Itoa(len(result))+" CoordinatorNodes.")
-	return OK, result
+	defer rows.Close()
+	for rows.Next() {
+		var n node.Node
+		var lastPing int64
+		if err = rows.Scan(&n.Address, &lastPing, &n.Ping, &n.IdentityKey); err != nil {
+			log.Error(CNDBReadError, "Error reading random CoordinatorNodes: "+err.Error())
+			return CNDBReadError, nil
+		}
+		n.LastPing = time.Unix(lastPing, 0)
+		nodes = append(nodes, n)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error(CNDBReadError, "Error reading random CoordinatorNodes: "+err.Error())
+		return CNDBReadError, nil
+	}
+	log.Info(OK, "Returning "+strconv.Itoa(len(nodes))+" CoordinatorNodes.")
+	return OK, nodes
 }
 
 //ClearNodeTables removes all elements from storageNodes and coordinatorNodes tables, for bootstrapping
-func ClearNodeTables() (status int) {
+func (s *SQLite) ClearNodeTables() (status int) {
+	defer metrics.ObserveDBQuery("coordinator", "clear_node_tables", time.Now())
 	log.Info(InProgress, "Clearing Node Tables...")
 	query := "DELETE FROM storageNodes; DELETE FROM coordinatorNodes"
-	_, err := coordinatorDB.Exec(query)
+	_, err := s.coordinatorDB.Exec(query)
 	if err != nil {
 		log.Error(DBWriteError, "Error clearing Node Tables: "+err.Error())
 		return DBWriteError
 	}
 	log.Info(OK, "Cleared Node Tables.")
+	s.updatePeerTableSizes()
 	return OK
 }
 
+//IsKnownNode returns whether identityKey belongs to a StorageNode or CoordinatorNode in the local database
+func (s *SQLite) IsKnownNode(identityKey string) (status int, known bool) {
+	defer metrics.ObserveDBQuery("coordinator", "is_known_node", time.Now())
+	//Nodes added before their identity keys were recorded have an empty one
+	if identityKey == "" {
+		return OK, false
+	}
+	query := "SELECT EXISTS(SELECT 1 FROM storageNodes WHERE identityKey=?) OR EXISTS(SELECT 1 FROM coordinatorNodes WHERE identityKey=?)"
+	if err := s.coordinatorDB.QueryRow(query, identityKey, identityKey).Scan(&known); err != nil {
+		log.Error(CNDBReadError, "Error looking up Node identity: "+err.Error())
+		return CNDBReadError, false
+	}
+	return OK, known
+}
+
 //UpdateMessageStatusStorage updates the status of a message in the local database
-func UpdateMessageStatusStorage(messageID string, status int) int {
-	log.Info(InProgress, "Updating Status of Message "+messageID)
+func (s *SQLite) UpdateMessageStatusStorage(messageID string, status int) int {
+	defer metrics.ObserveDBQuery("storage", "update_message_status", time.Now())
+	log.Info(InProgress, "Updating Status of Message "+keyring.Index(messageID))
 	query := "UPDATE messages SET verified=? WHERE id=?"
-	stmt, err := storageDB.Prepare(query)
+	stmt, err := s.storageDB.Prepare(query)
 	if err != nil {
-		log.Error(SNDBPrepareError, "Error updating status of message "+messageID+": "+err.Error())
+		log.Error(SNDBPrepareError, "Error updating status of message "+keyring.Index(messageID)+": "+err.Error())
 		return SNDBPrepareError
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(status, messageID)
+	_, err = stmt.Exec(status, keyring.Index(messageID))
 	if err != nil {
-		log.Error(SNDBWriteError, "Failed updating status of message "+messageID+": "+err.Error())
+		log.Error(SNDBWriteError, "Failed updating status of message "+keyring.Index(messageID)+": "+err.Error())
 		return SNDBWriteError
 	}
-	log.Info(OK, "Updated status of Message "+messageID+". New status: "+strconv.Itoa(status))
+	log.Info(OK, "Updated status of Message "+keyring.Index(messageID)+". New status: "+strconv.Itoa(status))
+	return OK
+}
+
+//LogMessageAnnouncement logs to the Coordinator Database that a StorageNode has announced to store a message described by metadata
+func (s *SQLite) LogMessageAnnouncement(id string, storageNode string, metadata message.Metadata) (status int) {
+	defer metrics.ObserveDBQuery("coordinator", "log_message_announcement", time.Now())
+	log.Info(InProgress, "Logging Announcement of Message "+keyring.Index(id)+" by "+storageNode+"...")
+	var count int
+	index, sealed := sealID(id)
+	err := s.coordinatorDB.QueryRow("SELECT COUNT(*) FROM messages WHERE id=? AND storageNode=?", index, storageNode).Scan(&count)
+	if err != nil {
+		log.Error(CNDBReadError, "Error logging Announcement of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBReadError
+	}
+	if count > 0 {
+		log.Info(OK, "Announcement of Message "+keyring.Index(id)+" by "+storageNode+" already present in Database.")
+		return OK
+	}
+
+	query := "INSERT INTO messages(id, sealedId, storageNode, reportedOn, expiresOn, sha256, size, createdOn, ttl, priority, bucket) VALUES (?, ?, ?, datetime('now'), ?, ?, ?, ?, ?, ?, ?)"
+	stmt, err := s.coordinatorDB.Prepare(query)
+	if err != nil {
+		log.Error(CNDBPrepareError, "Error logging Announcement of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBPrepareError
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(index, sealed, storageNode, unixTime(metadata.ExpiresOn), metadata.SHA256, metadata.Size, unixTime(metadata.CreatedOn), int64(metadata.TTL/time.Second), metadata.Priority, bucketOf(id))
+	if err != nil {
+		log.Error(CNDBWriteError, "Error logging Announcement of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBWriteError
+	}
+	log.Info(OK, "Logged Announcement of Message "+keyring.Index(id)+" by "+storageNode+".")
+	return OK
+}
+
+//GetMessageLocations returns the StorageNodes which announced to store a message
+func (s *SQLite) GetMessageLocations(id string) (status int, storageNodes []string) {
+	defer metrics.ObserveDBQuery("coordinator", "get_message_locations", time.Now())
+	log.Info(InProgress, "Getting StorageNodes storing Message "+keyring.Index(id)+"...")
+	rows, err := s.coordinatorDB.Query("SELECT storageNode FROM messages WHERE id=?", keyring.Index(id))
+	if err != nil {
+		log.Error(CNDBReadError, "Error getting StorageNodes storing Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBReadError, nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var storageNode string
+		if err = rows.Scan(&storageNode); err != nil {
+			continue
+		}
+		storageNodes = append(storageNodes, storageNode)
+	}
+	log.Info(OK, "Message "+keyring.Index(id)+" is stored on "+strconv.Itoa(len(storageNodes))+" StorageNodes.")
+	return OK, storageNodes
+}
+
+//GetMessageMetadataCoordinator returns the metadata announced for a message by the first StorageNode storing it
+func (s *SQLite) GetMessageMetadataCoordinator(id string) (status int, metadata message.Metadata, found bool) {
+	defer metrics.ObserveDBQuery("coordinator", "get_message_metadata", time.Now())
+	query := "SELECT expiresOn, sha256, size, createdOn, ttl, priority FROM messages WHERE id=? ORDER BY reportedOn LIMIT 1"
+	status, metadata, found = scanMetadata(s.coordinatorDB.QueryRow(query, keyring.Index(id)))
+	if status != OK {
+		log.Error(CNDBReadError, "Error getting Metadata of Message "+keyring.Index(id))
+		return CNDBReadError, metadata, false
+	}
+	return OK, metadata, found
+}
+
+//UpdateMessageStatusCoordinator updates the status of a message in the Coordinator Database
+func (s *SQLite) UpdateMessageStatusCoordinator(id string, status int) int {
+	defer metrics.ObserveDBQuery("coordinator", "update_message_status", time.Now())
+	log.Info(InProgress, "Updating Coordinator Status of Message "+keyring.Index(id))
+	query := "UPDATE messages SET verified=? WHERE id=?"
+	stmt, err := s.coordinatorDB.Prepare(query)
+	if err != nil {
+		log.Error(CNDBPrepareError, "Error updating status of message "+keyring.Index(id)+": "+err.Error())
+		return CNDBPrepareError
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(status, keyring.Index(id))
+	if err != nil {
+		log.Error(CNDBWriteError, "Failed updating status of message "+keyring.Index(id)+": "+err.Error())
+		return CNDBWriteError
+	}
+	log.Info(OK, "Updated Coordinator Status of Message "+keyring.Index(id)+". New status: "+strconv.Itoa(status))
 	return OK
 }
+
+//LogMessageReceipt records that the recipient of a message presented its confirmation key, and marks all announcements of the message as received.
+//recorded is false if the receipt had been recorded before
+func (s *SQLite) LogMessageReceipt(id string) (status int, recorded bool) {
+	defer metrics.ObserveDBQuery("coordinator", "log_message_receipt", time.Now())
+	log.Info(InProgress, "Logging Receipt of Message "+keyring.Index(id)+"...")
+	tx, err := s.coordinatorDB.Begin()
+	if err != nil {
+		log.Error(CNDBWriteError, "Error logging Receipt of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBWriteError, false
+	}
+	defer tx.Rollback()
+	index, sealed := sealID(id)
+	result, err := tx.Exec("INSERT OR IGNORE INTO receipts(id, sealedId, receivedOn) VALUES (?, ?, ?)", index, sealed, time.Now().UTC().Unix())
+	if err != nil {
+		log.Error(CNDBWriteError, "Error logging Receipt of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBWriteError, false
+	}
+	if inserted, err := result.RowsAffected(); err != nil || inserted == 0 {
+		log.Info(OK, "Receipt of Message "+keyring.Index(id)+" already present in Database.")
+		return OK, false
+	}
+	if _, err = tx.Exec("UPDATE messages SET verified=? WHERE id=?", message.StatusReceived, index); err != nil {
+		log.Error(CNDBWriteError, "Error logging Receipt of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBWriteError, false
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error(CNDBWriteError, "Error logging Receipt of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBWriteError, false
+	}
+	log.Info(OK, "Logged Receipt of Message "+keyring.Index(id)+".")
+	return OK, true
+}
+
+//GetMessageStatusCoordinator returns the status of a message in the Coordinator Database, -1 if the message is unknown
+func (s *SQLite) GetMessageStatusCoordinator(id string) (status int, messageStatus int) {
+	defer metrics.ObserveDBQuery("coordinator", "get_message_status", time.Now())
+	var received int
+	var verified sql.NullInt64
+	query := "SELECT (SELECT COUNT(*) FROM receipts WHERE id=?1), (SELECT MAX(verified) FROM messages WHERE id=?1)"
+	err := s.coordinatorDB.QueryRow(query, keyring.Index(id)).Scan(&received, &verified)
+	if err != nil {
+		log.Error(CNDBReadError, "Error getting status of message "+keyring.Index(id)+": "+err.Error())
+		return CNDBReadError, message.StatusUnknown
+	}
+	if received > 0 {
+		return OK, message.StatusReceived
+	}
+	if !verified.Valid {
+		return OK, message.StatusUnknown
+	}
+	return OK, int(verified.Int64)
+}
+
+//GetInbox returns up to limit messages in the buckets first to last which have neither been received nor expired, and were first announced after cursor
+func (s *SQLite) GetInbox(first int, last int, cursor int64, limit int) (status int, entries []message.InboxEntry) {
+	defer metrics.ObserveDBQuery("coordinator", "get_inbox", time.Now())
+	log.Info(InProgress, "Getting Inbox for Buckets "+strconv.Itoa(first)+" to "+strconv.Itoa(last)+"...")
+	inBuckets, args := bucketRanges(first, last)
+	//The rowid of the first announcement of a message serves as cursor, SQLite returns the other columns of that row
+	query := `SELECT MIN(rowid) AS cursor, id, sealedId FROM messages
+		WHERE ` + inBuckets + ` AND id NOT IN (SELECT id FROM receipts)
+		GROUP BY id HAVING cursor > ? AND MIN(verified) < ? AND (COUNT(*) > COUNT(expiresOn) OR MAX(expiresOn) > ?)
+		ORDER BY cursor LIMIT ?`
+	args = append(args, cursor, message.StatusReceived, time.Now().Unix(), limit)
+	rows, err := s.coordinatorDB.Query(query, args...)
+	if err != nil {
+		log.Error(CNDBReadError, "Error getting Inbox: "+err.Error())
+		return CNDBReadError, nil
+	}
+	//The rows are read up front, as the locations and metadata of each message are queried afterwards
+	for rows.Next() {
+		var entry message.InboxEntry
+		var index string
+		var sealed sql.NullString
+		if err = rows.Scan(&entry.Cursor, &index, &sealed); err != nil {
+			rows.Close()
+			log.Error(CNDBReadError, "Error reading Inbox: "+err.Error())
+			return CNDBReadError, nil
+		}
+		if entry.ID, err = openID(index, sealed); err != nil {
+			rows.Close()
+			log.Error(CNDBReadError, "Error opening MessageID in Inbox: "+err.Error())
+			return CNDBReadError, nil
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	for i := range entries {
+		if status, entries[i].StorageNodes = s.GetMessageLocations(entries[i].ID); status != OK {
+			return status, nil
+		}
+		if status, entries[i].Metadata, _ = s.GetMessageMetadataCoordinator(entries[i].ID); status != OK {
+			return status, nil
+		}
+	}
+	log.Info(OK, "Inbox for Buckets "+strconv.Itoa(first)+" to "+strconv.Itoa(last)+" contains "+strconv.Itoa(len(entries))+" Messages.")
+	return OK, entries
+}
+
+//SetMailbox stores the registration of the mailbox of a recipient, unless a registration with the same or a higher version is stored
+func (s *SQLite) SetMailbox(recipient string, version int64, registration mailbox.Registration) (status int, stored bool) {
+	defer metrics.ObserveDBQuery("coordinator", "set_mailbox", time.Now())
+	log.Info(InProgress, "Storing Version "+strconv.FormatInt(version, 10)+" of Mailbox "+keyring.Index(recipient)+"...")
+	encoded, err := json.Marshal(registration)
+	if err != nil {
+		log.Error(CNDBWriteError, "Error encoding Mailbox "+keyring.Index(recipient)+": "+err.Error())
+		return CNDBWriteError, false
+	}
+	index, sealed := sealID(recipient)
+	query := `INSERT INTO mailboxes(recipient, sealedId, version, registration, updatedOn) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(recipient) DO UPDATE SET sealedId=excluded.sealedId, version=excluded.version, registration=excluded.registration, updatedOn=excluded.updatedOn
+		WHERE excluded.version > mailboxes.version`
+	result, err := s.coordinatorDB.Exec(query, index, sealed, version, sealValue(string(encoded)), time.Now().UTC().Unix())
+	if err != nil {
+		log.Error(CNDBWriteError, "Error storing Mailbox "+keyring.Index(recipient)+": "+err.Error())
+		return CNDBWriteError, false
+	}
+	if changed, err := result.RowsAffected(); err != nil || changed == 0 {
+		log.Info(OK, "Mailbox "+keyring.Index(recipient)+" is already stored in the same or a newer Version.")
+		return OK, false
+	}
+	log.Info(OK, "Stored Version "+strconv.FormatInt(version, 10)+" of Mailbox "+keyring.Index(recipient)+".")
+	return OK, true
+}
+
+//GetMailbox returns the registration of the mailbox of a recipient
+func (s *SQLite) GetMailbox(recipient string) (status int, registration mailbox.Registration, found bool) {
+	defer metrics.ObserveDBQuery("coordinator", "get_mailbox", time.Now())
+	var encoded string
+	var sealed sql.NullString
+	err := s.coordinatorDB.QueryRow("SELECT registration, sealedId FROM mailboxes WHERE recipient=?", keyring.Index(recipient)).Scan(&encoded, &sealed)
+	if err == sql.ErrNoRows {
+		return OK, registration, false
+	}
+	if err == nil {
+		encoded, err = openValue(encoded, sealed)
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(encoded), &registration)
+	}
+	if err != nil {
+		log.Error(CNDBReadError, "Error reading Mailbox "+keyring.Index(recipient)+": "+err.Error())
+		return CNDBReadError, registration, false
+	}
+	return OK, registration, true
+}
+
+//LogDeviceReceipt records that a device of the mailbox of the recipient presented the confirmation key of a message.
+//recorded is false if it had been recorded before, confirmed is the number of devices which presented it, counting only the
+//devices of the current mailbox, so devices removed since do not count towards its quorum
+func (s *SQLite) LogDeviceReceipt(id string, device string, devices []string) (status int, recorded bool, confirmed int) {
+	defer metrics.ObserveDBQuery("coordinator", "log_device_receipt", time.Now())
+	log.Info(InProgress, "Logging Receipt of Message "+keyring.Index(id)+" by Device "+device+"...")
+	index, sealed := sealID(id)
+	result, err := s.coordinatorDB.Exec("INSERT OR IGNORE INTO deviceReceipts(id, sealedId, device, receivedOn) VALUES (?, ?, ?, ?)", index, sealed, device, time.Now().UTC().Unix())
+	if err != nil {
+		log.Error(CNDBWriteError, "Error logging Receipt of Message "+keyring.Index(id)+" by Device "+device+": "+err.Error())
+		return CNDBWriteError, false, 0
+	}
+	inserted, err := result.RowsAffected()
+	if err == nil && len(devices) > 0 {
+		args := []interface{}{index}
+		for _, current := range devices {
+			args = append(args, current)
+		}
+		query := "SELECT COUNT(*) FROM deviceReceipts WHERE id=? AND device IN (?" + strings.Repeat(", ?", len(devices)-1) + ")"
+		err = s.coordinatorDB.QueryRow(query, args...).Scan(&confirmed)
+	}
+	if err != nil {
+		log.Error(CNDBReadError, "Error counting Receipts of Message "+keyring.Index(id)+": "+err.Error())
+		return CNDBReadError, false, 0
+	}
+	log.Info(OK, "Message "+keyring.Index(id)+" has been received by "+strconv.Itoa(confirmed)+" Devices.")
+	return OK, inserted > 0, confirmed
+}
+
+//bucketOf returns the bucket of the recipient of a MessageID, or nil if it is not a valid MessageID. With encryption enabled,
+//buckets are permuted with keyring.Prefix, as they hold the first bits of the recipient fingerprint
+func bucketOf(id string) interface{} {
+	parsed, err := messageid.Parse(id)
+	if err != nil {
+		return nil
+	}
+	return keyring.Prefix(parsed.Bucket(), messageid.BucketBits)
+}
+
+//bucketRanges returns a condition selecting the stored buckets of the buckets first to last. With encryption enabled, the range
+//is split into the ranges of the prefixes it consists of, which keyring.Prefix maps to ranges again
+func bucketRanges(first int, last int) (condition string, args []interface{}) {
+	if !keyring.Enabled() {
+		return "bucket BETWEEN ? AND ?", []interface{}{first, last}
+	}
+	var ranges []string
+	for first <= last {
+		//The largest block of buckets sharing their first bits, which starts at first and does not exceed last
+		free := 0
+		for free < messageid.BucketBits && first&(1<<(free+1)-1) == 0 && first+1<<(free+1)-1 <= last {
+			free++
+		}
+		start := keyring.Prefix(first>>free, messageid.BucketBits-free) << free
+		ranges = append(ranges, "bucket BETWEEN ? AND ?")
+		args = append(args, start, start+1<<free-1)
+		first += 1 << free
+	}
+	if len(ranges) == 0 {
+		return "0", nil
+	}
+	return "(" + strings.Join(ranges, " OR ") + ")", args
+}
+
+//unixTime returns t as unix timestamp, or nil if t is not set
+func unixTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Unix()
+}
+
+//scanMetadata reads expiresOn, sha256, size, createdOn, ttl and priority, in this order. Times are unix timestamps, ttl is given in seconds
+func scanMetadata(row *sql.Row) (status int, metadata message.Metadata, found bool) {
+	var expiresOn, createdOn sql.NullInt64
+	var ttl int64
+	err := row.Scan(&expiresOn, &metadata.SHA256, &metadata.Size, &createdOn, &ttl, &metadata.Priority)
+	if err == sql.ErrNoRows {
+		return OK, metadata, false
+	}
+	if err != nil {
+		log.Error(DBReadError, "Error reading Metadata: "+err.Error())
+		return DBReadError, metadata, false
+	}
+	if expiresOn.Valid {
+		metadata.ExpiresOn = time.Unix(expiresOn.Int64, 0).UTC()
+	}
+	if createdOn.Valid {
+		metadata.CreatedOn = time.Unix(createdOn.Int64, 0).UTC()
+	}
+	metadata.TTL = time.Duration(ttl) * time.Second
+	return OK, metadata, true
+}
+
+//updatePeerTableSizes counts the entries in storageNodes and coordinatorNodes tables and exports them as metrics
+func (s *SQLite) updatePeerTableSizes() {
+	for _, table := range []string{"storageNodes", "coordinatorNodes"} {
+		var count int
+		err := s.coordinatorDB.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count)
+		if err != nil {
+			log.Warn(CNDBReadError, "Failed to count entries in "+table+": "+err.Error())
+			continue
+		}
+		metrics.PeerTableSize.WithLabelValues(table).Set(float64(count))
+	}
+}
@@ -0,0 +1,15 @@
+//go:build cgo && !purego
+
+package database
+
+import (
+	//Importing SQLite Driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//sqliteDriver is mattn's cgo binding of the SQLite C library. Build with -tags purego or CGO_ENABLED=0 to avoid cgo
+const sqliteDriver = "sqlite3"
+
+//sqliteOptions makes connections wait up to 5s for locks held by concurrent writers instead of failing with SQLITE_BUSY.
+//Transactions take the write lock when they begin, as upgrading a read lock cannot wait for a concurrent writer
+const sqliteOptions = "?_busy_timeout=5000&_txlock=immediate"
@@ -0,0 +1,16 @@
+//go:build !cgo || purego
+
+package database
+
+import (
+	//Importing pure-Go SQLite Driver
+	_ "modernc.org/sqlite"
+)
+
+//sqliteDriver is a translation of the SQLite C library to Go, which needs neither cgo nor gcc and thus allows cross-compiling.
+//It reads and writes the same database files as the cgo driver
+const sqliteDriver = "sqlite"
+
+//sqliteOptions makes connections wait up to 5s for locks held by concurrent writers instead of failing with SQLITE_BUSY.
+//Transactions take the write lock when they begin, as upgrading a read lock cannot wait for a concurrent writer
+const sqliteOptions = "?_pragma=busy_timeout(5000)&_txlock=immediate"
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"subframe/server/keyring"
+	. "subframe/status"
+)
+
+//sealID returns the value of the id and sealedId columns for a MessageID. sealedId is NULL if encryption is disabled
+func sealID(id string) (index string, sealed sql.NullString) {
+	if !keyring.Enabled() {
+		return id, sql.NullString{}
+	}
+	return keyring.Index(id), sql.NullString{String: keyring.SealString(id), Valid: true}
+}
+
+//openID returns the MessageID of a row, which is only kept in sealedId if encryption is enabled
+func openID(index string, sealed sql.NullString) (string, error) {
+	if !sealed.Valid {
+		return index, nil
+	}
+	return keyring.OpenString(sealed.String)
+}
+
+//sealValue returns the value of a column sealed along with sealedId, which stays plain if encryption is disabled
+func sealValue(value string) string {
+	if !keyring.Enabled() {
+		return value
+	}
+	return keyring.SealString(value)
+}
+
+//openValue returns the plain value of a column sealed along with sealedId
+func openValue(value string, sealed sql.NullString) (string, error) {
+	if !sealed.Valid {
+		return value, nil
+	}
+	return keyring.OpenString(value)
+}
+
+//staleCondition selects rows which are not sealed with the active key, or sealed although encryption is disabled
+func staleCondition() (condition string, args []interface{}) {
+	if !keyring.Enabled() {
+		return "sealedId IS NOT NULL", nil
+	}
+	return "sealedId IS NULL OR substr(sealedId, 1, ?) != ?", []interface{}{len(keyring.KeyID()) + 1, keyring.KeyID() + ":"}
+}
+
+//sealedTable is a table holding MessageIDs or recipients in column, which are sealed in sealedId. entries names its rows in logs
+type sealedTable struct {
+	name    string
+	table   string
+	column  string
+	entries string
+	db      *sql.DB
+}
+
+//sealedTables returns all tables holding MessageIDs or recipients. Message files are only moved for rows of the StorageDatabase,
+//registrations are resealed along with the recipients of mailboxes
+func (s *SQLite) sealedTables() []sealedTable {
+	return []sealedTable{
+		{"StorageDatabase", "messages", "id", "Messages", s.storageDB},
+		{"CoordinatorDatabase", "messages", "id", "Messages", s.coordinatorDB},
+		{"CoordinatorDatabase", "receipts", "id", "Messages", s.coordinatorDB},
+		{"CoordinatorDatabase", "deviceReceipts", "id", "Messages", s.coordinatorDB},
+		{"CoordinatorDatabase", "mailboxes", "recipient", "Mailboxes", s.coordinatorDB},
+	}
+}
+
+//CheckEncryption checks whether all messages are sealed with the active key, as messages sealed with a different key,
+//or not at all, cannot be found by their blind index
+func (s *SQLite) CheckEncryption() (status int) {
+	condition, args := staleCondition()
+	for _, t := range s.sealedTables() {
+		var count int
+		if err := t.db.QueryRow("SELECT COUNT(*) FROM "+t.table+" WHERE "+condition, args...).Scan(&count); err != nil {
+			log.Error(DBReadError, "Error checking encryption of "+t.name+": "+err.Error())
+			return DBReadError
+		}
+		if count == 0 {
+			continue
+		}
+		if !keyring.Enabled() {
+			log.Error(EncryptionRekeyRequired, t.name+" contains "+strconv.Itoa(count)+" encrypted "+t.entries+", but no encryption key is set.")
+		} else {
+			log.Error(EncryptionRekeyRequired, t.name+" contains "+strconv.Itoa(count)+" "+t.entries+" not encrypted with key "+keyring.KeyID()+". Run the rekey command to encrypt them.")
+		}
+		return EncryptionRekeyRequired
+	}
+	if keyring.Enabled() {
+		var count int
+		if err := s.coordinatorDB.QueryRow("SELECT COUNT(*) FROM messages WHERE bucket IS NULL").Scan(&count); err != nil {
+			log.Error(DBReadError, "Error checking encryption of CoordinatorDatabase: "+err.Error())
+			return DBReadError
+		}
+		//Messages without bucket are only missing from inbox queries, while plain buckets are only stored along with plain MessageIDs
+		if count > 0 {
+			log.Warn(EncryptionRekeyRequired, "CoordinatorDatabase contains "+strconv.Itoa(count)+" Messages without recipient buckets, which are missing from inboxes. Run the rekey command to add them.")
+		}
+	}
+	return OK
+}
+
+//Rekey seals all messages and mailboxes not yet sealed with the active key. moveMessage is called for every locally stored message before
+//its row is updated, to move the message file from oldName, and has to succeed if it has already been moved.
+//Rekeying can therefore be resumed after it has been interrupted
+func (s *SQLite) Rekey(moveMessage func(oldName string, id string, sealed bool) (status int)) (rekeyed int, status int) {
+	if !keyring.Enabled() {
+		log.Error(EncryptionKeyError, "Rekeying requires an encryption key.")
+		return 0, EncryptionKeyError
+	}
+	log.Info(InProgress, "Rekeying Messages and Mailboxes with key "+keyring.KeyID()+"...")
+	for _, t := range s.sealedTables() {
+		name, db := t.name, t.db
+		rows, status := s.staleRows(t)
+		if status != OK {
+			return rekeyed, status
+		}
+		for index, sealed := range rows {
+			id, err := openID(index, sealed)
+			if err != nil {
+				log.Error(EncryptionDecryptError, "Error decrypting ID of "+index+" in "+name+": "+err.Error()+". Add the key it was encrypted with to the key file.")
+				return rekeyed, EncryptionDecryptError
+			}
+			if db == s.storageDB && t.table == "messages" {
+				if status = moveMessage(index, id, sealed.Valid); status != OK {
+					return rekeyed, status
+				}
+			}
+			newIndex, newSealed := sealID(id)
+			update, args := "UPDATE "+t.table+" SET "+t.column+"=?, sealedId=?", []interface{}{newIndex, newSealed}
+			if db == s.coordinatorDB && t.table == "messages" {
+				update, args = update+", bucket=?", append(args, bucketOf(id))
+			}
+			if t.table == "mailboxes" {
+				var registration string
+				err = db.QueryRow("SELECT registration FROM mailboxes WHERE recipient=?", index).Scan(&registration)
+				if err == nil {
+					registration, err = openValue(registration, sealed)
+				}
+				if err != nil {
+					log.Error(EncryptionDecryptError, "Error decrypting Mailbox "+index+" in "+name+": "+err.Error())
+					return rekeyed, EncryptionDecryptError
+				}
+				update, args = update+", registration=?", append(args, sealValue(registration))
+			}
+			if _, err = db.Exec(update+" WHERE "+t.column+"=?", append(args, index)...); err != nil {
+				log.Error(DBWriteError, "Error rekeying "+index+" in "+name+": "+err.Error())
+				return rekeyed, DBWriteError
+			}
+			rekeyed++
+		}
+	}
+	//Messages sealed with the active key before buckets were permuted are not in any bucket
+	if status = s.rekeyBuckets(); status != OK {
+		return rekeyed, status
+	}
+	log.Info(OK, "Rekeyed "+strconv.Itoa(rekeyed)+" Messages and Mailboxes.")
+	return rekeyed, OK
+}
+
+//rekeyBuckets stores the permuted buckets of all messages in the CoordinatorDatabase which are not in any bucket, see bucketOf
+func (s *SQLite) rekeyBuckets() (status int) {
+	result, err := s.coordinatorDB.Query("SELECT DISTINCT id, sealedId FROM messages WHERE bucket IS NULL")
+	if err != nil {
+		log.Error(DBReadError, "Error reading Messages without recipient buckets: "+err.Error())
+		return DBReadError
+	}
+	rows := make(map[string]sql.NullString)
+	for result.Next() {
+		var index string
+		var sealed sql.NullString
+		if err = result.Scan(&index, &sealed); err != nil {
+			result.Close()
+			log.Error(DBReadError, "Error reading Messages without recipient buckets: "+err.Error())
+			return DBReadError
+		}
+		rows[index] = sealed
+	}
+	result.Close()
+	for index, sealed := range rows {
+		id, err := openID(index, sealed)
+		if err != nil {
+			log.Error(EncryptionDecryptError, "Error decrypting ID of "+index+" in CoordinatorDatabase: "+err.Error())
+			return EncryptionDecryptError
+		}
+		if _, err = s.coordinatorDB.Exec("UPDATE messages SET bucket=? WHERE id=?", bucketOf(id), index); err != nil {
+			log.Error(DBWriteError, "Error storing recipient bucket of "+index+" in CoordinatorDatabase: "+err.Error())
+			return DBWriteError
+		}
+	}
+	return OK
+}
+
+//staleRows returns the sealed column and sealedId of all rows of t which are not sealed with the active key. They are read up front,
+//as the rows are updated while rekeying
+func (s *SQLite) staleRows(t sealedTable) (rows map[string]sql.NullString, status int) {
+	condition, args := staleCondition()
+	result, err := t.db.Query("SELECT DISTINCT "+t.column+", sealedId FROM "+t.table+" WHERE "+condition, args...)
+	if err != nil {
+		log.Error(DBReadError, "Error reading "+t.entries+" to rekey: "+err.Error())
+		return nil, DBReadError
+	}
+	defer result.Close()
+	rows = make(map[string]sql.NullString)
+	for result.Next() {
+		var index string
+		var sealed sql.NullString
+		if err = result.Scan(&index, &sealed); err != nil {
+			log.Error(DBReadError, "Error reading "+t.entries+" to rekey: "+err.Error())
+			return nil, DBReadError
+		}
+		rows[index] = sealed
+	}
+	return rows, OK
+}
@@ -0,0 +1,179 @@
+package database
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"subframe/server/keyring"
+	"subframe/server/settings"
+	. "subframe/status"
+	"subframe/structs/mailbox"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"testing"
+	"time"
+)
+
+//enableEncryption enables encryption at rest with a new key until the test has finished
+func enableEncryption(t *testing.T) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(keyFile, []byte(keyring.GenerateKey()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := keyring.Init(settings.Config{EncryptionKeyFile: keyFile}); status != OK {
+		t.Fatalf("enabling encryption failed with status %d", status)
+	}
+	t.Cleanup(func() { keyring.Init(settings.Config{}) })
+}
+
+//testRegistration returns the recipient of a new mailbox and its signed registration
+func testRegistration(t *testing.T) (recipient string, registration mailbox.Registration) {
+	t.Helper()
+	_, identityKey, _ := ed25519.GenerateKey(nil)
+	signingKey, _, _ := ed25519.GenerateKey(nil)
+	mb := mailbox.Mailbox{
+		IdentityKey: identityKey.Public().(ed25519.PublicKey),
+		Devices:     []mailbox.Device{{ID: "phone", SigningKey: signingKey}},
+		Version:     1,
+	}
+	registration, err := mailbox.Sign(mb, identityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mb.Recipient(), registration
+}
+
+func TestEncryptedInbox(t *testing.T) {
+	enableEncryption(t)
+	s := OpenSQLite(t.TempDir())
+	t.Cleanup(s.Close)
+
+	future := message.Metadata{ExpiresOn: time.Now().Add(time.Hour)}
+	first := testMessageID(t, "recipient", "first")
+	second := testMessageID(t, "recipient", "second")
+	other := testMessageID(t, "other recipient", "other")
+	for _, id := range []string{first, other, second} {
+		if status := s.LogMessageAnnouncement(id, "http://storage-1.example", future); status != OK {
+			t.Fatalf("logging announcement failed with status %d", status)
+		}
+	}
+	parsed, _ := messageid.Parse(first)
+	bucket := parsed.Bucket()
+	//Buckets are permuted, so the stored buckets of different recipients do not reveal the first bits of their fingerprints
+	plain := 0
+	for _, id := range []string{first, other} {
+		parsed, _ := messageid.Parse(id)
+		var stored int
+		if err := s.coordinatorDB.QueryRow("SELECT bucket FROM messages WHERE id=?", keyring.Index(id)).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored == parsed.Bucket() {
+			plain++
+		}
+	}
+	if plain == 2 {
+		t.Errorf("recipient buckets are stored in plain")
+	}
+
+	status, entries := s.GetInbox(bucket, bucket, 0, 10)
+	if status != OK || len(entries) != 2 || entries[0].ID != first || entries[1].ID != second {
+		t.Fatalf("inbox is %+v with status %d, expected the first and the second message", entries, status)
+	}
+	//Prefixes of any length, and ranges not made up of a single prefix, select the permuted buckets
+	for bits := 0; bits <= messageid.BucketBits; bits++ {
+		first, last := messageid.PrefixOf(parsed, bits).Buckets()
+		if _, entries := s.GetInbox(first, last, 0, 10); !containsEntry(entries, second) {
+			t.Errorf("inbox of the prefix of %d bits is %+v, expected the second message", bits, entries)
+		}
+	}
+	if _, entries := s.GetInbox(max(bucket-3, 0), min(bucket+5, 1<<messageid.BucketBits-1), 0, 10); !containsEntry(entries, second) {
+		t.Errorf("inbox of the buckets around the recipient is %+v, expected the second message", entries)
+	}
+	otherID, _ := messageid.Parse(other)
+	if otherID.Bucket() != bucket {
+		if _, entries := s.GetInbox(otherID.Bucket(), otherID.Bucket(), 0, 10); len(entries) != 1 || entries[0].ID != other {
+			t.Errorf("inbox of the other recipient is %+v, expected only the other message", entries)
+		}
+	}
+	if _, entries = s.GetInbox(bucket, bucket, 0, 1); len(entries) != 1 || entries[0].ID != first {
+		t.Errorf("inbox limited to 1 entry is %+v, expected the first message", entries)
+	}
+	if _, after := s.GetInbox(bucket, bucket, entries[0].Cursor, 1); len(after) != 1 || after[0].ID != second {
+		t.Errorf("inbox after the first message is %+v, expected the second message", after)
+	}
+}
+
+//containsEntry returns whether entries contain the message id
+func containsEntry(entries []message.InboxEntry, id string) bool {
+	for _, entry := range entries {
+		if entry.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestEncryptedMailbox(t *testing.T) {
+	enableEncryption(t)
+	s := OpenSQLite(t.TempDir())
+	t.Cleanup(s.Close)
+
+	recipient, registration := testRegistration(t)
+	if status, stored := s.SetMailbox(recipient, 1, registration); status != OK || !stored {
+		t.Fatalf("storing mailbox failed with status %d", status)
+	}
+	var index, sealed string
+	if err := s.coordinatorDB.QueryRow("SELECT recipient, registration FROM mailboxes").Scan(&index, &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if index == recipient || strings.Contains(sealed, string(registration.Mailbox)) {
+		t.Errorf("mailbox of %s is stored in plain as %s: %s", recipient, index, sealed)
+	}
+	status, stored, found := s.GetMailbox(recipient)
+	if status != OK || !found || string(stored.Mailbox) != string(registration.Mailbox) || string(stored.Signature) != string(registration.Signature) {
+		t.Errorf("stored registration is %+v, expected %+v", stored, registration)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	s := OpenSQLite(t.TempDir())
+	t.Cleanup(s.Close)
+	id := testMessageID(t, "recipient", "plain")
+	if status := s.LogMessageAnnouncement(id, "http://storage-1.example", message.Metadata{}); status != OK {
+		t.Fatalf("logging announcement failed with status %d", status)
+	}
+	recipient, registration := testRegistration(t)
+	if status, _ := s.SetMailbox(recipient, 1, registration); status != OK {
+		t.Fatalf("storing mailbox failed with status %d", status)
+	}
+
+	enableEncryption(t)
+	if status := s.CheckEncryption(); status != EncryptionRekeyRequired {
+		t.Errorf("checking encryption returned status %d, expected %d", status, EncryptionRekeyRequired)
+	}
+	if _, status := s.Rekey(func(oldName string, id string, sealed bool) int { return OK }); status != OK {
+		t.Fatalf("rekeying failed with status %d", status)
+	}
+	if status := s.CheckEncryption(); status != OK {
+		t.Errorf("checking encryption after rekeying returned status %d", status)
+	}
+	parsed, _ := messageid.Parse(id)
+	if _, entries := s.GetInbox(parsed.Bucket(), parsed.Bucket(), 0, 10); len(entries) != 1 || entries[0].ID != id {
+		t.Errorf("inbox after rekeying is %+v, expected the message", entries)
+	}
+	//Messages sealed with the active key without a bucket are added to their bucket
+	if _, err := s.coordinatorDB.Exec("UPDATE messages SET bucket=NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if rekeyed, status := s.Rekey(func(oldName string, id string, sealed bool) int { return OK }); status != OK || rekeyed != 0 {
+		t.Fatalf("rekeying again rekeyed %d entries with status %d", rekeyed, status)
+	}
+	if _, entries := s.GetInbox(parsed.Bucket(), parsed.Bucket(), 0, 10); len(entries) != 1 || entries[0].ID != id {
+		t.Errorf("inbox after adding buckets is %+v, expected the message", entries)
+	}
+	if status, stored, found := s.GetMailbox(recipient); status != OK || !found || string(stored.Mailbox) != string(registration.Mailbox) {
+		t.Errorf("mailbox after rekeying is %+v, expected %+v", stored, registration)
+	}
+}
@@ -0,0 +1,468 @@
+package database
+
+import (
+	"math/rand"
+	"sort"
+	"subframe/server/keyring"
+	"subframe/server/metrics"
+	. "subframe/status"
+	"subframe/structs/mailbox"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"subframe/structs/node"
+	"sync"
+	"time"
+)
+
+type storedMessage struct {
+	verified  int
+	metadata  message.Metadata
+	lastScrub time.Time
+	lastCheck time.Time
+}
+
+type messageLocation struct {
+	storageNode string
+	reportedOn  time.Time
+	verified    int
+	metadata    message.Metadata
+	//cursor numbers announcements in the order they were recorded
+	cursor int64
+}
+
+type storedMailbox struct {
+	version      int64
+	registration mailbox.Registration
+}
+
+//Memory implements MessageStore, UsageStore, NodeStore and CoordinatorIndex in memory. Its contents are lost when the process exits
+type Memory struct {
+	mutex            sync.Mutex
+	messages         map[string]*storedMessage
+	storageNodes     map[string]node.Node
+	coordinatorNodes map[string]node.Node
+	locations        map[string][]*messageLocation
+	receipts         map[string]time.Time
+	mailboxes        map[string]storedMailbox
+	deviceReceipts   map[string]map[string]time.Time
+	announcements    int64
+	usedBytes        int64
+}
+
+//NewMemory returns an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		messages:         make(map[string]*storedMessage),
+		storageNodes:     make(map[string]node.Node),
+		coordinatorNodes: make(map[string]node.Node),
+		locations:        make(map[string][]*messageLocation),
+		receipts:         make(map[string]time.Time),
+		mailboxes:        make(map[string]storedMailbox),
+		deviceReceipts:   make(map[string]map[string]time.Time),
+	}
+}
+
+//CheckConnection always succeeds, as there is no connection to lose
+func (m *Memory) CheckConnection() (status int) {
+	return OK
+}
+
+//LogMessageStorage records that a message described by metadata has been received and stored locally
+func (m *Memory) LogMessageStorage(id string, metadata message.Metadata) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.messages[id]; ok {
+		log.Error(SNDBIdConflict, "Message "+keyring.Index(id)+" already present in Database.")
+		return SNDBIdConflict
+	}
+	m.messages[id] = &storedMessage{metadata: metadata}
+	return OK
+}
+
+//CheckMessageStorage checks whether a message is stored locally
+func (m *Memory) CheckMessageStorage(id string) (status int, hasMessage bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	_, hasMessage = m.messages[id]
+	return OK, hasMessage
+}
+
+//GetMessageHash returns the SHA-256 hash recorded for a locally stored message, empty if none has been recorded
+func (m *Memory) GetMessageHash(id string) (status int, sha256 string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if msg, ok := m.messages[id]; ok {
+		return OK, msg.metadata.SHA256
+	}
+	return OK, ""
+}
+
+//GetMessageMetadataStorage returns the metadata recorded for a locally stored message
+func (m *Memory) GetMessageMetadataStorage(id string) (status int, metadata message.Metadata, found bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if msg, ok := m.messages[id]; ok {
+		return OK, msg.metadata, true
+	}
+	return OK, message.Metadata{}, false
+}
+
+//GetMessagesToScrub returns up to limit messages which have not been scrubbed since before, least recently scrubbed first
+func (m *Memory) GetMessagesToScrub(before time.Time, limit int) (status int, ids []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, msg := range m.messages {
+		if msg.lastScrub.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return m.messages[ids[i]].lastScrub.Before(m.messages[ids[j]].lastScrub) })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return OK, ids
+}
+
+//GetStoredMessages returns the IDs of all locally stored messages
+func (m *Memory) GetStoredMessages() (status int, ids []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id := range m.messages {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return OK, ids
+}
+
+//LogMessageScrub records that a message has been verified against sha256, and records sha256 if no hash has been recorded yet
+func (m *Memory) LogMessageScrub(id string, sha256 string) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if msg, ok := m.messages[id]; ok {
+		msg.lastScrub = time.Now()
+		if msg.metadata.SHA256 == "" {
+			msg.metadata.SHA256 = sha256
+		}
+	}
+	return OK
+}
+
+//GetStorageUsage returns the recorded number of bytes used by stored messages
+func (m *Memory) GetStorageUsage() (status int, used int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return OK, m.usedBytes
+}
+
+//AddStorageUsage adds delta bytes, which may be negative, to the recorded usage
+func (m *Memory) AddStorageUsage(delta int64) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.usedBytes += delta
+	if m.usedBytes < 0 {
+		m.usedBytes = 0
+	}
+	return OK
+}
+
+//SetStorageUsage overwrites the recorded usage
+func (m *Memory) SetStorageUsage(used int64) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.usedBytes = used
+	return OK
+}
+
+//UpdateMessageStatusStorage updates the status of a locally stored message
+func (m *Memory) UpdateMessageStatusStorage(id string, status int) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if msg, ok := m.messages[id]; ok {
+		msg.verified = status
+	}
+	return OK
+}
+
+//CheckDueMessageStatusStorage returns up to limit messages which have not been received and whose status has not been checked
+//since before, least recently checked first, and records them as checked
+func (m *Memory) CheckDueMessageStatusStorage(before time.Time, limit int) (status int, ids []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, msg := range m.messages {
+		if msg.verified < message.StatusReceived && msg.lastCheck.Before(before) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return m.messages[ids[i]].lastCheck.Before(m.messages[ids[j]].lastCheck) })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	now := time.Now()
+	for _, id := range ids {
+		m.messages[id].lastCheck = now
+	}
+	return OK, ids
+}
+
+//GetExpiredMessagesStorage returns up to limit messages which expired before now or have been received
+func (m *Memory) GetExpiredMessagesStorage(now time.Time, limit int) (status int, ids []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for id, msg := range m.messages {
+		if msg.verified >= message.StatusReceived || (!msg.metadata.ExpiresOn.IsZero() && msg.metadata.ExpiresOn.Before(now)) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return OK, ids
+}
+
+//RemoveMessageStorage removes a locally stored message
+func (m *Memory) RemoveMessageStorage(id string) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.messages, id)
+	return OK
+}
+
+//AddStorageNode adds a StorageNode
+func (m *Memory) AddStorageNode(n node.Node) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.storageNodes[n.Address]; ok {
+		log.Error(CNDBWriteError, "Error adding StorageNode "+n.Address+" to database: already present")
+		return CNDBWriteError
+	}
+	m.storageNodes[n.Address] = n
+	m.updatePeerTableSizes()
+	return OK
+}
+
+//GetStorageNodes returns up to limit known StorageNodes
+func (m *Memory) GetStorageNodes(limit int) (status int, storageNodes []node.Node) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, n := range m.storageNodes {
+		if len(storageNodes) >= limit {
+			break
+		}
+		storageNodes = append(storageNodes, n)
+	}
+	return OK, storageNodes
+}
+
+//AddCoordinatorNode adds a CoordinatorNode
+func (m *Memory) AddCoordinatorNode(n node.Node) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.coordinatorNodes[n.Address]; ok {
+		log.Error(CNDBWriteError, "Error adding CoordinatorNode "+n.Address+" to database: already present")
+		return CNDBWriteError
+	}
+	m.coordinatorNodes[n.Address] = n
+	m.updatePeerTableSizes()
+	return OK
+}
+
+//GetCoordinatorNodes returns all known CoordinatorNodes
+func (m *Memory) GetCoordinatorNodes() (status int, coordinatorNodes []node.Node) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, n := range m.coordinatorNodes {
+		coordinatorNodes = append(coordinatorNodes, n)
+	}
+	return OK, coordinatorNodes
+}
+
+//GetRandomCoordinatorNodes returns max <number> random CoordinatorNodes
+func (m *Memory) GetRandomCoordinatorNodes(max int) (status int, nodes []node.Node) {
+	_, nodes = m.GetCoordinatorNodes()
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	if len(nodes) > max {
+		nodes = nodes[:max]
+	}
+	return OK, nodes
+}
+
+//ClearNodeTables removes all known nodes
+func (m *Memory) ClearNodeTables() (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.storageNodes = make(map[string]node.Node)
+	m.coordinatorNodes = make(map[string]node.Node)
+	m.updatePeerTableSizes()
+	return OK
+}
+
+//IsKnownNode returns whether identityKey belongs to a known StorageNode or CoordinatorNode
+func (m *Memory) IsKnownNode(identityKey string) (status int, known bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if identityKey == "" {
+		return OK, false
+	}
+	for _, nodes := range []map[string]node.Node{m.storageNodes, m.coordinatorNodes} {
+		for _, n := range nodes {
+			if n.IdentityKey == identityKey {
+				return OK, true
+			}
+		}
+	}
+	return OK, false
+}
+
+//LogMessageAnnouncement records that storageNode announced to store a message described by metadata
+func (m *Memory) LogMessageAnnouncement(id string, storageNode string, metadata message.Metadata) (status int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, location := range m.locations[id] {
+		if location.storageNode == storageNode {
+			return OK
+		}
+	}
+	m.announcements++
+	m.locations[id] = append(m.locations[id], &messageLocation{storageNode: storageNode, reportedOn: time.Now(), metadata: metadata, cursor: m.announcements})
+	return OK
+}
+
+//GetMessageLocations returns the StorageNodes which announced to store a message
+func (m *Memory) GetMessageLocations(id string) (status int, storageNodes []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, location := range m.locations[id] {
+		storageNodes = append(storageNodes, location.storageNode)
+	}
+	return OK, storageNodes
+}
+
+//GetMessageMetadataCoordinator returns the metadata announced for a message by the first StorageNode storing it
+func (m *Memory) GetMessageMetadataCoordinator(id string) (status int, metadata message.Metadata, found bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if locations := m.locations[id]; len(locations) > 0 {
+		return OK, locations[0].metadata, true
+	}
+	return OK, message.Metadata{}, false
+}
+
+//UpdateMessageStatusCoordinator updates the status of a message on all StorageNodes storing it
+func (m *Memory) UpdateMessageStatusCoordinator(id string, status int) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, location := range m.locations[id] {
+		location.verified = status
+	}
+	return OK
+}
+
+//LogMessageReceipt records that the recipient of a message presented its confirmation key. recorded is false if it had been recorded before
+func (m *Memory) LogMessageReceipt(id string) (status int, recorded bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.receipts[id]; ok {
+		return OK, false
+	}
+	m.receipts[id] = time.Now()
+	for _, location := range m.locations[id] {
+		location.verified = message.StatusReceived
+	}
+	return OK, true
+}
+
+//GetMessageStatusCoordinator returns the status of a message, -1 if the message is unknown
+func (m *Memory) GetMessageStatusCoordinator(id string) (status int, messageStatus int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.receipts[id]; ok {
+		return OK, message.StatusReceived
+	}
+	messageStatus = message.StatusUnknown
+	for _, location := range m.locations[id] {
+		if location.verified > messageStatus {
+			messageStatus = location.verified
+		}
+	}
+	return OK, messageStatus
+}
+
+//GetInbox returns up to limit messages in the buckets first to last which have neither been received nor expired, and were first announced after cursor
+func (m *Memory) GetInbox(first int, last int, cursor int64, limit int) (status int, entries []message.InboxEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for id, locations := range m.locations {
+		parsed, err := messageid.Parse(id)
+		if err != nil || parsed.Bucket() < first || parsed.Bucket() > last || locations[0].cursor <= cursor {
+			continue
+		}
+		if _, ok := m.receipts[id]; ok {
+			continue
+		}
+		entry := message.InboxEntry{ID: id, Metadata: locations[0].metadata, Cursor: locations[0].cursor}
+		pending := false
+		for _, location := range locations {
+			entry.StorageNodes = append(entry.StorageNodes, location.storageNode)
+			if location.verified < message.StatusReceived && (location.metadata.ExpiresOn.IsZero() || location.metadata.ExpiresOn.After(now)) {
+				pending = true
+			}
+		}
+		if pending {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Cursor < entries[j].Cursor })
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return OK, entries
+}
+
+//SetMailbox stores the registration of the mailbox of a recipient, unless a registration with the same or a higher version is stored
+func (m *Memory) SetMailbox(recipient string, version int64, registration mailbox.Registration) (status int, stored bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if current, ok := m.mailboxes[recipient]; ok && current.version >= version {
+		return OK, false
+	}
+	m.mailboxes[recipient] = storedMailbox{version: version, registration: registration}
+	return OK, true
+}
+
+//GetMailbox returns the registration of the mailbox of a recipient
+func (m *Memory) GetMailbox(recipient string) (status int, registration mailbox.Registration, found bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	current, found := m.mailboxes[recipient]
+	return OK, current.registration, found
+}
+
+//LogDeviceReceipt records that a device of the mailbox of the recipient presented the confirmation key of a message.
+//recorded is false if it had been recorded before, confirmed is the number of devices which presented it, counting only the
+//devices of the current mailbox, so devices removed since do not count towards its quorum
+func (m *Memory) LogDeviceReceipt(id string, device string, devices []string) (status int, recorded bool, confirmed int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	received, ok := m.deviceReceipts[id]
+	if !ok {
+		received = make(map[string]time.Time)
+		m.deviceReceipts[id] = received
+	}
+	if _, ok = received[device]; !ok {
+		received[device] = time.Now()
+		recorded = true
+	}
+	for _, current := range devices {
+		if _, ok = received[current]; ok {
+			confirmed++
+		}
+	}
+	return OK, recorded, confirmed
+}
+
+func (m *Memory) updatePeerTableSizes() {
+	metrics.PeerTableSize.WithLabelValues("storageNodes").Set(float64(len(m.storageNodes)))
+	metrics.PeerTableSize.WithLabelValues("coordinatorNodes").Set(float64(len(m.coordinatorNodes)))
+}
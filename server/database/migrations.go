@@ -0,0 +1,140 @@
+package database
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	. "subframe/status"
+)
+
+//Migrations reside in migrations/<database>/<version>_<description>.sql and are applied in order of their version
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version   int
+	name      string
+	statement string
+}
+
+//loadMigrations returns all embedded migrations for database, sorted by version
+func loadMigrations(database string) (migrations []migration, err error) {
+	dir := path.Join("migrations", database)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".sql") {
+			continue
+		}
+		version, err := strconv.Atoi(strings.SplitN(entry.Name(), "_", 2)[0])
+		if err != nil || version < 1 {
+			return nil, errors.New("migration " + entry.Name() + " does not start with a version number")
+		}
+		statement, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version, entry.Name(), string(statement)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, errors.New("migrations " + migrations[i-1].name + " and " + migrations[i].name + " share a version")
+		}
+	}
+	return migrations, nil
+}
+
+//migrate brings the schema of db up to date. Each migration runs in its own transaction together with its schema_version entry.
+//Databases with a newer schema than the embedded migrations know are refused, as they were written by a newer SuBFraMe version
+func migrate(db *sql.DB, database string) (status int) {
+	migrations, err := loadMigrations(database)
+	if err != nil {
+		log.Error(DBMigrationError, "Failed to load migrations for "+database+" database: "+err.Error())
+		return DBMigrationError
+	}
+
+	statement := `
+	CREATE TABLE IF NOT EXISTS schema_version(
+		version int not null primary key,
+		name varchar(255) not null,
+		appliedOn timestamp not null
+	);
+	`
+	if _, err = db.Exec(statement); err != nil {
+		log.Error(DBMigrationError, "Failed to create schema_version table for "+database+" database: "+err.Error())
+		return DBMigrationError
+	}
+
+	current, status := schemaVersion(db)
+	if status != OK {
+		return status
+	}
+	latest := 0
+	if len(migrations) > 0 {
+		latest = migrations[len(migrations)-1].version
+	}
+	if current > latest {
+		log.Error(DBSchemaTooNew, "Schema version "+strconv.Itoa(current)+" of "+database+" database is newer than the latest known version "+strconv.Itoa(latest)+". Refusing to start.")
+		return DBSchemaTooNew
+	}
+	if current == latest {
+		log.Info(OK, "Schema of "+database+" database is up to date (version "+strconv.Itoa(current)+").")
+		return OK
+	}
+
+	log.Info(InProgress, "Migrating "+database+" database from schema version "+strconv.Itoa(current)+" to "+strconv.Itoa(latest)+"...")
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if status := applyMigration(db, m); status != OK {
+			log.Error(status, "Failed to apply migration "+m.name+" to "+database+" database. Schema stays at version "+strconv.Itoa(current)+".")
+			return status
+		}
+		current = m.version
+		log.Info(OK, "Applied migration "+m.name+" to "+database+" database.")
+	}
+	log.Info(OK, "Migrated "+database+" database to schema version "+strconv.Itoa(current)+".")
+	return OK
+}
+
+func applyMigration(db *sql.DB, m migration) (status int) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Error(DBMigrationError, "Error starting transaction: "+err.Error())
+		return DBMigrationError
+	}
+	if _, err = tx.Exec(m.statement); err != nil {
+		tx.Rollback()
+		log.Error(DBMigrationError, "Error executing "+m.name+": "+err.Error())
+		return DBMigrationError
+	}
+	_, err = tx.Exec("INSERT INTO schema_version(version, name, appliedOn) VALUES (?, ?, datetime('now'))", m.version, m.name)
+	if err != nil {
+		tx.Rollback()
+		log.Error(DBMigrationError, "Error recording schema version: "+err.Error())
+		return DBMigrationError
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error(DBMigrationError, "Error committing "+m.name+": "+err.Error())
+		return DBMigrationError
+	}
+	return OK
+}
+
+//schemaVersion returns the version of the latest migration applied to db, 0 if none has been applied
+func schemaVersion(db *sql.DB) (version int, status int) {
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		log.Error(DBReadError, "Failed to read schema version: "+err.Error())
+		return 0, DBReadError
+	}
+	return version, OK
+}
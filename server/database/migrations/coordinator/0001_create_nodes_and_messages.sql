@@ -0,0 +1,17 @@
+-- Databases created before schema versioning already contain these tables, hence IF NOT EXISTS
+CREATE TABLE IF NOT EXISTS storageNodes(
+	address varchar(255) not null primary key,
+	lastPing timestamp not null,
+	ping int not null
+);
+CREATE TABLE IF NOT EXISTS coordinatorNodes(
+	address varchar(255) not null primary key,
+	lastPing timestamp not null,
+	ping int not null
+);
+CREATE TABLE IF NOT EXISTS messages(
+	id varchar(255) not null,
+	storageNode varchar(255) not null,
+	reportedOn timestamp not null,
+	verified tinyint not null default 0
+);
@@ -0,0 +1,2 @@
+-- With encryption at rest, id holds the blind index of the MessageID and sealedId the encrypted MessageID. Both stay plain otherwise
+ALTER TABLE messages ADD COLUMN sealedId text;
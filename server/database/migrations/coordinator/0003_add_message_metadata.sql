@@ -0,0 +1,7 @@
+-- Metadata announced along with messages, as recorded by the announcing StorageNode. Times are unix timestamps, ttl is given in seconds
+ALTER TABLE messages ADD COLUMN size integer not null default 0;
+ALTER TABLE messages ADD COLUMN createdOn integer;
+ALTER TABLE messages ADD COLUMN ttl integer not null default 0;
+ALTER TABLE messages ADD COLUMN priority int not null default 0;
+ALTER TABLE messages ADD COLUMN sha256 varchar(64) not null default '';
+ALTER TABLE messages ADD COLUMN expiresOn integer;
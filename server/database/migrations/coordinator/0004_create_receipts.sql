@@ -0,0 +1,7 @@
+-- Messages whose recipient presented the confirmation key. Receipts are kept apart from announcements,
+-- as a message may be received before this node learns about any StorageNode storing it
+CREATE TABLE receipts(
+	id varchar(255) not null primary key,
+	sealedId text,
+	receivedOn integer not null
+);
@@ -0,0 +1,4 @@
+-- Messages are indexed by the bucket of their recipient, the first 16 bits of the recipient fingerprint in the MessageID,
+-- so inbox queries do not need the MessageIDs, which may be sealed. Messages announced before are not in any bucket
+ALTER TABLE messages ADD COLUMN bucket integer;
+CREATE INDEX messages_bucket ON messages(bucket);
@@ -0,0 +1,17 @@
+-- Mailboxes of recipients receiving messages on multiple devices. recipient is the hex encoded fingerprint of the identity key,
+-- registration the registration signed by the recipient as JSON, so it can be passed on to senders and other CoordinatorNodes
+CREATE TABLE mailboxes(
+	recipient varchar(64) not null primary key,
+	version integer not null,
+	registration text not null,
+	updatedOn integer not null
+);
+-- Devices which presented the confirmation key of a message sent to their mailbox. The message is recorded in receipts
+-- once the quorum of the mailbox has been reached
+CREATE TABLE deviceReceipts(
+	id varchar(255) not null,
+	sealedId text,
+	device varchar(64) not null,
+	receivedOn integer not null,
+	primary key(id, device)
+);
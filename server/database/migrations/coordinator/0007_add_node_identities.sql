@@ -0,0 +1,6 @@
+-- The base64 encoded public identity key of each node, as returned by its /control/info. Requests signed with a known
+-- identity key are rate limited with the budget of nodes. Nodes added before are not known by any key
+ALTER TABLE storageNodes ADD COLUMN identityKey varchar(64) not null default '';
+ALTER TABLE coordinatorNodes ADD COLUMN identityKey varchar(64) not null default '';
+CREATE INDEX storageNodes_identityKey ON storageNodes(identityKey);
+CREATE INDEX coordinatorNodes_identityKey ON coordinatorNodes(identityKey);
@@ -0,0 +1,3 @@
+-- With encryption at rest, recipient holds the blind index of the fingerprint, sealedId the encrypted fingerprint and
+-- registration the encrypted registration. All stay plain otherwise
+ALTER TABLE mailboxes ADD COLUMN sealedId text;
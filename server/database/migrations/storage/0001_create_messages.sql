@@ -0,0 +1,7 @@
+-- Databases created before schema versioning already contain this table, hence IF NOT EXISTS
+CREATE TABLE IF NOT EXISTS messages(
+	id varchar(255) not null primary key,
+	verified tinyint not null default 0,
+	expiresOn timestamp not null,
+	lastCheck timestamp
+);
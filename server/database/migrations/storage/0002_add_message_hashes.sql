@@ -0,0 +1,3 @@
+-- Messages stored before hashes were recorded keep an empty sha256, which the scrubber fills in on their first pass
+ALTER TABLE messages ADD COLUMN sha256 varchar(64) not null default '';
+ALTER TABLE messages ADD COLUMN lastScrub timestamp;
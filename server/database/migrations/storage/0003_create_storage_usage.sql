@@ -0,0 +1,7 @@
+-- A single row keeping the bytes used by stored messages, so the quota can be checked without listing the storage backend
+CREATE TABLE storageUsage(
+	id int not null primary key check (id = 1),
+	usedBytes integer not null,
+	reconciledOn timestamp
+);
+INSERT INTO storageUsage(id, usedBytes) VALUES (1, 0);
@@ -0,0 +1,5 @@
+-- Metadata sent along with messages. createdOn is a unix timestamp, ttl is given in seconds, 0 if the sender did not request one
+ALTER TABLE messages ADD COLUMN size integer not null default 0;
+ALTER TABLE messages ADD COLUMN createdOn integer;
+ALTER TABLE messages ADD COLUMN ttl integer not null default 0;
+ALTER TABLE messages ADD COLUMN priority int not null default 0;
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	. "subframe/status"
+	"testing"
+	"time"
+)
+
+//The fixtures in testdata hold databases as written by earlier versions:
+//baseline has the tables created before schema versioning, intermediate the StorageDatabase at schema version 2 and
+//the CoordinatorDatabase at schema version 3. Both contain a few messages and nodes, which have to survive migrating
+
+//openFixture copies the databases of a fixture to a new data directory and opens them, which migrates them
+func openFixture(t *testing.T, fixture string) *SQLite {
+	t.Helper()
+	dataPath := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dataPath, "databases"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"storage.db", "coordinator.db"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", fixture, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dataPath, "databases", name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := OpenSQLite(dataPath)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func latestVersion(t *testing.T, database string) int {
+	t.Helper()
+	migrations, err := loadMigrations(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations[len(migrations)-1].version
+}
+
+func expectSchemaVersion(t *testing.T, db *sql.DB, database string) {
+	t.Helper()
+	version, status := schemaVersion(db)
+	if status != OK {
+		t.Fatalf("reading schema version of %s database failed with status %d", database, status)
+	}
+	if latest := latestVersion(t, database); version != latest {
+		t.Errorf("%s database is at schema version %d, expected %d", database, version, latest)
+	}
+}
+
+func TestMigrateFromBaseline(t *testing.T) {
+	s := openFixture(t, "baseline")
+	expectSchemaVersion(t, s.storageDB, "storage")
+	expectSchemaVersion(t, s.coordinatorDB, "coordinator")
+
+	for _, id := range []string{"baseline-message-1", "baseline-message-2"} {
+		if status, stored := s.CheckMessageStorage(id); status != OK || !stored {
+			t.Errorf("message %s got lost migrating the StorageDatabase", id)
+		}
+	}
+	if status, sha256 := s.GetMessageHash("baseline-message-1"); status != OK || sha256 != "" {
+		t.Errorf("baseline message has hash %q, expected none", sha256)
+	}
+	if status, used := s.GetStorageUsage(); status != OK || used != 0 {
+		t.Errorf("storage usage is %d with status %d, expected 0", used, status)
+	}
+
+	if status, nodes := s.GetCoordinatorNodes(); status != OK || len(nodes) != 1 || nodes[0].Address != "http://coordinator.example:8080" {
+		t.Errorf("CoordinatorNodes got lost migrating the CoordinatorDatabase: %v", nodes)
+	}
+	if status, nodes := s.GetStorageNodes(10); status != OK || len(nodes) != 1 || nodes[0].Address != "http://storage.example:8080" {
+		t.Errorf("StorageNodes got lost migrating the CoordinatorDatabase: %v", nodes)
+	}
+	if status, locations := s.GetMessageLocations("baseline-message-1"); status != OK || len(locations) != 1 {
+		t.Errorf("announcement got lost migrating the CoordinatorDatabase: %v", locations)
+	}
+}
+
+func TestMigrateFromIntermediateVersion(t *testing.T) {
+	s := openFixture(t, "intermediate")
+	expectSchemaVersion(t, s.storageDB, "storage")
+	expectSchemaVersion(t, s.coordinatorDB, "coordinator")
+
+	//Hashes recorded at schema version 2 are kept
+	expected := "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if status, sha256 := s.GetMessageHash("baseline-message-2"); status != OK || sha256 != expected {
+		t.Errorf("message hash is %q, expected %q", sha256, expected)
+	}
+
+	//Metadata recorded at schema version 3 is kept
+	status, metadata, found := s.GetMessageMetadataCoordinator("intermediate-message")
+	if status != OK || !found {
+		t.Fatalf("announcement got lost migrating the CoordinatorDatabase")
+	}
+	if metadata.Size != 42 || metadata.TTL != time.Hour {
+		t.Errorf("announced metadata is %+v, expected size 42 and a TTL of 1h", metadata)
+	}
+
+	//Tables added after schema version 3 are usable
+	if status, recorded := s.LogMessageReceipt("intermediate-message"); status != OK || !recorded {
+		t.Errorf("recording a receipt failed with status %d", status)
+	}
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	s := openFixture(t, "intermediate")
+	for _, database := range []struct {
+		name string
+		db   *sql.DB
+	}{{"storage", s.storageDB}, {"coordinator", s.coordinatorDB}} {
+		if status := migrate(database.db, database.name); status != OK {
+			t.Errorf("migrating the up to date %s database again failed with status %d", database.name, status)
+		}
+		expectSchemaVersion(t, database.db, database.name)
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	for _, database := range []string{"storage", "coordinator"} {
+		t.Run(database, func(t *testing.T) {
+			db, err := sql.Open(sqliteDriver, filepath.Join(t.TempDir(), database+".db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if status := migrate(db, database); status != OK {
+				t.Fatalf("migrating a new %s database failed with status %d", database, status)
+			}
+
+			//A newer SuBFraMe version migrated the database further
+			newer := latestVersion(t, database) + 1
+			if _, err = db.Exec("INSERT INTO schema_version(version, name, appliedOn) VALUES (?, 'newer.sql', datetime('now'))", newer); err != nil {
+				t.Fatal(err)
+			}
+			if status := migrate(db, database); status != DBSchemaTooNew {
+				t.Errorf("migrating a %s database at schema version %d returned status %d, expected %d", database, newer, status, DBSchemaTooNew)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package database
+
+import (
+	"subframe/structs/mailbox"
+	"subframe/structs/message"
+	"subframe/structs/node"
+	"time"
+)
+
+//MessageStore keeps track of the messages stored on the local StorageNode
+type MessageStore interface {
+	//LogMessageStorage records that a message described by metadata has been received and stored locally, until metadata.ExpiresOn
+	LogMessageStorage(id string, metadata message.Metadata) (status int)
+	//CheckMessageStorage checks whether a message is stored locally
+	CheckMessageStorage(id string) (status int, hasMessage bool)
+	//GetMessageHash returns the SHA-256 hash recorded for a locally stored message, empty if none has been recorded
+	GetMessageHash(id string) (status int, sha256 string)
+	//GetMessageMetadataStorage returns the metadata recorded for a locally stored message
+	GetMessageMetadataStorage(id string) (status int, metadata message.Metadata, found bool)
+	//GetMessagesToScrub returns up to limit messages which have not been scrubbed since before, least recently scrubbed first
+	GetMessagesToScrub(before time.Time, limit int) (status int, ids []string)
+	//GetStoredMessages returns the IDs of all locally stored messages
+	GetStoredMessages() (status int, ids []string)
+	//LogMessageScrub records that a message has been verified against sha256, and records sha256 if no hash has been recorded yet
+	LogMessageScrub(id string, sha256 string) (status int)
+	//UpdateMessageStatusStorage updates the status of a locally stored message
+	UpdateMessageStatusStorage(id string, status int) int
+	//CheckDueMessageStatusStorage returns up to limit messages which have not been received and whose status has not been checked
+	//since before, least recently checked first, and records them as checked
+	CheckDueMessageStatusStorage(before time.Time, limit int) (status int, ids []string)
+	//GetExpiredMessagesStorage returns up to limit messages which expired before now or have been received
+	GetExpiredMessagesStorage(now time.Time, limit int) (status int, ids []string)
+	//RemoveMessageStorage removes a message which has been removed from the storage backend
+	RemoveMessageStorage(id string) (status int)
+	//CheckConnection checks whether the store is usable
+	CheckConnection() (status int)
+}
+
+//UsageStore keeps track of the space used for message storage, so it does not have to be determined from the storage backend
+type UsageStore interface {
+	//GetStorageUsage returns the recorded number of bytes used by stored messages
+	GetStorageUsage() (status int, used int64)
+	//AddStorageUsage adds delta bytes, which may be negative, to the recorded usage
+	AddStorageUsage(delta int64) (status int)
+	//SetStorageUsage overwrites the recorded usage after it has been reconciled against the storage backend
+	SetStorageUsage(used int64) (status int)
+}
+
+//NodeStore keeps track of known StorageNodes and CoordinatorNodes
+type NodeStore interface {
+	AddStorageNode(n node.Node) (status int)
+	GetStorageNodes(limit int) (status int, storageNodes []node.Node)
+	AddCoordinatorNode(n node.Node) (status int)
+	GetCoordinatorNodes() (status int, coordinatorNodes []node.Node)
+	GetRandomCoordinatorNodes(max int) (status int, nodes []node.Node)
+	//ClearNodeTables removes all known nodes, for bootstrapping
+	ClearNodeTables() (status int)
+	//IsKnownNode returns whether identityKey belongs to a known StorageNode or CoordinatorNode
+	IsKnownNode(identityKey string) (status int, known bool)
+	//CheckConnection checks whether the store is usable
+	CheckConnection() (status int)
+}
+
+//CoordinatorIndex keeps track of which StorageNodes store which messages, and of the status of these messages
+type CoordinatorIndex interface {
+	//LogMessageAnnouncement records that storageNode announced to store a message described by metadata
+	LogMessageAnnouncement(id string, storageNode string, metadata message.Metadata) (status int)
+	GetMessageLocations(id string) (status int, storageNodes []string)
+	//GetMessageMetadataCoordinator returns the metadata announced for a message
+	GetMessageMetadataCoordinator(id string) (status int, metadata message.Metadata, found bool)
+	UpdateMessageStatusCoordinator(id string, status int) int
+	//LogMessageReceipt records that the recipient of a message presented its confirmation key. recorded is false if it had been recorded before
+	LogMessageReceipt(id string) (status int, recorded bool)
+	//GetMessageStatusCoordinator returns the status of a message, -1 if the message is unknown
+	GetMessageStatusCoordinator(id string) (status int, messageStatus int)
+	//GetInbox returns up to limit messages in the buckets first to last which have neither been received nor expired,
+	//and were first announced after cursor, in the order of their first announcement
+	GetInbox(first int, last int, cursor int64, limit int) (status int, entries []message.InboxEntry)
+	//SetMailbox stores the registration of the mailbox of a recipient, unless a registration with the same or a higher version is stored
+	SetMailbox(recipient string, version int64, registration mailbox.Registration) (status int, stored bool)
+	//GetMailbox returns the registration of the mailbox of a recipient
+	GetMailbox(recipient string) (status int, registration mailbox.Registration, found bool)
+	//LogDeviceReceipt records that a device of the mailbox of the recipient presented the confirmation key of a message.
+	//recorded is false if it had been recorded before, confirmed is the number of devices which presented it, counting only the
+	//devices of the current mailbox, so devices removed since do not count towards its quorum
+	LogDeviceReceipt(id string, device string, devices []string) (status int, recorded bool, confirmed int)
+}
+
+//Snapshotter writes consistent copies of all databases to a directory, while they are in use
+type Snapshotter interface {
+	Snapshot(dir string) (status int)
+}
+
+var _ MessageStore = (*SQLite)(nil)
+var _ UsageStore = (*SQLite)(nil)
+var _ NodeStore = (*SQLite)(nil)
+var _ CoordinatorIndex = (*SQLite)(nil)
+var _ Snapshotter = (*SQLite)(nil)
+var _ MessageStore = (*Memory)(nil)
+var _ UsageStore = (*Memory)(nil)
+var _ NodeStore = (*Memory)(nil)
+var _ CoordinatorIndex = (*Memory)(nil)
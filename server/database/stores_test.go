@@ -0,0 +1,471 @@
+package database
+
+import (
+	"crypto/ed25519"
+	"sort"
+	"strconv"
+	"strings"
+	. "subframe/status"
+	"subframe/structs/mailbox"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"subframe/structs/node"
+	"sync"
+	"testing"
+	"time"
+)
+
+//store is implemented by every store the node can run with
+type store interface {
+	MessageStore
+	UsageStore
+	NodeStore
+	CoordinatorIndex
+}
+
+//forEachStore runs test against a new SQLite store and a new Memory store. SQLite uses the driver selected by build tags,
+//so running the tests with and without -tags purego checks both drivers against the same expectations
+func forEachStore(t *testing.T, test func(t *testing.T, s store)) {
+	t.Run("SQLite-"+sqliteDriver, func(t *testing.T) {
+		s := OpenSQLite(t.TempDir())
+		t.Cleanup(s.Close)
+		test(t, s)
+	})
+	t.Run("Memory", func(t *testing.T) {
+		test(t, NewMemory())
+	})
+}
+
+//testMessageID returns a valid MessageID of a message to recipient. Messages to the same recipient share their bucket
+func testMessageID(t *testing.T, recipient string, confirmationKey string) string {
+	t.Helper()
+	id, err := messageid.New([]byte(recipient), confirmationKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id.String()
+}
+
+//Times are stored with a resolution of seconds
+var testTime = time.Unix(1700000000, 0).UTC()
+
+func TestMessageStore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		id := testMessageID(t, "recipient", "key")
+		metadata := message.Metadata{
+			TTL:       time.Hour,
+			Size:      1234,
+			CreatedOn: testTime,
+			SHA256:    "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+			Priority:  3,
+			ExpiresOn: testTime.Add(time.Hour),
+		}
+
+		if status, stored := s.CheckMessageStorage(id); status != OK || stored {
+			t.Fatalf("unknown message is stored")
+		}
+		if status := s.LogMessageStorage(id, metadata); status != OK {
+			t.Fatalf("logging message failed with status %d", status)
+		}
+		if status := s.LogMessageStorage(id, metadata); status != SNDBIdConflict {
+			t.Errorf("logging message twice returned status %d, expected %d", status, SNDBIdConflict)
+		}
+		if status, stored := s.CheckMessageStorage(id); status != OK || !stored {
+			t.Errorf("logged message is not stored")
+		}
+		if status, ids := s.GetStoredMessages(); status != OK || len(ids) != 1 || ids[0] != id {
+			t.Errorf("stored messages are %v, expected only the logged message", ids)
+		}
+		if status, sha256 := s.GetMessageHash(id); status != OK || sha256 != metadata.SHA256 {
+			t.Errorf("message hash is %q, expected %q", sha256, metadata.SHA256)
+		}
+
+		status, stored, found := s.GetMessageMetadataStorage(id)
+		if status != OK || !found {
+			t.Fatalf("metadata of logged message not found")
+		}
+		if stored.TTL != metadata.TTL || stored.Size != metadata.Size || !stored.CreatedOn.Equal(metadata.CreatedOn) ||
+			stored.SHA256 != metadata.SHA256 || stored.Priority != metadata.Priority || !stored.ExpiresOn.Equal(metadata.ExpiresOn) {
+			t.Errorf("metadata is %+v, expected %+v", stored, metadata)
+		}
+		if status, _, found := s.GetMessageMetadataStorage(testMessageID(t, "recipient", "other")); status != OK || found {
+			t.Errorf("metadata of unknown message found")
+		}
+		if status := s.UpdateMessageStatusStorage(id, message.StatusReceived); status != OK {
+			t.Errorf("updating message status failed with status %d", status)
+		}
+	})
+}
+
+func TestMessageScrubbing(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		scrubbed := testMessageID(t, "recipient", "scrubbed")
+		unscrubbed := testMessageID(t, "recipient", "unscrubbed")
+		for _, id := range []string{scrubbed, unscrubbed} {
+			if status := s.LogMessageStorage(id, message.Metadata{ExpiresOn: time.Now().Add(time.Hour)}); status != OK {
+				t.Fatalf("logging message failed with status %d", status)
+			}
+		}
+		if status := s.LogMessageScrub(scrubbed, "hash"); status != OK {
+			t.Fatalf("logging scrub failed with status %d", status)
+		}
+		if status, sha256 := s.GetMessageHash(scrubbed); status != OK || sha256 != "hash" {
+			t.Errorf("scrub did not record missing hash, hash is %q", sha256)
+		}
+		if status := s.LogMessageScrub(scrubbed, "other"); status != OK {
+			t.Fatalf("logging scrub failed with status %d", status)
+		}
+		if _, sha256 := s.GetMessageHash(scrubbed); sha256 != "hash" {
+			t.Errorf("scrub replaced recorded hash by %q", sha256)
+		}
+
+		status, ids := s.GetMessagesToScrub(time.Now().Add(-time.Hour), 10)
+		if status != OK || len(ids) != 1 || ids[0] != unscrubbed {
+			t.Errorf("messages to scrub are %v, expected only the unscrubbed message", ids)
+		}
+		status, ids = s.GetMessagesToScrub(time.Now().Add(time.Hour), 10)
+		if status != OK || len(ids) != 2 || ids[0] != unscrubbed {
+			t.Errorf("messages to scrub are %v, expected both messages, least recently scrubbed first", ids)
+		}
+		if _, ids = s.GetMessagesToScrub(time.Now().Add(time.Hour), 1); len(ids) != 1 {
+			t.Errorf("returned %d messages to scrub, expected the limit of 1", len(ids))
+		}
+	})
+}
+
+func TestMessageExpiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		pending := testMessageID(t, "recipient", "pending")
+		received := testMessageID(t, "recipient", "received")
+		expired := testMessageID(t, "recipient", "expired")
+		for id, expiresOn := range map[string]time.Time{pending: testTime.Add(time.Hour), received: testTime.Add(time.Hour), expired: testTime.Add(-time.Hour)} {
+			if status := s.LogMessageStorage(id, message.Metadata{ExpiresOn: expiresOn}); status != OK {
+				t.Fatalf("logging message failed with status %d", status)
+			}
+		}
+		if status := s.UpdateMessageStatusStorage(received, message.StatusReceived); status != OK {
+			t.Fatalf("updating message status failed with status %d", status)
+		}
+
+		//Checked messages are only due again after the delay, received ones are never due
+		status, due := s.CheckDueMessageStatusStorage(time.Now().Add(-time.Hour), 1)
+		if status != OK || len(due) != 1 || due[0] == received {
+			t.Errorf("messages due for a check are %v, expected the limit of 1 unreceived message", due)
+		}
+		if _, more := s.CheckDueMessageStatusStorage(time.Now().Add(-time.Hour), 10); len(more) != 1 || more[0] == due[0] || more[0] == received {
+			t.Errorf("messages due for a check are %v, expected the other unreceived message", more)
+		}
+		if _, more := s.CheckDueMessageStatusStorage(time.Now().Add(-time.Hour), 10); len(more) != 0 {
+			t.Errorf("messages due for a check are %v, expected none after checking all", more)
+		}
+		if _, more := s.CheckDueMessageStatusStorage(time.Now().Add(time.Hour), 10); len(more) != 2 {
+			t.Errorf("messages due for a check are %v, expected both unreceived messages after the delay", more)
+		}
+
+		status, ids := s.GetExpiredMessagesStorage(testTime, 10)
+		sort.Strings(ids)
+		want := []string{received, expired}
+		sort.Strings(want)
+		if status != OK || strings.Join(ids, ",") != strings.Join(want, ",") {
+			t.Errorf("expired messages are %v, expected the received and the expired message", ids)
+		}
+		for _, id := range ids {
+			if status := s.RemoveMessageStorage(id); status != OK {
+				t.Fatalf("removing message failed with status %d", status)
+			}
+		}
+		if _, stored := s.CheckMessageStorage(expired); stored {
+			t.Errorf("removed message is still stored")
+		}
+		if _, ids = s.GetStoredMessages(); len(ids) != 1 || ids[0] != pending {
+			t.Errorf("stored messages are %v, expected only the pending message", ids)
+		}
+	})
+}
+
+func TestUsageStore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		steps := []struct {
+			apply    func() int
+			expected int64
+		}{
+			{func() int { return s.AddStorageUsage(100) }, 100},
+			{func() int { return s.AddStorageUsage(-30) }, 70},
+			{func() int { return s.AddStorageUsage(-100) }, 0},
+			{func() int { return s.SetStorageUsage(500) }, 500},
+		}
+		for i, step := range steps {
+			if status := step.apply(); status != OK {
+				t.Fatalf("step %d failed with status %d", i, status)
+			}
+			if status, used := s.GetStorageUsage(); status != OK || used != step.expected {
+				t.Errorf("usage after step %d is %d, expected %d", i, used, step.expected)
+			}
+		}
+	})
+}
+
+//TestConcurrentWriters writes from several connections, and from a second handle on the same files as a snapshot or command
+//running next to the server would, which must wait for each other instead of failing with SQLITE_BUSY
+func TestConcurrentWriters(t *testing.T) {
+	dataPath := t.TempDir()
+	handles := []*SQLite{OpenSQLite(dataPath), OpenSQLite(dataPath)}
+	for _, s := range handles {
+		t.Cleanup(s.Close)
+	}
+
+	const writers, writes = 8, 25
+	var wg sync.WaitGroup
+	failed := make(chan int, writers*writes*2)
+	for w := 0; w < writers; w++ {
+		s := handles[w%len(handles)]
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if status := s.AddStorageUsage(1); status != OK {
+					failed <- status
+				}
+				id := testMessageID(t, "recipient", "writer-"+strconv.Itoa(w)+"-"+strconv.Itoa(i))
+				if status := s.LogMessageStorage(id, message.Metadata{ExpiresOn: testTime}); status != OK {
+					failed <- status
+				}
+				if status, _ := s.CheckDueMessageStatusStorage(time.Now(), 10); status != OK {
+					failed <- status
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(failed)
+	for status := range failed {
+		t.Errorf("concurrent write failed with status %d", status)
+	}
+	if _, used := handles[0].GetStorageUsage(); used != writers*writes {
+		t.Errorf("usage is %d, expected %d", used, writers*writes)
+	}
+	if _, ids := handles[1].GetStoredMessages(); len(ids) != writers*writes {
+		t.Errorf("%d messages are stored, expected %d", len(ids), writers*writes)
+	}
+}
+
+func TestNodeStore(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		storageNodes := []node.Node{
+			{Address: "http://storage-1.example", LastPing: testTime, Ping: 10, IdentityKey: "c3RvcmFnZS0x"},
+			{Address: "http://storage-2.example", LastPing: testTime.Add(time.Minute), Ping: 20},
+		}
+		for _, n := range storageNodes {
+			if status := s.AddStorageNode(n); status != OK {
+				t.Fatalf("adding StorageNode failed with status %d", status)
+			}
+		}
+		if status := s.AddStorageNode(storageNodes[0]); status == OK {
+			t.Errorf("adding a StorageNode twice succeeded")
+		}
+		coordinatorNode := node.Node{Address: "http://coordinator.example", LastPing: testTime, Ping: 30, IdentityKey: "Y29vcmRpbmF0b3I="}
+		if status := s.AddCoordinatorNode(coordinatorNode); status != OK {
+			t.Fatalf("adding CoordinatorNode failed with status %d", status)
+		}
+
+		status, nodes := s.GetStorageNodes(10)
+		if status != OK || len(nodes) != len(storageNodes) {
+			t.Fatalf("got %d StorageNodes, expected %d", len(nodes), len(storageNodes))
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Address < nodes[j].Address })
+		for i, n := range nodes {
+			if n.Address != storageNodes[i].Address || !n.LastPing.Equal(storageNodes[i].LastPing) || n.IdentityKey != storageNodes[i].IdentityKey {
+				t.Errorf("got StorageNode %+v, expected %+v", n, storageNodes[i])
+			}
+		}
+		if _, nodes = s.GetStorageNodes(1); len(nodes) != 1 {
+			t.Errorf("got %d StorageNodes, expected the limit of 1", len(nodes))
+		}
+		status, nodes = s.GetCoordinatorNodes()
+		if status != OK || len(nodes) != 1 || nodes[0].Address != coordinatorNode.Address || !nodes[0].LastPing.Equal(coordinatorNode.LastPing) {
+			t.Errorf("got CoordinatorNodes %+v, expected %+v", nodes, coordinatorNode)
+		}
+
+		for identityKey, expected := range map[string]bool{"c3RvcmFnZS0x": true, "Y29vcmRpbmF0b3I=": true, "dW5rbm93bg==": false, "": false} {
+			if status, known := s.IsKnownNode(identityKey); status != OK || known != expected {
+				t.Errorf("identity key %q is known: %v with status %d, expected %v", identityKey, known, status, expected)
+			}
+		}
+
+		for _, address := range []string{"http://coordinator-2.example", "http://coordinator-3.example"} {
+			s.AddCoordinatorNode(node.Node{Address: address, LastPing: testTime, Ping: 40})
+		}
+		status, nodes = s.GetRandomCoordinatorNodes(2)
+		if status != OK || len(nodes) != 2 || nodes[0].Address == nodes[1].Address {
+			t.Errorf("got random CoordinatorNodes %+v, expected 2 different ones", nodes)
+		}
+		for _, n := range nodes {
+			if n.Address == coordinatorNode.Address && (n.Ping != coordinatorNode.Ping || n.IdentityKey != coordinatorNode.IdentityKey || !n.LastPing.Equal(testTime)) {
+				t.Errorf("got random CoordinatorNode %+v, expected %+v", n, coordinatorNode)
+			}
+		}
+		if _, nodes = s.GetRandomCoordinatorNodes(10); len(nodes) != 3 {
+			t.Errorf("got %d random CoordinatorNodes, expected all 3", len(nodes))
+		}
+
+		if status := s.ClearNodeTables(); status != OK {
+			t.Fatalf("clearing node tables failed with status %d", status)
+		}
+		if _, known := s.IsKnownNode("c3RvcmFnZS0x"); known {
+			t.Errorf("identity key is still known after clearing")
+		}
+		if _, nodes = s.GetStorageNodes(10); len(nodes) != 0 {
+			t.Errorf("%d StorageNodes left after clearing", len(nodes))
+		}
+		if _, nodes = s.GetCoordinatorNodes(); len(nodes) != 0 {
+			t.Errorf("%d CoordinatorNodes left after clearing", len(nodes))
+		}
+	})
+}
+
+func TestCoordinatorIndex(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		id := testMessageID(t, "recipient", "key")
+		metadata := message.Metadata{TTL: time.Hour, Size: 42, CreatedOn: testTime, SHA256: "hash", Priority: 1, ExpiresOn: time.Now().Add(time.Hour).Truncate(time.Second)}
+
+		if status, messageStatus := s.GetMessageStatusCoordinator(id); status != OK || messageStatus != message.StatusUnknown {
+			t.Errorf("status of unknown message is %d, expected %d", messageStatus, message.StatusUnknown)
+		}
+		for _, storageNode := range []string{"http://storage-1.example", "http://storage-2.example", "http://storage-1.example"} {
+			if status := s.LogMessageAnnouncement(id, storageNode, metadata); status != OK {
+				t.Fatalf("logging announcement failed with status %d", status)
+			}
+		}
+		status, locations := s.GetMessageLocations(id)
+		sort.Strings(locations)
+		if status != OK || len(locations) != 2 || locations[0] != "http://storage-1.example" || locations[1] != "http://storage-2.example" {
+			t.Errorf("message is stored on %v, expected both StorageNodes once", locations)
+		}
+		status, announced, found := s.GetMessageMetadataCoordinator(id)
+		if status != OK || !found || announced.Size != metadata.Size || announced.TTL != metadata.TTL || !announced.ExpiresOn.Equal(metadata.ExpiresOn) {
+			t.Errorf("announced metadata is %+v, expected %+v", announced, metadata)
+		}
+		if status, messageStatus := s.GetMessageStatusCoordinator(id); status != OK || messageStatus != message.StatusStored {
+			t.Errorf("status of announced message is %d, expected %d", messageStatus, message.StatusStored)
+		}
+
+		if status, recorded := s.LogMessageReceipt(id); status != OK || !recorded {
+			t.Errorf("logging receipt failed with status %d", status)
+		}
+		if status, recorded := s.LogMessageReceipt(id); status != OK || recorded {
+			t.Errorf("receipt was recorded twice")
+		}
+		if status, messageStatus := s.GetMessageStatusCoordinator(id); status != OK || messageStatus != message.StatusReceived {
+			t.Errorf("status of received message is %d, expected %d", messageStatus, message.StatusReceived)
+		}
+
+		//Messages may be received before any StorageNode announced them
+		early := testMessageID(t, "recipient", "early")
+		s.LogMessageReceipt(early)
+		if _, messageStatus := s.GetMessageStatusCoordinator(early); messageStatus != message.StatusReceived {
+			t.Errorf("status of message received before its announcement is %d, expected %d", messageStatus, message.StatusReceived)
+		}
+	})
+}
+
+func TestInbox(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		future := message.Metadata{ExpiresOn: time.Now().Add(time.Hour)}
+		first := testMessageID(t, "recipient", "first")
+		second := testMessageID(t, "recipient", "second")
+		received := testMessageID(t, "recipient", "received")
+		expired := testMessageID(t, "recipient", "expired")
+		other := testMessageID(t, "other recipient", "other")
+		s.LogMessageAnnouncement(first, "http://storage-1.example", future)
+		s.LogMessageAnnouncement(received, "http://storage-1.example", future)
+		s.LogMessageAnnouncement(expired, "http://storage-1.example", message.Metadata{ExpiresOn: time.Now().Add(-time.Hour)})
+		s.LogMessageAnnouncement(second, "http://storage-1.example", future)
+		s.LogMessageAnnouncement(other, "http://storage-1.example", future)
+		//A later announcement of the first message does not move it behind the second one
+		s.LogMessageAnnouncement(first, "http://storage-2.example", future)
+		s.LogMessageReceipt(received)
+
+		parsed, _ := messageid.Parse(first)
+		bucket := parsed.Bucket()
+		status, entries := s.GetInbox(bucket, bucket, 0, 10)
+		if status != OK {
+			t.Fatalf("getting inbox failed with status %d", status)
+		}
+		if len(entries) != 2 || entries[0].ID != first || entries[1].ID != second {
+			t.Fatalf("inbox is %+v, expected the first and the second message", entries)
+		}
+		if len(entries[0].StorageNodes) != 2 {
+			t.Errorf("first message is stored on %v, expected both StorageNodes", entries[0].StorageNodes)
+		}
+		if entries[0].Cursor >= entries[1].Cursor {
+			t.Errorf("cursors %d and %d are not increasing", entries[0].Cursor, entries[1].Cursor)
+		}
+
+		if _, entries = s.GetInbox(bucket, bucket, 0, 1); len(entries) != 1 || entries[0].ID != first {
+			t.Errorf("inbox limited to 1 entry is %+v, expected the first message", entries)
+		}
+		_, after := s.GetInbox(bucket, bucket, entries[0].Cursor, 10)
+		if len(after) != 1 || after[0].ID != second {
+			t.Errorf("inbox after the first message is %+v, expected the second message", after)
+		}
+		if _, all := s.GetInbox(0, 1<<messageid.BucketBits-1, 0, 10); len(all) != 3 {
+			t.Errorf("inbox of all buckets contains %d messages, expected 3", len(all))
+		}
+	})
+}
+
+func TestMailboxes(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s store) {
+		_, identityKey, _ := ed25519.GenerateKey(nil)
+		signingKey, _, _ := ed25519.GenerateKey(nil)
+		mb := mailbox.Mailbox{
+			IdentityKey: identityKey.Public().(ed25519.PublicKey),
+			Devices:     []mailbox.Device{{ID: "phone", SigningKey: signingKey}},
+			Version:     2,
+		}
+		registration, err := mailbox.Sign(mb, identityKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		recipient := mb.Recipient()
+
+		if status, _, found := s.GetMailbox(recipient); status != OK || found {
+			t.Errorf("unknown mailbox found")
+		}
+		if status, stored := s.SetMailbox(recipient, 2, registration); status != OK || !stored {
+			t.Fatalf("storing mailbox failed with status %d", status)
+		}
+		for _, version := range []int64{1, 2} {
+			if status, stored := s.SetMailbox(recipient, version, mailbox.Registration{Mailbox: []byte("{}")}); status != OK || stored {
+				t.Errorf("version %d replaced stored version 2", version)
+			}
+		}
+		status, stored, found := s.GetMailbox(recipient)
+		if status != OK || !found || string(stored.Mailbox) != string(registration.Mailbox) || string(stored.Signature) != string(registration.Signature) {
+			t.Fatalf("stored registration is %+v, expected %+v", stored, registration)
+		}
+		if _, err = stored.Open(); err != nil {
+			t.Errorf("stored registration cannot be opened: %s", err)
+		}
+
+		id := testMessageID(t, "recipient", "key")
+		for i, step := range []struct {
+			device    string
+			devices   []string
+			recorded  bool
+			confirmed int
+		}{
+			{"phone", []string{"phone", "laptop"}, true, 1},
+			{"phone", []string{"phone", "laptop"}, false, 1},
+			{"laptop", []string{"phone", "laptop"}, true, 2},
+			//Receipts of devices removed from the mailbox are not counted
+			{"tablet", []string{"laptop", "tablet"}, true, 2},
+			{"laptop", []string{"tablet"}, false, 1},
+		} {
+			status, recorded, confirmed := s.LogDeviceReceipt(id, step.device, step.devices)
+			if status != OK || recorded != step.recorded || confirmed != step.confirmed {
+				t.Errorf("receipt %d by %s: recorded %t and confirmed %d, expected %t and %d", i, step.device, recorded, confirmed, step.recorded, step.confirmed)
+			}
+		}
+	})
+}
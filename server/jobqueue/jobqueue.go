@@ -1,10 +1,14 @@
 package jobqueue
 
 import (
+	"context"
 	"strconv"
 	"subframe/server/logger"
+	"subframe/server/metrics"
 	"subframe/server/settings"
 	. "subframe/status"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,25 +36,27 @@ func (sw worker) start() {
 	log.Info(InProgress, "Starting worker "+sw.id+".")
 	go func() {
 		for {
-			workerCount := len(workerPool)
-			queueLength := len(Queue)
+			workerCount := workerCount()
+			queueLength := int(atomic.LoadInt64(&waiting))
+			config := settings.Get()
 
-			if workerCount < settings.MaxWorkers && queueLength >= settings.QueueMaxLength {
+			if workerCount < config.MaxWorkers && queueLength >= config.QueueMaxLength {
 				log.Info(JQQueueTooLong, "Queue length exceeds settings.MaxQueueLength. Trying to spawn new worker...")
 				SpawnWorker()
-			} else if workerCount > 1 && queueLength <= settings.QueueMaxLength {
-				log.Info(JQTooManyWorkers, "Too many workers for current queue length. Killing worker "+sw.id+"...")
-				sw.die <- true
+			} else if workerCount > 1 && queueLength <= config.QueueMaxLength && removeWorkerFromPool(sw.id, 1) {
+				log.Info(JQTooManyWorkers, "Too many workers for current queue length. Killed worker "+sw.id+".")
+				return
 			}
 			select {
 			case job := <-Queue:
 				{
 					job.execute()
+					pending.Done()
 				}
 			case <-sw.die:
 				{
 					log.Info(InProgress, "Killing worker "+sw.id+"...")
-					removeWorkerFromPool(sw.id)
+					removeWorkerFromPool(sw.id, 0)
 					return
 				}
 			}
@@ -59,32 +65,156 @@ func (sw worker) start() {
 }
 
 var workerPool []*worker
+var workerPoolMutex sync.Mutex
+var workerSerial int64
+
+//Number of jobs waiting to be picked up by a worker
+var waiting int64
+
+//Jobs which have been enqueued, but not yet executed
+var pending sync.WaitGroup
 
 //Queue holds all jobs waiting to be executed
 var Queue = make(chan Job)
 
+//closed is set once Drain started, after which no jobs are accepted. It guards pending.Add, so it never races with pending.Wait
+var closed bool
+var closedMutex sync.Mutex
+
+//stopped is closed once Drain killed the workers, releasing jobs which are still waiting for one
+var stopped = make(chan struct{})
+
+//Enqueue adds a job to the Queue and blocks until a worker picks it up. Jobs are dropped once the Queue is drained
+func Enqueue(job Job) (status int) {
+	closedMutex.Lock()
+	if closed {
+		closedMutex.Unlock()
+		log.Warn(JQQueueClosed, "Dropped job, as the Queue is being drained.")
+		return JQQueueClosed
+	}
+	pending.Add(1)
+	closedMutex.Unlock()
+
+	atomic.AddInt64(&waiting, 1)
+	metrics.JobQueueDepth.Inc()
+	defer metrics.JobQueueDepth.Dec()
+	defer atomic.AddInt64(&waiting, -1)
+	select {
+	case Queue <- job:
+		return OK
+	case <-stopped:
+		pending.Done()
+		log.Warn(JQQueueClosed, "Dropped job, as all workers have been killed.")
+		return JQQueueClosed
+	}
+}
+
 //SpawnWorker spawns a new Worker, if MaxWorkers setting allows it
 func SpawnWorker() {
-	if len(workerPool) >= settings.MaxWorkers {
+	workerPoolMutex.Lock()
+	if len(workerPool) >= settings.Get().MaxWorkers {
+		workerPoolMutex.Unlock()
 		log.Warn(JQTooManyWorkers, "settings.MaxWorkers does not allow for a new Worker to be spawned.")
 		return
 	}
 	log.Info(InProgress, "Spawning and starting new Worker...")
 	worker := worker{
-		id:  strconv.FormatInt(time.Now().Unix(), 16),
-		die: make(chan bool),
+		id:  strconv.FormatInt(time.Now().Unix(), 16) + "-" + strconv.FormatInt(atomic.AddInt64(&workerSerial, 1), 10),
+		die: make(chan bool, 1),
 	}
 	workerPool = append(workerPool, &worker)
-	log.Info(OK, "New worker count: "+strconv.Itoa(len(workerPool)))
+	count := len(workerPool)
+	workerPoolMutex.Unlock()
+
+	metrics.JobQueueWorkers.Set(float64(count))
+	log.Info(OK, "New worker count: "+strconv.Itoa(count))
 	worker.start()
 }
 
-func removeWorkerFromPool(id string) {
-	//Remove worker with id from pool
+//Drain waits until all enqueued jobs have been executed, or ctx is done, then kills all workers
+func Drain(ctx context.Context) {
+	log.Info(InProgress, "Draining Queue...")
+	closedMutex.Lock()
+	if closed {
+		closedMutex.Unlock()
+		return
+	}
+	closed = true
+	closedMutex.Unlock()
+
+	drained := make(chan bool)
+	go func() {
+		pending.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		log.Info(OK, "Drained Queue.")
+	case <-ctx.Done():
+		log.Warn(JQDrainTimeout, "Timed out waiting for "+strconv.FormatInt(atomic.LoadInt64(&waiting), 10)+" queued jobs.")
+	}
+
+	workerPoolMutex.Lock()
+	workers := append([]*worker(nil), workerPool...)
+	workerPoolMutex.Unlock()
+	for _, w := range workers {
+		w.kill()
+	}
+	close(stopped)
+}
+
+//ApplySettings kills surplus workers if settings.MaxWorkers has been lowered. New workers are spawned on demand
+func ApplySettings(previous settings.Config, next settings.Config) {
+	workerPoolMutex.Lock()
+	surplus := len(workerPool) - next.MaxWorkers
+	var workers []*worker
+	if surplus > 0 {
+		workers = append(workers, workerPool[len(workerPool)-surplus:]...)
+	}
+	workerPoolMutex.Unlock()
+
+	if len(workers) > 0 {
+		log.Info(JQTooManyWorkers, "settings.MaxWorkers lowered to "+strconv.Itoa(next.MaxWorkers)+". Killing "+strconv.Itoa(len(workers))+" workers...")
+	}
+	for _, w := range workers {
+		w.kill()
+	}
+}
+
+//kill makes the worker stop once it finished its current job
+func (sw *worker) kill() {
+	select {
+	case sw.die <- true:
+	default:
+		//Worker is already being killed
+	}
+}
+
+func workerCount() int {
+	workerPoolMutex.Lock()
+	defer workerPoolMutex.Unlock()
+	return len(workerPool)
+}
+
+//removeWorkerFromPool removes the worker with id from the pool, as long as more than keep workers remain
+func removeWorkerFromPool(id string, keep int) (removed bool) {
+	workerPoolMutex.Lock()
+	if len(workerPool) <= keep {
+		workerPoolMutex.Unlock()
+		return false
+	}
 	for index, value := range workerPool {
 		if value.id == id {
 			workerPool = append(workerPool[:index], workerPool[index+1:]...)
+			removed = true
+			break
 		}
 	}
+	count := len(workerPool)
+	workerPoolMutex.Unlock()
+
+	metrics.JobQueueWorkers.Set(float64(count))
 	log.Info(OK, "Worker "+id+" killed.")
+	return removed
 }
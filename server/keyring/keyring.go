@@ -0,0 +1,295 @@
+package keyring
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"subframe/server/logger"
+	"subframe/server/settings"
+	. "subframe/status"
+)
+
+var log = logger.Logger{Prefix: "keyring/Main"}
+
+//KeySize is the size of a master key in bytes
+const KeySize = 32
+
+//KeyIDSize is the size of the ID prepended to everything sealed with a key
+const KeyIDSize = 4
+
+//passphraseIterations is the PBKDF2 work factor for master keys derived from passphrases
+const passphraseIterations = 600000
+
+//ErrUnknownKey is returned by Open if data was sealed with a key that is not in the keyring
+var ErrUnknownKey = errors.New("sealed with unknown key")
+
+//ErrMalformed is returned by Open if data is too short or not in the sealed format
+var ErrMalformed = errors.New("malformed sealed data")
+
+//key holds the subkeys derived from a master key, so the same master key is never used for different purposes
+type key struct {
+	id     []byte
+	aead   cipher.AEAD
+	index  []byte
+	prefix []byte
+}
+
+//keys holds the active key first, followed by previous keys, which are only used to open data not yet rekeyed
+var keys []*key
+
+//Init loads the master keys from settings.EncryptionKeyFile or settings.EncryptionPassphrase. Without either, encryption stays disabled
+func Init(config settings.Config) (status int) {
+	keys = nil
+	var masterKeys [][]byte
+	switch {
+	case config.EncryptionKeyFile != "":
+		log.Info(InProgress, "Loading encryption keys from "+config.EncryptionKeyFile+"...")
+		var err error
+		if masterKeys, err = readKeyFile(config.EncryptionKeyFile); err != nil {
+			log.Error(EncryptionKeyError, "Failed to load encryption keys: "+err.Error())
+			return EncryptionKeyError
+		}
+	case config.EncryptionPassphrase != "":
+		log.Info(InProgress, "Deriving encryption key from passphrase...")
+		salt, err := loadSalt(config.DataPath + "/encryption.salt")
+		if err != nil {
+			log.Error(EncryptionKeyError, "Failed to load passphrase salt: "+err.Error())
+			return EncryptionKeyError
+		}
+		for _, passphrase := range []string{config.EncryptionPassphrase, config.EncryptionPreviousPassphrase} {
+			if passphrase == "" {
+				continue
+			}
+			master, err := pbkdf2.Key(sha256.New, passphrase, salt, passphraseIterations, KeySize)
+			if err != nil {
+				log.Error(EncryptionKeyError, "Failed to derive encryption key: "+err.Error())
+				return EncryptionKeyError
+			}
+			masterKeys = append(masterKeys, master)
+		}
+	default:
+		log.Info(OK, "Encryption at rest is disabled.")
+		return OK
+	}
+
+	for _, master := range masterKeys {
+		k, err := deriveKey(master)
+		if err != nil {
+			log.Error(EncryptionKeyError, "Failed to derive encryption key: "+err.Error())
+			keys = nil
+			return EncryptionKeyError
+		}
+		keys = append(keys, k)
+	}
+	log.Info(OK, "Encryption at rest is enabled with key "+KeyID()+".")
+	return OK
+}
+
+//Enabled returns whether messages and sensitive database columns are encrypted
+func Enabled() bool {
+	return len(keys) > 0
+}
+
+//KeyID returns the hex encoded ID of the active key, empty if encryption is disabled
+func KeyID() string {
+	if !Enabled() {
+		return ""
+	}
+	return hex.EncodeToString(keys[0].id)
+}
+
+//Index returns a blind index of value under the active key, which allows to look up values without storing them.
+//Without encryption, value is returned unchanged
+func Index(value string) string {
+	if !Enabled() {
+		return value
+	}
+	mac := hmac.New(sha256.New, keys[0].index)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//Prefix returns a keyed permutation of value, a number of the given bits, under the active key. Each bit is flipped by an HMAC
+//of the bits before it, so values sharing their first bits are mapped to values sharing as many first bits, and all values starting
+//with a prefix are mapped to a range again. Without encryption, value is returned unchanged
+func Prefix(value int, bits int) int {
+	if !Enabled() {
+		return value
+	}
+	mac := hmac.New(sha256.New, keys[0].prefix)
+	permuted := 0
+	for i := 0; i < bits; i++ {
+		leading := value >> (bits - i)
+		mac.Reset()
+		mac.Write([]byte{byte(i), byte(leading >> 24), byte(leading >> 16), byte(leading >> 8), byte(leading)})
+		bit := (value >> (bits - 1 - i)) & 1
+		permuted = permuted<<1 | (bit ^ int(mac.Sum(nil)[0]&1))
+	}
+	return permuted
+}
+
+//Overhead returns the number of bytes Seal adds to its plaintext
+func Overhead() int {
+	return KeyIDSize + keys[0].aead.NonceSize() + keys[0].aead.Overhead()
+}
+
+//Seal encrypts and authenticates plaintext and additional data with the active key. additional is not included in the result
+//and has to be passed to Open again
+func Seal(plaintext []byte, additional []byte) []byte {
+	k := keys[0]
+	sealed := make([]byte, KeyIDSize+k.aead.NonceSize(), Overhead()+len(plaintext))
+	copy(sealed, k.id)
+	if _, err := rand.Read(sealed[KeyIDSize:]); err != nil {
+		log.Fatal(GenericInternalError, "Failed to generate nonce: "+err.Error())
+	}
+	return k.aead.Seal(sealed, sealed[KeyIDSize:], plaintext, additional)
+}
+
+//Open decrypts data sealed with any key in the keyring
+func Open(sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < KeyIDSize {
+		return nil, ErrMalformed
+	}
+	k := findKey(sealed[:KeyIDSize])
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	if len(sealed) < KeyIDSize+k.aead.NonceSize()+k.aead.Overhead() {
+		return nil, ErrMalformed
+	}
+	nonce := sealed[KeyIDSize : KeyIDSize+k.aead.NonceSize()]
+	return k.aead.Open(nil, nonce, sealed[KeyIDSize+k.aead.NonceSize():], additional)
+}
+
+//SealString seals value for storage in a text column, as "<key ID>:<base64>". The key ID prefix allows to find values sealed with previous keys
+func SealString(value string) string {
+	return KeyID() + ":" + base64.StdEncoding.EncodeToString(Seal([]byte(value), nil))
+}
+
+//OpenString opens a value sealed with SealString
+func OpenString(sealed string) (string, error) {
+	separator := strings.IndexByte(sealed, ':')
+	if separator < 0 {
+		return "", ErrMalformed
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed[separator+1:])
+	if err != nil {
+		return "", ErrMalformed
+	}
+	value, err := Open(raw, nil)
+	return string(value), err
+}
+
+func findKey(id []byte) *key {
+	for _, k := range keys {
+		if bytes.Equal(k.id, id) {
+			return k
+		}
+	}
+	return nil
+}
+
+//deriveKey derives independent subkeys for the key ID, the AEAD, blind indexes and prefixes from a master key
+func deriveKey(master []byte) (*key, error) {
+	id, err := hkdf.Key(sha256.New, master, nil, "subframe key id", KeyIDSize)
+	if err != nil {
+		return nil, err
+	}
+	content, err := hkdf.Key(sha256.New, master, nil, "subframe content", 32)
+	if err != nil {
+		return nil, err
+	}
+	index, err := hkdf.Key(sha256.New, master, nil, "subframe index", 32)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := hkdf.Key(sha256.New, master, nil, "subframe prefix", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(content)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &key{id: id, aead: aead, index: index, prefix: prefix}, nil
+}
+
+//readKeyFile reads base64 encoded master keys, one per line. The first key is active, the following ones are previous keys.
+//Empty lines and lines starting with # are ignored
+func readKeyFile(path string) ([][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if stat, err := file.Stat(); err == nil && stat.Mode().Perm()&0077 != 0 {
+		log.Warn(EncryptionKeyError, "Key file "+path+" is accessible by other users than its owner.")
+	}
+
+	var masterKeys [][]byte
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		master, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(master) != KeySize {
+			return nil, errors.New("every key has to be 32 base64 encoded bytes")
+		}
+		masterKeys = append(masterKeys, master)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(masterKeys) == 0 {
+		return nil, errors.New("no key in " + path)
+	}
+	return masterKeys, nil
+}
+
+//loadSalt reads the salt used to derive master keys from passphrases, generating it on first use.
+//The salt is not secret, but losing it makes all encrypted data unreadable
+func loadSalt(path string) ([]byte, error) {
+	salt, err := ioutil.ReadFile(path)
+	if err == nil {
+		return salt, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	salt = make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return salt, ioutil.WriteFile(path, salt, 0600)
+}
+
+//GenerateKey returns a new random master key, base64 encoded as expected in key files
+func GenerateKey() string {
+	master := make([]byte, KeySize)
+	if _, err := rand.Read(master); err != nil {
+		log.Fatal(GenericInternalError, "Failed to generate key: "+err.Error())
+	}
+	return base64.StdEncoding.EncodeToString(master)
+}
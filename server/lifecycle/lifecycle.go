@@ -0,0 +1,122 @@
+package lifecycle
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"subframe/server/logger"
+	. "subframe/status"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var log = logger.Logger{Prefix: "lifecycle/Main"}
+
+//Hook stops a subsystem. It should return once the subsystem is stopped, or ctx is done
+type Hook func(ctx context.Context)
+
+type namedHook struct {
+	name string
+	hook Hook
+}
+
+var rootContext, cancelRoot = context.WithCancel(context.Background())
+var hooks []namedHook
+var reloadHooks []func()
+var hooksMutex sync.Mutex
+var shutdownOnce sync.Once
+var signalsOnce sync.Once
+
+//Context returns the root context, which is cancelled as soon as the server starts shutting down
+func Context() context.Context {
+	return rootContext
+}
+
+//ShuttingDown returns whether the server has started shutting down
+func ShuttingDown() bool {
+	return rootContext.Err() != nil
+}
+
+//OnShutdown registers a Hook to be run on shutdown. Hooks run in reverse order of registration,
+//so subsystems should register right after being initialized
+func OnShutdown(name string, hook Hook) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	hooks = append(hooks, namedHook{name, hook})
+}
+
+//OnReload registers a function to be run whenever SIGHUP is received
+func OnReload(reload func()) {
+	hooksMutex.Lock()
+	defer hooksMutex.Unlock()
+	reloadHooks = append(reloadHooks, reload)
+}
+
+//HandleSignals starts handling signals in the background. SIGINT and SIGTERM cancel the root context, SIGHUP runs all reload functions.
+//It should be called before initialization, so a signal received during startup interrupts it instead of killing the process
+//without running the registered Hooks. Signals received after the first SIGINT or SIGTERM are not handled anymore
+func HandleSignals() {
+	signalsOnce.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+		go func() {
+			for s := range c {
+				log.Info(InProgress, "Received "+s.String()+".")
+				if s != syscall.SIGHUP {
+					signal.Stop(c)
+					cancelRoot()
+					return
+				}
+
+				hooksMutex.Lock()
+				reloads := append([]func(){}, reloadHooks...)
+				hooksMutex.Unlock()
+				for _, reload := range reloads {
+					reload()
+				}
+			}
+		}()
+	})
+}
+
+//WaitForSignal blocks until SIGINT or SIGTERM is received, or the root context is cancelled otherwise
+func WaitForSignal() {
+	HandleSignals()
+	<-rootContext.Done()
+}
+
+//Shutdown cancels the root context and runs all registered Hooks, sharing a deadline of timeout.
+//Subsequent calls do nothing
+func Shutdown(timeout time.Duration) {
+	shutdownOnce.Do(func() {
+		log.Info(InProgress, "Shutting down...")
+		cancelRoot()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		hooksMutex.Lock()
+		defer hooksMutex.Unlock()
+		for i := len(hooks) - 1; i >= 0; i-- {
+			if ctx.Err() != nil {
+				log.Warn(ShutdownDeadlineExceeded, "Shutdown deadline exceeded, stopping "+hooks[i].name+" without waiting...")
+			}
+			runHook(ctx, hooks[i])
+		}
+		hooks = nil
+		log.Info(OK, "Shut down.")
+	})
+}
+
+func runHook(ctx context.Context, h namedHook) {
+	//A failing subsystem must not keep the remaining ones from being stopped
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error(GenericInternalError, "Failed to stop "+h.name+".")
+		}
+	}()
+	log.Info(InProgress, "Stopping "+h.name+"...")
+	h.hook(ctx)
+	log.Info(OK, "Stopped "+h.name+".")
+}
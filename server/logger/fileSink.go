@@ -0,0 +1,39 @@
+package logger
+
+import (
+	"os"
+	"time"
+)
+
+type fileSink struct {
+	file       *os.File
+	lastPrefix string
+}
+
+func newFileSink(logPath string) (sink *fileSink, err error) {
+	file, err := os.Create(logPath + "/" + time.Now().Format("Mon-Jan-2-2006-15-04-05.log"))
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{file: file}, nil
+}
+
+func (s *fileSink) Write(l Log) error {
+	if s.lastPrefix != "" && s.lastPrefix != l.Prefix {
+		//Log empty line when changing Prefixes / Contexts
+		if _, err := s.file.WriteString("\n"); err != nil {
+			return err
+		}
+	}
+	s.lastPrefix = l.Prefix
+	_, err := s.file.WriteString(formatLogLine(l) + "\n")
+	return err
+}
+
+func (s *fileSink) Flush() error {
+	return s.file.Sync()
+}
+
+func (s *fileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,163 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//httpMaxBatches is the number of full batches held back while the collector is unreachable, before log elements are dropped
+const httpMaxBatches = 10
+
+type httpSink struct {
+	url       string
+	batchSize int
+	client    *http.Client
+	mutex     sync.Mutex
+	batch     []httpLogElement
+	dropped   int
+	//failing is set while the collector does not accept log elements. Retries are then left to the periodic flush
+	failing bool
+	//full wakes the background flusher once a batch is full, so writers never wait for the collector
+	full    chan bool
+	stop    chan bool
+	stopped sync.WaitGroup
+}
+
+type httpLogElement struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Prefix  string    `json:"prefix"`
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+}
+
+func newHTTPSink(url string, batchSize int, flushInterval int) (sink *httpSink, err error) {
+	if url == "" {
+		return nil, errors.New("no collector URL set")
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	if flushInterval <= 0 {
+		flushInterval = 10
+	}
+
+	sink = &httpSink{
+		url:       url,
+		batchSize: batchSize,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		full:      make(chan bool, 1),
+		stop:      make(chan bool),
+	}
+
+	//Send full batches, and periodically send batches that did not fill up in time
+	sink.stopped.Add(1)
+	go func() {
+		defer sink.stopped.Done()
+		ticker := time.NewTicker(time.Duration(flushInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := sink.Flush(); err != nil {
+					reportSinkError(err)
+				}
+			case <-sink.full:
+				if err := sink.Flush(); err != nil {
+					reportSinkError(err)
+				}
+			case <-sink.stop:
+				return
+			}
+		}
+	}()
+	return sink, nil
+}
+
+//Write is called while the logger is locked, so it only queues the log element. Full batches are sent in the background
+func (s *httpSink) Write(l Log) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.batch) >= httpMaxBatches*s.batchSize {
+		//Reported once the collector accepts log elements again
+		s.dropped++
+		return nil
+	}
+	s.batch = append(s.batch, httpLogElement{l.Time, logtypeDescriptions[l.Type-1], l.Prefix, l.Status, l.Message})
+
+	if len(s.batch) >= s.batchSize && !s.failing {
+		select {
+		case s.full <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+//Flush sends all queued log elements. If the collector does not accept them, they are queued again to be retried
+func (s *httpSink) Flush() error {
+	s.mutex.Lock()
+	batch := s.batch
+	dropped := s.dropped
+	s.batch = nil
+	s.dropped = 0
+	s.mutex.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+	if dropped > 0 {
+		reportSinkError(errors.New("dropped " + strconv.Itoa(dropped) + " log elements, as the collector did not keep up"))
+	}
+
+	err := s.send(batch)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failing = err != nil
+	if err == nil {
+		return nil
+	}
+	//Log elements written meanwhile are newer, so the oldest are dropped if the queue overflows
+	s.batch = append(batch, s.batch...)
+	if excess := len(s.batch) - httpMaxBatches*s.batchSize; excess > 0 {
+		s.batch = s.batch[excess:]
+		s.dropped += excess
+	}
+	return errors.New("retrying " + strconv.Itoa(len(s.batch)) + " log elements later: " + err.Error())
+}
+
+func (s *httpSink) send(batch []httpLogElement) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("collector responded with " + resp.Status)
+	}
+	return nil
+}
+
+//Close sends the queued log elements a last time, and drops them if the collector does not accept them
+func (s *httpSink) Close() error {
+	close(s.stop)
+	s.stopped.Wait()
+	if err := s.Flush(); err != nil {
+		s.mutex.Lock()
+		dropped := len(s.batch) + s.dropped
+		s.batch = nil
+		s.dropped = 0
+		s.mutex.Unlock()
+		return errors.New("dropped " + strconv.Itoa(dropped) + " log elements on close: " + err.Error())
+	}
+	return nil
+}
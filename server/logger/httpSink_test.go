@@ -0,0 +1,155 @@
+package logger
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPSinkSendsFullBatchesInBackground(t *testing.T) {
+	release := make(chan bool)
+	batches := make(chan []httpLogElement, 4)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var batch []httpLogElement
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		<-release
+		batches <- batch
+	}))
+	defer collector.Close()
+
+	sink, err := newHTTPSink(collector.URL, 2, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The collector blocks until released, so writes would block as well if they sent batches themselves
+	written := make(chan bool)
+	go func() {
+		for i := 0; i < 3; i++ {
+			sink.Write(Log{time.Now(), "logger/Test", LogtypeInfo, 1000, "message"})
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("Write blocked while the collector was busy")
+	}
+
+	close(release)
+	select {
+	case batch := <-batches:
+		if len(batch) < 2 {
+			t.Errorf("collector received %d log elements, expected a full batch", len(batch))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("full batch was not sent")
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPSinkDropsWhenCollectorIsBehind(t *testing.T) {
+	sink := &httpSink{batchSize: 1, full: make(chan bool, 1)}
+	for i := 0; i < httpMaxBatches+5; i++ {
+		if err := sink.Write(Log{time.Now(), "logger/Test", LogtypeWarn, 2000, "message"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sink.batch) != httpMaxBatches || sink.dropped != 5 {
+		t.Errorf("held back %d and dropped %d log elements, expected %d and 5", len(sink.batch), sink.dropped, httpMaxBatches)
+	}
+}
+
+func TestHTTPSinkRetriesFailedBatches(t *testing.T) {
+	var mutex sync.Mutex
+	failing := true
+	var received []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []httpLogElement
+		if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+		for _, element := range batch {
+			received = append(received, element.Message)
+		}
+	}))
+	defer collector.Close()
+
+	sink, err := newHTTPSink(collector.URL, 10, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	for _, message := range []string{"first", "second"} {
+		sink.Write(Log{time.Now(), "logger/Test", LogtypeInfo, 1000, message})
+	}
+	if err = sink.Flush(); err == nil {
+		t.Fatal("Flush succeeded while the collector failed")
+	}
+
+	mutex.Lock()
+	failing = false
+	mutex.Unlock()
+	sink.Write(Log{time.Now(), "logger/Test", LogtypeInfo, 1000, "third"})
+	if err = sink.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if strings.Join(received, ",") != "first,second,third" {
+		t.Errorf("collector received %q, expected the failed batch to be retried in order", received)
+	}
+}
+
+func TestFlushDoesNotBlockLogging(t *testing.T) {
+	requested := make(chan bool, 1)
+	release := make(chan bool)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case requested <- true:
+		default:
+		}
+		<-release
+	}))
+	defer collector.Close()
+
+	Init([]SinkConfig{{Type: SinkTypeHTTP, Level: "INFO", Address: collector.URL, BatchSize: 100, FlushInterval: 60}})
+	defer Close()
+	testLogger := Logger{"logger/Test"}
+	testLogger.Info(1000, "before flush")
+
+	flushed := make(chan bool)
+	go func() {
+		Flush()
+		close(flushed)
+	}()
+	<-requested
+
+	//The collector is busy with the flushed batch, which must not keep other log elements from being written
+	logged := make(chan bool)
+	go func() {
+		testLogger.Info(1000, "during flush")
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(time.Second):
+		t.Error("logging blocked while the batch was sent")
+	}
+	close(release)
+	<-flushed
+}
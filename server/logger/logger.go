@@ -2,11 +2,10 @@ package logger
 
 import (
 	"errors"
-	"fmt"
 	"github.com/bclicn/color"
-	"os"
 	"strconv"
 	"subframe/status"
+	"sync"
 	"time"
 )
 
@@ -26,7 +25,6 @@ const LogtypeFatal = 4
 var Initialized = false
 
 var logtypeDescriptions = [...]string{"INFO", "WARN", "ERROR", "FATAL"}
-var logFile *os.File
 var logLogger = Logger{"logger/Logger"}
 
 //LogPath is the Path at which log files reside
@@ -35,22 +33,109 @@ var LogPath string
 //ColorizedLogs turns on or off colorized realtime log output
 var ColorizedLogs bool
 
-var logQueue []string
+var logQueue []Log
+var sinks []registeredSink
+var logMutex sync.Mutex
 
-//Init initializes the Logger
-func Init() {
-	logLogger.Info("Initializing Logger...")
-	logFile = makeLogFile()
+type registeredSink struct {
+	sink  Sink
+	level int
+}
+
+//Init initializes the Logger and opens all configured Sinks
+func Init(configs []SinkConfig) {
+	logLogger.Info(status.InProgress, "Initializing Logger...")
+	opened := openSinks(configs)
+
+	logMutex.Lock()
+	sinks = opened
+	queued := len(logQueue)
+	//Replay log elements cached before initialization; they have already been printed to the CLI
+	for _, l := range logQueue {
+		for _, s := range sinks {
+			if _, isStdout := s.sink.(*stdoutSink); isStdout || l.Type < s.level {
+				continue
+			}
+			writeToSink(s.sink, l)
+		}
+	}
+	logQueue = logQueue[:0]
 	Initialized = true
-	logLogger.Info("Initialized Logger")
+	logMutex.Unlock()
+
+	logLogger.Info(status.OK, "Wrote "+strconv.Itoa(queued)+" cached log elements to "+strconv.Itoa(len(opened))+" log sinks.")
+	logLogger.Info(status.OK, "Initialized Logger")
+}
+
+//Reconfigure replaces all Sinks by the configured ones, closing the previous Sinks
+func Reconfigure(configs []SinkConfig) {
+	logLogger.Info(status.InProgress, "Reconfiguring Logger...")
+	opened := openSinks(configs)
+
+	logMutex.Lock()
+	previous := sinks
+	sinks = opened
+	logMutex.Unlock()
+
+	for _, s := range previous {
+		if err := s.sink.Flush(); err != nil {
+			reportSinkError(err)
+		}
+		if err := s.sink.Close(); err != nil {
+			reportSinkError(err)
+		}
+	}
+	logLogger.Info(status.OK, "Reconfigured Logger with "+strconv.Itoa(len(opened))+" log sinks.")
+}
+
+func openSinks(configs []SinkConfig) (opened []registeredSink) {
+	for _, config := range configs {
+		if err := config.Validate(); err != nil {
+			logLogger.Error(status.LogSinkConfigError, "Skipped invalid "+config.Type+" log sink: "+err.Error())
+			continue
+		}
+		sink, level, err := openSink(config)
+		if err != nil {
+			logLogger.Error(status.LogSinkOpenError, "Failed to open "+config.Type+" log sink: "+err.Error())
+			continue
+		}
+		opened = append(opened, registeredSink{sink, level})
+	}
+	return opened
+}
+
+//Flush flushes all buffered log elements to their Sinks. Sinks may send them over the network, so logging continues meanwhile
+func Flush() {
+	logMutex.Lock()
+	current := sinks
+	logMutex.Unlock()
+
+	for _, s := range current {
+		if err := s.sink.Flush(); err != nil {
+			reportSinkError(err)
+		}
+	}
 }
 
-//Close closes the Logger
+//Close flushes and closes all Sinks. Log elements written meanwhile are cached until the Logger is initialized again
 func Close() {
-	logLogger.Info("Closing Logger...")
-	logFile.Close()
+	logLogger.Info(status.InProgress, "Closing Logger...")
+	logLogger.Info(status.OK, "Closed Logger.")
+
+	logMutex.Lock()
+	previous := sinks
+	sinks = nil
 	Initialized = false
-	logLogger.Info("Closed Logger.")
+	logMutex.Unlock()
+
+	for _, s := range previous {
+		if err := s.sink.Flush(); err != nil {
+			reportSinkError(err)
+		}
+		if err := s.sink.Close(); err != nil {
+			reportSinkError(err)
+		}
+	}
 }
 
 //Logger creates a new Logger for a specific context
@@ -88,80 +173,23 @@ func (l Logger) Fatal(status int, message string) {
 	panic(errors.New(message))
 }
 
-var lastPrefix string
-
 func mainLogger(l Log) {
-	if lastPrefix != "" && lastPrefix != l.Prefix {
-		//Log empty line when changing Prefixes / Contexts
-		logToCLI("")
-		logToFile("")
-	}
-
-	if !Initialized || !ColorizedLogs {
-		logToCLI(formatLogLine(l))
-	} else {
-		logToCLI(formatLogLineCLI(l))
-	}
-	logToFile(formatLogLine(l))
-	lastPrefix = l.Prefix
-}
-
-func logToCLI(logLine string) {
-	fmt.Println(logLine)
-}
+	logMutex.Lock()
+	defer logMutex.Unlock()
 
-func logToFile(logLine string) {
-	if Initialized {
-		//Write buffer to file
-		if len(logQueue) > 0 {
-
-			l := Log{
-				time.Now(),
-				"logger/Logger",
-				LogtypeInfo,
-				status.OK,
-				"Writing logQueue (" + strconv.Itoa(len(logQueue)) + " Elements) to logfile...",
-			}
-			if ColorizedLogs {
-				logToCLI(formatLogLineCLI(l))
-			} else {
-				logToCLI(formatLogLine(l))
-			}
-
-			for _, value := range logQueue {
-				logFile.WriteString(value + "\n")
-			}
-			logFile.Sync()
-			logQueue = logQueue[:0]
-
-			l = Log{
-				time.Now(),
-				"logger/Logger",
-				LogtypeInfo,
-				status.OK,
-				"Wrote logQueue to logfile...",
-			}
-
-			if ColorizedLogs {
-				logToCLI(formatLogLineCLI(l))
-			} else {
-				logToCLI(formatLogLine(l))
-			}
-		}
-		logFile.WriteString(logLine + "\n")
-		logFile.Sync()
+	if !Initialized {
+		//If logger is not yet initialized, print to CLI and cache log element for the remaining sinks
+		stdoutFallback.Write(l)
+		logQueue = append(logQueue, l)
 		return
 	}
-	//If logger is not yet initialized, cache log lines to buffer
-	logQueue = append(logQueue, logLine)
-}
 
-func makeLogFile() (logFile *os.File) {
-	file, err := os.Create(LogPath + "/" + time.Now().Format("Mon-Jan-2-2006-15-04-05.log"))
-	if err != nil {
-		panic(err)
+	for _, s := range sinks {
+		if l.Type < s.level {
+			continue
+		}
+		writeToSink(s.sink, l)
 	}
-	return file
 }
 
 func formatTime(t time.Time) (formatted string) {
@@ -183,7 +211,7 @@ func formatStatusCode(status int) (formatted string) {
 func formatLogLine(l Log) (line string) {
 	//Format like:
 	//[Mon Jan 1 12:13:14 2019] [INFO] [logger/Init] [1000] Initialized Logger.
-	return formatTime(l.Time) + " " + formatLogType(l.Type) + " " + formatPrefix(l.Prefix) + " " + formatStatusCode(l.StatusCode) + " " + l.Message
+	return formatTime(l.Time) + " " + formatLogType(l.Type) + " " + formatPrefix(l.Prefix) + " " + formatStatusCode(l.Status) + " " + l.Message
 }
 
 func formatTimeCLI(t time.Time) (formatted string) {
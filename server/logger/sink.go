@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"subframe/status"
+)
+
+//SinkTypeFile writes logs to a new file in LogPath
+const SinkTypeFile = "file"
+
+//SinkTypeStdout writes logs to stdout
+const SinkTypeStdout = "stdout"
+
+//SinkTypeSyslog sends logs to a syslog daemon using RFC 5424
+const SinkTypeSyslog = "syslog"
+
+//SinkTypeHTTP sends batches of logs to a remote collector
+const SinkTypeHTTP = "http"
+
+//Sink is a destination log elements are written to
+type Sink interface {
+	Write(l Log) error
+	Flush() error
+	Close() error
+}
+
+//SinkConfig describes a single Sink and the minimum level of log elements it receives
+type SinkConfig struct {
+	//Type is one of SinkTypeFile, SinkTypeStdout, SinkTypeSyslog or SinkTypeHTTP
+	Type string
+	//Level is the minimum level (INFO, WARN, ERROR, FATAL) of log elements written to the sink
+	Level string
+	//Format is used by stdout sinks and is one of "plain", "color" or "journald". If empty, ColorizedLogs decides
+	Format string `json:",omitempty"`
+	//Network is used by syslog sinks and is one of "udp", "tcp", "unix" or "unixgram"
+	Network string `json:",omitempty"`
+	//Address is the syslog address or socket path, or the URL of the remote collector
+	Address string `json:",omitempty"`
+	//BatchSize is the number of log elements sent to the remote collector at once
+	BatchSize int `json:",omitempty"`
+	//FlushInterval is the maximum time in seconds log elements are held back before being sent to the remote collector
+	FlushInterval int `json:",omitempty"`
+}
+
+//DefaultSinks returns the Sinks used if none are configured
+func DefaultSinks() []SinkConfig {
+	return []SinkConfig{
+		{Type: SinkTypeStdout, Level: "INFO"},
+		{Type: SinkTypeFile, Level: "INFO"},
+	}
+}
+
+//Validate checks whether the Sink can be opened with this configuration, without opening it
+func (c SinkConfig) Validate() error {
+	if _, err := ParseLevel(c.Level); err != nil {
+		return err
+	}
+	switch c.Type {
+	case SinkTypeFile:
+	case SinkTypeStdout:
+		if _, err := newStdoutSink(c.Format); err != nil {
+			return err
+		}
+	case SinkTypeSyslog:
+		switch c.Network {
+		case "udp", "tcp", "unix", "unixgram":
+		default:
+			return errors.New("unknown syslog network \"" + c.Network + "\"")
+		}
+		if c.Address == "" {
+			return errors.New("no syslog address set")
+		}
+	case SinkTypeHTTP:
+		if c.Address == "" {
+			return errors.New("no collector URL set")
+		}
+	default:
+		return errors.New("unknown sink type \"" + c.Type + "\"")
+	}
+	return nil
+}
+
+var stdoutFallback = &stdoutSink{}
+
+func openSink(config SinkConfig) (sink Sink, level int, err error) {
+	level, err = ParseLevel(config.Level)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch config.Type {
+	case SinkTypeFile:
+		sink, err = newFileSink(LogPath)
+	case SinkTypeStdout:
+		sink, err = newStdoutSink(config.Format)
+	case SinkTypeSyslog:
+		sink, err = newSyslogSink(config.Network, config.Address)
+	case SinkTypeHTTP:
+		sink, err = newHTTPSink(config.Address, config.BatchSize, config.FlushInterval)
+	default:
+		err = errors.New("unknown sink type \"" + config.Type + "\"")
+	}
+	return sink, level, err
+}
+
+//ParseLevel returns the Logtype matching the level description, defaulting to LogtypeInfo if empty
+func ParseLevel(level string) (logType int, err error) {
+	if level == "" {
+		return LogtypeInfo, nil
+	}
+	for index, description := range logtypeDescriptions {
+		if strings.ToUpper(level) == description {
+			return index + 1, nil
+		}
+	}
+	return 0, errors.New("unknown log level \"" + level + "\"")
+}
+
+func writeToSink(sink Sink, l Log) {
+	if err := sink.Write(l); err != nil {
+		reportSinkError(err)
+	}
+}
+
+//Sink errors cannot be logged through the logger itself, so they are written to stderr directly
+func reportSinkError(err error) {
+	fmt.Fprintln(os.Stderr, "[LOGGER] "+formatStatusCode(status.LogSinkWriteError)+" Failed to write to log sink: "+err.Error())
+}
@@ -0,0 +1,53 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+//Priority prefixes understood by journald, see sd-daemon(3)
+var journaldPriorities = [...]string{"<6>", "<4>", "<3>", "<2>"}
+
+type stdoutSink struct {
+	format     string
+	lastPrefix string
+}
+
+func newStdoutSink(format string) (sink *stdoutSink, err error) {
+	switch format {
+	case "", "plain", "color", "journald":
+		return &stdoutSink{format: format}, nil
+	}
+	return nil, errors.New("unknown stdout format \"" + format + "\"")
+}
+
+func (s *stdoutSink) Write(l Log) error {
+	if s.format == "journald" {
+		//journald keeps track of time and splits entries itself, so neither timestamps nor empty lines are needed
+		_, err := fmt.Fprintln(os.Stdout, journaldPriorities[l.Type-1]+formatLogType(l.Type)+" "+formatPrefix(l.Prefix)+" "+formatStatusCode(l.Status)+" "+l.Message)
+		return err
+	}
+
+	if s.lastPrefix != "" && s.lastPrefix != l.Prefix {
+		//Log empty line when changing Prefixes / Contexts
+		fmt.Fprintln(os.Stdout)
+	}
+	s.lastPrefix = l.Prefix
+
+	var err error
+	if s.format == "color" || (s.format == "" && Initialized && ColorizedLogs) {
+		_, err = fmt.Fprintln(os.Stdout, formatLogLineCLI(l))
+	} else {
+		_, err = fmt.Fprintln(os.Stdout, formatLogLine(l))
+	}
+	return err
+}
+
+func (s *stdoutSink) Flush() error {
+	return nil
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
@@ -0,0 +1,103 @@
+package logger
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+//Messages are sent with facility daemon (3)
+const syslogFacility = 3
+
+//Syslog severities matching LogtypeInfo, LogtypeWarn, LogtypeError and LogtypeFatal
+var syslogSeverities = [...]int{6, 4, 3, 2}
+
+type syslogSink struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslogSink(network string, address string) (sink *syslogSink, err error) {
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return nil, errors.New("unknown syslog network \"" + network + "\"")
+	}
+	if address == "" {
+		return nil, errors.New("no syslog address set")
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	sink = &syslogSink{network: network, address: address, hostname: hostname}
+	if err = sink.connect(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (s *syslogSink) connect() (err error) {
+	s.conn, err = net.DialTimeout(s.network, s.address, 5*time.Second)
+	return err
+}
+
+func (s *syslogSink) Write(l Log) error {
+	message := s.formatMessage(l)
+	if s.network == "tcp" || s.network == "unix" {
+		//Stream transports use octet-counting framing, see RFC 6587
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+
+	_, err := s.conn.Write([]byte(message))
+	if err == nil {
+		return nil
+	}
+
+	//Reconnect once, e.g. after the syslog daemon has been restarted
+	s.conn.Close()
+	if err = s.connect(); err != nil {
+		return err
+	}
+	_, err = s.conn.Write([]byte(message))
+	return err
+}
+
+//Format like (RFC 5424):
+//<30>1 2019-01-01T12:13:14.000000+01:00 hostname subframe 1234 1000 [subframe@32473 prefix="logger/Logger"] Initialized Logger.
+func (s *syslogSink) formatMessage(l Log) string {
+	priority := syslogFacility*8 + syslogSeverities[l.Type-1]
+	return "<" + strconv.Itoa(priority) + ">1 " +
+		l.Time.Format("2006-01-02T15:04:05.000000Z07:00") + " " +
+		s.hostname + " subframe " +
+		strconv.Itoa(os.Getpid()) + " " +
+		strconv.Itoa(l.Status) + " " +
+		"[subframe@32473 prefix=\"" + escapeSDParam(l.Prefix) + "\"] " +
+		l.Message
+}
+
+func (s *syslogSink) Flush() error {
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	return s.conn.Close()
+}
+
+//Escapes '"', '\' and ']' inside structured data parameter values
+func escapeSDParam(value string) string {
+	escaped := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '"', '\\', ']':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, value[i])
+	}
+	return string(escaped)
+}
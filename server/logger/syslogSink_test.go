@@ -0,0 +1,168 @@
+package logger
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//syslogLine matches an RFC 5424 message of facility daemon, as written by syslogSink
+var syslogLine = regexp.MustCompile(`^<(\d+)>1 \d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}\.\d{6}(Z|[+-]\d{2}:\d{2}) \S+ subframe \d+ (\d+) \[subframe@32473 prefix="((?:[^"\\\]]|\\.)*)"\] (.*)$`)
+
+//listenSyslog starts a syslog listener on network and returns its address and the messages it receives
+func listenSyslog(t *testing.T, network string) (address string, messages chan string) {
+	t.Helper()
+	messages = make(chan string, 16)
+	switch network {
+	case "udp", "unixgram":
+		address = "127.0.0.1:0"
+		if network == "unixgram" {
+			address = filepath.Join(t.TempDir(), "syslog.sock")
+		}
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buffer := make([]byte, 65536)
+			for {
+				n, _, err := conn.ReadFrom(buffer)
+				if err != nil {
+					return
+				}
+				messages <- string(buffer[:n])
+			}
+		}()
+		return conn.LocalAddr().String(), messages
+	case "tcp":
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			for {
+				//Octet-counting framing: the message length, a space and the message
+				length, err := reader.ReadString(' ')
+				if err != nil {
+					return
+				}
+				n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+				if err != nil {
+					messages <- "invalid frame length " + strconv.Quote(length)
+					return
+				}
+				message := make([]byte, n)
+				if _, err := io.ReadFull(reader, message); err != nil {
+					return
+				}
+				messages <- string(message)
+			}
+		}()
+		return listener.Addr().String(), messages
+	}
+	t.Fatal("unknown network " + network)
+	return "", nil
+}
+
+func receive(t *testing.T, messages chan string) string {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("no syslog message received")
+		return ""
+	}
+}
+
+func TestSyslogSinkFraming(t *testing.T) {
+	for _, network := range []string{"udp", "tcp", "unixgram"} {
+		t.Run(network, func(t *testing.T) {
+			address, messages := listenSyslog(t, network)
+			sink, err := newSyslogSink(network, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sink.Close()
+
+			logs := []Log{
+				{time.Now(), "logger/Test", LogtypeInfo, 1000, "Initialized Logger."},
+				{time.Now(), `quoted "prefix]\`, LogtypeError, 4900, "Failed to open log sink"},
+			}
+			for _, l := range logs {
+				if err := sink.Write(l); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			//Facility daemon (3) with the severities of LogtypeInfo (6) and LogtypeError (3)
+			expected := []struct {
+				priority string
+				status   string
+				prefix   string
+				message  string
+			}{
+				{"30", "1000", "logger/Test", "Initialized Logger."},
+				{"27", "4900", `quoted \"prefix\]\\`, "Failed to open log sink"},
+			}
+			for _, e := range expected {
+				message := receive(t, messages)
+				match := syslogLine.FindStringSubmatch(message)
+				if match == nil {
+					t.Fatalf("message %q is not in RFC 5424 format", message)
+				}
+				if match[1] != e.priority || match[3] != e.status || match[4] != e.prefix || match[5] != e.message {
+					t.Errorf("message %q, expected priority %s, status %s, prefix %q and message %q", message, e.priority, e.status, e.prefix, e.message)
+				}
+			}
+		})
+	}
+}
+
+func TestSinkLevelFiltering(t *testing.T) {
+	address, messages := listenSyslog(t, "udp")
+	Init([]SinkConfig{{Type: SinkTypeSyslog, Level: "WARN", Network: "udp", Address: address}})
+	defer Close()
+
+	testLogger := Logger{"logger/Test"}
+	testLogger.Info(1000, "info")
+	testLogger.Warn(2000, "warn")
+	testLogger.Error(3000, "error")
+
+	for _, expected := range []string{"warn", "error"} {
+		message := receive(t, messages)
+		if !strings.HasSuffix(message, "] "+expected) {
+			t.Errorf("received %q, expected message %q", message, expected)
+		}
+	}
+	select {
+	case message := <-messages:
+		t.Errorf("received %q below the level of the sink", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestInvalidSinkIsSkipped(t *testing.T) {
+	Init([]SinkConfig{{Type: SinkTypeSyslog, Level: "INFO", Network: "carrier-pigeon", Address: "localhost"}})
+	defer Close()
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if len(sinks) != 0 {
+		t.Errorf("opened %d sinks for an invalid configuration", len(sinks))
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"context"
 	"os"
-	"os/signal"
+	"reflect"
 	"subframe/server/bootstrapper"
 	"subframe/server/database"
 	"subframe/server/jobqueue"
+	"subframe/server/keyring"
+	"subframe/server/lifecycle"
 	"subframe/server/logger"
 	"subframe/server/networking"
+	"subframe/server/scrubber"
 	"subframe/server/settings"
 	"subframe/server/storage"
+	"subframe/server/sweeper"
 	. "subframe/status"
 )
 
@@ -17,34 +22,73 @@ var log = logger.Logger{Prefix: "main/Main"}
 var greeter = "                  .--.                  \n              `-/oooooo/-`              \n           .:+oooooooooooo+:.           \n       `-/oooooooooooooooooooo/-`       \n    .:+oooooooooooooooooooooooooo+:.    \n  :oooooooo+////////////////+oooooooo:  \n /ooooooo:`                  `:ooooooo/ \n /ooooooo   -//////////////-   ooooooo/ \n /oooooo+   /oooooooooooooo/   ooooooo/ \n /oooooo+   /oooooooooooooo/   ooooooo/ \n /oooooo+   /oooooooooooooo/   ooooooo/ \n /oooooo+   /oooooooooooooo/   ooooooo/ \n /oooooo+   /+-............`  `ooooooo/ \n /oooooo+   /oo:`           `-+ooooooo/ \n /oooooo+   /ooooooooooooooooooooooooo/ \n /oooooo+ `:oooooooooooooooooooooooooo/ \n  :oooooo:ooooooooooooooooooooooooooo:  \n    .:+oooooooooooooooooooooooooo+:.    \n       `-/oooooooooooooooooooo/-`       \n           .:+oooooooooooo+:.           \n              `-/oooooo/-`              \n                  .--.                  "
 
 func main() {
+	//Settings are read first, as --print-config exits before anything else is printed
+	settings.Load()
+	if args := settings.Args(); len(args) > 0 {
+		os.Exit(runCommand(args))
+	}
+	settings.Write()
+	config := settings.Get()
+
 	println(greeter)
 	log.Info(OK, "Welcome to SuBFraMe Server!")
 	log.Info(InProgress, "Initializing Server...")
 
-	settings.Read()
-	defer settings.Write()
+	//Runs registered shutdown hooks in reverse order, also if initialization fails or is interrupted by a signal
+	defer lifecycle.Shutdown(config.ShutdownTimeout.Std())
+	lifecycle.HandleSignals()
+
+	if keyring.Init(config) != OK {
+		log.Fatal(EncryptionKeyError, "Failed to load encryption keys.")
+	}
+	db := database.OpenSQLite(config.DataPath)
+	if status := db.CheckEncryption(); status != OK {
+		log.Fatal(status, "Messages are not encrypted with the configured key.")
+	}
+	backend, err := storage.NewBackend(config)
+	if err != nil {
+		log.Fatal(StorageDirectoryError, "Failed to open storage backend: "+err.Error())
+	}
+	messageStorage := storage.New(db, db, backend)
 
-	storage.Init()
-	defer storage.Finish()
+	logger.Init(config.LogSinks)
+	lifecycle.OnShutdown("Logger", func(ctx context.Context) { logger.Close() })
+	settings.OnChange(func(previous settings.Config, next settings.Config) {
+		if !reflect.DeepEqual(previous.LogSinks, next.LogSinks) {
+			logger.Reconfigure(next.LogSinks)
+		}
+	})
+	settings.OnChange(storage.ApplySettings)
+	lifecycle.OnShutdown("Settings", func(ctx context.Context) { settings.Write() })
 
-	logger.Init()
-	defer logger.Close()
+	lifecycle.OnShutdown("Database", func(ctx context.Context) { db.Close() })
+	lifecycle.OnShutdown("Storage", messageStorage.Finish)
+	lifecycle.OnShutdown("Log Sinks", func(ctx context.Context) { logger.Flush() })
 
 	jobqueue.SpawnWorker()
+	settings.OnChange(jobqueue.ApplySettings)
+	lifecycle.OnShutdown("JobQueue", jobqueue.Drain)
 
-	networking.Init()
-	defer networking.Stop()
+	node := networking.New(db, db, db, db, messageStorage)
+	node.Start()
+	lifecycle.OnShutdown("Networking", node.Stop)
 
-	database.Init()
-	defer database.Close()
+	bootstrapper.New(db).Bootstrap()
+	if lifecycle.ShuttingDown() {
+		log.Info(InProgress, "Startup interrupted, stopping SuBFraMe Server...")
+		return
+	}
 
-	bootstrapper.Bootstrap()
+	messageScrubber := scrubber.New(db, messageStorage, node)
+	messageScrubber.Start()
+	lifecycle.OnShutdown("Scrubber", messageScrubber.Stop)
 
-	//Wait for interrupt, then return
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
+	messageSweeper := sweeper.New(db, messageStorage, node)
+	messageSweeper.Start()
+	lifecycle.OnShutdown("Sweeper", messageSweeper.Stop)
 
-	<-c
+	//Reload settings on SIGHUP, wait for SIGINT or SIGTERM, then shut down
+	lifecycle.OnReload(func() { settings.Reload() })
+	lifecycle.WaitForSignal()
 	log.Info(InProgress, "Stopping SuBFraMe Server...")
-	return
 }
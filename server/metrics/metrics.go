@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "subframe"
+
+//sizeBuckets range from 1KB to 1GB
+var sizeBuckets = prometheus.ExponentialBuckets(1024, 4, 11)
+
+//StoragePuts counts PUT operations on local message storage, by result
+var StoragePuts = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "puts_total",
+	Help: "Number of messages stored, by result.",
+}, []string{"result"})
+
+//StorageGets counts GET operations on local message storage, by result
+var StorageGets = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "gets_total",
+	Help: "Number of messages served, by result.",
+}, []string{"result"})
+
+//StorageMessageSize observes the size of stored and served messages, by operation
+var StorageMessageSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "message_size_bytes",
+	Help:    "Size of stored and served messages.",
+	Buckets: sizeBuckets,
+}, []string{"operation"})
+
+//StorageLatency observes the duration of storage operations, by operation
+var StorageLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "operation_duration_seconds",
+	Help:    "Duration of storage operations.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"operation"})
+
+//StorageBytesUsed is the space currently used for message storage
+var StorageBytesUsed = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "used_bytes",
+	Help: "Space currently used for message storage.",
+})
+
+//StorageBytesLimit is the maximum space used for message storage, as set in settings.DiskSpace
+var StorageBytesLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "limit_bytes",
+	Help: "Maximum space used for message storage.",
+})
+
+//ScrubbedMessages counts messages verified by the scrubber, by result
+var ScrubbedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "scrubbed_messages_total",
+	Help: "Number of messages verified by the scrubber, by result.",
+}, []string{"result"})
+
+//RemovedMessages counts expired and received messages removed by the sweeper, by result
+var RemovedMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "removed_messages_total",
+	Help: "Number of expired and received messages removed by the sweeper, by result.",
+}, []string{"result"})
+
+//StorageBytesReserved is the space set aside for messages which are being received
+var StorageBytesReserved = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace, Subsystem: "storage", Name: "reserved_bytes",
+	Help: "Space reserved for messages which are being received.",
+})
+
+//JobQueueDepth is the number of jobs waiting to be picked up by a worker
+var JobQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace, Subsystem: "jobqueue", Name: "depth",
+	Help: "Number of jobs waiting to be picked up by a worker.",
+})
+
+//JobQueueWorkers is the number of currently running workers
+var JobQueueWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace, Subsystem: "jobqueue", Name: "workers",
+	Help: "Number of currently running workers.",
+})
+
+//CoordinatorRequests counts requests sent to CoordinatorNodes, by peer and outcome
+var CoordinatorRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "coordinator_requests_total",
+	Help: "Number of requests sent to CoordinatorNodes, by peer and outcome.",
+}, []string{"peer", "outcome"})
+
+//Announces counts message announcements to the CoordinatorNetwork, by result
+var Announces = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "announces_total",
+	Help: "Number of message announcements to the CoordinatorNetwork, by result.",
+}, []string{"result"})
+
+//StampChecks counts checks of postage stamps on messages and announcements, by result
+var StampChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "stamp_checks_total",
+	Help: "Number of postage stamps checked on messages and announcements, by result.",
+}, []string{"result"})
+
+//RateLimitHits counts requests rejected by rate limits, by request class, "uploads" for the concurrent upload limit and "banned" for banned addresses
+var RateLimitHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "rate_limit_hits_total",
+	Help: "Number of requests rejected by rate limits, by limit.",
+}, []string{"limit"})
+
+//Bans counts addresses banned for sending too many invalid requests
+var Bans = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "bans_total",
+	Help: "Number of addresses banned for sending too many invalid requests.",
+})
+
+//Verifications counts confirmation keys presented to the CoordinatorNode, by result
+var Verifications = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "verifications_total",
+	Help: "Number of confirmation keys presented to mark messages as received, by result.",
+}, []string{"result"})
+
+//InboxQueries counts inbox queries answered by the CoordinatorNode, by the length of their prefix in bits
+var InboxQueries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "inbox_queries_total",
+	Help: "Number of inbox queries, by the length of the recipient prefix in bits.",
+}, []string{"bits"})
+
+//Subscriptions tracks the open inbox subscriptions, by kind
+var Subscriptions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "subscriptions",
+	Help: "Number of open inbox subscriptions, by kind (longpoll, sse or websocket).",
+}, []string{"kind"})
+
+//Redistributions counts pushes of announced messages to other StorageNodes, by result
+var Redistributions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace, Subsystem: "networking", Name: "redistributions_total",
+	Help: "Number of messages pushed to other StorageNodes on request of the CoordinatorNetwork, by result.",
+}, []string{"result"})
+
+//DBQueryLatency observes the duration of database queries, by database and query
+var DBQueryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace, Subsystem: "database", Name: "query_duration_seconds",
+	Help:    "Duration of database queries.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"database", "query"})
+
+//PeerTableSize is the number of known nodes, by table
+var PeerTableSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: namespace, Subsystem: "database", Name: "peer_table_size",
+	Help: "Number of known nodes, by table.",
+}, []string{"table"})
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		StoragePuts,
+		StorageGets,
+		StorageMessageSize,
+		StorageLatency,
+		StorageBytesUsed,
+		StorageBytesLimit,
+		StorageBytesReserved,
+		ScrubbedMessages,
+		RemovedMessages,
+		JobQueueDepth,
+		JobQueueWorkers,
+		CoordinatorRequests,
+		Announces,
+		Redistributions,
+		StampChecks,
+		RateLimitHits,
+		Bans,
+		Verifications,
+		InboxQueries,
+		Subscriptions,
+		DBQueryLatency,
+		PeerTableSize,
+	)
+}
+
+//Handler returns the HTTP handler serving all metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+//ObserveDBQuery records the time passed since start as the duration of query on database, meant to be deferred
+func ObserveDBQuery(database string, query string, start time.Time) {
+	DBQueryLatency.WithLabelValues(database, query).Observe(time.Since(start).Seconds())
+}
+
+//ObserveStorage records the time passed since start as the duration of a storage operation, meant to be deferred
+func ObserveStorage(operation string, start time.Time) {
+	StorageLatency.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
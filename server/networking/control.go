@@ -0,0 +1,313 @@
+package networking
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"subframe/server/lifecycle"
+	"subframe/server/logger"
+	"subframe/server/settings"
+	"subframe/server/snapshot"
+	"subframe/server/storage"
+	. "subframe/status"
+	"sync"
+	"time"
+)
+
+var clog = logger.Logger{Prefix: "networking/Control"}
+
+//ProtocolVersions lists the versions of the SuBFraMe protocol this node speaks
+var ProtocolVersions = []string{"1"}
+
+//How long the result of the coordinator reachability check is reused
+const coordinatorCheckInterval = 30 * time.Second
+
+var startTime = time.Now()
+
+//ReadinessCheck returns a non-empty reason if the node is not ready to serve requests
+type ReadinessCheck func() (reason string)
+
+var readinessChecks = map[string]ReadinessCheck{
+	"lifecycle": checkNotShuttingDown,
+}
+var readinessMutex sync.Mutex
+
+//RegisterReadinessCheck adds a check that has to pass before /control/ready reports the node as ready
+func RegisterReadinessCheck(name string, check ReadinessCheck) {
+	readinessMutex.Lock()
+	defer readinessMutex.Unlock()
+	readinessChecks[name] = check
+}
+
+type nodeInfo struct {
+	Version          string   `json:"version"`
+	Roles            []string `json:"roles"`
+	NetworkID        string   `json:"networkId"`
+	IdentityKey      string   `json:"identityKey"`
+	Uptime           int64    `json:"uptime"`
+	FreeCapacity     int64    `json:"freeCapacity"`
+	ProtocolVersions []string `json:"protocolVersions"`
+	PendingRestart   []string `json:"pendingRestart"`
+}
+
+func (n *Node) handleControlRequest(res http.ResponseWriter, req *http.Request) {
+	action := strings.TrimPrefix(req.URL.Path, "/control/")
+	if action == "reload" {
+		handleReload(res, req)
+		return
+	}
+	if req.Method != "GET" {
+		writeResponse(res, http.StatusMethodNotAllowed, req.Method+" is not allowed here.")
+		return
+	}
+
+	switch action {
+	case "health":
+		writeJSONResponse(res, http.StatusOK, map[string]string{"status": "ok"})
+	case "ready":
+		handleReady(res)
+	case "info":
+		n.handleInfo(res)
+	case "snapshot":
+		n.handleSnapshot(res, req)
+	case "quota":
+		n.handleQuota(res, req)
+	case "stamp-rules":
+		writeJSONResponse(res, http.StatusOK, n.storage.StampRules())
+	default:
+		clog.Info(SNNetworkingBadRequest, "Unknown control action "+action)
+		writeResponse(res, http.StatusNotFound, "Unknown control action")
+	}
+}
+
+func handleReady(res http.ResponseWriter) {
+	readinessMutex.Lock()
+	checks := make(map[string]ReadinessCheck, len(readinessChecks))
+	for name, check := range readinessChecks {
+		checks[name] = check
+	}
+	readinessMutex.Unlock()
+
+	ready := true
+	results := make(map[string]string, len(checks))
+	for name, check := range checks {
+		if reason := check(); reason != "" {
+			ready = false
+			results[name] = reason
+			continue
+		}
+		results[name] = "ok"
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONResponse(res, status, map[string]interface{}{"ready": ready, "checks": results})
+}
+
+func (n *Node) handleInfo(res http.ResponseWriter) {
+	writeJSONResponse(res, http.StatusOK, nodeInfo{
+		Version:          settings.Version,
+		Roles:            nodeRoles(),
+		NetworkID:        settings.Get().NetworkID,
+		IdentityKey:      storage.IdentityPublicKey(),
+		Uptime:           int64(time.Since(startTime).Seconds()),
+		FreeCapacity:     n.storage.FreeSpace(),
+		ProtocolVersions: ProtocolVersions,
+		PendingRestart:   settings.PendingRestart(),
+	})
+}
+
+//handleReload reloads the settings, like sending SIGHUP. It requires the control token
+func handleReload(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeResponse(res, http.StatusMethodNotAllowed, req.Method+" is not allowed here.")
+		return
+	}
+	if !authorizeControl(res, req, "settings reload") {
+		return
+	}
+
+	applied, pending, err := settings.Reload()
+	if err != nil {
+		writeJSONResponse(res, http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "pendingRestart": pending})
+		return
+	}
+	writeJSONResponse(res, http.StatusOK, map[string]interface{}{"applied": applied, "pendingRestart": pending})
+}
+
+//handleQuota returns the storage usage and active reservations. Reservations reveal which messages are being received, so it requires the control token
+func (n *Node) handleQuota(res http.ResponseWriter, req *http.Request) {
+	if !authorizeControl(res, req, "quota") {
+		return
+	}
+	writeJSONResponse(res, http.StatusOK, n.storage.QuotaStatus())
+}
+
+//handleSnapshot streams a snapshot of the node state. It contains the identity key, so it requires the control token
+func (n *Node) handleSnapshot(res http.ResponseWriter, req *http.Request) {
+	if !authorizeControl(res, req, "snapshot") {
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/gzip")
+	res.Header().Set("Content-Disposition", "attachment; filename=\"subframe-snapshot-"+time.Now().UTC().Format("20060102-150405")+".tar.gz\"")
+	writer := &countingWriter{writer: res}
+	if snapshot.Write(writer, settings.Get().DataPath, n.snapshots) != OK {
+		if writer.count == 0 {
+			res.Header().Del("Content-Disposition")
+			res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			writeResponse(res, http.StatusInternalServerError, "Failed to create snapshot")
+			return
+		}
+		//The status has already been sent, so the client can only learn about the failure from the aborted connection
+		panic(http.ErrAbortHandler)
+	}
+}
+
+//authorizeControl checks that req carries settings.ControlToken as bearer token, and rejects it otherwise.
+//The source address is not trusted, as requests forwarded by a local reverse proxy appear to come from the local machine
+func authorizeControl(res http.ResponseWriter, req *http.Request, action string) bool {
+	token := settings.Get().ControlToken
+	if token == "" {
+		clog.Warn(SNNetworkingForbidden, "Denied "+action+" requested by "+req.RemoteAddr+", as no control token is set.")
+		writeResponse(res, http.StatusForbidden, "The "+action+" is disabled, as no control token is set")
+		return false
+	}
+	sent, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		clog.Warn(SNNetworkingForbidden, "Denied "+action+" requested by "+req.RemoteAddr+" without the control token.")
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		writeResponse(res, http.StatusUnauthorized, "The "+action+" requires the control token")
+		return false
+	}
+	return true
+}
+
+type countingWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = w.writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+func nodeRoles() []string {
+	return []string{"storage", "coordinator"}
+}
+
+func checkNotShuttingDown() string {
+	if lifecycle.ShuttingDown() {
+		return "node is shutting down"
+	}
+	return ""
+}
+
+func (n *Node) checkDatabaseReady() string {
+	if n.messages.CheckConnection() != OK || n.nodes.CheckConnection() != OK {
+		return "databases are not open"
+	}
+	return ""
+}
+
+func (n *Node) checkStorageReady() string {
+	if n.storage.CheckWritable() != OK {
+		return "messages directory is not writable"
+	}
+	return ""
+}
+
+//coordinatorCheckTimeout is the time all CoordinatorNodes together have to answer the reachability check
+const coordinatorCheckTimeout = 2 * time.Second
+
+var lastCoordinatorCheck time.Time
+var lastCoordinatorResult string
+
+//coordinatorCheckDone is closed once the active reachability check finished, or nil if none is active
+var coordinatorCheckDone chan struct{}
+var coordinatorCheckMutex sync.Mutex
+
+//checkCoordinatorReachable reports whether at least one known CoordinatorNode answers its health endpoint.
+//Concurrent readiness probes wait for the same check instead of starting their own
+func (n *Node) checkCoordinatorReachable() string {
+	coordinatorCheckMutex.Lock()
+	if time.Since(lastCoordinatorCheck) < coordinatorCheckInterval {
+		defer coordinatorCheckMutex.Unlock()
+		return lastCoordinatorResult
+	}
+	if done := coordinatorCheckDone; done != nil {
+		coordinatorCheckMutex.Unlock()
+		<-done
+		coordinatorCheckMutex.Lock()
+		defer coordinatorCheckMutex.Unlock()
+		return lastCoordinatorResult
+	}
+	done := make(chan struct{})
+	coordinatorCheckDone = done
+	coordinatorCheckMutex.Unlock()
+
+	result := "no CoordinatorNode reachable"
+	if n.probeCoordinatorNodes() {
+		result = ""
+	}
+
+	coordinatorCheckMutex.Lock()
+	lastCoordinatorResult = result
+	lastCoordinatorCheck = time.Now()
+	coordinatorCheckDone = nil
+	coordinatorCheckMutex.Unlock()
+	close(done)
+	return result
+}
+
+//probeCoordinatorNodes asks all known CoordinatorNodes at once, and returns as soon as the first one answers healthy
+func (n *Node) probeCoordinatorNodes() bool {
+	status, coordinatorNodes := n.nodes.GetCoordinatorNodes()
+	if status != OK || len(coordinatorNodes) == 0 {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), coordinatorCheckTimeout)
+	defer cancel()
+
+	healthy := make(chan bool, len(coordinatorNodes))
+	for _, coordinatorNode := range coordinatorNodes {
+		go func(address string) {
+			req, err := http.NewRequestWithContext(ctx, "GET", address+"/control/health", nil)
+			if err != nil {
+				healthy <- false
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				healthy <- false
+				return
+			}
+			resp.Body.Close()
+			healthy <- resp.StatusCode == http.StatusOK
+		}(coordinatorNode.Address)
+	}
+	for range coordinatorNodes {
+		if <-healthy {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, data interface{}) {
+	response, err := json.Marshal(data)
+	if err != nil {
+		clog.Error(SNNetworkingEncodingError, "Failed to encode response: "+err.Error())
+		writeResponse(w, http.StatusInternalServerError, "Failed to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse(w, status, string(response))
+}
@@ -0,0 +1,47 @@
+package networking
+
+import (
+	"net/http"
+	"subframe/server/settings"
+	"testing"
+)
+
+func TestControlToken(t *testing.T) {
+	request := func(url string, authorization string) int {
+		t.Helper()
+		req, err := http.NewRequest("GET", url+"/control/quota", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	//Requests from the local machine are not trusted without the token, as they may have been forwarded by a reverse proxy
+	n := startTestNode(t, func(config *settings.Config) { config.ControlToken = "secret" })
+	for _, test := range []struct {
+		authorization string
+		status        int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	} {
+		if status := request(n.url, test.authorization); status != test.status {
+			t.Errorf("quota requested with authorization %q returned %d, expected %d", test.authorization, status, test.status)
+		}
+	}
+
+	n = startTestNode(t, nil)
+	if status := request(n.url, "Bearer "); status != http.StatusForbidden {
+		t.Errorf("quota requested without a control token set returned %d, expected %d", status, http.StatusForbidden)
+	}
+}
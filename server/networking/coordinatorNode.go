@@ -1,3 +1,347 @@
 package networking
 
-import ()
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"subframe/server/jobqueue"
+	"subframe/server/keyring"
+	"subframe/server/logger"
+	"subframe/server/metrics"
+	"subframe/server/settings"
+	"subframe/server/storage"
+	. "subframe/status"
+	"subframe/structs/mailbox"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"subframe/structs/stamp"
+	"time"
+)
+
+var cnlog = logger.Logger{Prefix: "networking/CoordinatorNode"}
+
+//coordinatorReplicas is the number of StorageNodes a message should be stored on. Announcements are answered with "true"
+//until that many StorageNodes announced the message, asking the announcing node to redistribute it
+const coordinatorReplicas = 3
+
+//headerInboxMaxPrefixBits tells clients the longest prefix accepted by inbox queries
+const headerInboxMaxPrefixBits = "X-Inbox-Max-Prefix-Bits"
+
+//handleCoordinatorRequest serves the CoordinatorNode API: /coordinator/<action>/<MessageID>[/<StorageNode>], as well as
+//inbox queries and subscriptions by recipient prefix and mailboxes by recipient
+func (n *Node) handleCoordinatorRequest(w http.ResponseWriter, req *http.Request) {
+	cnlog.Info(InProgress, "Handling incoming "+req.Method+" request to "+logPath(req.URL.Path)+"...")
+	//The escaped path is split, as StorageNode addresses contain slashes
+	parts := strings.Split(req.URL.EscapedPath(), "/")[1:]
+	for i := range parts {
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			parts = nil
+			break
+		}
+		parts[i] = part
+	}
+	//Inbox queries and subscriptions take a recipient prefix instead of a MessageID, which may be empty
+	if len(parts) == 3 && (parts[1] == "inbox" || parts[1] == "subscribe") {
+		n.handleInbox(w, req, parts[1], parts[2])
+		return
+	}
+	if len(parts) == 3 && parts[1] == "mailbox" {
+		n.handleMailbox(w, req, parts[2])
+		return
+	}
+	if len(parts) < 3 || parts[2] == "" {
+		cnlog.Info(CNNetworkingBadRequest, "Action or Slug for "+logPath(req.URL.Path)+" is invalid")
+		strike(req, "an invalid slug")
+		writeResponse(w, http.StatusBadRequest, "Invalid Action or Slug")
+		return
+	}
+	action, messageID := parts[1], parts[2]
+	id, err := messageid.Parse(messageID)
+	if err != nil {
+		cnlog.Info(CNNetworkingMalformedID, "MessageID in "+logPath(req.URL.Path)+" is malformed: "+err.Error())
+		if action == "verify" {
+			metrics.Verifications.WithLabelValues("malformed").Inc()
+		}
+		strike(req, "a malformed MessageID")
+		writeResponse(w, http.StatusBadRequest, "Invalid MessageID: "+err.Error())
+		return
+	}
+
+	switch action {
+	case "announce":
+		if len(parts) < 4 || parts[3] == "" {
+			writeResponse(w, http.StatusBadRequest, "Announcements require the address of the StorageNode")
+			return
+		}
+		n.handleAnnounce(w, req, id, parts[3])
+	case "verify":
+		if len(parts) < 4 || parts[3] == "" {
+			writeResponse(w, http.StatusBadRequest, "Verifications require the confirmation key")
+			return
+		}
+		n.handleVerify(w, req, id, parts[3])
+	case "get":
+		_, locations := n.coordinator.GetMessageLocations(messageID)
+		if locations == nil {
+			locations = []string{}
+		}
+		writeJSONResponse(w, http.StatusOK, locations)
+	case "status":
+		_, messageStatus := n.coordinator.GetMessageStatusCoordinator(messageID)
+		writeResponse(w, http.StatusOK, strconv.Itoa(messageStatus))
+	case "metadata":
+		s, metadata, found := n.coordinator.GetMessageMetadataCoordinator(messageID)
+		if s != OK {
+			writeResponse(w, http.StatusInternalServerError, "Error reading metadata of message "+messageID)
+			return
+		}
+		if !found {
+			writeResponse(w, http.StatusNotFound, "Unknown message "+messageID)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, metadata)
+	default:
+		cnlog.Info(CNNetworkingBadRequest, "Unknown action "+action)
+		strike(req, "an invalid slug")
+		writeResponse(w, http.StatusBadRequest, "Invalid Action or Slug")
+	}
+}
+
+//handleInbox returns the pending messages of all recipients whose fingerprint starts with prefix, continuing after the cursor
+//in the "after" query parameter. Recipients pick their own messages from the entries, so the CoordinatorNode only learns
+//that the recipient is one of those sharing the prefix. With "wait", the query is held open until there are entries, up to
+//settings.InboxMaxWait. The subscribe action streams entries instead, see handleSubscribe
+func (n *Node) handleInbox(w http.ResponseWriter, req *http.Request, action string, value string) {
+	config := settings.Get()
+	w.Header().Set(headerInboxMaxPrefixBits, strconv.Itoa(config.InboxMaxPrefixBits))
+	prefix, err := messageid.ParsePrefix(value)
+	if err != nil {
+		cnlog.Info(CNNetworkingBadRequest, "Inbox prefix in "+logPath(req.URL.Path)+" is invalid: "+err.Error())
+		strike(req, "an invalid prefix")
+		writeResponse(w, http.StatusBadRequest, "Invalid prefix: "+err.Error())
+		return
+	}
+	if prefix.Bits > config.InboxMaxPrefixBits {
+		cnlog.Info(CNNetworkingBadRequest, "Rejected inbox query with a prefix of "+strconv.Itoa(prefix.Bits)+" bits.")
+		writeResponse(w, http.StatusBadRequest, "Prefixes are limited to "+strconv.Itoa(config.InboxMaxPrefixBits)+" bits")
+		return
+	}
+	//Server-Sent Event clients resume with the ID of the last event received
+	after := req.URL.Query().Get("after")
+	if after == "" {
+		after = req.Header.Get("Last-Event-ID")
+	}
+	var cursor int64
+	if after != "" {
+		if cursor, err = strconv.ParseInt(after, 10, 64); err != nil || cursor < 0 {
+			writeResponse(w, http.StatusBadRequest, "Invalid cursor "+after)
+			return
+		}
+	}
+	var wait time.Duration
+	if value := req.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			writeResponse(w, http.StatusBadRequest, "Invalid wait "+value)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, time.Duration(config.InboxMaxWait))
+	}
+	first, last := prefix.Buckets()
+	if action == "subscribe" {
+		n.handleSubscribe(w, req, first, last, cursor)
+		return
+	}
+	metrics.InboxQueries.WithLabelValues(strconv.Itoa(prefix.Bits)).Inc()
+	if wait > 0 {
+		n.handleLongPoll(w, req, first, last, cursor, wait)
+		return
+	}
+	s, entries := n.coordinator.GetInbox(first, last, cursor, config.InboxMaxEntries)
+	if s != OK {
+		writeResponse(w, http.StatusInternalServerError, "Error reading inbox")
+		return
+	}
+	if entries == nil {
+		entries = []message.InboxEntry{}
+	}
+	writeJSONResponse(w, http.StatusOK, entries)
+}
+
+//handleAnnounce records that storageNode stores a message, along with the metadata in the query of req.
+//Announcements have to carry the postage stamp of the message. The response tells the StorageNode whether to redistribute the message
+func (n *Node) handleAnnounce(w http.ResponseWriter, req *http.Request, id messageid.ID, storageNode string) {
+	messageID := id.String()
+	metadata, err := message.ParseQuery(req.URL.Query())
+	if err != nil {
+		cnlog.Error(CNNetworkingBadRequest, "Metadata announced for Message "+keyring.Index(messageID)+" is invalid: "+err.Error())
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rules := storage.CoordinatorStampRules()
+	err = rules.Check(metadata.Stamp, messageID, metadata.Size, time.Now())
+	metrics.StampChecks.WithLabelValues(stampResult(err)).Inc()
+	if err != nil {
+		cnlog.Info(CNNetworkingStampRejected, "Rejected announcement of Message "+keyring.Index(messageID)+" by "+storageNode+": "+err.Error())
+		w.Header().Set(stamp.RequiredHeader, strconv.Itoa(rules.Required(metadata.Size)))
+		writeResponse(w, http.StatusPaymentRequired, err.Error())
+		return
+	}
+	if metadata.CreatedOn.IsZero() {
+		metadata.CreatedOn = time.Now().UTC()
+	}
+	if n.coordinator.LogMessageAnnouncement(messageID, storageNode, metadata) != OK {
+		writeResponse(w, http.StatusInternalServerError, "Error recording announcement of message "+messageID)
+		return
+	}
+	notifySubscribers(id)
+	_, locations := n.coordinator.GetMessageLocations(messageID)
+	cnlog.Info(OK, storageNode+" announced Message "+keyring.Index(messageID)+", which is stored on "+strconv.Itoa(len(locations))+" StorageNodes.")
+	//Received messages are not redistributed any further
+	_, messageStatus := n.coordinator.GetMessageStatusCoordinator(messageID)
+	writeResponse(w, http.StatusOK, strconv.FormatBool(len(locations) < coordinatorReplicas && messageStatus != message.StatusReceived))
+}
+
+//handleVerify marks a message as received, if key is its confirmation key. Every CoordinatorNode checks the key itself,
+//so a verification is only replicated to other CoordinatorNodes by passing on the key, and forged verifications are rejected
+//by each of them. Repeated verifications succeed without effect. Messages to mailboxes are only marked as received once
+//enough of their devices confirmed them, see verifyDevice
+func (n *Node) handleVerify(w http.ResponseWriter, req *http.Request, id messageid.ID, key string) {
+	messageID := id.String()
+	if !id.Confirms(key) {
+		cnlog.Warn(CNNetworkingVerificationFailed, "Rejected forged confirmation key for Message "+keyring.Index(messageID)+" from "+sourceAddress(req)+".")
+		metrics.Verifications.WithLabelValues("forged").Inc()
+		strike(req, "a forged confirmation key")
+		writeResponse(w, http.StatusForbidden, "Invalid confirmation key")
+		return
+	}
+	r := receipt{messageID: messageID, verification: "/verify/" + url.PathEscape(messageID) + "/" + url.PathEscape(key)}
+	s, registration, found := n.coordinator.GetMailbox(mailbox.RecipientOf(id))
+	if s != OK {
+		writeResponse(w, http.StatusInternalServerError, "Error reading mailbox of message "+messageID)
+		return
+	}
+	if found {
+		if !n.verifyDevice(w, req, messageID, key, registration, &r) {
+			return
+		}
+	} else if req.URL.Query().Get("device") != "" {
+		//A device confirmation is not counted as receipt, as this node would not know how many devices have to confirm
+		cnlog.Info(CNNetworkingBadRequest, "Cannot verify Message "+keyring.Index(messageID)+" for a device, as the mailbox of its recipient is unknown.")
+		writeResponse(w, http.StatusConflict, "Unknown mailbox")
+		return
+	}
+	s, recorded := n.coordinator.LogMessageReceipt(messageID)
+	if s != OK {
+		writeResponse(w, http.StatusInternalServerError, "Error recording receipt of message "+messageID)
+		return
+	}
+	writeResponse(w, http.StatusOK, "true")
+	if !recorded {
+		metrics.Verifications.WithLabelValues("repeated").Inc()
+		return
+	}
+	metrics.Verifications.WithLabelValues("ok").Inc()
+	cnlog.Info(OK, "Message "+keyring.Index(messageID)+" has been received.")
+	r.received = true
+	n.replicateReceipt(r)
+}
+
+//verifyDevice records the confirmation of a message to a mailbox by the device in the "device" query parameter, signed with the
+//"signature" query parameter. It responds itself and returns false unless the quorum of the mailbox has been reached
+func (n *Node) verifyDevice(w http.ResponseWriter, req *http.Request, messageID string, key string, registration mailbox.Registration, r *receipt) (complete bool) {
+	mb, err := registration.Open()
+	if err != nil {
+		cnlog.Error(CNNetworkingBadRequest, "Stored mailbox of Message "+keyring.Index(messageID)+" is invalid: "+err.Error())
+		writeResponse(w, http.StatusInternalServerError, "Error reading mailbox of message "+messageID)
+		return false
+	}
+	deviceID := req.URL.Query().Get("device")
+	if deviceID == "" {
+		writeResponse(w, http.StatusBadRequest, "Messages to mailboxes have to be confirmed by a device")
+		return false
+	}
+	device, registered := mb.Device(deviceID)
+	signature, err := base64.RawURLEncoding.DecodeString(req.URL.Query().Get("signature"))
+	if !registered || err != nil || !device.Confirms(messageID, key, signature) {
+		cnlog.Warn(CNNetworkingVerificationFailed, "Rejected forged confirmation of Message "+keyring.Index(messageID)+" by Device "+deviceID+" from "+sourceAddress(req)+".")
+		metrics.Verifications.WithLabelValues("forged").Inc()
+		strike(req, "a forged device confirmation")
+		writeResponse(w, http.StatusForbidden, "Invalid device confirmation")
+		return false
+	}
+	s, recorded, confirmed := n.coordinator.LogDeviceReceipt(messageID, deviceID, mb.DeviceIDs())
+	if s != OK {
+		writeResponse(w, http.StatusInternalServerError, "Error recording receipt of message "+messageID)
+		return false
+	}
+	r.verification += "?" + url.Values{"device": {deviceID}, "signature": {req.URL.Query().Get("signature")}}.Encode()
+	r.recipient = mb.Recipient()
+	r.registration = registration
+	if confirmed >= mb.Required() {
+		return true
+	}
+	writeResponse(w, http.StatusOK, "true")
+	if !recorded {
+		metrics.Verifications.WithLabelValues("repeated").Inc()
+		return false
+	}
+	metrics.Verifications.WithLabelValues("device").Inc()
+	cnlog.Info(OK, "Message "+keyring.Index(messageID)+" has been received by "+strconv.Itoa(confirmed)+" of "+strconv.Itoa(mb.Required())+" Devices.")
+	n.replicateReceipt(*r)
+	return false
+}
+
+//receipt is a verification to be passed on to other CoordinatorNodes
+type receipt struct {
+	messageID    string
+	verification string
+	//recipient and registration identify the mailbox the message was sent to, if any
+	recipient    string
+	registration mailbox.Registration
+	//received is set once the message has been received, so StorageNodes are notified
+	received bool
+}
+
+//replicateReceipt passes a verification on to all other known CoordinatorNodes in the background, along with the mailbox the message
+//was sent to, so they can count the confirmations of its devices. Once the message has been received, the StorageNodes storing it
+//are asked to update its status. StorageNodes query the status from the CoordinatorNetwork themselves, so they do not have to trust the notification
+func (n *Node) replicateReceipt(r receipt) {
+	task := func(data interface{}) {
+		log := logger.Logger{Prefix: "networking/Receipt-" + keyring.Index(r.messageID)}
+		var registration []byte
+		if r.recipient != "" {
+			registration, _ = json.Marshal(r.registration)
+		}
+		_, coordinatorNodes := n.nodes.GetCoordinatorNodes()
+		for _, coordinatorNode := range coordinatorNodes {
+			if coordinatorNode.Address == settings.Get().RemoteAddress {
+				continue
+			}
+			if registration != nil {
+				if s, _ := SendNodeRequest(NODE_COORDINATOR, coordinatorNode.Address, "/mailbox/"+r.recipient, string(registration)); s != OK {
+					log.Warn(CNNetworkingReplicationError, "Failed to pass on Mailbox to "+coordinatorNode.Address+".")
+				}
+			}
+			if s, _ := SendNodeRequest(NODE_COORDINATOR, coordinatorNode.Address, r.verification, ""); s != OK {
+				log.Warn(CNNetworkingReplicationError, "Failed to pass on Receipt to "+coordinatorNode.Address+".")
+			}
+		}
+		if !r.received {
+			log.Info(OK, "Replicated Receipt to "+strconv.Itoa(len(coordinatorNodes))+" CoordinatorNodes.")
+			return
+		}
+		_, storageNodes := n.coordinator.GetMessageLocations(r.messageID)
+		for _, storageNode := range storageNodes {
+			if s, _ := SendNodeRequest(NODE_STORAGE, storageNode, "/update/"+url.PathEscape(r.messageID), ""); s != OK {
+				log.Warn(CNNetworkingReplicationError, "Failed to notify "+storageNode+" of Receipt.")
+			}
+		}
+		log.Info(OK, "Replicated Receipt to "+strconv.Itoa(len(coordinatorNodes))+" CoordinatorNodes and "+strconv.Itoa(len(storageNodes))+" StorageNodes.")
+	}
+	jobqueue.Enqueue(jobqueue.Job{Task: task, Data: r.messageID})
+}
@@ -0,0 +1,141 @@
+package networking
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"subframe/server/database"
+	"subframe/server/storage"
+	. "subframe/status"
+	"subframe/structs/mailbox"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"subframe/structs/node"
+	"testing"
+	"time"
+)
+
+//statusRecorder passes on the status updates of locally stored messages to updates
+type statusRecorder struct {
+	*database.Memory
+	updates chan int
+}
+
+func (s statusRecorder) UpdateMessageStatusStorage(id string, status int) int {
+	s.updates <- status
+	return s.Memory.UpdateMessageStatusStorage(id, status)
+}
+
+func TestReceiptUpdatesStorageNodes(t *testing.T) {
+	n := startTestNode(t, nil)
+	recorder := statusRecorder{Memory: n.db, updates: make(chan int, 1)}
+	n.messages = recorder
+	if status := n.db.AddCoordinatorNode(node.Node{Address: n.url, IdentityKey: storage.IdentityPublicKey()}); status != OK {
+		t.Fatalf("adding CoordinatorNode failed with status %d", status)
+	}
+
+	id, err := messageid.New([]byte("recipient"), "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := message.Metadata{ExpiresOn: time.Now().Add(time.Hour)}
+	if status := n.db.LogMessageStorage(id.String(), metadata); status != OK {
+		t.Fatalf("logging storage failed with status %d", status)
+	}
+	if status := n.db.LogMessageAnnouncement(id.String(), n.url, metadata); status != OK {
+		t.Fatalf("logging announcement failed with status %d", status)
+	}
+
+	resp, err := http.Get(n.url + "/coordinator/verify/" + url.PathEscape(id.String()) + "/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "true" {
+		t.Fatalf("verification responded %s: %s", resp.Status, body)
+	}
+
+	//The StorageNode is notified in the background, and queries the status from the CoordinatorNode
+	select {
+	case status := <-recorder.updates:
+		if status != message.StatusReceived {
+			t.Errorf("StorageNode updated the status to %d, expected %d", status, message.StatusReceived)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("StorageNode has not been notified of the receipt")
+	}
+}
+
+func TestDeviceQuorum(t *testing.T) {
+	n := startTestNode(t, nil)
+	identityPublic, identityKey, _ := ed25519.GenerateKey(nil)
+	signingKeys := map[string]ed25519.PrivateKey{}
+	register := func(version int64, quorum int, devices ...string) {
+		t.Helper()
+		mb := mailbox.Mailbox{IdentityKey: identityPublic, Quorum: quorum, Version: version}
+		for _, device := range devices {
+			if signingKeys[device] == nil {
+				_, signingKeys[device], _ = ed25519.GenerateKey(nil)
+			}
+			mb.Devices = append(mb.Devices, mailbox.Device{ID: device, SigningKey: signingKeys[device].Public().(ed25519.PublicKey)})
+		}
+		registration, err := mailbox.Sign(mb, identityKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status, stored := n.db.SetMailbox(mb.Recipient(), version, registration); status != OK || !stored {
+			t.Fatalf("storing mailbox failed with status %d", status)
+		}
+	}
+
+	id, err := messageid.New(identityPublic, "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirm := func(device string, signedBy string) int {
+		t.Helper()
+		signature := base64.RawURLEncoding.EncodeToString(mailbox.SignConfirmation(signingKeys[signedBy], id.String(), "key"))
+		resp, err := http.Get(n.url + "/coordinator/verify/" + url.PathEscape(id.String()) + "/key?" + url.Values{"device": {device}, "signature": {signature}}.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	received := func() bool {
+		_, messageStatus := n.db.GetMessageStatusCoordinator(id.String())
+		return messageStatus == message.StatusReceived
+	}
+
+	register(1, 2, "phone", "laptop", "tablet")
+	for _, test := range []struct {
+		name     string
+		device   string
+		signedBy string
+		status   int
+	}{
+		{"signed by another device", "laptop", "phone", http.StatusForbidden},
+		{"of an unknown device", "watch", "phone", http.StatusForbidden},
+		{"of a device", "phone", "phone", http.StatusOK},
+		{"repeated", "phone", "phone", http.StatusOK},
+	} {
+		if status := confirm(test.device, test.signedBy); status != test.status {
+			t.Errorf("confirmation %s returned %d, expected %d", test.name, status, test.status)
+		}
+		if received() {
+			t.Fatalf("message is received after confirmation %s, below the quorum", test.name)
+		}
+	}
+
+	//The confirmation of a device removed from the mailbox does not count towards the quorum
+	register(2, 2, "laptop", "tablet")
+	if status := confirm("laptop", "laptop"); status != http.StatusOK || received() {
+		t.Errorf("confirmation by the first current device returned %d, received: %t", status, received())
+	}
+	if status := confirm("tablet", "tablet"); status != http.StatusOK || !received() {
+		t.Errorf("confirmation reaching the quorum returned %d, received: %t", status, received())
+	}
+}
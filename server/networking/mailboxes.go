@@ -0,0 +1,112 @@
+package networking
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"subframe/server/jobqueue"
+	"subframe/server/keyring"
+	"subframe/server/logger"
+	"subframe/server/settings"
+	. "subframe/status"
+	"subframe/structs/mailbox"
+)
+
+//maxRegistrationSize limits the size of mailbox registrations
+const maxRegistrationSize = 64 << 10
+
+//handleMailbox serves the mailbox of a recipient, identified by the hex encoded fingerprint of its identity key. GET returns
+//the registration, so senders can seal messages to the devices. POST stores a registration, if it is signed by the recipient
+//and newer than the one stored, and passes it on to all other known CoordinatorNodes
+func (n *Node) handleMailbox(w http.ResponseWriter, req *http.Request, recipient string) {
+	if fingerprint, err := hex.DecodeString(recipient); err != nil || len(fingerprint) != 32 || hex.EncodeToString(fingerprint) != recipient {
+		cnlog.Info(CNNetworkingBadRequest, "Recipient in "+logPath(req.URL.Path)+" is invalid")
+		strike(req, "an invalid recipient")
+		writeResponse(w, http.StatusBadRequest, "Recipients are identified by the lowercase hex encoded fingerprint of their identity key")
+		return
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+		s, registration, found := n.coordinator.GetMailbox(recipient)
+		if s != OK {
+			writeResponse(w, http.StatusInternalServerError, "Error reading mailbox "+recipient)
+			return
+		}
+		if !found {
+			writeResponse(w, http.StatusNotFound, "Unknown mailbox "+recipient)
+			return
+		}
+		writeJSONResponse(w, http.StatusOK, registration)
+	case "POST":
+		n.registerMailbox(w, req, recipient)
+	default:
+		writeResponse(w, http.StatusMethodNotAllowed, req.Method+" is not allowed here.")
+	}
+}
+
+func (n *Node) registerMailbox(w http.ResponseWriter, req *http.Request, recipient string) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRegistrationSize))
+	if err != nil {
+		strike(req, "an oversized mailbox")
+		writeResponse(w, http.StatusRequestEntityTooLarge, "Mailbox too large")
+		return
+	}
+	var registration mailbox.Registration
+	if err = json.Unmarshal(body, &registration); err != nil {
+		writeResponse(w, http.StatusBadRequest, "Malformed registration: "+err.Error())
+		return
+	}
+	mb, err := registration.Open()
+	if err == mailbox.ErrSignature {
+		cnlog.Warn(CNNetworkingVerificationFailed, "Rejected forged registration of Mailbox "+keyring.Index(recipient)+" from "+sourceAddress(req)+".")
+		strike(req, "a forged mailbox")
+		writeResponse(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err != nil {
+		writeResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if mb.Recipient() != recipient {
+		writeResponse(w, http.StatusBadRequest, "Mailbox belongs to recipient "+mb.Recipient())
+		return
+	}
+	s, stored := n.coordinator.SetMailbox(recipient, mb.Version, registration)
+	if s != OK {
+		writeResponse(w, http.StatusInternalServerError, "Error storing mailbox "+recipient)
+		return
+	}
+	if !stored {
+		//Registrations passed on by other CoordinatorNodes may arrive repeatedly
+		_, current, _ := n.coordinator.GetMailbox(recipient)
+		if string(current.Mailbox) == string(registration.Mailbox) {
+			writeResponse(w, http.StatusOK, "false")
+			return
+		}
+		writeResponse(w, http.StatusConflict, "A registration with the same or a higher version is stored")
+		return
+	}
+	cnlog.Info(OK, "Registered Version "+strconv.FormatInt(mb.Version, 10)+" of Mailbox "+keyring.Index(recipient)+" with "+strconv.Itoa(len(mb.Devices))+" Devices.")
+	writeResponse(w, http.StatusOK, "true")
+	n.replicateMailbox(recipient, body)
+}
+
+//replicateMailbox passes a registration on to all other known CoordinatorNodes in the background. They check the signature themselves
+func (n *Node) replicateMailbox(recipient string, registration []byte) {
+	task := func(data interface{}) {
+		log := logger.Logger{Prefix: "networking/Mailbox-" + keyring.Index(recipient)}
+		_, coordinatorNodes := n.nodes.GetCoordinatorNodes()
+		for _, coordinatorNode := range coordinatorNodes {
+			if coordinatorNode.Address == settings.Get().RemoteAddress {
+				continue
+			}
+			if s, _ := SendNodeRequest(NODE_COORDINATOR, coordinatorNode.Address, "/mailbox/"+recipient, string(registration)); s != OK {
+				log.Warn(CNNetworkingReplicationError, "Failed to pass on Mailbox to "+coordinatorNode.Address+".")
+			}
+		}
+		log.Info(OK, "Replicated Mailbox to "+strconv.Itoa(len(coordinatorNodes))+" CoordinatorNodes.")
+	}
+	jobqueue.Enqueue(jobqueue.Job{Task: task, Data: recipient})
+}
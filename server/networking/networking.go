@@ -1,25 +1,77 @@
 package networking
 
 import (
+	"context"
+	"net/http"
+	"strings"
+	"subframe/server/database"
+	"subframe/server/keyring"
 	"subframe/server/logger"
+	"subframe/server/storage"
 	. "subframe/status"
 )
 
 var mlog = logger.Logger{Prefix: "networking/Main"}
 
-//Init Initializes StorageNode HTTP Api and starts coordinator network service
-func Init() {
+//Node serves the StorageNode and CoordinatorNode APIs of the local node
+type Node struct {
+	messages    database.MessageStore
+	nodes       database.NodeStore
+	coordinator database.CoordinatorIndex
+	snapshots   database.Snapshotter
+	storage     *storage.Storage
+	server      *http.Server
+}
+
+//New returns a Node serving the messages in messageStorage, using messages, nodes and coordinator as persistence.
+//snapshots copies the databases for /control/snapshot
+func New(messages database.MessageStore, nodes database.NodeStore, coordinator database.CoordinatorIndex, snapshots database.Snapshotter, messageStorage *storage.Storage) *Node {
+	return &Node{
+		messages:    messages,
+		nodes:       nodes,
+		coordinator: coordinator,
+		snapshots:   snapshots,
+		storage:     messageStorage,
+	}
+}
+
+//Start Initializes StorageNode HTTP Api and starts coordinator network service
+func (n *Node) Start() {
 	mlog.Info(InProgress, "Initializing Networking...")
+	RegisterReadinessCheck("database", n.checkDatabaseReady)
+	RegisterReadinessCheck("storage", n.checkStorageReady)
+	RegisterReadinessCheck("coordinator", n.checkCoordinatorReachable)
 	//Start StorageNode Api
-	startStorageNodeAPIService()
+	n.startStorageNodeAPIService()
 
-	//Start CoordinatorNode service
+	//The CoordinatorNode service is served by the same HTTP Server, below /coordinator/
 	mlog.Info(OK, "Initialized Networking.")
 }
 
-//Stop terminates and stops all active network connections and interfaces
-func Stop() {
+//Stop stops accepting new requests and waits for active requests to finish, until ctx is done
+func (n *Node) Stop(ctx context.Context) {
 	mlog.Info(InProgress, "Stopping Networking...")
-
+	//Subscriptions are ended first, as their connections never become idle
+	closeSubscriptions()
+	if n.server != nil {
+		//Shutdown closes all listeners first, then waits for active connections to become idle
+		if err := n.server.Shutdown(ctx); err != nil {
+			mlog.Error(SNNetworkingServerError, "Failed to finish active requests: "+err.Error())
+			n.server.Close()
+		}
+	}
 	mlog.Info(OK, "Stopped Networking.")
 }
+
+//logPath returns a request path for logging. With encryption enabled, the segments after the action, which hold MessageIDs,
+//recipients and StorageNode addresses, are replaced by their blind index
+func logPath(path string) string {
+	if !keyring.Enabled() {
+		return path
+	}
+	parts := strings.Split(path, "/")
+	for i := 3; i < len(parts); i++ {
+		parts[i] = keyring.Index(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,45 @@
+package networking
+
+import (
+	"net/http/httptest"
+	"subframe/server/database"
+	"subframe/server/jobqueue"
+	"subframe/server/settings"
+	"subframe/server/storage"
+	"testing"
+)
+
+//testNode is a Node serving both roles with in-memory stores, reachable at url
+type testNode struct {
+	*Node
+	db  *database.Memory
+	url string
+}
+
+//startTestNode starts a Node with in-memory stores and a memory backend on a local test server. configure may adjust the settings,
+//whose RemoteAddress is the URL of the test server
+func startTestNode(t *testing.T, configure func(config *settings.Config)) testNode {
+	t.Helper()
+	previous := settings.Get()
+	t.Cleanup(func() { settings.Set(previous) })
+	config := settings.DefaultConfig()
+	config.DataPath = t.TempDir()
+	config.StorageBackend = "memory"
+	if configure != nil {
+		configure(&config)
+	}
+	settings.Set(config)
+
+	db := database.NewMemory()
+	backend, err := storage.NewBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := New(db, db, db, nil, storage.New(db, db, backend))
+	server := httptest.NewServer(n.handler())
+	t.Cleanup(server.Close)
+	config.RemoteAddress = server.URL
+	settings.Set(config)
+	jobqueue.SpawnWorker()
+	return testNode{Node: n, db: db, url: server.URL}
+}
@@ -0,0 +1,69 @@
+package networking
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"subframe/server/settings"
+	"subframe/server/storage"
+	"time"
+)
+
+//Requests between nodes are signed with the identity key of the sending node, so they can be rate limited per node
+//instead of per source address. The signature covers method, path, query, timestamp and network ID
+const (
+	headerNodeIdentity  = "X-Node-Identity"
+	headerNodeTimestamp = "X-Node-Timestamp"
+	headerNodeSignature = "X-Node-Signature"
+)
+
+//maxSignatureAge is how far the timestamp of a signed request may differ from the local time
+const maxSignatureAge = 5 * time.Minute
+
+//signRequest adds the identity of the local node to an outgoing request
+func signRequest(req *http.Request) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(headerNodeIdentity, storage.IdentityPublicKey())
+	req.Header.Set(headerNodeTimestamp, timestamp)
+	req.Header.Set(headerNodeSignature, base64.StdEncoding.EncodeToString(storage.Sign(signedData(req, timestamp))))
+}
+
+//requestIdentity returns the identity key of the node which signed req, or an empty string if req is not signed validly
+func requestIdentity(req *http.Request) string {
+	identity := req.Header.Get(headerNodeIdentity)
+	if identity == "" {
+		return ""
+	}
+	timestamp := req.Header.Get(headerNodeTimestamp)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(seconds, 0)).Abs() > maxSignatureAge {
+		return ""
+	}
+	key, err := base64.StdEncoding.DecodeString(identity)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return ""
+	}
+	signature, err := base64.StdEncoding.DecodeString(req.Header.Get(headerNodeSignature))
+	if err != nil || !ed25519.Verify(key, signedData(req, timestamp), signature) {
+		return ""
+	}
+	return identity
+}
+
+//nodeIdentity returns the identity key of the known node which signed req. Requests signed validly by keys of nodes missing
+//from the NodeStore are treated like unsigned ones, as anyone can generate a key
+func (n *Node) nodeIdentity(req *http.Request) string {
+	identity := requestIdentity(req)
+	if identity == "" {
+		return ""
+	}
+	if _, known := n.nodes.IsKnownNode(identity); !known {
+		return ""
+	}
+	return identity
+}
+
+func signedData(req *http.Request, timestamp string) []byte {
+	return []byte(req.Method + "\n" + req.URL.RequestURI() + "\n" + timestamp + "\n" + settings.Get().NetworkID)
+}
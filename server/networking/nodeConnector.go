@@ -2,12 +2,19 @@ package networking
 
 import (
 	"bytes"
+	"encoding/json"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
-	"subframe/server/database"
+	"subframe/server/keyring"
+	"subframe/server/lifecycle"
 	"subframe/server/logger"
+	"subframe/server/metrics"
 	. "subframe/status"
+	"subframe/structs/message"
+	"time"
 )
 
 var nlog = logger.Logger{Prefix: "networking/NodeConnector"}
@@ -24,7 +31,7 @@ func SendNodeRequest(nodeType int, address string, queryString string, data stri
 	case NODE_STORAGE:
 		return sendStorageNodeRequest(address, queryString, data)
 	case NODE_COORDINATOR:
-		return sendCoordinatorNodeRequest(address, queryString)
+		return sendCoordinatorNodeRequest(address, queryString, data)
 	}
 	return NetworkingBadNodeType, nil
 }
@@ -34,107 +41,241 @@ func sendStorageNodeRequest(address string, queryString string, data string) (st
 	var err error
 	if data == "" {
 		//There is no data to be POSTed, send GET Request
-		nlog.Info("Sending StorageNode GET Request to " + address + "/storage" + queryString + "...")
-		resp, err = http.Get(address + "/storage" + queryString)
+		nlog.Info(InProgress, "Sending StorageNode GET Request to "+address+logPath("/storage"+queryString)+"...")
+		resp, err = sendRequest("GET", address+"/storage"+queryString, nil)
 
 	} else {
 		//There is data to be POSTed, send POST Request
-		nlog.Info("Sending StorageNode POST Request to " + address + "/storage" + queryString + "...")
-		resp, err = http.Post(address+"/storage"+queryString, "raw", bytes.NewBufferString(data))
+		nlog.Info(InProgress, "Sending StorageNode POST Request to "+address+logPath("/storage"+queryString)+"...")
+		resp, err = sendRequest("POST", address+"/storage"+queryString, bytes.NewBufferString(data))
 	}
 	if err != nil {
-		nlog.Error("Error sending request: " + err.Error())
+		nlog.Error(SNNetworkingOutgoingRequestError, "Error sending request: "+err.Error())
 		return SNNetworkingOutgoingRequestError, nil
 	}
 	defer resp.Body.Close()
 
-	nlog.Info("Reading response...")
+	nlog.Info(InProgress, "Reading response...")
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		nlog.Error("Error reading response: " + err.Error())
+		nlog.Error(SNNetworkingReadingResponseError, "Error reading response: "+err.Error())
 		return SNNetworkingReadingResponseError, nil
 	}
 
-	nlog.Info("Read response.")
+	nlog.Info(OK, "Read response.")
 	return OK, body
 }
 
-func sendCoordinatorNodeRequest(address string, queryString string) (status int, response []byte) {
+func sendCoordinatorNodeRequest(address string, queryString string, data string) (status int, response []byte) {
 	//TODO: Send Request, get response; if in coordinator network send request via socket
-	nlog.Info("Sending CoordinatorNode HTTP Request to " + address + "/coordinator" + queryString + "...")
-	resp, err := http.Get(address + "/coordinator" + queryString)
+	var resp *http.Response
+	var err error
+	if data == "" {
+		nlog.Info(InProgress, "Sending CoordinatorNode GET Request to "+address+logPath("/coordinator"+queryString)+"...")
+		resp, err = sendRequest("GET", address+"/coordinator"+queryString, nil)
+	} else {
+		nlog.Info(InProgress, "Sending CoordinatorNode POST Request to "+address+logPath("/coordinator"+queryString)+"...")
+		resp, err = sendRequest("POST", address+"/coordinator"+queryString, bytes.NewBufferString(data))
+	}
 	if err != nil {
-		nlog.Error("Error sending request: " + err.Error())
+		nlog.Error(CNNetworkingOutgoingRequestError, "Error sending request: "+err.Error())
+		metrics.CoordinatorRequests.WithLabelValues(address, "request_error").Inc()
 		return CNNetworkingOutgoingRequestError, nil
 	}
 	defer resp.Body.Close()
 
-	nlog.Info("Reading response...")
+	nlog.Info(InProgress, "Reading response...")
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		nlog.Error("Error reading response: " + err.Error())
+		nlog.Error(CNNetworkingReadingResponseError, "Error reading response: "+err.Error())
+		metrics.CoordinatorRequests.WithLabelValues(address, "response_error").Inc()
 		return CNNetworkingReadingResponseError, nil
 	}
 
-	nlog.Info("Read response")
+	if resp.StatusCode != http.StatusOK {
+		nlog.Error(CNNetworkingReadingResponseError, address+" responded "+resp.Status+": "+string(body))
+		metrics.CoordinatorRequests.WithLabelValues(address, "rejected").Inc()
+		return CNNetworkingReadingResponseError, body
+	}
+	nlog.Info(OK, "Read response")
+	metrics.CoordinatorRequests.WithLabelValues(address, "ok").Inc()
 	return OK, body
 }
 
+//sendRequest sends a request bound to the root context, so pending requests are aborted on shutdown
+func sendRequest(method string, url string, body io.Reader) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(lifecycle.Context(), method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "raw")
+	}
+	signRequest(req)
+	return http.DefaultClient.Do(req)
+}
+
 //Ping returns the current Ping to the specified address
 func Ping(address string) (ping int) {
 	//TODO: Get Ping of Node
-	nlog.Info("Pinging Node " + address)
+	nlog.Info(InProgress, "Pinging Node "+address)
 
 	ping = 123
 
-	nlog.Info("Ping test for " + address + " returned: " + strconv.Itoa(ping))
+	nlog.Info(OK, "Ping test for "+address+" returned: "+strconv.Itoa(ping))
 	return ping
 }
 
+//FetchIdentityKey returns the public identity key the node at address reports in its /control/info
+func FetchIdentityKey(address string) (status int, identityKey string) {
+	nlog.Info(InProgress, "Getting identity of Node "+address+"...")
+	resp, err := sendRequest("GET", address+"/control/info", nil)
+	if err != nil {
+		nlog.Error(SNNetworkingOutgoingRequestError, "Error sending request: "+err.Error())
+		return SNNetworkingOutgoingRequestError, ""
+	}
+	defer resp.Body.Close()
+
+	var info nodeInfo
+	if resp.StatusCode != http.StatusOK {
+		nlog.Error(SNNetworkingReadingResponseError, address+" responded "+resp.Status)
+		return SNNetworkingReadingResponseError, ""
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		nlog.Error(SNNetworkingReadingResponseError, "Error reading response: "+err.Error())
+		return SNNetworkingReadingResponseError, ""
+	}
+	nlog.Info(OK, "Node "+address+" has identity "+info.IdentityKey)
+	return OK, info.IdentityKey
+}
+
 //GetMessageStatus queries the CoordinatorNetwork for the status of the specified message
-func GetMessageStatus(messageID string) (status int) {
-	nlog.Info("Getting Status for Message " + messageID + " from CoordinatorNetwork...")
+func (n *Node) GetMessageStatus(messageID string) (status int) {
+	nlog.Info(InProgress, "Getting Status for Message "+keyring.Index(messageID)+" from CoordinatorNetwork...")
 	//If Message is not present in local database, no need to check status
-	s, isStored := database.CheckMessageStorage(messageID)
+	s, isStored := n.messages.CheckMessageStorage(messageID)
 
 	if s != OK {
-		nlog.Error("Failed to check whether message is stored on this Node. Aborting...")
-		return
+		nlog.Error(s, "Failed to check whether message is stored on this Node. Aborting...")
+		return -1
 	}
 
-	if isStored {
-		nlog.Error("Message " + messageID + " does not appear to be stored on this Node.")
-		return
+	if !isStored {
+		nlog.Error(SNDBReadError, "Message "+keyring.Index(messageID)+" does not appear to be stored on this Node.")
+		return -1
 	}
 
 	//Get Status from up to three different coordinator nodes
-	nlog.Info("Getting CoordinatorNodes...")
-	s, coordinatorNodes := database.GetRandomCoordinatorNodes(3)
+	nlog.Info(InProgress, "Getting CoordinatorNodes...")
+	s, coordinatorNodes := n.nodes.GetRandomCoordinatorNodes(3)
 	if s != OK {
-		nlog.Error("Failed to get CoordinatorNodes.")
-		return
+		nlog.Error(s, "Failed to get CoordinatorNodes.")
+		return -1
 	}
-	nlog.Info("Got " + strconv.Itoa(len(coordinatorNodes)) + " CoordinatorNodes.")
+	if len(coordinatorNodes) == 0 {
+		nlog.Error(CNDBReadError, "Received empty List of CoordinatorNodes.")
+		return -1
+	}
+	nlog.Info(OK, "Got "+strconv.Itoa(len(coordinatorNodes))+" CoordinatorNodes.")
 	newStatus := make([]string, len(coordinatorNodes))
 	for index, value := range coordinatorNodes {
-		newStatus[index] = sendCoordinatorNodeRequest(value, "/status/"+messageID)
+		_, response := sendCoordinatorNodeRequest(value.Address, "/status/"+url.PathEscape(messageID), "")
+		newStatus[index] = string(response)
 	}
 
-	nlog.Info("Got status from " + strconv.Itoa(len(coordinatorNodes)) + " Nodes. Checking...")
+	nlog.Info(InProgress, "Got status from "+strconv.Itoa(len(coordinatorNodes))+" Nodes. Checking...")
 	for _, value := range newStatus {
 		if value != newStatus[0] {
 			//TODO: Network is out of sync; handle appropriately
-			nlog.Error("Status do not match. CoordinatorNetwork appears out of sync.")
+			nlog.Error(CNNetworkingOutOfSync, "Status do not match. CoordinatorNetwork appears out of sync.")
 			return -1
 		}
 	}
 
 	//Network is in sync, return status
-	nlog.Info("New Status appear valid. Returning.")
+	nlog.Info(OK, "New Status appear valid. Returning.")
 	status, err := strconv.Atoi(newStatus[0])
 	if err == nil {
 		return status
 	}
-	nlog.Error("Error returning new Status: " + err.Error())
+	nlog.Error(GenericInternalError, "Error returning new Status: "+err.Error())
 	return -1
 }
+
+//GetMessageLocations queries the CoordinatorNetwork for the StorageNodes which announced to store the specified message
+func (n *Node) GetMessageLocations(messageID string) (status int, storageNodes []string) {
+	nlog.Info(InProgress, "Getting StorageNodes storing Message "+keyring.Index(messageID)+" from CoordinatorNetwork...")
+	s, coordinatorNodes := n.nodes.GetRandomCoordinatorNodes(3)
+	if s != OK {
+		nlog.Error(s, "Failed to get CoordinatorNodes.")
+		return s, nil
+	}
+
+	//Locations reported by any of the CoordinatorNodes are merged, as a single copy suffices
+	known := make(map[string]bool)
+	for _, value := range coordinatorNodes {
+		s, response := sendCoordinatorNodeRequest(value.Address, "/get/"+url.PathEscape(messageID), "")
+		var locations []string
+		if s != OK || json.Unmarshal(response, &locations) != nil {
+			continue
+		}
+		for _, location := range locations {
+			if !known[location] {
+				known[location] = true
+				storageNodes = append(storageNodes, location)
+			}
+		}
+	}
+	nlog.Info(OK, "Message "+keyring.Index(messageID)+" is stored on "+strconv.Itoa(len(storageNodes))+" StorageNodes.")
+	return OK, storageNodes
+}
+
+//PushMessage stores a copy of a locally stored message on the StorageNode at address, along with its metadata.
+//The receiving node determines the expiry of its copy itself
+func (n *Node) PushMessage(address string, msg message.Message) (status int) {
+	nlog.Info(InProgress, "Pushing Message "+keyring.Index(msg.ID)+" to "+address+"...")
+	content, info, s := n.storage.Get(msg.ID)
+	if s != http.StatusOK {
+		return SNNetworkingStorageError
+	}
+	defer content.Close()
+
+	req, err := http.NewRequestWithContext(lifecycle.Context(), "POST", address+"/storage/put/"+url.PathEscape(msg.ID), content)
+	if err != nil {
+		nlog.Error(SNNetworkingOutgoingRequestError, "Error pushing Message "+keyring.Index(msg.ID)+": "+err.Error())
+		return SNNetworkingOutgoingRequestError
+	}
+	metadata := msg.Metadata
+	metadata.ExpiresOn = time.Time{}
+	metadata.WriteHeader(req.Header)
+	req.ContentLength = info.Size
+	signRequest(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		nlog.Error(SNNetworkingOutgoingRequestError, "Error pushing Message "+keyring.Index(msg.ID)+": "+err.Error())
+		return SNNetworkingOutgoingRequestError
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		nlog.Warn(SNNetworkingReadingResponseError, address+" did not accept Message "+keyring.Index(msg.ID)+": "+resp.Status)
+		return SNNetworkingReadingResponseError
+	}
+	nlog.Info(OK, "Pushed Message "+keyring.Index(msg.ID)+" to "+address+".")
+	return OK
+}
+
+//FetchMessage requests a message from the StorageNode at address. The caller has to close content
+func FetchMessage(address string, messageID string) (content io.ReadCloser, status int) {
+	nlog.Info(InProgress, "Fetching Message "+keyring.Index(messageID)+" from "+address+"...")
+	resp, err := sendRequest("GET", address+"/storage/get/"+url.PathEscape(messageID), nil)
+	if err != nil {
+		nlog.Error(SNNetworkingOutgoingRequestError, "Error fetching Message "+keyring.Index(messageID)+": "+err.Error())
+		return nil, SNNetworkingOutgoingRequestError
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		nlog.Error(SNNetworkingReadingResponseError, "Error fetching Message "+keyring.Index(messageID)+": "+address+" responded "+resp.Status)
+		return nil, SNNetworkingReadingResponseError
+	}
+	return resp.Body, OK
+}
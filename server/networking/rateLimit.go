@@ -0,0 +1,228 @@
+package networking
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"subframe/server/metrics"
+	"subframe/server/settings"
+	. "subframe/status"
+	"sync"
+	"time"
+)
+
+//Request classes with separate rate limits
+const (
+	classGet     = "get"
+	classPut     = "put"
+	classControl = "control"
+)
+
+//burstWindow is the share of the budget per minute which can be used at once
+const burstWindow = 10 * time.Second
+
+//bucketSweepInterval is the minimum time between removals of unused buckets and expired strikes
+const bucketSweepInterval = time.Minute
+
+//bucket is a token bucket, refilled continuously at rate tokens per second up to capacity
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+//offender counts invalid requests from a source address, and holds its ban if it sent too many
+type offender struct {
+	strikes     int
+	firstStrike time.Time
+	bannedUntil time.Time
+}
+
+var buckets = make(map[string]*bucket)
+var offenders = make(map[string]*offender)
+var lastSweep time.Time
+var limitMutex sync.Mutex
+
+//activeUploads counts the message bodies and upload chunks currently received
+var activeUploads int
+var uploadMutex sync.Mutex
+
+//limited wraps handler with the ban check and the rate limit of the class returned by classify for each request
+func (n *Node) limited(classify func(req *http.Request) string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		address := sourceAddress(req)
+		if until := bannedUntil(address); !until.IsZero() {
+			metrics.RateLimitHits.WithLabelValues("banned").Inc()
+			res.Header().Set("Retry-After", retryAfter(time.Until(until)))
+			writeResponse(res, http.StatusForbidden, "Too many invalid requests, try again later")
+			return
+		}
+		class := classify(req)
+		verify := func() string { return n.nodeIdentity(req) }
+		if wait := takeToken(class, address, req.Header.Get(headerNodeIdentity) != "", verify); wait > 0 {
+			slog.Info(SNNetworkingRateLimited, "Rate limited "+class+" request from "+address+" to "+logPath(req.URL.Path))
+			metrics.RateLimitHits.WithLabelValues(class).Inc()
+			res.Header().Set("Retry-After", retryAfter(wait))
+			writeResponse(res, http.StatusTooManyRequests, "Too many requests, try again later")
+			return
+		}
+		handler(res, req)
+	}
+}
+
+//storageRequestClass classifies requests to /storage/ by their action
+func storageRequestClass(req *http.Request) string {
+	switch strings.SplitN(strings.TrimPrefix(req.URL.Path, "/storage/"), "/", 2)[0] {
+	case "get":
+		return classGet
+	case "put", "upload":
+		return classPut
+	}
+	return classControl
+}
+
+//coordinatorRequestClass classifies requests to /coordinator/ by their action. Announcements and mailbox registrations are limited like storing messages
+func coordinatorRequestClass(req *http.Request) string {
+	if strings.HasPrefix(req.URL.Path, "/coordinator/announce/") || (req.Method == "POST" && strings.HasPrefix(req.URL.Path, "/coordinator/mailbox/")) {
+		return classPut
+	}
+	return classGet
+}
+
+func controlRequestClass(req *http.Request) string {
+	return classControl
+}
+
+//takeToken takes a token for a request of class from address, and returns how long to wait for a token if there is none left.
+//Signed requests are limited per address with the budget of nodes before verify checks their signature, so forged signatures cannot
+//force verifications beyond that budget. Requests of known nodes, whose identity is returned by verify, are then limited per identity
+//with the same budget, so an address cannot add up the budgets of several nodes. All other requests are limited like unsigned ones
+func takeToken(class string, address string, signed bool, verify func() string) (wait time.Duration) {
+	config := settings.Get()
+	perMinute := map[string]int{classGet: config.RateLimitGet, classPut: config.RateLimitPut, classControl: config.RateLimitControl}[class]
+	if perMinute == 0 {
+		return 0
+	}
+	if !signed {
+		return takeFrom(class+"/address/"+address, perMinute)
+	}
+	if wait = takeFrom(class+"/node-address/"+address, perMinute*config.RateLimitNodeFactor); wait > 0 {
+		return wait
+	}
+	if identity := verify(); identity != "" {
+		return takeFrom(class+"/node/"+identity, perMinute*config.RateLimitNodeFactor)
+	}
+	return takeFrom(class+"/address/"+address, perMinute)
+}
+
+//takeFrom takes a token from the bucket of key, refilled with perMinute tokens per minute
+func takeFrom(key string, perMinute int) (wait time.Duration) {
+	rate := float64(perMinute) / time.Minute.Seconds()
+	capacity := math.Max(rate*burstWindow.Seconds(), 1)
+
+	limitMutex.Lock()
+	defer limitMutex.Unlock()
+	now := time.Now()
+	sweepBuckets(now)
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+//strike records an invalid request, like an invalid slug or an oversized body, and bans the source address of req
+//once it sent settings.BanThreshold invalid requests within settings.BanDuration
+func strike(req *http.Request, reason string) {
+	config := settings.Get()
+	if config.BanThreshold == 0 {
+		return
+	}
+	address := sourceAddress(req)
+	duration := time.Duration(config.BanDuration)
+
+	limitMutex.Lock()
+	defer limitMutex.Unlock()
+	now := time.Now()
+	o, ok := offenders[address]
+	if !ok || now.Sub(o.firstStrike) > duration {
+		o = &offender{firstStrike: now}
+		offenders[address] = o
+	}
+	o.strikes++
+	if o.strikes >= config.BanThreshold && now.After(o.bannedUntil) {
+		o.bannedUntil = now.Add(duration)
+		slog.Warn(SNNetworkingBanned, "Banned "+address+" for "+settings.Duration(duration).String()+" after "+strconv.Itoa(o.strikes)+" invalid requests, the last one being "+reason+".")
+		metrics.Bans.Inc()
+	}
+}
+
+//bannedUntil returns the end of the ban of address, or the zero time if it is not banned
+func bannedUntil(address string) time.Time {
+	limitMutex.Lock()
+	defer limitMutex.Unlock()
+	if o, ok := offenders[address]; ok && time.Now().Before(o.bannedUntil) {
+		return o.bannedUntil
+	}
+	return time.Time{}
+}
+
+//sweepBuckets removes buckets which have been refilled completely, and offenders whose strikes and ban expired. limitMutex has to be held
+func sweepBuckets(now time.Time) {
+	if now.Sub(lastSweep) < bucketSweepInterval {
+		return
+	}
+	lastSweep = now
+	for key, b := range buckets {
+		//No budget is so low that its bucket is not refilled after an hour
+		if now.Sub(b.updated) > time.Hour {
+			delete(buckets, key)
+		}
+	}
+	duration := time.Duration(settings.Get().BanDuration)
+	for address, o := range offenders {
+		if now.Sub(o.firstStrike) > duration && now.After(o.bannedUntil) {
+			delete(offenders, address)
+		}
+	}
+}
+
+//acquireUploadSlot reserves one of settings.MaxConcurrentUploads slots for receiving a message body, and returns false if none is free.
+//Slots have to be released with releaseUploadSlot
+func acquireUploadSlot() bool {
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	if activeUploads >= settings.Get().MaxConcurrentUploads {
+		return false
+	}
+	activeUploads++
+	return true
+}
+
+func releaseUploadSlot() {
+	uploadMutex.Lock()
+	activeUploads--
+	uploadMutex.Unlock()
+}
+
+//sourceAddress returns the IP address a request was sent from. Proxy headers are not trusted
+func sourceAddress(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+//retryAfter formats wait as value of a Retry-After header, in whole seconds
+func retryAfter(wait time.Duration) string {
+	return strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10)
+}
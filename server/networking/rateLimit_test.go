@@ -0,0 +1,188 @@
+package networking
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"subframe/server/settings"
+	"testing"
+	"time"
+)
+
+//useLimits sets the rate limits and bans of configure, with all buckets and strikes cleared, until the test has finished
+func useLimits(t *testing.T, configure func(config *settings.Config)) {
+	t.Helper()
+	previous := settings.Get()
+	config := settings.DefaultConfig()
+	configure(&config)
+	settings.Set(config)
+	reset := func() {
+		limitMutex.Lock()
+		buckets = make(map[string]*bucket)
+		offenders = make(map[string]*offender)
+		lastSweep = time.Time{}
+		limitMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		settings.Set(previous)
+		reset()
+	})
+}
+
+//unsigned returns a verify function for takeToken, which fails the test as unsigned requests must not be verified
+func unsigned(t *testing.T) func() string {
+	return func() string {
+		t.Errorf("unsigned request is verified")
+		return ""
+	}
+}
+
+//signedBy returns a verify function for takeToken, which returns identity and counts its calls
+func signedBy(identity string, calls *int) func() string {
+	return func() string {
+		*calls++
+		return identity
+	}
+}
+
+//taken returns how many of count requests of class from address are accepted
+func taken(class string, address string, count int, signed bool, verify func() string) (accepted int) {
+	for i := 0; i < count; i++ {
+		if takeToken(class, address, signed, verify) == 0 {
+			accepted++
+		}
+	}
+	return accepted
+}
+
+func TestClassBudgets(t *testing.T) {
+	useLimits(t, func(config *settings.Config) {
+		config.RateLimitGet = 600
+		config.RateLimitPut = 12
+		config.RateLimitControl = 0
+	})
+	for _, test := range []struct {
+		class    string
+		accepted int
+	}{
+		//Up to 10 seconds worth of the budget, but at least one request
+		{classGet, 100},
+		{classPut, 2},
+		{classControl, 200},
+	} {
+		if accepted := taken(test.class, "192.0.2.1", 200, false, unsigned(t)); accepted != test.accepted {
+			t.Errorf("%d %s requests accepted at once, expected %d", accepted, test.class, test.accepted)
+		}
+	}
+	//Every address and class has its own bucket
+	if accepted := taken(classPut, "192.0.2.2", 200, false, unsigned(t)); accepted != 2 {
+		t.Errorf("%d put requests from another address accepted, expected 2", accepted)
+	}
+	if wait := takeToken(classPut, "192.0.2.1", false, unsigned(t)); wait <= 0 || wait > 5*time.Second {
+		t.Errorf("put request without tokens has to wait %v, expected up to 5s", wait)
+	}
+}
+
+func TestBucketRefill(t *testing.T) {
+	useLimits(t, func(config *settings.Config) { config.RateLimitGet = 60 })
+	if accepted := taken(classGet, "192.0.2.1", 20, false, unsigned(t)); accepted != 10 {
+		t.Fatalf("%d requests accepted at once, expected 10", accepted)
+	}
+	for _, test := range []struct {
+		elapsed  time.Duration
+		accepted int
+	}{
+		{500 * time.Millisecond, 0},
+		{3 * time.Second, 3},
+		//Buckets are not refilled beyond their capacity
+		{time.Minute, 10},
+	} {
+		limitMutex.Lock()
+		buckets[classGet+"/address/192.0.2.1"].updated = time.Now().Add(-test.elapsed)
+		limitMutex.Unlock()
+		if accepted := taken(classGet, "192.0.2.1", 20, false, unsigned(t)); accepted != test.accepted {
+			t.Errorf("%d requests accepted after %v, expected %d", accepted, test.elapsed, test.accepted)
+		}
+	}
+}
+
+func TestNodeBudgets(t *testing.T) {
+	useLimits(t, func(config *settings.Config) {
+		config.RateLimitGet = 60
+		config.RateLimitNodeFactor = 10
+	})
+	var calls int
+	for _, test := range []struct {
+		name     string
+		address  string
+		identity string
+		accepted int
+		calls    int
+	}{
+		{"known node", "192.0.2.1", "first", 100, 100},
+		//The address is limited to the budget of a single node, and checked before the signature is verified
+		{"another node at the same address", "192.0.2.1", "second", 0, 0},
+		{"another node at another address", "192.0.2.2", "second", 100, 100},
+		{"the same node at another address", "192.0.2.3", "first", 0, 100},
+		//Requests failing verification are limited like unsigned ones
+		{"forged signature", "192.0.2.4", "", 10, 100},
+	} {
+		calls = 0
+		if accepted := taken(classGet, test.address, 200, true, signedBy(test.identity, &calls)); accepted != test.accepted || calls != test.calls {
+			t.Errorf("%d requests signed by %s accepted after %d verifications, expected %d after %d", accepted, test.name, calls, test.accepted, test.calls)
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	useLimits(t, func(config *settings.Config) {
+		config.BanThreshold = 3
+		config.BanDuration = settings.Duration(time.Minute)
+	})
+	request := func(address string) *http.Request {
+		req := httptest.NewRequest("GET", "/storage/get/message", nil)
+		req.RemoteAddr = address + ":1234"
+		return req
+	}
+	for _, test := range []struct {
+		name    string
+		address string
+		strikes int
+		aged    bool
+		banned  bool
+	}{
+		{"below threshold", "192.0.2.1", 2, false, false},
+		{"at threshold", "192.0.2.2", 3, false, true},
+		//Strikes older than BanDuration are forgotten
+		{"after strikes expired", "192.0.2.3", 3, true, false},
+	} {
+		for i := 0; i < test.strikes; i++ {
+			if test.aged && i == test.strikes-1 {
+				limitMutex.Lock()
+				offenders[test.address].firstStrike = time.Now().Add(-2 * time.Minute)
+				limitMutex.Unlock()
+			}
+			strike(request(test.address), "an invalid slug")
+		}
+		if banned := !bannedUntil(test.address).IsZero(); banned != test.banned {
+			t.Errorf("address %s is banned: %t, expected %t", test.name, banned, test.banned)
+		}
+	}
+
+	handler := (&Node{}).limited(storageRequestClass, func(res http.ResponseWriter, req *http.Request) {})
+	res := httptest.NewRecorder()
+	handler(res, request("192.0.2.2"))
+	if res.Code != http.StatusForbidden || res.Header().Get("Retry-After") == "" {
+		t.Errorf("request of banned address returned %d with Retry-After %q", res.Code, res.Header().Get("Retry-After"))
+	}
+
+	//Bans end after BanDuration
+	limitMutex.Lock()
+	offenders["192.0.2.2"].bannedUntil = time.Now().Add(-time.Second)
+	limitMutex.Unlock()
+	res = httptest.NewRecorder()
+	handler(res, request("192.0.2.2"))
+	if res.Code != http.StatusOK {
+		t.Errorf("request after the ban ended returned %d", res.Code)
+	}
+}
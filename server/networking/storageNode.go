@@ -1,58 +1,100 @@
 package networking
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math/rand"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strconv"
 	"strings"
-	"subframe/server/database"
 	"subframe/server/jobqueue"
+	"subframe/server/keyring"
 	"subframe/server/logger"
+	"subframe/server/metrics"
 	"subframe/server/settings"
 	"subframe/server/storage"
+	. "subframe/status"
 	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"subframe/structs/stamp"
+	"time"
 )
 
 var slog = logger.Logger{Prefix: "networking/StorageNode"}
 
+//maxHeaderBytes limits the size of request headers
+const maxHeaderBytes = 64 << 10
+
 var storageNodeActions = []string{
 	"get",
 	"put",
+	"upload",
 	"update",
 	"control",
 }
 
-func startStorageNodeAPIService() {
-	slog.Info("Starting HTTP Server at " + settings.LocalAddress + "...")
-	http.HandleFunc("/storage/", handleRequest)
+func (n *Node) startStorageNodeAPIService() {
+	localAddress := settings.Get().LocalAddress
+	slog.Info(InProgress, "Starting HTTP Server at "+localAddress+"...")
+	//There is no timeout for reading or writing whole requests, as messages may be large and clients slow.
+	//Slow clients are limited by MaxConcurrentUploads instead
+	n.server = &http.Server{
+		Addr:              localAddress,
+		Handler:           n.handler(),
+		ReadHeaderTimeout: time.Duration(settings.Get().HeaderTimeout),
+		IdleTimeout:       time.Duration(settings.Get().IdleTimeout),
+		MaxHeaderBytes:    maxHeaderBytes,
+	}
 	go func() {
-		err := (http.ListenAndServe(settings.LocalAddress, nil))
-		slog.Fatal("Fatal failure in HTTP Storage Interface Server: " + err.Error())
+		err := n.server.ListenAndServe()
+		if err == http.ErrServerClosed {
+			return
+		}
+		slog.Fatal(SNNetworkingServerError, "Fatal failure in HTTP Storage Interface Server: "+err.Error())
 	}()
 }
 
-func handleRequest(responseWriter http.ResponseWriter, req *http.Request) {
-	slog.Info("Handling incoming " + req.Method + " request to " + req.URL.Path + "...")
+//handler routes requests to the StorageNode, CoordinatorNode and control APIs, each with its rate limit
+func (n *Node) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/storage/", n.limited(storageRequestClass, n.handleRequest))
+	mux.HandleFunc("/control/", n.limited(controlRequestClass, n.handleControlRequest))
+	mux.HandleFunc("/coordinator/", n.limited(coordinatorRequestClass, n.handleCoordinatorRequest))
+	mux.HandleFunc("/metrics", n.limited(controlRequestClass, metrics.Handler().ServeHTTP))
+	return mux
+}
+
+func (n *Node) handleRequest(responseWriter http.ResponseWriter, req *http.Request) {
+	slog.Info(InProgress, "Handling incoming "+req.Method+" request to "+logPath(req.URL.Path)+"...")
 	request := storageRequest{
-		res: responseWriter,
-		req: req,
+		Node: n,
+		res:  responseWriter,
+		req:  req,
 	}
 
 	if request.parsePath() != http.StatusOK || !request.isValid() {
-		slog.Info("Action or Slug for " + req.URL.Path + " is invalid")
+		slog.Info(SNNetworkingBadRequest, "Action or Slug for "+logPath(req.URL.Path)+" is invalid")
+		strike(req, "an invalid slug")
 		writeResponse(responseWriter, http.StatusBadRequest, "Invalid Action or Slug")
 		return
 	}
+	if err := request.validateMessageID(); err != nil {
+		slog.Info(SNNetworkingMalformedID, "MessageID in "+logPath(req.URL.Path)+" is malformed: "+err.Error())
+		strike(req, "a malformed MessageID")
+		writeResponse(responseWriter, http.StatusBadRequest, "Invalid MessageID: "+err.Error())
+		return
+	}
 
 	//Handle Request
-	slog.Info("Request appears valid (Action: " + request.action + ", Slug: " + request.slug + "). Processing...")
+	slog.Info(InProgress, "Request appears valid (Action: "+request.action+", Slug: "+keyring.Index(request.slug)+"). Processing...")
 	request.handle()
 }
 
 type storageRequest struct {
+	*Node
 	res    http.ResponseWriter
 	req    *http.Request
 	action string
@@ -69,11 +111,8 @@ func (r *storageRequest) parsePath() (status int) {
 		return http.StatusOK
 	}
 	r.action = parts[1]
-	rexp, err := regexp.Compile("[^A-Za-z0-9]")
-	if err != nil {
-		return http.StatusBadRequest
-	}
-	r.slug = rexp.ReplaceAllString(parts[2], "-")
+	//The slug is used as is. MessageIDs are validated by validateMessageID, and the storage backends derive file names from a digest of them
+	r.slug = parts[2]
 	return http.StatusOK
 }
 
@@ -92,6 +131,15 @@ func (r *storageRequest) isValid() bool {
 	return validAction && validMsgID
 }
 
+//validateMessageID checks that the slug of all actions but control is a well-formed MessageID
+func (r storageRequest) validateMessageID() error {
+	if r.action == "control" {
+		return nil
+	}
+	_, err := messageid.Parse(r.slug)
+	return err
+}
+
 func (r storageRequest) handle() {
 	//Handle request
 	switch r.action {
@@ -99,6 +147,8 @@ func (r storageRequest) handle() {
 		r.handleGet()
 	case "put":
 		r.handlePut()
+	case "upload":
+		r.handleUpload()
 	case "control":
 		r.handleControl()
 	case "update":
@@ -107,118 +157,371 @@ func (r storageRequest) handle() {
 }
 
 func (r storageRequest) handleGet() {
-	slog.Info("Handling MessageGET Request for " + r.slug + "...")
+	slog.Info(InProgress, "Handling MessageGET Request for "+keyring.Index(r.slug)+"...")
 
-	if r.req.Method != "GET" {
-		slog.Error("Client is trying to MessageGET with a " + r.req.Method + " Request.")
+	if r.req.Method != "GET" && r.req.Method != "HEAD" {
+		slog.Error(SNNetworkingBadRequest, "Client is trying to MessageGET with a "+r.req.Method+" Request.")
 		writeResponse(r.res, http.StatusBadRequest, r.req.Method+" is not allowed here.")
 		return
 	}
 
-	message, readingError := storage.Get(r.slug)
+	content, info, readingError := r.storage.Get(r.slug)
 	if readingError != http.StatusOK {
-		slog.Error("Cannot server Message " + r.slug + ": " + strconv.Itoa(readingError))
+		slog.Error(SNNetworkingStorageError, "Cannot serve Message "+keyring.Index(r.slug)+": "+strconv.Itoa(readingError))
 		writeResponse(r.res, readingError, "Error getting message with ID "+r.slug)
 		return
 	}
-	responsedata, encodingError := json.Marshal(message)
-	if encodingError != nil {
-		slog.Error("Error serving Message " + r.slug + ": " + encodingError.Error())
-		writeResponse(r.res, http.StatusInternalServerError, "Error serving message from disk")
-		return
+	defer content.Close()
+
+	//Envelopes are served as raw bytes. ServeContent sets Content-Length and handles Range and conditional requests
+	slog.Info(OK, "Serving Message "+keyring.Index(r.slug)+"...")
+	r.res.Header().Set("Content-Type", "application/octet-stream")
+	if info.ETag != "" {
+		r.res.Header().Set("ETag", info.ETag)
+	}
+	if _, metadata, found := r.messages.GetMessageMetadataStorage(r.slug); found {
+		metadata.WriteHeader(r.res.Header())
+	}
+	if info.SHA256 != "" {
+		r.res.Header().Set(message.HeaderHash, info.SHA256)
 	}
-	slog.Info("Serving Message " + r.slug + "...")
-	writeResponse(r.res, http.StatusOK, string(responsedata))
+	http.ServeContent(r.res, r.req, "", info.ModTime, content)
 }
 
 func (r storageRequest) handlePut() {
-	slog.Info("Handling MessagePUT Request for " + r.slug + "...")
+	slog.Info(InProgress, "Handling MessagePUT Request for "+keyring.Index(r.slug)+"...")
 
 	if r.req.Method != "POST" {
-		slog.Error("Client is trying to MessagePUT with a " + r.req.Method + " Request.")
+		slog.Error(SNNetworkingBadRequest, "Client is trying to MessagePUT with a "+r.req.Method+" Request.")
 		writeResponse(r.res, http.StatusBadRequest, r.req.Method+" is not allowed here.")
 		return
 	}
 
 	messageID := r.slug
-	r.req.Body = http.MaxBytesReader(r.res, r.req.Body, int64(settings.MessageMaxSize)*1024*1024)
-	messageBody, error := ioutil.ReadAll(r.req.Body)
-	if error != nil {
-		if len(messageBody) >= settings.MessageMaxSize*1024*1024 {
-			exceeds := (len(messageBody) / 1024 / 1024) - settings.MessageMaxSize
-			slog.Error("Message size exceeds settings.MessageMaxSize (by " + strconv.Itoa(exceeds) + "M), denying storage request.")
-			writeResponse(r.res, http.StatusRequestEntityTooLarge, "Message too large to be accepted by this node")
-			return
-		}
-		slog.Error("Transmission of message failed: " + error.Error())
-		writeResponse(r.res, http.StatusBadRequest, "Transmission of Message Body failed. Please try again.")
+	metadata, err := message.ParseHeader(r.req.Header)
+	if err != nil {
+		slog.Error(SNNetworkingBadRequest, "Metadata of Message "+keyring.Index(messageID)+" is invalid: "+err.Error())
+		writeResponse(r.res, http.StatusBadRequest, err.Error())
+		return
+	}
+	maxSize := settings.Get().MessageMaxSize
+	if r.req.ContentLength > int64(maxSize) {
+		slog.Error(SNNetworkingMessageTooLarge, "Message size exceeds settings.MessageMaxSize ("+maxSize.String()+"), denying storage request.")
+		strike(r.req, "an oversized message")
+		writeResponse(r.res, http.StatusRequestEntityTooLarge, "Message too large to be accepted by this node")
+		return
+	}
+	if !r.checkStamp(messageID, metadata.Stamp, r.req.ContentLength) {
+		return
+	}
+	if !r.acquireUploadSlot() {
 		return
 	}
+	defer releaseUploadSlot()
+	body := bufio.NewReader(http.MaxBytesReader(r.res, r.req.Body, int64(maxSize)))
 
 	//TODO: Verify that message is somewhat valid
-	if len(messageBody) == 0 {
-		slog.Error("Message Body is empty")
+	if _, err := body.Peek(1); err == io.EOF {
+		slog.Error(SNNetworkingBadRequest, "Message Body is empty")
 		writeResponse(r.res, http.StatusBadRequest, "Empty Message Body")
 		return
 	}
 
-	slog.Info("Message " + messageID + " successfully transmitted. Storing...")
-	message := message.Message{
-		ID:      messageID,
-		Content: string(messageBody),
+	slog.Info(InProgress, "Receiving Message "+keyring.Index(messageID)+"...")
+	info, status := r.storage.Put(messageID, body, r.req.ContentLength, metadata.SHA256)
+	if status == http.StatusOK {
+		metadata = receivedMetadata(metadata, info)
+		if r.messages.LogMessageStorage(messageID, metadata) != OK {
+			//A message missing from the database would never expire, nor be found by the scrubber
+			r.storage.Discard(messageID, info)
+			status = http.StatusInternalServerError
+		}
 	}
 
-	status := storage.Put(message)
-	if status == http.StatusOK {
-		status = database.LogMessageStorage(messageID)
+	switch status {
+	case http.StatusOK:
+	case http.StatusUnprocessableEntity:
+		slog.Error(SNNetworkingBadRequest, "Message "+keyring.Index(messageID)+" does not match its "+message.HeaderHash+".")
+		writeResponse(r.res, status, "Message does not match "+message.HeaderHash)
+		return
+	case http.StatusRequestEntityTooLarge:
+		slog.Error(SNNetworkingMessageTooLarge, "Message size exceeds settings.MessageMaxSize ("+maxSize.String()+"), denying storage request.")
+		strike(r.req, "an oversized message")
+		writeResponse(r.res, status, "Message too large to be accepted by this node")
+		return
+	case http.StatusBadRequest:
+		slog.Error(SNNetworkingBadRequest, "Transmission of message failed.")
+		writeResponse(r.res, status, "Transmission of Message Body failed. Please try again.")
+		return
+	default:
+		slog.Error(SNNetworkingStorageError, "Error storing message: "+strconv.Itoa(status))
+		writeResponse(r.res, status, "Error storing message "+messageID)
+		return
+	}
+
+	if info.ETag != "" {
+		r.res.Header().Set("ETag", info.ETag)
+	}
+	slog.Info(OK, "Successfully stored Message "+keyring.Index(messageID))
+	writeResponse(r.res, http.StatusOK, "Successfully stored message "+messageID)
+
+	r.announceMessage(message.Message{ID: messageID, Metadata: metadata})
+}
+
+//receivedMetadata completes the metadata sent along with a message, once the message has been stored as info
+func receivedMetadata(metadata message.Metadata, info storage.ObjectInfo) message.Metadata {
+	now := time.Now()
+	if metadata.CreatedOn.IsZero() || metadata.CreatedOn.After(now) {
+		metadata.CreatedOn = now.UTC()
 	}
+	metadata.Size = info.Size
+	metadata.SHA256 = info.SHA256
+	metadata.ExpiresOn = storage.Expiry(metadata, now)
+	return metadata
+}
 
+//checkStamp verifies the postage stamp sent for a message of size bytes against the current StampRules,
+//and rejects the request if the stamp is insufficient. The rejection tells the client how many bits are required.
+//Messages pushed by known nodes were checked by the node accepting them from the client, so like announcements they only
+//have to satisfy the rules of an empty node, as of the time of their stamp, as pushes may be queued for longer than stamps last
+func (r storageRequest) checkStamp(messageID string, value string, size int64) bool {
+	rules := r.storage.StampRules()
+	now := time.Now()
+	if r.nodeIdentity(r.req) != "" {
+		rules = storage.CoordinatorStampRules()
+		if s, err := stamp.Parse(value); err == nil {
+			now = s.Timestamp
+		}
+	}
+	if !rules.Enabled() {
+		return true
+	}
+	if size < 0 {
+		slog.Info(SNNetworkingStampRejected, "Size of Message "+keyring.Index(messageID)+" is unknown, rejecting its stamp.")
+		writeResponse(r.res, http.StatusLengthRequired, "Stamps are bound to the size of messages, which has to be sent in advance")
+		return false
+	}
+	err := rules.Check(value, messageID, size, now)
+	metrics.StampChecks.WithLabelValues(stampResult(err)).Inc()
+	if err != nil {
+		slog.Info(SNNetworkingStampRejected, "Rejected stamp for Message "+keyring.Index(messageID)+": "+err.Error())
+		r.res.Header().Set(stamp.RequiredHeader, strconv.Itoa(rules.Required(size)))
+		writeResponse(r.res, http.StatusPaymentRequired, err.Error())
+		return false
+	}
+	return true
+}
+
+//acquireUploadSlot reserves a slot for receiving a message body, and rejects the request if all slots are in use
+func (r storageRequest) acquireUploadSlot() bool {
+	if acquireUploadSlot() {
+		return true
+	}
+	slog.Info(SNNetworkingTooManyUploads, "Rejecting Message "+keyring.Index(r.slug)+", as "+strconv.Itoa(settings.Get().MaxConcurrentUploads)+" messages are being received.")
+	metrics.RateLimitHits.WithLabelValues("uploads").Inc()
+	r.res.Header().Set("Retry-After", "1")
+	writeResponse(r.res, http.StatusServiceUnavailable, "Too many messages are being received, try again later")
+	return false
+}
+
+//stampResult returns the metrics label for the result of a stamp check
+func stampResult(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case stamp.ErrMissing:
+		return "missing"
+	case stamp.ErrInsufficient:
+		return "insufficient"
+	case stamp.ErrExpired:
+		return "expired"
+	case stamp.ErrInvalid:
+		return "invalid"
+	}
+	return "malformed"
+}
+
+//handleUpload handles resumable uploads. Sessions are addressed with the session query parameter:
+//POST starts a session or finishes it, PUT sends a chunk, GET returns the progress and DELETE aborts the upload
+func (r storageRequest) handleUpload() {
+	messageID := r.slug
+	query := r.req.URL.Query()
+	sessionID := query.Get("session")
+	slog.Info(InProgress, "Handling Upload Request for "+keyring.Index(messageID)+"...")
+
+	var upload storage.UploadStatus
+	var status int
+	switch {
+	case r.req.Method == "POST" && sessionID == "":
+		size := int64(-1)
+		if length := r.req.Header.Get("Upload-Length"); length != "" {
+			parsed, err := strconv.ParseInt(length, 10, 64)
+			if err != nil || parsed <= 0 {
+				writeResponse(r.res, http.StatusBadRequest, "Invalid Upload-Length")
+				return
+			}
+			size = parsed
+		}
+		//Uploads reserve space, so they are only started with a stamp. The stamp is checked again when the upload is finished
+		if !r.checkStamp(messageID, r.req.Header.Get(stamp.Header), size) {
+			return
+		}
+		upload, status = r.storage.BeginUpload(messageID, size)
+	case r.req.Method == "PUT" || r.req.Method == "PATCH":
+		number, numberErr := strconv.Atoi(query.Get("chunk"))
+		offset, offsetErr := strconv.ParseInt(query.Get("offset"), 10, 64)
+		hash := r.req.Header.Get("X-Chunk-Hash")
+		if sessionID == "" || numberErr != nil || offsetErr != nil || hash == "" {
+			slog.Error(SNNetworkingBadRequest, "Chunk for Upload of "+keyring.Index(messageID)+" is missing session, chunk, offset or X-Chunk-Hash.")
+			writeResponse(r.res, http.StatusBadRequest, "Chunks require the session, chunk and offset parameters and an X-Chunk-Hash header")
+			return
+		}
+		maxSize := int64(settings.Get().MessageMaxSize)
+		if r.req.ContentLength > maxSize {
+			strike(r.req, "an oversized chunk")
+			writeResponse(r.res, http.StatusRequestEntityTooLarge, "Chunk too large to be accepted by this node")
+			return
+		}
+		if !r.acquireUploadSlot() {
+			return
+		}
+		body := http.MaxBytesReader(r.res, r.req.Body, maxSize)
+		upload, status = r.storage.WriteChunk(messageID, sessionID, number, offset, hash, body, r.req.ContentLength)
+		releaseUploadSlot()
+		if status == http.StatusRequestEntityTooLarge {
+			strike(r.req, "an oversized chunk")
+		}
+	case r.req.Method == "GET" && sessionID != "":
+		upload, status = r.storage.UploadProgress(messageID, sessionID)
+	case r.req.Method == "POST":
+		r.finishUpload(messageID, sessionID)
+		return
+	case r.req.Method == "DELETE" && sessionID != "":
+		status = r.storage.AbortUpload(messageID, sessionID)
+		writeResponse(r.res, status, http.StatusText(status))
+		return
+	default:
+		slog.Error(SNNetworkingBadRequest, "Client is trying to Upload with a "+r.req.Method+" Request.")
+		writeResponse(r.res, http.StatusBadRequest, r.req.Method+" is not allowed here.")
+		return
+	}
+
+	//The progress is returned on rejected chunks as well, so clients know where to resume
+	if upload.Session == "" {
+		writeResponse(r.res, status, http.StatusText(status))
+		return
+	}
+	writeJSONResponse(r.res, status, upload)
+}
+
+func (r storageRequest) finishUpload(messageID string, sessionID string) {
+	metadata, err := message.ParseHeader(r.req.Header)
+	if err != nil {
+		writeResponse(r.res, http.StatusBadRequest, err.Error())
+		return
+	}
+	if metadata.SHA256 == "" {
+		writeResponse(r.res, http.StatusBadRequest, "Finishing an upload requires an X-Content-Hash header")
+		return
+	}
+	progress, status := r.storage.UploadProgress(messageID, sessionID)
+	if status != http.StatusOK {
+		writeResponse(r.res, status, http.StatusText(status))
+		return
+	}
+	if !r.checkStamp(messageID, metadata.Stamp, progress.Offset) {
+		return
+	}
+
+	info, status := r.storage.FinishUpload(messageID, sessionID, metadata.SHA256)
+	if status == http.StatusOK {
+		metadata = receivedMetadata(metadata, info)
+		if r.messages.LogMessageStorage(messageID, metadata) != OK {
+			//A message missing from the database would never expire, nor be found by the scrubber
+			r.storage.Discard(messageID, info)
+			status = http.StatusInternalServerError
+		}
+	}
 	if status != http.StatusOK {
-		slog.Error("Error storing message: " + strconv.Itoa(status))
+		slog.Error(SNNetworkingStorageError, "Error finishing Upload of Message "+keyring.Index(messageID)+": "+strconv.Itoa(status))
 		writeResponse(r.res, status, "Error storing message "+messageID)
 		return
 	}
 
-	slog.Info("Successfully stored Message " + messageID)
+	if info.ETag != "" {
+		r.res.Header().Set("ETag", info.ETag)
+	}
+	slog.Info(OK, "Successfully stored Message "+keyring.Index(messageID))
 	writeResponse(r.res, http.StatusOK, "Successfully stored message "+messageID)
 
+	r.announceMessage(message.Message{ID: messageID, Metadata: metadata})
+}
+
+//announceMessage announces a newly stored message along with its metadata to the CoordinatorNetwork in the background,
+//and pushes it to another StorageNode if the CoordinatorNetwork asks for more copies
+func (n *Node) announceMessage(msg message.Message) {
 	task := func(data interface{}) {
-		log := logger.Logger{Prefix: "networking/Announce-" + messageID}
-		messageID, ok := data.(string)
+		log := logger.Logger{Prefix: "networking/Announce-" + keyring.Index(msg.ID)}
+		msg, ok := data.(message.Message)
 		if !ok {
-			log.Error("Error starting Announcing Thread")
+			log.Error(SNNetworkingJobError, "Error starting Announcing Thread")
 			return
 		}
 
-		log.Info("Getting CoordinatorNodes to announce Message to...")
+		log.Info(InProgress, "Getting CoordinatorNodes to announce Message to...")
 		//Get three random coordinatorNodes
-		coordinatorNodes := database.GetRandomCoordinatorNodes(3)
+		_, coordinatorNodes := n.nodes.GetRandomCoordinatorNodes(3)
 		if len(coordinatorNodes) == 0 {
-			log.Error("Received empty List of CoordinatorNodes.")
+			log.Error(SNNetworkingAnnounceError, "Received empty List of CoordinatorNodes.")
+			metrics.Announces.WithLabelValues("no_coordinators").Inc()
 			return
 		}
-		log.Info("Announcing Message to " + strconv.Itoa(len(coordinatorNodes)) + " CoordinatorNodes...")
+		log.Info(InProgress, "Announcing Message to "+strconv.Itoa(len(coordinatorNodes))+" CoordinatorNodes...")
 		//Announce MessageID to CoordinatorNetwork
 		var redistribute = "true"
 		for _, value := range coordinatorNodes {
-			r := SendNodeRequest(NODE_COORDINATOR, value, "/announce/"+messageID+"/"+settings.RemoteAddress, "")
+			status, r := SendNodeRequest(NODE_COORDINATOR, value.Address, "/announce/"+url.PathEscape(msg.ID)+"/"+url.PathEscape(settings.Get().RemoteAddress)+"?"+msg.Metadata.Query().Encode(), "")
+			if status != OK {
+				metrics.Announces.WithLabelValues("error").Inc()
+				continue
+			}
 			//If at least one node orders to not further distribute the message, do not
-			if r == "false" {
-				redistribute = r
+			if string(r) == "false" {
+				redistribute = string(r)
+				metrics.Announces.WithLabelValues("stop").Inc()
+			} else {
+				metrics.Announces.WithLabelValues("redistribute").Inc()
 			}
 		}
-		log.Info("Announced Message to CoordinatorNetwork. Redistributing: " + redistribute)
+		log.Info(OK, "Announced Message to CoordinatorNetwork. Redistributing: "+redistribute)
 		if redistribute == "true" {
-			//TODO: Push Message to other StorageNodes
+			n.redistributeMessage(log, msg)
 		}
 	}
 	job := jobqueue.Job{
 		Task: task,
-		Data: messageID,
+		Data: msg,
 	}
-	select {
-	case jobqueue.Queue <- job:
+	jobqueue.Enqueue(job)
+}
+
+//redistributeMessage pushes a message to the first of up to 10 random StorageNodes which accepts it.
+//The receiving node announces the message in turn, until the CoordinatorNetwork holds enough copies
+func (n *Node) redistributeMessage(log logger.Logger, msg message.Message) {
+	_, storageNodes := n.nodes.GetStorageNodes(10)
+	rand.Shuffle(len(storageNodes), func(i, j int) { storageNodes[i], storageNodes[j] = storageNodes[j], storageNodes[i] })
+	for _, storageNode := range storageNodes {
+		if storageNode.Address == settings.Get().RemoteAddress {
+			continue
+		}
+		if n.PushMessage(storageNode.Address, msg) == OK {
+			log.Info(OK, "Redistributed Message to "+storageNode.Address+".")
+			metrics.Redistributions.WithLabelValues("ok").Inc()
+			return
+		}
 	}
+	log.Warn(SNNetworkingRedistributeError, "No StorageNode accepted the Message.")
+	metrics.Redistributions.WithLabelValues("failed").Inc()
 }
 
 func (r storageRequest) handleControl() {
@@ -232,62 +535,62 @@ func (r storageRequest) handleControl() {
 }
 
 func (r storageRequest) printStorageNodes() {
-	slog.Info("Exporting 10 StorageNodes...")
-	storageNodes := database.GetStorageNodes(10)
+	slog.Info(InProgress, "Exporting 10 StorageNodes...")
+	_, storageNodes := r.nodes.GetStorageNodes(10)
 	response, err := json.Marshal(storageNodes)
 	if err != nil {
-		slog.Error("Failed to export StorageNodes: " + err.Error())
+		slog.Error(SNNetworkingEncodingError, "Failed to export StorageNodes: "+err.Error())
 		writeResponse(r.res, http.StatusInternalServerError, "Failed to export StorageNodes.")
 		return
 	}
-	slog.Info("Exported StorageNodes.")
+	slog.Info(OK, "Exported StorageNodes.")
 	writeResponse(r.res, http.StatusOK, string(response))
 }
 
 func (r storageRequest) printCoordinatorNodes() {
-	slog.Info("Exporting CoordinatorNodes...")
-	coordinatorNodes := database.GetCoordinatorNodes()
+	slog.Info(InProgress, "Exporting CoordinatorNodes...")
+	_, coordinatorNodes := r.nodes.GetCoordinatorNodes()
 	response, err := json.Marshal(coordinatorNodes)
 	if err != nil {
-		slog.Error("Failed to export CoordinatorNodes: " + err.Error())
+		slog.Error(SNNetworkingEncodingError, "Failed to export CoordinatorNodes: "+err.Error())
 		writeResponse(r.res, http.StatusInternalServerError, "Failed to export CoordinatorNodes.")
 		return
 	}
-	slog.Info("Exported CoordinatorNodes.")
+	slog.Info(OK, "Exported CoordinatorNodes.")
 	writeResponse(r.res, http.StatusOK, string(response))
 }
 
 func (r storageRequest) updateMessageStatus() {
-	slog.Info("Received UPDATE for Message " + r.slug)
+	slog.Info(InProgress, "Received UPDATE for Message "+keyring.Index(r.slug))
 	messageID := r.slug
 
 	job := jobqueue.Job{
 		Task: func(data interface{}) {
 			messageID, ok := data.(string)
 			if ok {
-				log := logger.Logger{Prefix: "networking/Update-" + messageID}
-				status := GetMessageStatus(messageID)
+				log := logger.Logger{Prefix: "networking/Update-" + keyring.Index(messageID)}
+				status := r.GetMessageStatus(messageID)
 				if status > -1 {
-					log.Info("Updating Message Status to " + strconv.Itoa(status))
-					database.UpdateMessageStatusStorage(messageID, status)
+					log.Info(InProgress, "Updating Message Status to "+strconv.Itoa(status))
+					r.messages.UpdateMessageStatusStorage(messageID, status)
 					return
 				}
-				log.Error("Received inconclusive Message Status. Not updating local database.")
+				log.Error(CNNetworkingOutOfSync, "Received inconclusive Message Status. Not updating local database.")
 			} else {
-				slog.Error("Error Starting Update-Thread")
+				slog.Error(SNNetworkingJobError, "Error Starting Update-Thread")
 			}
 		},
 		Data: messageID,
 	}
 
-	select {
-	case jobqueue.Queue <- job:
-	}
+	//The job is enqueued in the background, as the CoordinatorNode sending the update waits for the response from a job itself,
+	//which would block the only worker if both roles are served by this node
+	go jobqueue.Enqueue(job)
 
 	writeResponse(r.res, http.StatusOK, "OK")
 }
 
 func writeResponse(w http.ResponseWriter, status int, response string) {
 	w.WriteHeader(status)
-	fmt.Fprintf(w, response)
+	fmt.Fprint(w, response)
 }
@@ -0,0 +1,54 @@
+package networking
+
+import (
+	"net/http"
+	"strings"
+	"subframe/server/settings"
+	"subframe/server/storage"
+	. "subframe/status"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"subframe/structs/node"
+	"subframe/structs/stamp"
+	"testing"
+	"time"
+)
+
+func TestPushAfterStampExpired(t *testing.T) {
+	enableStamps := func(config *settings.Config) { config.StampBits = 4 }
+	source := startTestNode(t, enableStamps)
+	target := startTestNode(t, enableStamps)
+
+	id, err := messageid.New([]byte("recipient"), "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "content of the message"
+	if _, status := source.storage.Put(id.String(), strings.NewReader(content), int64(len(content)), ""); status != http.StatusOK {
+		t.Fatalf("putting message failed with status %d", status)
+	}
+	if status := source.db.LogMessageStorage(id.String(), message.Metadata{ExpiresOn: time.Now().Add(time.Hour)}); status != OK {
+		t.Fatalf("logging message failed with status %d", status)
+	}
+
+	//The stamp was valid when the message was accepted, but has expired while the push was queued
+	rules := storage.CoordinatorStampRules()
+	minted := stamp.Stamp{Bits: rules.Required(int64(len(content))), Timestamp: time.Now().Add(-2 * settings.Get().StampMaxAge.Std()).UTC().Truncate(time.Second)}
+	for !minted.Valid(id.String(), int64(len(content))) {
+		minted.Nonce++
+	}
+	pushed := message.Message{ID: id.String(), Metadata: message.Metadata{Stamp: minted.String()}}
+
+	if status := source.PushMessage(target.url, pushed); status != SNNetworkingReadingResponseError {
+		t.Errorf("push with an expired stamp by an unknown node returned status %d, expected a rejection", status)
+	}
+	if status := target.db.AddStorageNode(node.Node{Address: source.url, IdentityKey: storage.IdentityPublicKey()}); status != OK {
+		t.Fatalf("adding StorageNode failed with status %d", status)
+	}
+	if status := source.PushMessage(target.url, pushed); status != OK {
+		t.Fatalf("push with an expired stamp by a known node failed with status %d", status)
+	}
+	if _, stored := target.db.CheckMessageStorage(id.String()); !stored {
+		t.Errorf("pushed message is not recorded by the target")
+	}
+}
@@ -0,0 +1,274 @@
+package networking
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strconv"
+	"subframe/server/database"
+	"subframe/server/metrics"
+	"subframe/server/settings"
+	. "subframe/status"
+	"subframe/structs/message"
+	"subframe/structs/messageid"
+	"sync"
+	"time"
+)
+
+//Subscriptions deliver inbox entries to recipients as announcements arrive, instead of recipients polling for them.
+//Like inbox queries they select buckets by a recipient prefix, and resume after the cursor of the last entry received
+
+//subscriptionKeepAlive is the interval of keep-alives sent on idle Server-Sent Event streams and WebSockets
+const subscriptionKeepAlive = 30 * time.Second
+
+//subscriptionWriteTimeout is the time a subscriber has to accept a write before the subscription is ended
+const subscriptionWriteTimeout = 10 * time.Second
+
+//subscriber is woken whenever a message is announced in one of the buckets first to last, and reads new entries from inbox
+type subscriber struct {
+	first   int
+	last    int
+	wake    chan struct{}
+	inbox   database.CoordinatorIndex
+	address string
+}
+
+var subscribers = make(map[*subscriber]bool)
+
+//subscriptionsPerAddress counts the subscribers of each source address
+var subscriptionsPerAddress = make(map[string]int)
+var subscriberMutex sync.Mutex
+
+//subscriptionsClosed is closed on shutdown, ending all subscriptions
+var subscriptionsClosed = make(chan struct{})
+var closeSubscriptionsOnce sync.Once
+
+//upgrader accepts WebSockets from any origin, as subscriptions neither use cookies nor other credentials
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(req *http.Request) bool { return true },
+}
+
+//subscribe registers a subscriber from address for the buckets first to last of inbox. It returns nil and the name of the
+//exceeded setting if settings.MaxSubscriptions, or settings.MaxSubscriptionsPerAddress from address, are active.
+//Subscribers have to be removed with unsubscribe
+func subscribe(inbox database.CoordinatorIndex, address string, first int, last int) (s *subscriber, exceeded string) {
+	config := settings.Get()
+	subscriberMutex.Lock()
+	defer subscriberMutex.Unlock()
+	if len(subscribers) >= config.MaxSubscriptions {
+		return nil, "MaxSubscriptions"
+	}
+	if subscriptionsPerAddress[address] >= config.MaxSubscriptionsPerAddress {
+		return nil, "MaxSubscriptionsPerAddress"
+	}
+	s = &subscriber{first: first, last: last, wake: make(chan struct{}, 1), inbox: inbox, address: address}
+	subscribers[s] = true
+	subscriptionsPerAddress[address]++
+	return s, ""
+}
+
+func unsubscribe(s *subscriber) {
+	subscriberMutex.Lock()
+	delete(subscribers, s)
+	if subscriptionsPerAddress[s.address]--; subscriptionsPerAddress[s.address] <= 0 {
+		delete(subscriptionsPerAddress, s.address)
+	}
+	subscriberMutex.Unlock()
+}
+
+//notifySubscribers wakes all subscribers of the bucket of a newly announced message. Subscribers already woken are not
+//woken again, as they query all new entries at once
+func notifySubscribers(id messageid.ID) {
+	bucket := id.Bucket()
+	subscriberMutex.Lock()
+	defer subscriberMutex.Unlock()
+	for s := range subscribers {
+		if bucket < s.first || bucket > s.last {
+			continue
+		}
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//closeSubscriptions ends all active subscriptions and long-polls, as they would otherwise delay shutdown
+func closeSubscriptions() {
+	closeSubscriptionsOnce.Do(func() { close(subscriptionsClosed) })
+}
+
+//wait returns the entries after cursor as soon as there are any, or no entries after timeout.
+//ended is true if ctx is done or subscriptions have been closed
+func (s *subscriber) wait(ctx context.Context, cursor int64, timeout time.Duration) (status int, entries []message.InboxEntry, ended bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		status, entries = s.inbox.GetInbox(s.first, s.last, cursor, settings.Get().InboxMaxEntries)
+		if status != OK || len(entries) > 0 {
+			return status, entries, false
+		}
+		select {
+		case <-s.wake:
+		case <-timer.C:
+			return OK, nil, false
+		case <-ctx.Done():
+			return OK, nil, true
+		case <-subscriptionsClosed:
+			return OK, nil, true
+		}
+	}
+}
+
+//handleLongPoll answers an inbox query once there are entries after cursor, or with no entries after wait
+func (n *Node) handleLongPoll(w http.ResponseWriter, req *http.Request, first int, last int, cursor int64, wait time.Duration) {
+	s, exceeded := subscribe(n.coordinator, sourceAddress(req), first, last)
+	if s == nil {
+		rejectSubscription(w, req, exceeded)
+		return
+	}
+	defer unsubscribe(s)
+	metrics.Subscriptions.WithLabelValues("longpoll").Inc()
+	defer metrics.Subscriptions.WithLabelValues("longpoll").Dec()
+
+	status, entries, _ := s.wait(req.Context(), cursor, wait)
+	if status != OK {
+		writeResponse(w, http.StatusInternalServerError, "Error reading inbox")
+		return
+	}
+	if entries == nil {
+		entries = []message.InboxEntry{}
+	}
+	writeJSONResponse(w, http.StatusOK, entries)
+}
+
+//handleSubscribe streams the entries after cursor as Server-Sent Events, or as WebSocket messages if the client asks to upgrade the connection
+func (n *Node) handleSubscribe(w http.ResponseWriter, req *http.Request, first int, last int, cursor int64) {
+	s, exceeded := subscribe(n.coordinator, sourceAddress(req), first, last)
+	if s == nil {
+		rejectSubscription(w, req, exceeded)
+		return
+	}
+	defer unsubscribe(s)
+	if websocket.IsWebSocketUpgrade(req) {
+		streamWebSocket(w, req, s, cursor)
+	} else {
+		streamEvents(w, req, s, cursor)
+	}
+}
+
+//streamEvents sends every entry as Server-Sent Event of type "message", with the cursor as event ID. Clients reconnecting
+//with Last-Event-ID resume after it
+func streamEvents(w http.ResponseWriter, req *http.Request, s *subscriber, cursor int64) {
+	metrics.Subscriptions.WithLabelValues("sse").Inc()
+	defer metrics.Subscriptions.WithLabelValues("sse").Dec()
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	controller.SetWriteDeadline(time.Now().Add(subscriptionWriteTimeout))
+	w.WriteHeader(http.StatusOK)
+	for {
+		if controller.Flush() != nil {
+			return
+		}
+		status, entries, ended := s.wait(req.Context(), cursor, subscriptionKeepAlive)
+		if status != OK {
+			cnlog.Error(CNNetworkingSubscriptionError, "Ending subscription of "+sourceAddress(req)+", as its inbox cannot be read.")
+			return
+		}
+		if ended {
+			return
+		}
+		if controller.SetWriteDeadline(time.Now().Add(subscriptionWriteTimeout)) != nil {
+			return
+		}
+		if len(entries) == 0 {
+			fmt.Fprint(w, ": keep-alive\n\n")
+			continue
+		}
+		for _, entry := range entries {
+			data, err := json.Marshal(entry)
+			if err != nil {
+				cnlog.Error(SNNetworkingEncodingError, "Failed to encode inbox entry: "+err.Error())
+				return
+			}
+			fmt.Fprint(w, "id: "+strconv.FormatInt(entry.Cursor, 10)+"\nevent: message\ndata: "+string(data)+"\n\n")
+			cursor = entry.Cursor
+		}
+	}
+}
+
+//streamWebSocket sends every entry as JSON text message. Clients resume by subscribing again with the cursor of the last entry received.
+//Messages sent by the client are discarded, apart from closing the WebSocket
+func streamWebSocket(w http.ResponseWriter, req *http.Request, s *subscriber, cursor int64) {
+	conn, err := upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		//Upgrade already responded with an error
+		cnlog.Info(CNNetworkingBadRequest, "Failed to upgrade subscription of "+sourceAddress(req)+" to WebSocket: "+err.Error())
+		return
+	}
+	defer conn.Close()
+	metrics.Subscriptions.WithLabelValues("websocket").Inc()
+	defer metrics.Subscriptions.WithLabelValues("websocket").Dec()
+
+	//The connection is hijacked, so its end is detected by reading. Clients have to answer pings in time
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn.SetReadLimit(maxHeaderBytes)
+	conn.SetReadDeadline(time.Now().Add(2 * subscriptionKeepAlive))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * subscriptionKeepAlive))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		status, entries, ended := s.wait(ctx, cursor, subscriptionKeepAlive)
+		deadline := time.Now().Add(subscriptionWriteTimeout)
+		if status != OK {
+			cnlog.Error(CNNetworkingSubscriptionError, "Ending subscription of "+sourceAddress(req)+", as its inbox cannot be read.")
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "Error reading inbox"), deadline)
+			return
+		}
+		if ended {
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), deadline)
+			return
+		}
+		if len(entries) == 0 {
+			if conn.WriteControl(websocket.PingMessage, nil, deadline) != nil {
+				return
+			}
+			continue
+		}
+		conn.SetWriteDeadline(deadline)
+		for _, entry := range entries {
+			if conn.WriteJSON(entry) != nil {
+				return
+			}
+			cursor = entry.Cursor
+		}
+	}
+}
+
+//rejectSubscription answers a subscription rejected as the setting named exceeded is reached. Addresses exceeding their own
+//limit are rate limited, while the node is unavailable for all addresses if it holds settings.MaxSubscriptions
+func rejectSubscription(w http.ResponseWriter, req *http.Request, exceeded string) {
+	cnlog.Warn(CNNetworkingTooManySubscriptions, "Rejected subscription of "+sourceAddress(req)+", as settings."+exceeded+" are active.")
+	metrics.RateLimitHits.WithLabelValues("subscriptions").Inc()
+	w.Header().Set("Retry-After", retryAfter(subscriptionKeepAlive))
+	if exceeded == "MaxSubscriptionsPerAddress" {
+		writeResponse(w, http.StatusTooManyRequests, "Too many active subscriptions from this address, try again later")
+		return
+	}
+	writeResponse(w, http.StatusServiceUnavailable, "Too many active subscriptions, try again later")
+}
@@ -0,0 +1,144 @@
+package scrubber
+
+import (
+	"context"
+	"subframe/server/database"
+	"subframe/server/keyring"
+	"subframe/server/lifecycle"
+	"subframe/server/logger"
+	"subframe/server/metrics"
+	"subframe/server/networking"
+	"subframe/server/settings"
+	"subframe/server/storage"
+	. "subframe/status"
+	"time"
+)
+
+var log = logger.Logger{Prefix: "scrubber/Main"}
+
+
+//batchSize is the number of messages fetched from the database at once
+const batchSize = 100
+
+//idleDelay is the time to wait before looking for messages again, if there are none to scrub or scrubbing is disabled
+const idleDelay = time.Minute
+
+//Scrubber re-hashes the messages in a Storage in the background, at the rate set in settings.ScrubRate.
+//Messages not matching their recorded hash are quarantined and fetched again from another StorageNode
+type Scrubber struct {
+	messages database.MessageStore
+	storage  *storage.Storage
+	node     *networking.Node
+	stopped  chan bool
+}
+
+//New returns a Scrubber for the messages in messageStorage, which are kept track of in messages. Lost messages are restored through node
+func New(messages database.MessageStore, messageStorage *storage.Storage, node *networking.Node) *Scrubber {
+	return &Scrubber{messages: messages, storage: messageStorage, node: node, stopped: make(chan bool)}
+}
+
+//Start starts scrubbing in the background
+func (s *Scrubber) Start() {
+	log.Info(OK, "Starting Scrubber...")
+	go s.run()
+}
+
+//Stop waits for the scrubber to notice the shutdown, until ctx is done
+func (s *Scrubber) Stop(ctx context.Context) {
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		log.Warn(ShutdownDeadlineExceeded, "Timed out waiting for Scrubber to stop.")
+	}
+}
+
+func (s *Scrubber) run() {
+	defer close(s.stopped)
+	ctx := lifecycle.Context()
+	for ctx.Err() == nil {
+		config := settings.Get()
+		var ids []string
+		if config.ScrubRate > 0 {
+			_, ids = s.messages.GetMessagesToScrub(time.Now().Add(-config.ScrubInterval.Std()), batchSize)
+		}
+		if len(ids) == 0 {
+			select {
+			case <-time.After(idleDelay):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				return
+			}
+			s.scrub(id, int64(settings.Get().ScrubRate))
+		}
+	}
+}
+
+//scrub verifies a single message and repairs it if necessary
+func (s *Scrubber) scrub(id string, rate int64) {
+	_, expected := s.messages.GetMessageHash(id)
+	sha, status := s.storage.Hash(id, rate)
+	if lifecycle.ShuttingDown() {
+		return
+	}
+
+	switch {
+	case status == OK && expected == "":
+		log.Info(OK, "Recorded Hash of Message "+keyring.Index(id)+", which was stored before hashes were recorded.")
+		metrics.ScrubbedMessages.WithLabelValues("recorded").Inc()
+	case status == OK && sha == expected:
+		metrics.ScrubbedMessages.WithLabelValues("ok").Inc()
+	case expected == "":
+		//Without a recorded hash, a copy from another StorageNode could not be verified
+		log.Error(status, "Cannot read Message "+keyring.Index(id)+" and no Hash has been recorded to restore it.")
+		metrics.ScrubbedMessages.WithLabelValues("unreadable").Inc()
+	default:
+		if status == OK {
+			log.Error(StorageChecksumMismatch, "Message "+keyring.Index(id)+" is corrupted (SHA-256 "+sha+", expected "+expected+").")
+			metrics.ScrubbedMessages.WithLabelValues("corrupted").Inc()
+			if s.storage.Quarantine(id) != OK {
+				break
+			}
+		} else {
+			log.Error(status, "Cannot read Message "+keyring.Index(id)+". Trying to restore it...")
+			metrics.ScrubbedMessages.WithLabelValues("unreadable").Inc()
+			//A copy which is still present, e.g. failing authentication, would keep the restored one from being stored
+			exists, status := s.storage.Exists(id)
+			if status != OK || (exists && s.storage.Quarantine(id) != OK) {
+				break
+			}
+		}
+		if s.refetch(id, expected) {
+			metrics.ScrubbedMessages.WithLabelValues("restored").Inc()
+		} else {
+			metrics.ScrubbedMessages.WithLabelValues("lost").Inc()
+		}
+	}
+	s.messages.LogMessageScrub(id, sha)
+}
+
+//refetch restores a message from the first other StorageNode holding a copy matching sha256
+func (s *Scrubber) refetch(id string, sha256 string) bool {
+	_, storageNodes := s.node.GetMessageLocations(id)
+	own := settings.Get().RemoteAddress
+	for _, address := range storageNodes {
+		if address == own {
+			continue
+		}
+		content, status := networking.FetchMessage(address, id)
+		if status != OK {
+			continue
+		}
+		status = s.storage.Restore(id, content, sha256)
+		content.Close()
+		if status == OK {
+			log.Info(OK, "Restored Message "+keyring.Index(id)+" from "+address+".")
+			return true
+		}
+	}
+	log.Error(StorageChecksumMismatch, "No StorageNode holds an intact copy of Message "+keyring.Index(id)+".")
+	return false
+}
@@ -0,0 +1,109 @@
+package scrubber
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"subframe/server/database"
+	"subframe/server/keyring"
+	"subframe/server/networking"
+	"subframe/server/settings"
+	"subframe/server/storage"
+	. "subframe/status"
+	"subframe/structs/message"
+	"subframe/structs/node"
+	"testing"
+	"time"
+)
+
+//enableEncryption enables encryption at rest with a new key until the test has finished
+func enableEncryption(t *testing.T) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(keyFile, []byte(keyring.GenerateKey()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := keyring.Init(settings.Config{EncryptionKeyFile: keyFile}); status != OK {
+		t.Fatalf("enabling encryption failed with status %d", status)
+	}
+	t.Cleanup(func() { keyring.Init(settings.Config{}) })
+}
+
+//peer serves an intact copy of a message as another StorageNode, and as the CoordinatorNode listing it as the location of the message
+func peer(t *testing.T, id string, content string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/coordinator/get/" + id:
+			json.NewEncoder(w).Encode([]string{server.URL})
+		case "/storage/get/" + id:
+			w.Write([]byte(content))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestScrubCorruptedEncryptedCopy(t *testing.T) {
+	enableEncryption(t)
+	previous := settings.Get()
+	t.Cleanup(func() { settings.Set(previous) })
+	config := settings.DefaultConfig()
+	config.DataPath = t.TempDir()
+	settings.Set(config)
+
+	db := database.NewMemory()
+	backend, err := storage.NewBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageStorage := storage.New(db, db, backend)
+	id, content := "message", "content of the message"
+	hash := sha256.Sum256([]byte(content))
+	sha := hex.EncodeToString(hash[:])
+	if _, status := messageStorage.Put(id, strings.NewReader(content), int64(len(content)), sha); status != http.StatusOK {
+		t.Fatalf("putting message failed with status %d", status)
+	}
+	if status := db.LogMessageStorage(id, message.Metadata{SHA256: sha, ExpiresOn: time.Now().Add(time.Hour)}); status != OK {
+		t.Fatalf("logging message failed with status %d", status)
+	}
+
+	//Flipping a byte of the sealed file makes it fail authentication, so it cannot be read, but is still present
+	var sealed string
+	filepath.Walk(filepath.Join(config.DataPath, "messages"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			sealed = path
+		}
+		return err
+	})
+	raw, err := ioutil.ReadFile(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	if err = ioutil.WriteFile(sealed, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := db.AddCoordinatorNode(node.Node{Address: peer(t, id, content).URL}); status != OK {
+		t.Fatalf("adding CoordinatorNode failed with status %d", status)
+	}
+	s := New(db, messageStorage, networking.New(db, db, db, nil, messageStorage))
+	s.scrub(id, 0)
+
+	if restored, status := messageStorage.Hash(id, 0); status != OK || restored != sha {
+		t.Errorf("message has hash %q after scrubbing with status %d, expected the restored copy", restored, status)
+	}
+	quarantined, _ := ioutil.ReadDir(filepath.Join(config.DataPath, "quarantine"))
+	if len(quarantined) != 1 {
+		t.Errorf("%d files are quarantined, expected the corrupted copy", len(quarantined))
+	}
+}
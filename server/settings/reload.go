@@ -0,0 +1,77 @@
+package settings
+
+import (
+	"reflect"
+	"subframe/server/logger"
+	. "subframe/status"
+	"sync"
+)
+
+//ChangeHandler is notified with the previous and the new live settings after a reload
+type ChangeHandler func(previous Config, next Config)
+
+var changeHandlers []ChangeHandler
+var pendingRestart []string
+var reloadMutex sync.Mutex
+
+//OnChange registers a ChangeHandler to be notified whenever the live settings change
+func OnChange(handler ChangeHandler) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	changeHandlers = append(changeHandlers, handler)
+}
+
+//PendingRestart returns the names of changed settings which only take effect after a restart
+func PendingRestart() []string {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	return append([]string(nil), pendingRestart...)
+}
+
+//Reload rereads and validates the settings and swaps the live settings, keeping those which require a restart.
+//It returns the names of the applied settings; invalid settings are rejected as a whole
+func Reload() (applied []string, pending []string, err error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	log.Info(InProgress, "Reloading Settings...")
+	next, persisted, _, _, warnings, err := load(commandLineArgs)
+	for _, warning := range warnings {
+		log.Warn(SettingsReadError, warning)
+	}
+	if err != nil {
+		log.Error(SettingsValidationError, "Keeping current settings: "+err.Error())
+		return nil, pendingRestart, err
+	}
+
+	previous := Get()
+	live := next
+	pendingRestart = nil
+	configType := reflect.TypeOf(next)
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		previousValue := reflect.ValueOf(previous).Field(i).Interface()
+		nextValue := reflect.ValueOf(next).Field(i).Interface()
+		if reflect.DeepEqual(previousValue, nextValue) {
+			continue
+		}
+		if field.Tag.Get("reload") == "restart" {
+			reflect.ValueOf(&live).Elem().Field(i).Set(reflect.ValueOf(previousValue))
+			pendingRestart = append(pendingRestart, field.Name)
+			log.Warn(SettingsPendingRestart, field.Name+" changed, restart to apply.")
+			continue
+		}
+		applied = append(applied, field.Name)
+		log.Info(OK, field.Name+" changed to "+formatField(reflect.ValueOf(nextValue))+".")
+	}
+
+	current.Store(&live)
+	loaded.Store(&next)
+	stored.Store(&persisted)
+	logger.ColorizedLogs = live.ColorizedLogs
+	for _, handler := range changeHandlers {
+		handler(previous, live)
+	}
+	log.Info(OK, "Reloaded Settings.")
+	return applied, append([]string(nil), pendingRestart...), nil
+}
@@ -2,140 +2,465 @@ package settings
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
-	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
 	"subframe/server/logger"
 	. "subframe/status"
+	"subframe/structs/messageid"
+	"sync/atomic"
 )
 
 var log = logger.Logger{Prefix: "settings/Main"}
 
-//BootstrapNode is used for Bootstrapping the local instance
-var BootstrapNode = ""
+//Command line arguments stay the same for the lifetime of the process and are reapplied on every reload
+var commandLineArgs = os.Args[1:]
 
-//DataPath is used to store message and database files
-var DataPath = "./data"
+//Version is the SuBFraMe Server version, set at build time with -ldflags "-X subframe/server/settings.Version=..."
+var Version = "dev"
 
-//RemoteAddress is used to access the local instance remotely
-var RemoteAddress = "localhost:9123"
+//Config holds all settings of the local instance.
+//Settings are read from defaults, settings.json, SUBFRAME_* environment variables and command line arguments, in order of precedence.
+//Settings tagged with reload:"restart" are not changed by Reload, but only take effect after a restart
+type Config struct {
+	//BootstrapNode is used for Bootstrapping the local instance
+	BootstrapNode string `flag:"bootstrap-node" env:"SUBFRAME_BOOTSTRAP_NODE" reload:"restart" usage:"If set, SuBFraMe will reinitialize the local Node Database and sync it with the BootstrapNode"`
 
-//LocalAddress is the IP and Port the StorageNode instance listens on
-var LocalAddress = "0.0.0.0:9123"
+	//DataPath is used to store message and database files. It is only informational in settings.json, which resides in DataPath itself
+	DataPath string `flag:"data-dir" env:"SUBFRAME_DATA_PATH" reload:"restart" usage:"The SuBFraMe data directory, messages, databases and settings will be stored here"`
 
-//DiskSpace is the maximum space used for message storage
-var DiskSpace = 5000
+	//NetworkID identifies the SuBFraMe network this node is part of
+	NetworkID string `flag:"network-id" env:"SUBFRAME_NETWORK_ID" reload:"restart" usage:"The ID of the SuBFraMe network this node is part of"`
 
-//MaxWorkers is the maximum number of workers to spawn
-var MaxWorkers = 10
+	//RemoteAddress is used to access the local instance remotely
+	RemoteAddress string `flag:"remote-address" env:"SUBFRAME_REMOTE_ADDRESS" usage:"The remote address of this SuBFraMe Instance"`
 
-//QueueMaxLength is the maximum length of a queue before a new worker is spawned, if the current worker count does not exceed MaxWorkers
-var QueueMaxLength = 10
+	//LocalAddress is the IP and Port the StorageNode instance listens on
+	LocalAddress string `flag:"local-address" env:"SUBFRAME_LOCAL_ADDRESS" reload:"restart" usage:"The IP and Port the Node Interface will listen on"`
 
-//MessageMaxSize defines the maximum size of an individual message file
-var MessageMaxSize = 100
+	//ControlToken authorizes reloading the settings, querying the quota and creating snapshots through the control API. It is never written to settings.json
+	ControlToken string `json:"-" flag:"control-token" env:"SUBFRAME_CONTROL_TOKEN" usage:"The bearer token required to reload settings, query the quota and create snapshots through the control API, preferably set via SUBFRAME_CONTROL_TOKEN. Empty disables these actions"`
 
-//MessageMinCheckDelay defines the minimum time in hours between individual checks of the message status
-var MessageMinCheckDelay = 12
+	//StorageBackend defines where message files are stored
+	StorageBackend string `flag:"storage-backend" env:"SUBFRAME_STORAGE_BACKEND" reload:"restart" usage:"Where messages are stored: \"fs\" (DataPath/messages), \"s3\" (S3-compatible object storage) or \"memory\" (lost on exit)"`
 
-//MessageMaxStoreTime defines the maximum time a message is stored locally, in days
-var MessageMaxStoreTime = 7
+	//S3Endpoint is the URL of the object storage used by the s3 StorageBackend
+	S3Endpoint string `flag:"s3-endpoint" env:"SUBFRAME_S3_ENDPOINT" reload:"restart" usage:"The URL of the S3-compatible object storage, e.g. https://s3.eu-central-1.amazonaws.com"`
 
-//ColorizedOutput defines whether realtime logs should be colorized
-var ColorizedLogs = false
+	//S3Region is the region used to sign requests to the object storage
+	S3Region string `flag:"s3-region" env:"SUBFRAME_S3_REGION" reload:"restart" usage:"The region of the S3 bucket"`
 
-//Read reads settings from local storage and overwrites them with command-line-arguments
+	//S3Bucket is the bucket messages are stored in
+	S3Bucket string `flag:"s3-bucket" env:"SUBFRAME_S3_BUCKET" reload:"restart" usage:"The S3 bucket messages are stored in"`
+
+	//S3Prefix is prepended to the key of every message, so a bucket can be shared
+	S3Prefix string `flag:"s3-prefix" env:"SUBFRAME_S3_PREFIX" reload:"restart" usage:"The prefix of message keys in the S3 bucket, e.g. messages/"`
+
+	//S3AccessKey is the access key ID used to sign requests to the object storage
+	S3AccessKey string `flag:"s3-access-key" env:"SUBFRAME_S3_ACCESS_KEY" reload:"restart" usage:"The S3 access key ID"`
+
+	//S3SecretKey is the secret access key. It is never written to settings.json, and should be passed as environment variable
+	S3SecretKey string `json:"-" flag:"s3-secret-key" env:"SUBFRAME_S3_SECRET_KEY" reload:"restart" usage:"The S3 secret access key, preferably set via SUBFRAME_S3_SECRET_KEY"`
+
+	//EncryptionKeyFile holds the master keys used to encrypt message files and sensitive database columns, one base64 encoded key per line.
+	//The first key is active, the following ones are only used to read data until it has been rekeyed
+	EncryptionKeyFile string `flag:"encryption-key-file" env:"SUBFRAME_ENCRYPTION_KEY_FILE" reload:"restart" usage:"The file holding the encryption keys, one per line, the first being active. Empty disables encryption at rest, unless a passphrase is set"`
+
+	//EncryptionPassphrase is used to derive the master key instead of EncryptionKeyFile. It is never written to settings.json
+	EncryptionPassphrase string `json:"-" flag:"encryption-passphrase" env:"SUBFRAME_ENCRYPTION_PASSPHRASE" reload:"restart" usage:"The passphrase the encryption key is derived from, preferably set via SUBFRAME_ENCRYPTION_PASSPHRASE"`
+
+	//EncryptionPreviousPassphrase is only used to read data until it has been rekeyed after changing EncryptionPassphrase
+	EncryptionPreviousPassphrase string `json:"-" flag:"encryption-previous-passphrase" env:"SUBFRAME_ENCRYPTION_PREVIOUS_PASSPHRASE" reload:"restart" usage:"The passphrase previously used, while rekeying after changing the passphrase"`
+
+	//DiskSpace is the maximum space used for message storage
+	DiskSpace ByteSize `flag:"disk-space" env:"SUBFRAME_DISK_SPACE" unit:"MB" usage:"The maximum space SuBFraMe will use to store Messages, e.g. 5GB"`
+
+	//MaxWorkers is the maximum number of workers to spawn
+	MaxWorkers int `flag:"max-workers" env:"SUBFRAME_MAX_WORKERS" usage:"The maximum number of worker threads"`
+
+	//QueueMaxLength is the maximum length of a queue before a new worker is spawned, if the current worker count does not exceed MaxWorkers
+	QueueMaxLength int `flag:"max-queue-length" env:"SUBFRAME_MAX_QUEUE_LENGTH" usage:"The maximum size a queue can have before a new worker is spawned, before exceeding max-workers"`
+
+	//MessageMaxSize defines the maximum size of an individual message file
+	MessageMaxSize ByteSize `flag:"message-max-size" env:"SUBFRAME_MESSAGE_MAX_SIZE" unit:"MB" usage:"The maximum size of an individual message file, e.g. 100MB"`
+
+	//MessageMinCheckDelay defines the minimum time between individual checks of the message status
+	MessageMinCheckDelay Duration `flag:"message-min-check-delay" env:"SUBFRAME_MESSAGE_MIN_CHECK_DELAY" unit:"h" usage:"The minimum time between individual checks of the same message against the coordinator network, e.g. 12h"`
+
+	//MessageMinStoreTime defines the minimum time a message is stored locally, even if its sender requested a shorter TTL
+	MessageMinStoreTime Duration `flag:"message-min-store-time" env:"SUBFRAME_MESSAGE_MIN_STORE_TIME" unit:"h" usage:"The minimum time a message is stored locally, even if its sender requested a shorter TTL, e.g. 1h"`
+
+	//MessageMaxStoreTime defines the maximum time a message is stored locally, and the TTL of messages without one
+	MessageMaxStoreTime Duration `flag:"message-max-store-time" env:"SUBFRAME_MESSAGE_MAX_STORE_TIME" unit:"d" usage:"The maximum time a message is stored locally, e.g. 7d"`
+
+	//UploadSessionTimeout defines how long a resumable upload is kept without receiving a chunk
+	UploadSessionTimeout Duration `flag:"upload-session-timeout" env:"SUBFRAME_UPLOAD_SESSION_TIMEOUT" unit:"h" usage:"The time after which an inactive resumable upload is discarded, e.g. 24h"`
+
+	//StampBits is the number of zero bits required of postage stamps for messages up to StampSizeStep. 0 disables stamps
+	StampBits int `flag:"stamp-bits" env:"SUBFRAME_STAMP_BITS" usage:"The proof of work required to store messages up to stamp-size-step, in bits. Every bit doubles the work. 0 accepts messages without stamps"`
+
+	//StampSizeStep is the message size up to which StampBits suffice. Every doubling of the size beyond requires another bit
+	StampSizeStep ByteSize `flag:"stamp-size-step" env:"SUBFRAME_STAMP_SIZE_STEP" unit:"MB" usage:"The message size up to which stamp-bits suffice, every doubling beyond requires another bit, e.g. 1MB"`
+
+	//StampLoadBits is the number of bits required in addition once DiskSpace is used up, increasing linearly with the usage
+	StampLoadBits int `flag:"stamp-load-bits" env:"SUBFRAME_STAMP_LOAD_BITS" usage:"The additional bits required as the node fills up, reached when disk-space is used up"`
+
+	//StampMaxAge defines how long after being minted stamps are accepted
+	StampMaxAge Duration `flag:"stamp-max-age" env:"SUBFRAME_STAMP_MAX_AGE" unit:"m" usage:"The time after minting stamps are accepted, e.g. 1h"`
+
+	//RateLimitGet is the number of message and status requests per minute accepted from a single source address. 0 disables the limit
+	RateLimitGet int `flag:"rate-limit-get" env:"SUBFRAME_RATE_LIMIT_GET" usage:"The number of message and status requests per minute accepted from a single address, 0 for unlimited"`
+
+	//RateLimitPut is the number of requests storing messages or announcing them per minute accepted from a single source address. 0 disables the limit
+	RateLimitPut int `flag:"rate-limit-put" env:"SUBFRAME_RATE_LIMIT_PUT" usage:"The number of requests storing or announcing messages per minute accepted from a single address, 0 for unlimited"`
+
+	//RateLimitControl is the number of control requests per minute accepted from a single source address. 0 disables the limit
+	RateLimitControl int `flag:"rate-limit-control" env:"SUBFRAME_RATE_LIMIT_CONTROL" usage:"The number of control and metrics requests per minute accepted from a single address, 0 for unlimited"`
+
+	//RateLimitNodeFactor multiplies the rate limits for requests signed by other nodes, which are limited per node identity
+	RateLimitNodeFactor int `flag:"rate-limit-node-factor" env:"SUBFRAME_RATE_LIMIT_NODE_FACTOR" usage:"The factor the rate limits are multiplied with for requests signed by other nodes"`
+
+	//MaxConcurrentUploads is the number of message bodies and upload chunks received at the same time
+	MaxConcurrentUploads int `flag:"max-concurrent-uploads" env:"SUBFRAME_MAX_CONCURRENT_UPLOADS" usage:"The number of messages and upload chunks received at the same time"`
+
+	//BanThreshold is the number of invalid requests, like invalid slugs or oversized bodies, after which a source address is banned. 0 disables bans
+	BanThreshold int `flag:"ban-threshold" env:"SUBFRAME_BAN_THRESHOLD" usage:"The number of invalid requests within ban-duration after which an address is banned, 0 to never ban"`
+
+	//BanDuration defines how long source addresses are banned, and how long invalid requests count towards BanThreshold
+	BanDuration Duration `flag:"ban-duration" env:"SUBFRAME_BAN_DURATION" unit:"m" usage:"The time an address is banned for, e.g. 15m"`
+
+	//HeaderTimeout is the time clients have to send the headers of a request
+	HeaderTimeout Duration `flag:"header-timeout" env:"SUBFRAME_HEADER_TIMEOUT" unit:"s" reload:"restart" usage:"The time clients have to send request headers, e.g. 10s"`
+
+	//IdleTimeout is the time idle keep-alive connections are kept open
+	IdleTimeout Duration `flag:"idle-timeout" env:"SUBFRAME_IDLE_TIMEOUT" unit:"s" reload:"restart" usage:"The time idle connections are kept open, e.g. 2m"`
+
+	//InboxMaxPrefixBits is the longest recipient prefix accepted by inbox queries. Shorter prefixes select more recipients, hiding the one querying among them
+	InboxMaxPrefixBits int `flag:"inbox-max-prefix-bits" env:"SUBFRAME_INBOX_MAX_PREFIX_BITS" usage:"The longest recipient prefix accepted by inbox queries, in bits, up to 16"`
+
+	//InboxMaxEntries is the maximum number of messages returned by a single inbox query
+	InboxMaxEntries int `flag:"inbox-max-entries" env:"SUBFRAME_INBOX_MAX_ENTRIES" usage:"The maximum number of messages returned by an inbox query"`
+
+	//InboxMaxWait is the longest time a long-polling inbox query is held open until new messages arrive
+	InboxMaxWait Duration `flag:"inbox-max-wait" env:"SUBFRAME_INBOX_MAX_WAIT" unit:"s" usage:"The longest time long-polling inbox queries wait for new messages, e.g. 1m. 0 disables long-polling"`
+
+	//MaxSubscriptions is the number of inbox subscriptions and long-polling inbox queries held open at the same time
+	MaxSubscriptions int `flag:"max-subscriptions" env:"SUBFRAME_MAX_SUBSCRIPTIONS" usage:"The number of inbox subscriptions and long-polls held open at the same time"`
+
+	//MaxSubscriptionsPerAddress is the number of inbox subscriptions and long-polling inbox queries held open for a single source address
+	MaxSubscriptionsPerAddress int `flag:"max-subscriptions-per-address" env:"SUBFRAME_MAX_SUBSCRIPTIONS_PER_ADDRESS" usage:"The number of inbox subscriptions and long-polls held open for a single address"`
+
+	//ScrubRate limits how many bytes of stored messages are re-hashed per second to detect corruption. 0 disables scrubbing
+	ScrubRate ByteSize `flag:"scrub-rate" env:"SUBFRAME_SCRUB_RATE" unit:"MB" usage:"The amount of stored messages re-hashed per second to detect corruption, e.g. 1MB. 0 disables scrubbing"`
+
+	//ScrubInterval defines the minimum time between scrubs of the same message
+	ScrubInterval Duration `flag:"scrub-interval" env:"SUBFRAME_SCRUB_INTERVAL" unit:"h" usage:"The minimum time between scrubs of the same message, e.g. 24h"`
+
+	//ShutdownTimeout defines the maximum time to wait for active requests and jobs on shutdown
+	ShutdownTimeout Duration `flag:"shutdown-timeout" env:"SUBFRAME_SHUTDOWN_TIMEOUT" unit:"s" reload:"restart" usage:"The maximum time to wait for active requests and jobs on shutdown, e.g. 30s"`
+
+	//ColorizedLogs defines whether realtime logs should be colorized
+	ColorizedLogs bool `flag:"colorized-output" env:"SUBFRAME_COLORIZED_LOGS" usage:"Turns on or off colorized realtime logs"`
+
+	//LogSinks defines where logs are written to, and the minimum level of logs each sink receives
+	LogSinks []logger.SinkConfig `flag:"log-sinks" env:"SUBFRAME_LOG_SINKS" usage:"The log sinks as JSON array, e.g. [{\"Type\":\"stdout\",\"Level\":\"INFO\"}]"`
+}
+
+//DefaultConfig returns the settings used if neither settings.json, environment variables nor command line arguments set them
+func DefaultConfig() Config {
+	return Config{
+		BootstrapNode:              "",
+		DataPath:                   "./data",
+		NetworkID:                  "subframe",
+		RemoteAddress:              "localhost:9123",
+		LocalAddress:               "0.0.0.0:9123",
+		StorageBackend:             "fs",
+		S3Region:                   "us-east-1",
+		DiskSpace:                  5000 * Megabyte,
+		MaxWorkers:                 10,
+		QueueMaxLength:             10,
+		MessageMaxSize:             100 * Megabyte,
+		MessageMinCheckDelay:       12 * Hour,
+		MessageMinStoreTime:        1 * Hour,
+		MessageMaxStoreTime:        7 * Day,
+		UploadSessionTimeout:       24 * Hour,
+		StampBits:                  20,
+		StampSizeStep:              1 * Megabyte,
+		StampLoadBits:              4,
+		StampMaxAge:                1 * Hour,
+		RateLimitGet:               600,
+		RateLimitPut:               60,
+		RateLimitControl:           60,
+		RateLimitNodeFactor:        10,
+		MaxConcurrentUploads:       32,
+		BanThreshold:               20,
+		BanDuration:                15 * Minute,
+		HeaderTimeout:              10 * Second,
+		IdleTimeout:                2 * Minute,
+		InboxMaxPrefixBits:         12,
+		InboxMaxEntries:            1000,
+		InboxMaxWait:               1 * Minute,
+		MaxSubscriptions:           1000,
+		MaxSubscriptionsPerAddress: 10,
+		ScrubRate:                  1 * Megabyte,
+		ScrubInterval:              24 * Hour,
+		ShutdownTimeout:            30 * Second,
+		ColorizedLogs:              false,
+		LogSinks:                   logger.DefaultSinks(),
+	}
+}
+
+//current holds the live settings, loaded holds the settings as last read, including those pending until restart.
+//stored holds the settings as last read from defaults and settings.json, without environment variables and command line arguments
+var current atomic.Pointer[Config]
+var loaded atomic.Pointer[Config]
+var stored atomic.Pointer[Config]
+
+//positionalArgs holds the command line arguments following the flags, e.g. a command like "snapshot"
+var positionalArgs []string
+
+func init() {
+	defaults := DefaultConfig()
+	current.Store(&defaults)
+	loaded.Store(&defaults)
+	stored.Store(&defaults)
+}
+
+//Get returns the current settings
+func Get() Config {
+	return *current.Load()
+}
+
+//Set replaces the current settings without reading them, e.g. in tests
+func Set(config Config) {
+	current.Store(&config)
+	loaded.Store(&config)
+	stored.Store(&config)
+}
+
+//Validate checks all settings for sensible values and returns a description of every invalid one
+func (c Config) Validate() error {
+	var problems []string
+	invalid := func(name string, problem string) {
+		problems = append(problems, name+": "+problem)
+	}
+
+	if c.DataPath == "" {
+		invalid("DataPath", "must not be empty")
+	}
+	if c.NetworkID == "" {
+		invalid("NetworkID", "must not be empty")
+	}
+	if c.RemoteAddress == "" {
+		invalid("RemoteAddress", "must not be empty")
+	}
+	if _, _, err := net.SplitHostPort(c.LocalAddress); err != nil {
+		invalid("LocalAddress", "must be of the form \"ip:port\" (got \""+c.LocalAddress+"\")")
+	}
+	switch c.StorageBackend {
+	case "fs", "memory":
+	case "s3":
+		if endpoint, err := url.Parse(c.S3Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			invalid("S3Endpoint", "must be an http or https URL (got \""+c.S3Endpoint+"\")")
+		}
+		if c.S3Bucket == "" {
+			invalid("S3Bucket", "must not be empty")
+		}
+		if c.S3Region == "" {
+			invalid("S3Region", "must not be empty")
+		}
+		if c.S3AccessKey == "" || c.S3SecretKey == "" {
+			invalid("S3AccessKey", "S3AccessKey and S3SecretKey must be set")
+		}
+	default:
+		invalid("StorageBackend", "must be one of fs, s3 or memory (got \""+c.StorageBackend+"\")")
+	}
+	if c.EncryptionKeyFile != "" && c.EncryptionPassphrase != "" {
+		invalid("EncryptionPassphrase", "must not be set together with EncryptionKeyFile")
+	}
+	if c.EncryptionPreviousPassphrase != "" && c.EncryptionPassphrase == "" {
+		invalid("EncryptionPreviousPassphrase", "requires EncryptionPassphrase")
+	}
+	if c.DiskSpace <= 0 {
+		invalid("DiskSpace", "must be greater than 0")
+	}
+	if c.MessageMaxSize <= 0 {
+		invalid("MessageMaxSize", "must be greater than 0")
+	} else if c.DiskSpace > 0 && c.MessageMaxSize > c.DiskSpace {
+		invalid("MessageMaxSize", "must not exceed DiskSpace ("+c.DiskSpace.String()+", got "+c.MessageMaxSize.String()+")")
+	}
+	if c.MaxWorkers < 1 {
+		invalid("MaxWorkers", "must be at least 1 (got "+strconv.Itoa(c.MaxWorkers)+")")
+	}
+	if c.QueueMaxLength < 1 {
+		invalid("QueueMaxLength", "must be at least 1 (got "+strconv.Itoa(c.QueueMaxLength)+")")
+	}
+	if c.MessageMinCheckDelay <= 0 {
+		invalid("MessageMinCheckDelay", "must be greater than 0")
+	}
+	if c.MessageMaxStoreTime < Second {
+		invalid("MessageMaxStoreTime", "must be at least 1s")
+	}
+	if c.MessageMinStoreTime < 0 || c.MessageMinStoreTime > c.MessageMaxStoreTime {
+		invalid("MessageMinStoreTime", "must be between 0 and MessageMaxStoreTime ("+c.MessageMaxStoreTime.String()+", got "+c.MessageMinStoreTime.String()+")")
+	}
+	if c.UploadSessionTimeout <= 0 {
+		invalid("UploadSessionTimeout", "must be greater than 0")
+	}
+	if c.StampBits < 0 || c.StampBits > 64 {
+		invalid("StampBits", "must be between 0 and 64 (got "+strconv.Itoa(c.StampBits)+")")
+	}
+	if c.StampSizeStep <= 0 {
+		invalid("StampSizeStep", "must be greater than 0")
+	}
+	if c.StampLoadBits < 0 || c.StampBits+c.StampLoadBits > 64 {
+		invalid("StampLoadBits", "must be between 0 and 64 minus StampBits (got "+strconv.Itoa(c.StampLoadBits)+")")
+	}
+	if c.StampMaxAge < Minute {
+		invalid("StampMaxAge", "must be at least 1m")
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{{"RateLimitGet", c.RateLimitGet}, {"RateLimitPut", c.RateLimitPut}, {"RateLimitControl", c.RateLimitControl}, {"BanThreshold", c.BanThreshold}} {
+		if limit.value < 0 {
+			invalid(limit.name, "must not be negative (got "+strconv.Itoa(limit.value)+")")
+		}
+	}
+	if c.RateLimitNodeFactor < 1 {
+		invalid("RateLimitNodeFactor", "must be at least 1 (got "+strconv.Itoa(c.RateLimitNodeFactor)+")")
+	}
+	if c.MaxConcurrentUploads < 1 {
+		invalid("MaxConcurrentUploads", "must be at least 1 (got "+strconv.Itoa(c.MaxConcurrentUploads)+")")
+	}
+	if c.BanDuration <= 0 {
+		invalid("BanDuration", "must be greater than 0")
+	}
+	if c.HeaderTimeout <= 0 {
+		invalid("HeaderTimeout", "must be greater than 0")
+	}
+	if c.IdleTimeout <= 0 {
+		invalid("IdleTimeout", "must be greater than 0")
+	}
+	if c.InboxMaxPrefixBits < 0 || c.InboxMaxPrefixBits > messageid.BucketBits {
+		invalid("InboxMaxPrefixBits", "must be between 0 and "+strconv.Itoa(messageid.BucketBits)+" (got "+strconv.Itoa(c.InboxMaxPrefixBits)+")")
+	}
+	if c.InboxMaxEntries < 1 {
+		invalid("InboxMaxEntries", "must be at least 1 (got "+strconv.Itoa(c.InboxMaxEntries)+")")
+	}
+	if c.InboxMaxWait < 0 {
+		invalid("InboxMaxWait", "must not be negative")
+	}
+	if c.MaxSubscriptions < 1 {
+		invalid("MaxSubscriptions", "must be at least 1 (got "+strconv.Itoa(c.MaxSubscriptions)+")")
+	}
+	if c.MaxSubscriptionsPerAddress < 1 {
+		invalid("MaxSubscriptionsPerAddress", "must be at least 1 (got "+strconv.Itoa(c.MaxSubscriptionsPerAddress)+")")
+	}
+	if c.ScrubInterval <= 0 {
+		invalid("ScrubInterval", "must be greater than 0")
+	}
+	if c.ShutdownTimeout <= 0 {
+		invalid("ShutdownTimeout", "must be greater than 0")
+	}
+	for index, sink := range c.LogSinks {
+		if err := sink.Validate(); err != nil {
+			invalid("LogSinks["+strconv.Itoa(index)+"]", err.Error())
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	message := "invalid settings:"
+	for _, problem := range problems {
+		message += "\n\t" + problem
+	}
+	return errors.New(message)
+}
+
+//Read reads settings from local storage, environment variables and command line arguments, and writes them back to local storage
 func Read() {
-	log.Info(InProgress, "Reading Settings...")
-	jsonstring, err := ioutil.ReadFile(DataPath + "/settings.json")
-	if err == nil {
-		data := make(map[string]interface{})
-		err := json.Unmarshal(jsonstring, &data)
-		if err == nil {
-			RemoteAddress, _ = data["RemoteAddress"].(string)
-
-			LocalAddress, _ = data["LocalAddress"].(string)
-
-			tmp, ok := data["DiskSpace"].(float64)
-			if ok {
-				DiskSpace = int(tmp)
-			}
-
-			tmp, ok = data["MaxWorkers"].(float64)
-			if ok {
-				MaxWorkers = int(tmp)
-			}
-
-			tmp, ok = data["QueueMaxLength"].(float64)
-			if ok {
-				QueueMaxLength = int(tmp)
-			}
-
-			tmp, ok = data["MessageMaxSize"].(float64)
-			if ok {
-				MessageMaxSize = int(tmp)
-			}
-
-			tmp, ok = data["MessageMinCheckDelay"].(float64)
-			if ok {
-				MessageMinCheckDelay = int(tmp)
-			}
-
-			tmp, ok = data["MessageMaxStoreTime"].(float64)
-			if ok {
-				MessageMaxStoreTime = int(tmp)
-			}
-
-			ColorizedLogs, _ = data["ColorizedLogs"].(bool)
-		} else {
-			log.Warn(SettingsReadError, "Failed to read settings from file ("+err.Error()+"). Falling back to defaults or using command line arguments...")
+	Load()
+	Write()
+}
+
+//Args returns the command line arguments following the flags
+func Args() []string {
+	return positionalArgs
+}
+
+//Load reads settings from local storage, environment variables and command line arguments, without writing them.
+//If --print-config is set, the resulting settings are printed and the process exits
+func Load() {
+	config, persisted, printConfig, positional, warnings, err := load(commandLineArgs)
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if printConfig {
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(2)
 		}
+		jsonstring, _ := json.MarshalIndent(config, "", "\t")
+		os.Stdout.Write(append(jsonstring, '\n'))
+		os.Exit(0)
 	}
 
-	parseCommandLineArgs()
-	logger.ColorizedLogs = ColorizedLogs
+	log.Info(InProgress, "Reading Settings...")
+	for _, warning := range warnings {
+		log.Warn(SettingsReadError, warning)
+	}
+	if err != nil {
+		log.Fatal(SettingsValidationError, err.Error())
+	}
+
+	current.Store(&config)
+	loaded.Store(&config)
+	stored.Store(&persisted)
+	positionalArgs = positional
+	logger.ColorizedLogs = config.ColorizedLogs
 	log.Info(OK, "Successfully read Settings.")
-	Write()
 }
 
-//Write writes settings to local storage
+//Write writes the settings from defaults and settings.json back to settings.json, so new settings appear with their defaults.
+//Environment variables and command line arguments only apply while they are set, and are not written. The file is replaced
+//atomically, so an interrupted write never leaves a truncated settings.json behind
 func Write() {
-	//Write settings to disk
+	config := *stored.Load()
+	path := config.DataPath + "/settings.json"
 	log.Info(InProgress, "Writing settings...")
-	data := make(map[string]interface{})
-	data["RemoteAddress"] = RemoteAddress
-	data["LocalAddress"] = LocalAddress
-	data["DiskSpace"] = DiskSpace
-	data["MaxWorkers"] = MaxWorkers
-	data["QueueMaxLength"] = QueueMaxLength
-	data["MessageMaxSize"] = MessageMaxSize
-	data["MessageMinCheckDelay"] = MessageMinCheckDelay
-	data["MessageMaxStoreTime"] = MessageMaxStoreTime
-	data["ColorizedLogs"] = ColorizedLogs
-
-	jsonstring, err := json.MarshalIndent(data, "", "\t")
-	f, err := os.Create(DataPath + "/settings.json")
+
+	jsonstring, err := json.MarshalIndent(config, "", "\t")
 	if err != nil {
 		log.Fatal(SettingsWriteError, err.Error())
 	}
-	f.Write(jsonstring)
-	f.Close()
-	log.Info(OK, "Wrote settings to "+DataPath+"/settings.json")
-}
-
-func parseCommandLineArgs() {
-	log.Info(InProgress, "Parsing Commandline Arguments...")
-	flag.StringVar(&BootstrapNode, "bootstrap-node", BootstrapNode, "If set, SuBFraMe will reinitialize the local Node Database and sync it with the BootstrapNode")
-	flag.StringVar(&DataPath, "data-dir", DataPath, "The SuBFraMe data directory, messages, databases and settings will be stored here")
-	flag.StringVar(&RemoteAddress, "remote-address", RemoteAddress, "The remote address of this SuBFraMe Instance")
-	flag.StringVar(&LocalAddress, "local-address", LocalAddress, "The IP and Port the Node Interface will listen on")
-	flag.IntVar(&DiskSpace, "disk-space", DiskSpace, "The maximum space SuBFraMe will use to store Messages in MB")
-	flag.IntVar(&MaxWorkers, "max-workers", MaxWorkers, "The maximum number of worker threads")
-	flag.IntVar(&QueueMaxLength, "max-queue-length", QueueMaxLength, "The maximum size a queue can have before a new worker is spawned, before exceeding max-workers")
-	flag.IntVar(&MessageMaxSize, "message-max-size", MessageMaxSize, "The maximum size of an individual message file, in MB")
-	flag.IntVar(&MessageMinCheckDelay, "message-min-check-delay", MessageMinCheckDelay, "The minimum time in hours between individual checks of the same message against the coordinator network")
-	flag.IntVar(&MessageMaxStoreTime, "message-max-store-time", MessageMaxStoreTime, "The maximum time a message is stored locally, in days")
-	flag.BoolVar(&ColorizedLogs, "colorized-output", ColorizedLogs, "Turns on or off colorized realtime logs")
-	flag.Parse()
-	log.Info(OK, "Parsed Commandline Arguments.")
+	if err = os.MkdirAll(config.DataPath, 0755); err != nil {
+		log.Fatal(SettingsWriteError, err.Error())
+	}
+	file, err := os.CreateTemp(config.DataPath, ".settings-")
+	if err != nil {
+		log.Fatal(SettingsWriteError, err.Error())
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(jsonstring)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		log.Fatal(SettingsWriteError, err.Error())
+	}
+	log.Info(OK, "Wrote settings to "+path)
 }
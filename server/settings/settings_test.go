@@ -0,0 +1,50 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWritePersistsOnlyFileSettings(t *testing.T) {
+	dataPath := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dataPath, "settings.json"), []byte(`{"RateLimitGet": 42}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SUBFRAME_DATA_PATH", dataPath)
+	t.Setenv("SUBFRAME_MAX_WORKERS", "7")
+
+	config, persisted, _, _, _, err := load([]string{"--stamp-bits", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultConfig()
+	if config.RateLimitGet != 42 || config.MaxWorkers != 7 || config.StampBits != 5 {
+		t.Errorf("loaded RateLimitGet %d, MaxWorkers %d and StampBits %d, expected the file, environment and argument to apply", config.RateLimitGet, config.MaxWorkers, config.StampBits)
+	}
+	if persisted.RateLimitGet != 42 || persisted.MaxWorkers != defaults.MaxWorkers || persisted.StampBits != defaults.StampBits {
+		t.Errorf("persisting RateLimitGet %d, MaxWorkers %d and StampBits %d, expected only the file to apply", persisted.RateLimitGet, persisted.MaxWorkers, persisted.StampBits)
+	}
+
+	previous := Get()
+	t.Cleanup(func() { Set(previous) })
+	Set(config)
+	stored.Store(&persisted)
+	Write()
+
+	jsonstring, err := ioutil.ReadFile(filepath.Join(dataPath, "settings.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	written := Config{}
+	if warnings := applyFile(&written, jsonstring); len(warnings) > 0 {
+		t.Fatal(warnings)
+	}
+	if written.RateLimitGet != 42 || written.MaxWorkers != defaults.MaxWorkers || written.StampBits != defaults.StampBits {
+		t.Errorf("wrote RateLimitGet %d, MaxWorkers %d and StampBits %d, expected only the file settings", written.RateLimitGet, written.MaxWorkers, written.StampBits)
+	}
+	if entries, _ := os.ReadDir(dataPath); len(entries) != 1 {
+		t.Errorf("%d files are left in the data directory, expected only settings.json", len(entries))
+	}
+}
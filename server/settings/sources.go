@@ -0,0 +1,196 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+)
+
+var byteSizeType = reflect.TypeOf(ByteSize(0))
+var durationType = reflect.TypeOf(Duration(0))
+
+//load builds the settings from defaults, settings.json, environment variables and command line arguments.
+//persisted holds the settings from defaults and settings.json only, which are written back to settings.json
+func load(args []string) (config Config, persisted Config, printConfig bool, positional []string, warnings []string, err error) {
+	config = DefaultConfig()
+
+	//Flags are parsed as plain strings first, so values can be applied with the same rules as environment variables
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configType := reflect.TypeOf(config)
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		value := &stringFlag{value: formatField(reflect.ValueOf(config).Field(i)), isBool: field.Type.Kind() == reflect.Bool}
+		flags.Var(value, field.Tag.Get("flag"), field.Tag.Get("usage"))
+	}
+	flags.BoolVar(&printConfig, "print-config", false, "Print the resulting settings as JSON and exit")
+	if err = flags.Parse(args); err != nil {
+		return config, config, printConfig, nil, warnings, err
+	}
+	positional = flags.Args()
+	setFlags := make(map[string]string)
+	flags.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = f.Value.String()
+	})
+
+	//settings.json resides in DataPath, which therefore has to be known before reading the file
+	dataPath := config.DataPath
+	if value, ok := os.LookupEnv("SUBFRAME_DATA_PATH"); ok {
+		dataPath = value
+	}
+	if value, ok := setFlags["data-dir"]; ok {
+		dataPath = value
+	}
+
+	jsonstring, readErr := ioutil.ReadFile(dataPath + "/settings.json")
+	if readErr == nil {
+		warnings = append(warnings, applyFile(&config, jsonstring)...)
+	} else if !os.IsNotExist(readErr) {
+		warnings = append(warnings, "Failed to read settings from file ("+readErr.Error()+"). Falling back to defaults...")
+	}
+	config.DataPath = dataPath
+	persisted = config
+
+	var problems []string
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if value, ok := os.LookupEnv(field.Tag.Get("env")); ok {
+			if err := setField(&config, field, value); err != nil {
+				problems = append(problems, field.Tag.Get("env")+": "+err.Error())
+			}
+		}
+	}
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if value, ok := setFlags[field.Tag.Get("flag")]; ok {
+			if err := setField(&config, field, value); err != nil {
+				problems = append(problems, "--"+field.Tag.Get("flag")+": "+err.Error())
+			}
+		}
+	}
+	if len(problems) > 0 {
+		message := "invalid settings:"
+		for _, problem := range problems {
+			message += "\n\t" + problem
+		}
+		return config, persisted, printConfig, positional, warnings, errors.New(message)
+	}
+
+	return config, persisted, printConfig, positional, warnings, config.Validate()
+}
+
+//applyFile overwrites settings present in settings.json. Invalid entries are skipped and reported as warnings
+func applyFile(config *Config, jsonstring []byte) (warnings []string) {
+	data := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(jsonstring, &data); err != nil {
+		return []string{"Failed to read settings from file (" + err.Error() + "). Falling back to defaults..."}
+	}
+
+	configType := reflect.TypeOf(*config)
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		raw, ok := data[field.Name]
+		if !ok {
+			continue
+		}
+
+		var err error
+		var value string
+		if field.Type == byteSizeType || field.Type == durationType {
+			//Sizes and durations are stored as strings, older versions stored plain numbers in their default unit
+			var number float64
+			if json.Unmarshal(raw, &number) == nil {
+				value = strconv.FormatFloat(number, 'f', -1, 64)
+			} else {
+				err = json.Unmarshal(raw, &value)
+			}
+			if err == nil {
+				err = setField(config, field, value)
+			}
+		} else {
+			err = json.Unmarshal(raw, reflect.ValueOf(config).Elem().Field(i).Addr().Interface())
+		}
+		if err != nil {
+			warnings = append(warnings, "Ignoring invalid setting "+field.Name+" in settings.json: "+err.Error())
+		}
+	}
+	return warnings
+}
+
+//setField parses value according to the type of field and sets it in config
+func setField(config *Config, field reflect.StructField, value string) error {
+	target := reflect.ValueOf(config).Elem().FieldByIndex(field.Index)
+	switch {
+	case field.Type == byteSizeType:
+		unit, err := ParseByteSize("1"+field.Tag.Get("unit"), Byte)
+		if err != nil {
+			return err
+		}
+		size, err := ParseByteSize(value, unit)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(size))
+	case field.Type == durationType:
+		unit, err := ParseDuration("1"+field.Tag.Get("unit"), Second)
+		if err != nil {
+			return err
+		}
+		duration, err := ParseDuration(value, unit)
+		if err != nil {
+			return err
+		}
+		target.SetInt(int64(duration))
+	case field.Type.Kind() == reflect.String:
+		target.SetString(value)
+	case field.Type.Kind() == reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("invalid number \"" + value + "\"")
+		}
+		target.SetInt(int64(number))
+	case field.Type.Kind() == reflect.Bool:
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("invalid boolean \"" + value + "\"")
+		}
+		target.SetBool(enabled)
+	default:
+		//Complex settings like LogSinks are passed as JSON
+		return json.Unmarshal([]byte(value), target.Addr().Interface())
+	}
+	return nil
+}
+
+//formatField formats a setting as it would be passed on the command line
+func formatField(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Struct:
+		jsonstring, _ := json.Marshal(value.Interface())
+		return string(jsonstring)
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+//stringFlag holds the raw value of a command line argument. Boolean settings may be passed without value
+type stringFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *stringFlag) String() string {
+	return f.value
+}
+
+func (f *stringFlag) Set(value string) error {
+	f.value = value
+	return nil
+}
+
+func (f *stringFlag) IsBoolFlag() bool {
+	return f.isBool
+}
@@ -0,0 +1,132 @@
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ByteSize is a size in bytes, written in human units like "5GB"
+type ByteSize int64
+
+//Size units, using powers of 1024
+const (
+	Byte     ByteSize = 1
+	Kilobyte          = 1024 * Byte
+	Megabyte          = 1024 * Kilobyte
+	Gigabyte          = 1024 * Megabyte
+	Terabyte          = 1024 * Gigabyte
+)
+
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"TB", Terabyte}, {"GB", Gigabyte}, {"MB", Megabyte}, {"KB", Kilobyte}, {"B", Byte},
+}
+
+//ParseByteSize parses sizes like "5GB", "100 MB" or "1.5T". Numbers without unit are interpreted as defaultUnit
+func ParseByteSize(value string, defaultUnit ByteSize) (ByteSize, error) {
+	number, suffix := splitUnit(value)
+	amount, err := strconv.ParseFloat(number, 64)
+	if err != nil || amount < 0 {
+		return 0, errors.New("invalid size \"" + value + "\", expected e.g. \"5GB\"")
+	}
+	if suffix == "" {
+		return ByteSize(amount * float64(defaultUnit)), nil
+	}
+	for _, unit := range byteUnits {
+		if suffix == unit.suffix || suffix+"B" == unit.suffix {
+			return ByteSize(amount * float64(unit.size)), nil
+		}
+	}
+	return 0, errors.New("invalid size unit in \"" + value + "\", expected one of B, KB, MB, GB, TB")
+}
+
+//String formats the size in the largest unit it can be expressed in without fraction
+func (b ByteSize) String() string {
+	for _, unit := range byteUnits {
+		if b != 0 && b%unit.size == 0 {
+			return strconv.FormatInt(int64(b/unit.size), 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+//MarshalJSON writes the size in human units
+func (b ByteSize) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+//Duration is a time span, written in human units like "7d"
+type Duration time.Duration
+
+//Duration units, extending time's units by days and weeks
+const (
+	Second = Duration(time.Second)
+	Minute = Duration(time.Minute)
+	Hour   = Duration(time.Hour)
+	Day    = 24 * Hour
+	Week   = 7 * Day
+)
+
+var durationUnits = []struct {
+	suffix   string
+	duration Duration
+}{
+	{"w", Week}, {"d", Day}, {"h", Hour}, {"m", Minute}, {"s", Second},
+}
+
+//ParseDuration parses durations like "7d", "12h" or "1h30m". Numbers without unit are interpreted as defaultUnit
+func ParseDuration(value string, defaultUnit Duration) (Duration, error) {
+	number, suffix := splitUnit(value)
+	amount, err := strconv.ParseFloat(number, 64)
+	if err == nil && amount >= 0 {
+		if suffix == "" {
+			return Duration(amount * float64(defaultUnit)), nil
+		}
+		for _, unit := range durationUnits {
+			if strings.ToLower(suffix) == unit.suffix {
+				return Duration(amount * float64(unit.duration)), nil
+			}
+		}
+	}
+	//Fall back to Go's format for compound durations
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d < 0 {
+		return 0, errors.New("invalid duration \"" + value + "\", expected e.g. \"7d\", \"12h\" or \"30s\"")
+	}
+	return Duration(d), nil
+}
+
+//String formats the duration in the largest unit it can be expressed in without fraction
+func (d Duration) String() string {
+	for _, unit := range durationUnits {
+		if d != 0 && d%unit.duration == 0 {
+			return strconv.FormatInt(int64(d/unit.duration), 10) + unit.suffix
+		}
+	}
+	return time.Duration(d).String()
+}
+
+//MarshalJSON writes the duration in human units
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+//Std returns the duration as time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+//splitUnit splits "5 GB" into "5" and "GB"
+func splitUnit(value string) (number string, suffix string) {
+	value = strings.TrimSpace(value)
+	i := len(value)
+	for i > 0 && (value[i-1] < '0' || value[i-1] > '9') && value[i-1] != '.' {
+		i--
+	}
+	return strings.TrimSpace(value[:i]), strings.ToUpper(strings.TrimSpace(value[i:]))
+}
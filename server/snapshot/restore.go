@@ -0,0 +1,167 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	. "subframe/status"
+)
+
+//Restore verifies the snapshot read from r against its manifest and unpacks it into dataPath, which must not exist or be empty.
+//Files are unpacked into a temporary directory first, so dataPath is only created once the whole snapshot has been verified
+func Restore(r io.Reader, dataPath string) (status int) {
+	log.Info(InProgress, "Restoring Snapshot into "+dataPath+"...")
+	dataPath = filepath.Clean(dataPath)
+	if entries, err := os.ReadDir(dataPath); err == nil && len(entries) > 0 {
+		log.Error(SnapshotTargetNotEmpty, dataPath+" is not empty. Snapshots can only be restored into a fresh data directory.")
+		return SnapshotTargetNotEmpty
+	} else if err != nil && !os.IsNotExist(err) {
+		log.Error(SnapshotTargetNotEmpty, "Cannot read "+dataPath+": "+err.Error())
+		return SnapshotTargetNotEmpty
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		log.Error(SnapshotWriteError, "Error creating parent directory of "+dataPath+": "+err.Error())
+		return SnapshotWriteError
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dataPath), "."+filepath.Base(dataPath)+".restore-")
+	if err != nil {
+		log.Error(SnapshotWriteError, "Error creating temporary directory: "+err.Error())
+		return SnapshotWriteError
+	}
+	defer os.RemoveAll(tmp)
+
+	manifest, checksums, status := unpack(r, tmp)
+	if status != OK {
+		return status
+	}
+	if status := verify(manifest, checksums); status != OK {
+		return status
+	}
+
+	//An empty dataPath is removed, so the verified directory can take its place
+	os.Remove(dataPath)
+	if err := os.Rename(tmp, dataPath); err != nil {
+		log.Error(SnapshotWriteError, "Error moving restored files to "+dataPath+": "+err.Error())
+		return SnapshotWriteError
+	}
+	log.Info(OK, "Restored "+strconv.Itoa(len(manifest.Files))+" files created on "+manifest.CreatedOn.String()+" by SuBFraMe "+manifest.ServerVersion+" into "+dataPath+".")
+	return OK
+}
+
+//unpack writes all files of the archive to dir and returns the manifest and the checksums of the unpacked files
+func unpack(r io.Reader, dir string) (manifest Manifest, checksums map[string]File, status int) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		log.Error(SnapshotReadError, "Error reading Snapshot: "+err.Error())
+		return manifest, nil, SnapshotReadError
+	}
+	archive := tar.NewReader(gz)
+	checksums = make(map[string]File)
+	hasManifest := false
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Error(SnapshotReadError, "Error reading Snapshot: "+err.Error())
+			return manifest, nil, SnapshotReadError
+		}
+
+		if header.Name == ManifestName {
+			if err = json.NewDecoder(archive).Decode(&manifest); err != nil {
+				log.Error(SnapshotReadError, "Error reading manifest: "+err.Error())
+				return manifest, nil, SnapshotReadError
+			}
+			hasManifest = true
+			continue
+		}
+		name, err := cleanName(header)
+		if err != nil {
+			log.Error(SnapshotReadError, "Refusing to restore "+header.Name+": "+err.Error())
+			return manifest, nil, SnapshotReadError
+		}
+		file, err := unpackFile(archive, dir, name)
+		if err != nil {
+			log.Error(SnapshotWriteError, "Error restoring "+name+": "+err.Error())
+			return manifest, nil, SnapshotWriteError
+		}
+		checksums[name] = file
+	}
+
+	if !hasManifest {
+		log.Error(SnapshotReadError, "Snapshot contains no manifest.")
+		return manifest, nil, SnapshotReadError
+	}
+	if manifest.FormatVersion != FormatVersion {
+		log.Error(SnapshotReadError, "Unsupported Snapshot format version "+strconv.Itoa(manifest.FormatVersion)+".")
+		return manifest, nil, SnapshotReadError
+	}
+	return manifest, checksums, OK
+}
+
+//cleanName only accepts regular files with relative paths that stay inside the data directory
+func cleanName(header *tar.Header) (string, error) {
+	if header.Typeflag != tar.TypeReg {
+		return "", errors.New("not a regular file")
+	}
+	name := path.Clean(header.Name)
+	if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return "", errors.New("path leaves the data directory")
+	}
+	return name, nil
+}
+
+func unpackFile(archive io.Reader, dir string, name string) (File, error) {
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return File{}, err
+	}
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return File{}, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), archive)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return File{}, err
+	}
+	return File{Path: name, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+//verify checks that exactly the files listed in the manifest were unpacked, with matching sizes and checksums
+func verify(manifest Manifest, checksums map[string]File) (status int) {
+	for _, expected := range manifest.Files {
+		actual, ok := checksums[expected.Path]
+		if !ok {
+			log.Error(SnapshotChecksumMismatch, "Snapshot is missing "+expected.Path+".")
+			return SnapshotChecksumMismatch
+		}
+		if actual.Size != expected.Size || actual.SHA256 != expected.SHA256 {
+			log.Error(SnapshotChecksumMismatch, "Checksum of "+expected.Path+" does not match the manifest.")
+			return SnapshotChecksumMismatch
+		}
+		delete(checksums, expected.Path)
+	}
+	for name := range checksums {
+		log.Error(SnapshotChecksumMismatch, "Snapshot contains "+name+", which is not listed in the manifest.")
+		return SnapshotChecksumMismatch
+	}
+	log.Info(OK, "Verified "+strconv.Itoa(len(manifest.Files))+" files against the manifest.")
+	return OK
+}
@@ -0,0 +1,155 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"subframe/server/database"
+	"subframe/server/logger"
+	"subframe/server/settings"
+	. "subframe/status"
+	"time"
+)
+
+var log = logger.Logger{Prefix: "snapshot/Main"}
+
+//FormatVersion is the version of the snapshot layout, increased whenever Restore has to treat snapshots differently
+const FormatVersion = 1
+
+//ManifestName is the name of the manifest inside the archive. It is always the last entry
+const ManifestName = "manifest.json"
+
+//Manifest describes the contents of a snapshot
+type Manifest struct {
+	FormatVersion int
+	ServerVersion string
+	NetworkID     string
+	CreatedOn     time.Time
+	Files         []File
+}
+
+//File describes a single file of a snapshot, with its path relative to DataPath
+type File struct {
+	Path   string
+	Size   int64
+	SHA256 string
+}
+
+//Write writes a gzipped tar archive of the node state in dataPath to w: the databases, message files, settings.json, identity.key
+//and the salt of the encryption passphrase. Encryption keys are never included.
+//Message files are only included for the fs storage backend, other backends have to be backed up on their own.
+//Databases are copied first. Message files are written before they are logged to the database and never modified,
+//so every message referenced by the copied databases is part of the snapshot
+func Write(w io.Writer, dataPath string, databases database.Snapshotter) (status int) {
+	log.Info(InProgress, "Writing Snapshot of "+dataPath+"...")
+	//Database copies are as large as the databases themselves, so they are kept next to them rather than in a possibly small tmpfs
+	tmp, err := os.MkdirTemp(dataPath, ".snapshot-")
+	if err != nil {
+		log.Error(SnapshotWriteError, "Error creating temporary directory: "+err.Error())
+		return SnapshotWriteError
+	}
+	defer os.RemoveAll(tmp)
+	if status := databases.Snapshot(tmp); status != OK {
+		return status
+	}
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	manifest := Manifest{
+		FormatVersion: FormatVersion,
+		ServerVersion: settings.Version,
+		NetworkID:     settings.Get().NetworkID,
+		CreatedOn:     time.Now().UTC(),
+	}
+	add := func(source string, name string) error {
+		file, err := addFile(archive, source, name)
+		if err != nil {
+			return errors.New("error adding " + name + ": " + err.Error())
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	}
+
+	for _, name := range []string{"storage.db", "coordinator.db"} {
+		if err == nil {
+			err = add(filepath.Join(tmp, name), "databases/"+name)
+		}
+	}
+	for _, name := range []string{"settings.json", "identity.key", "encryption.salt"} {
+		if _, statErr := os.Stat(filepath.Join(dataPath, name)); err == nil && statErr == nil {
+			err = add(filepath.Join(dataPath, name), name)
+		}
+	}
+	if backend := settings.Get().StorageBackend; backend != "fs" {
+		log.Warn(SnapshotWriteError, "Messages are kept in the "+backend+" storage backend and are not part of the Snapshot.")
+	} else if err == nil {
+		err = filepath.Walk(filepath.Join(dataPath, "messages"), func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			//Hidden files are incomplete uploads
+			if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+				return err
+			}
+			relative, err := filepath.Rel(dataPath, path)
+			if err != nil {
+				return err
+			}
+			return add(path, filepath.ToSlash(relative))
+		})
+	}
+	if err != nil {
+		log.Error(SnapshotWriteError, "Error writing Snapshot: "+err.Error())
+		return SnapshotWriteError
+	}
+
+	jsonstring, _ := json.MarshalIndent(manifest, "", "\t")
+	err = archive.WriteHeader(&tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(jsonstring)), ModTime: manifest.CreatedOn})
+	if err == nil {
+		_, err = archive.Write(jsonstring)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		log.Error(SnapshotWriteError, "Error finishing Snapshot: "+err.Error())
+		return SnapshotWriteError
+	}
+	log.Info(OK, "Wrote Snapshot with "+strconv.Itoa(len(manifest.Files))+" files.")
+	return OK
+}
+
+//addFile copies source into the archive as name and returns its manifest entry
+func addFile(archive *tar.Writer, source string, name string) (File, error) {
+	file, err := os.Open(source)
+	if err != nil {
+		return File{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return File{}, err
+	}
+
+	header := &tar.Header{Name: name, Mode: 0600, Size: info.Size(), ModTime: info.ModTime()}
+	if err = archive.WriteHeader(header); err != nil {
+		return File{}, err
+	}
+	hash := sha256.New()
+	//Size is fixed by the header, files growing in the meantime are cut off
+	if _, err = io.CopyN(io.MultiWriter(archive, hash), file, info.Size()); err != nil {
+		return File{}, err
+	}
+	return File{Path: name, Size: info.Size(), SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
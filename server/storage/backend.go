@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"subframe/server/keyring"
+	"subframe/server/settings"
+	"time"
+)
+
+//ErrNotFound is returned by a Backend if a message does not exist
+var ErrNotFound = errors.New("message not found")
+
+//ErrExists is returned by Backend.Put if a message already exists
+var ErrExists = errors.New("message already exists")
+
+//Backend stores message files
+type Backend interface {
+	//Put stores a new message read from content. The message only becomes visible once content has been read completely.
+	//It returns ErrExists instead of overwriting a message
+	Put(id string, content io.Reader) (ObjectInfo, error)
+	//Get opens a message for reading. Seeking allows to serve parts of a message without reading all of it
+	Get(id string) (io.ReadSeekCloser, ObjectInfo, error)
+	Delete(id string) error
+	Stat(id string) (ObjectInfo, error)
+	//List returns the IDs of all stored messages
+	List() ([]string, error)
+	//Usage returns the space in bytes used by all stored messages, including incomplete ones
+	Usage() (int64, error)
+	//Close persists all pending writes
+	Close() error
+}
+
+//ObjectInfo describes a stored message
+type ObjectInfo struct {
+	ID   string
+	Size int64
+	//StoredSize is the space taken up in the backend, which exceeds Size if the message is encrypted
+	StoredSize int64
+	ModTime    time.Time
+	//ETag is a quoted, strong HTTP entity tag, which changes whenever the content of a message changes
+	ETag string
+	//SHA256 is the hex-encoded SHA-256 hash of the content. It is always set by Put, other methods leave it empty if the backend does not keep it
+	SHA256 string
+}
+
+//NewBackend returns the Backend selected by settings.StorageBackend, which encrypts messages if keyring is enabled
+func NewBackend(config settings.Config) (Backend, error) {
+	var backend Backend
+	var err error
+	switch config.StorageBackend {
+	case "fs":
+		backend, err = newFSBackend(config.DataPath + "/messages")
+	case "memory":
+		backend = newMemoryBackend()
+	case "s3":
+		backend, err = newS3Backend(config.S3Endpoint, config.S3Region, config.S3Bucket, config.S3Prefix, config.S3AccessKey, config.S3SecretKey)
+	default:
+		return nil, errors.New("unknown storage backend \"" + config.StorageBackend + "\"")
+	}
+	if err != nil || !keyring.Enabled() {
+		return backend, err
+	}
+	return newEncryptedBackend(backend), nil
+}
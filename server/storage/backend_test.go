@@ -0,0 +1,335 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"subframe/server/keyring"
+	"sync"
+	"testing"
+	"time"
+)
+
+//s3Stub is a minimal stand-in for an S3-compatible object storage, serving a single bucket with path-style requests.
+//It checks that requests are signed, but not the signature itself
+type s3Stub struct {
+	t       *testing.T
+	bucket  string
+	mutex   sync.Mutex
+	objects map[string]s3StubObject
+}
+
+type s3StubObject struct {
+	content  []byte
+	modTime  time.Time
+	metadata http.Header
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		s.t.Errorf("%s %s is not signed", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if req.URL.Path == "/"+s.bucket && req.Method == "GET" {
+		s.list(w, req)
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/"+s.bucket+"/")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	object, exists := s.objects[key]
+	switch req.Method {
+	case "PUT":
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if hash := sha256.Sum256(content); req.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+			s.t.Errorf("PUT %s carries the wrong payload hash", key)
+		}
+		if exists && req.Header.Get("If-None-Match") == "*" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		metadata := http.Header{}
+		for name, values := range req.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				metadata[name] = values
+			}
+		}
+		s.objects[key] = s3StubObject{content: content, modTime: time.Now(), metadata: metadata}
+		w.Header().Set("ETag", s.objects[key].etag())
+	case "GET", "HEAD":
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		//ServeContent handles Range and If-Match like the object storage
+		w.Header().Set("ETag", object.etag())
+		http.ServeContent(w, req, "", object.modTime, bytes.NewReader(object.content))
+	case "DELETE":
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+//list answers ListObjectsV2 requests with one object per page, so continuation tokens are followed
+func (s *s3Stub) list(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	s.mutex.Lock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	type content struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string    `xml:",omitempty"`
+		Contents              []content `xml:",omitempty"`
+	}{}
+	if start < len(keys) {
+		object := s.objects[keys[start]]
+		result.Contents = []content{{keys[start], int64(len(object.content)), object.modTime}}
+	}
+	if start+1 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 1)
+	}
+	s.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (o s3StubObject) etag() string {
+	hash := sha256.Sum256(o.content)
+	return "\"" + hex.EncodeToString(hash[:16]) + "\""
+}
+
+//forEachBackend runs test against every Backend, each starting out empty
+func forEachBackend(t *testing.T, test func(t *testing.T, b Backend)) {
+	t.Run("fs", func(t *testing.T) {
+		b, err := newFSBackend(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		test(t, b)
+	})
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryBackend())
+	})
+	t.Run("encrypted", func(t *testing.T) {
+		useKeys(t, keyring.GenerateKey())
+		test(t, newEncryptedBackend(newMemoryBackend()))
+	})
+	t.Run("s3", func(t *testing.T) {
+		//An object outside of the prefix must neither be listed nor counted
+		stub := &s3Stub{t: t, bucket: "subframe", objects: map[string]s3StubObject{"other/object": {content: []byte("not a message")}}}
+		server := httptest.NewServer(stub)
+		defer server.Close()
+		b, err := newS3Backend(server.URL, "us-east-1", "subframe", "messages/", "access", "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+		test(t, b)
+	})
+}
+
+func put(t *testing.T, b Backend, id string, content string) ObjectInfo {
+	t.Helper()
+	info, err := b.Put(id, strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("storing %s failed: %v", id, err)
+	}
+	return info
+}
+
+func read(t *testing.T, reader io.Reader) string {
+	t.Helper()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestBackendPutGet(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		content := "Hello, SuBFraMe!"
+		hash := sha256.Sum256([]byte(content))
+		info := put(t, b, "message-1", content)
+		if info.ID != "message-1" || info.Size != int64(len(content)) || info.SHA256 != hex.EncodeToString(hash[:]) || info.ETag == "" {
+			t.Errorf("Put returned %+v", info)
+		}
+
+		reader, got, err := b.Get("message-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if read(t, reader) != content {
+			t.Errorf("Get returned different content")
+		}
+		if got.Size != info.Size || got.ETag != info.ETag {
+			t.Errorf("Get described the message as %+v, Put as %+v", got, info)
+		}
+		if stat, err := b.Stat("message-1"); err != nil || stat.Size != info.Size || stat.ETag != info.ETag {
+			t.Errorf("Stat returned %+v, %v", stat, err)
+		}
+
+		if _, _, err = b.Get("message-2"); err != ErrNotFound {
+			t.Errorf("Get of a missing message returned %v, expected ErrNotFound", err)
+		}
+		if _, err = b.Stat("message-2"); err != ErrNotFound {
+			t.Errorf("Stat of a missing message returned %v, expected ErrNotFound", err)
+		}
+	})
+}
+
+func TestBackendPutExisting(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		put(t, b, "message-1", "original")
+		if _, err := b.Put("message-1", strings.NewReader("replacement")); err != ErrExists {
+			t.Errorf("storing an existing message returned %v, expected ErrExists", err)
+		}
+		reader, _, err := b.Get("message-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		if content := read(t, reader); content != "original" {
+			t.Errorf("existing message was replaced by %q", content)
+		}
+	})
+}
+
+func TestBackendRange(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		put(t, b, "message-1", "0123456789")
+		reader, _, err := b.Get("message-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+
+		for _, seek := range []struct {
+			offset   int64
+			whence   int
+			position int64
+			rest     string
+		}{
+			{4, io.SeekStart, 4, "456789"},
+			{-3, io.SeekEnd, 7, "789"},
+			{0, io.SeekStart, 0, "0123456789"},
+		} {
+			position, err := reader.Seek(seek.offset, seek.whence)
+			if err != nil || position != seek.position {
+				t.Fatalf("seeking to %d from %d returned %d, %v", seek.offset, seek.whence, position, err)
+			}
+			if rest := read(t, reader); rest != seek.rest {
+				t.Errorf("read %q after seeking to %d, expected %q", rest, position, seek.rest)
+			}
+		}
+
+		//Reading part of the message, then seeking back, must not continue where the first read stopped
+		if _, err = reader.Seek(2, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		part := make([]byte, 3)
+		if _, err = io.ReadFull(reader, part); err != nil || string(part) != "234" {
+			t.Fatalf("read %q, %v, expected \"234\"", part, err)
+		}
+		if _, err = reader.Seek(1, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if rest := read(t, reader); rest != "123456789" {
+			t.Errorf("read %q after seeking back, expected \"123456789\"", rest)
+		}
+	})
+}
+
+func TestBackendDelete(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		put(t, b, "message-1", "content")
+		if err := b.Delete("message-1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Stat("message-1"); err != ErrNotFound {
+			t.Errorf("Stat of a deleted message returned %v, expected ErrNotFound", err)
+		}
+		if err := b.Delete("message-1"); err != ErrNotFound {
+			t.Errorf("deleting a missing message returned %v, expected ErrNotFound", err)
+		}
+		//Deleted messages can be stored again
+		put(t, b, "message-1", "content")
+	})
+}
+
+func TestBackendUsage(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		if usage, err := b.Usage(); err != nil || usage != 0 {
+			t.Errorf("empty backend uses %d bytes, %v", usage, err)
+		}
+		first := put(t, b, "message-1", "12345")
+		second := put(t, b, "message-2", "1234567890")
+		put(t, b, "message-3", "123")
+		if err := b.Delete("message-3"); err != nil {
+			t.Fatal(err)
+		}
+		//Encrypted messages take up more space than their content
+		if expected := first.StoredSize + second.StoredSize; expected < 15 {
+			t.Errorf("messages of 15 bytes are stored in %d bytes", expected)
+		} else if usage, err := b.Usage(); err != nil || usage != expected {
+			t.Errorf("backend uses %d bytes, %v, expected %d", usage, err, expected)
+		}
+	})
+}
+
+func TestBackendList(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b Backend) {
+		ids := []string{"message-1", "message/2", "MESSAGE-1"}
+		for _, id := range ids {
+			put(t, b, id, "content of "+id)
+		}
+		if err := b.Delete("message/2"); err != nil {
+			t.Fatal(err)
+		}
+
+		listed, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		//Encrypted messages are listed by their blind index
+		expected := []string{keyring.Index("MESSAGE-1"), keyring.Index("message-1")}
+		sort.Strings(listed)
+		sort.Strings(expected)
+		if strings.Join(listed, ",") != strings.Join(expected, ",") {
+			t.Errorf("List returned %q, expected %q", listed, expected)
+		}
+	})
+}
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strconv"
+	"subframe/server/keyring"
+	. "subframe/status"
+)
+
+//encryptedMagic starts every encrypted message, to tell it apart from messages stored before encryption was enabled
+var encryptedMagic = []byte("SFE1")
+
+//segmentSize is the amount of plaintext sealed at once. Segments are sealed independently, so ranges can be read without decrypting whole messages
+const segmentSize = 64 << 10
+
+//errTruncated is returned if an encrypted message is shorter than its header or its last segment is missing
+var errTruncated = errors.New("encrypted message is truncated")
+
+//encryptedBackend seals messages with keyring before passing them on to backend. Messages are stored under their blind index,
+//so the stored names reveal neither the message nor recipient IDs. Each segment is bound to the name and its position, so
+//segments cannot be swapped between or within messages, and truncation is detected by the flag marking the last segment
+type encryptedBackend struct {
+	backend Backend
+}
+
+func newEncryptedBackend(backend Backend) *encryptedBackend {
+	return &encryptedBackend{backend: backend}
+}
+
+func (b *encryptedBackend) Put(id string, content io.Reader) (ObjectInfo, error) {
+	name := keyring.Index(id)
+	hash := sha256.New()
+	sealer := &sealingReader{reader: io.TeeReader(content, hash), name: name, pending: encryptedMagic}
+	info, err := b.backend.Put(name, sealer)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info = b.plainInfo(id, info)
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return info, nil
+}
+
+func (b *encryptedBackend) Get(id string) (io.ReadSeekCloser, ObjectInfo, error) {
+	name := keyring.Index(id)
+	content, info, err := b.backend.Get(name)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	reader, err := newOpeningReader(content, name, info.Size)
+	if err != nil {
+		content.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return reader, b.plainInfo(id, info), nil
+}
+
+func (b *encryptedBackend) Delete(id string) error {
+	return b.backend.Delete(keyring.Index(id))
+}
+
+func (b *encryptedBackend) Stat(id string) (ObjectInfo, error) {
+	info, err := b.backend.Stat(keyring.Index(id))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return b.plainInfo(id, info), nil
+}
+
+//List returns the blind indexes the messages are stored under, as their IDs cannot be recovered. keyring.Index maps IDs to them
+func (b *encryptedBackend) List() ([]string, error) {
+	return b.backend.List()
+}
+
+//Usage returns the space used by the sealed messages, as that is what counts against settings.DiskSpace
+func (b *encryptedBackend) Usage() (int64, error) {
+	return b.backend.Usage()
+}
+
+func (b *encryptedBackend) Close() error {
+	return b.backend.Close()
+}
+
+//rawGet opens a message as stored in the Backend, i.e. still sealed if messages are encrypted
+func (s *Storage) rawGet(id string) (io.ReadSeekCloser, ObjectInfo, error) {
+	if encrypted, ok := s.backend.(*encryptedBackend); ok {
+		return encrypted.backend.Get(keyring.Index(id))
+	}
+	return s.backend.Get(id)
+}
+
+//plainInfo describes a sealed message by its ID and plaintext size. The hash of the sealed message is meaningless to callers
+func (b *encryptedBackend) plainInfo(id string, info ObjectInfo) ObjectInfo {
+	info.ID = id
+	info.StoredSize = info.Size
+	info.Size = plainSize(info.Size)
+	info.SHA256 = ""
+	return info
+}
+
+//segmentCount returns the number of segments of a message, which is sealed in storedSize bytes
+func segmentCount(storedSize int64) int64 {
+	body := storedSize - int64(len(encryptedMagic))
+	sealedSegment := int64(segmentSize + keyring.Overhead())
+	return (body + sealedSegment - 1) / sealedSegment
+}
+
+//plainSize returns the size of a message, which is sealed in storedSize bytes
+func plainSize(storedSize int64) int64 {
+	size := storedSize - int64(len(encryptedMagic)) - segmentCount(storedSize)*int64(keyring.Overhead())
+	return max(size, 0)
+}
+
+//segmentData returns the additional data binding a segment to its message and position
+func segmentData(name string, index int64, last bool) []byte {
+	data := make([]byte, len(name)+9)
+	copy(data, name)
+	binary.BigEndian.PutUint64(data[len(name):], uint64(index))
+	if last {
+		data[len(data)-1] = 1
+	}
+	return data
+}
+
+//sealingReader reads plaintext from reader and returns the sealed message. It reads one byte ahead of every segment,
+//to know whether it is the last one. Empty messages consist of a single empty segment
+type sealingReader struct {
+	reader  io.Reader
+	name    string
+	index   int64
+	pending []byte
+	next    []byte
+	done    bool
+}
+
+func (s *sealingReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.sealSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *sealingReader) sealSegment() error {
+	segment := make([]byte, segmentSize+1)
+	filled := copy(segment, s.next)
+	n, err := io.ReadFull(s.reader, segment[filled:])
+	filled += n
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := filled <= segmentSize
+	if !last {
+		s.next = segment[segmentSize:filled]
+		filled = segmentSize
+	} else {
+		s.next = nil
+	}
+	s.pending = keyring.Seal(segment[:filled], segmentData(s.name, s.index, last))
+	s.index++
+	s.done = last
+	return nil
+}
+
+//openingReader decrypts a sealed message segment by segment, and seeks by reading only the segment containing the new offset
+type openingReader struct {
+	content  io.ReadSeekCloser
+	name     string
+	size     int64
+	segments int64
+	offset   int64
+	//plain holds the decrypted segment with index segment, if any
+	plain   []byte
+	segment int64
+}
+
+func newOpeningReader(content io.ReadSeekCloser, name string, storedSize int64) (*openingReader, error) {
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := io.ReadFull(content, magic); err != nil {
+		return nil, errTruncated
+	}
+	if !bytes.Equal(magic, encryptedMagic) {
+		return nil, errors.New("message is not encrypted")
+	}
+	segments := segmentCount(storedSize)
+	if segments < 1 {
+		return nil, errTruncated
+	}
+	return &openingReader{content: content, name: name, size: plainSize(storedSize), segments: segments, segment: -1}, nil
+}
+
+func (o *openingReader) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		//The last segment is opened even if it is empty, so truncation is always detected
+		if o.size == 0 && o.segment < 0 {
+			if err := o.load(0); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	index := o.offset / segmentSize
+	if index != o.segment {
+		if err := o.load(index); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain[o.offset-index*segmentSize:])
+	o.offset += int64(n)
+	return n, nil
+}
+
+func (o *openingReader) load(index int64) error {
+	sealedSegment := int64(segmentSize + keyring.Overhead())
+	if _, err := o.content.Seek(int64(len(encryptedMagic))+index*sealedSegment, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, sealedSegment)
+	n, err := io.ReadFull(o.content, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	plain, err := keyring.Open(sealed[:n], segmentData(o.name, index, index == o.segments-1))
+	if err != nil {
+		return errors.New("failed to decrypt segment " + strconv.FormatInt(index, 10) + ": " + err.Error())
+	}
+	o.plain = plain
+	o.segment = index
+	return nil
+}
+
+func (o *openingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *openingReader) Close() error {
+	return o.content.Close()
+}
+
+//RekeyMessage moves a message stored as oldName to the name and key currently used by b, which has to encrypt messages.
+//sealed tells whether the message has been encrypted before, or was stored before encryption was enabled
+func RekeyMessage(b Backend, oldName string, id string, sealed bool) (status int) {
+	encrypted, ok := b.(*encryptedBackend)
+	if !ok {
+		log.Error(EncryptionKeyError, "Rekeying requires an encryption key.")
+		return EncryptionKeyError
+	}
+	content, info, err := encrypted.backend.Get(oldName)
+	if err == ErrNotFound {
+		//The message has been moved before rekeying was interrupted, or its file is lost
+		if _, err = b.Stat(id); err == ErrNotFound {
+			log.Warn(StorageReadError, "File of Message "+keyring.Index(id)+" is missing. Skipping...")
+		}
+		return OK
+	}
+	if err != nil {
+		log.Error(StorageReadError, "Error reading Message "+keyring.Index(id)+": "+err.Error())
+		return StorageReadError
+	}
+	defer content.Close()
+
+	var reader io.Reader = content
+	if sealed {
+		if reader, err = newOpeningReader(content, oldName, info.Size); err != nil {
+			log.Error(EncryptionDecryptError, "Error decrypting Message "+keyring.Index(id)+": "+err.Error())
+			return EncryptionDecryptError
+		}
+	}
+	if _, err = b.Put(id, reader); err != nil && err != ErrExists {
+		log.Error(StorageWriteError, "Error rekeying Message "+keyring.Index(id)+": "+err.Error())
+		return StorageWriteError
+	}
+	if err = encrypted.backend.Delete(oldName); err != nil {
+		log.Error(StorageWriteError, "Error removing Message "+keyring.Index(id)+" after rekeying: "+err.Error())
+		return StorageWriteError
+	}
+	return OK
+}
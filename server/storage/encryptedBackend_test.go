@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"subframe/server/keyring"
+	"subframe/server/settings"
+	. "subframe/status"
+	"testing"
+)
+
+//useKeys enables encryption at rest with the given master keys, the first being active, until the test has finished
+func useKeys(t *testing.T, keys ...string) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Join(keys, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if status := keyring.Init(settings.Config{EncryptionKeyFile: keyFile}); status != OK {
+		t.Fatalf("enabling encryption failed with status %d", status)
+	}
+	t.Cleanup(func() { keyring.Init(settings.Config{}) })
+}
+
+//segmentedContent returns content spanning several segments, which differ from each other
+func segmentedContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+//replaceSealed replaces the sealed message stored for id in b by the result of modify
+func replaceSealed(t *testing.T, b *encryptedBackend, id string, modify func(sealed []byte) []byte) {
+	t.Helper()
+	name := keyring.Index(id)
+	content, _, err := b.backend.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := []byte(read(t, content))
+	content.Close()
+	if err = b.backend.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.backend.Put(name, bytes.NewReader(modify(sealed))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptedSegments(t *testing.T) {
+	useKeys(t, keyring.GenerateKey())
+	b := newEncryptedBackend(newMemoryBackend())
+	content := segmentedContent(2*segmentSize + 100)
+	info, err := b.Put("message", bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) || info.StoredSize != int64(len(encryptedMagic)+3*keyring.Overhead()+len(content)) {
+		t.Errorf("message of %d bytes in 3 segments is described as %+v", len(content), info)
+	}
+
+	raw, _, err := b.backend.Get(keyring.Index("message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sealed := read(t, raw); strings.Contains(sealed, string(content[:64])) {
+		t.Errorf("content is stored in plain text")
+	}
+	raw.Close()
+
+	reader, _, err := b.Get("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if !bytes.Equal([]byte(read(t, reader)), content) {
+		t.Fatalf("Get returned different content")
+	}
+	//Ranges across segment boundaries are read from both segments
+	for _, offset := range []int64{segmentSize - 5, 2*segmentSize - 1, 0, segmentSize} {
+		if _, err = reader.Seek(offset, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		part := make([]byte, 10)
+		if _, err = io.ReadFull(reader, part); err != nil || !bytes.Equal(part, content[offset:offset+10]) {
+			t.Errorf("read %v, %v at %d, expected %v", part, err, offset, content[offset:offset+10])
+		}
+	}
+}
+
+func TestEncryptedFlippedByte(t *testing.T) {
+	useKeys(t, keyring.GenerateKey())
+	b := newEncryptedBackend(newMemoryBackend())
+	content := segmentedContent(2 * segmentSize)
+	if _, err := b.Put("message", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	replaceSealed(t, b, "message", func(sealed []byte) []byte {
+		sealed[len(sealed)-1] ^= 1
+		return sealed
+	})
+
+	reader, _, err := b.Get("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	//The first segment is still intact, the second fails authentication
+	part := make([]byte, 10)
+	if _, err = io.ReadFull(reader, part); err != nil || !bytes.Equal(part, content[:10]) {
+		t.Errorf("reading the intact segment returned %v, %v", part, err)
+	}
+	if _, err = reader.Seek(segmentSize, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ioutil.ReadAll(reader); err == nil {
+		t.Errorf("reading the modified segment succeeded")
+	}
+}
+
+func TestEncryptedTruncated(t *testing.T) {
+	useKeys(t, keyring.GenerateKey())
+	b := newEncryptedBackend(newMemoryBackend())
+	if _, err := b.Put("message", bytes.NewReader(segmentedContent(2*segmentSize))); err != nil {
+		t.Fatal(err)
+	}
+	//Cutting off the last segment leaves a message, which looks complete but lacks the flag marking its last segment
+	replaceSealed(t, b, "message", func(sealed []byte) []byte {
+		return sealed[:len(encryptedMagic)+segmentSize+keyring.Overhead()]
+	})
+
+	reader, info, err := b.Get("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if info.Size != segmentSize {
+		t.Errorf("truncated message has %d bytes, expected %d", info.Size, segmentSize)
+	}
+	if _, err = ioutil.ReadAll(reader); err == nil {
+		t.Errorf("reading the truncated message succeeded")
+	}
+
+	//Messages shorter than their header are truncated as well
+	replaceSealed(t, b, "message", func(sealed []byte) []byte {
+		return sealed[:2]
+	})
+	if _, _, err = b.Get("message"); err != errTruncated {
+		t.Errorf("Get of a message without header returned %v, expected errTruncated", err)
+	}
+}
+
+func TestRekeyMessage(t *testing.T) {
+	oldKey, newKey := keyring.GenerateKey(), keyring.GenerateKey()
+	useKeys(t, oldKey)
+	inner := newMemoryBackend()
+	content := segmentedContent(segmentSize + 10)
+	if _, err := newEncryptedBackend(inner).Put("sealed", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	oldName := keyring.Index("sealed")
+	//Messages stored before encryption was enabled are kept under their ID
+	if _, err := inner.Put("plain", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	useKeys(t, newKey, oldKey)
+	b := newEncryptedBackend(inner)
+	if status := RekeyMessage(b, oldName, "sealed", true); status != OK {
+		t.Fatalf("rekeying sealed message failed with status %d", status)
+	}
+	if status := RekeyMessage(b, "plain", "plain", false); status != OK {
+		t.Fatalf("rekeying plain message failed with status %d", status)
+	}
+	//Rekeying again after an interruption skips messages which have been moved
+	if status := RekeyMessage(b, oldName, "sealed", true); status != OK {
+		t.Errorf("rekeying moved message failed with status %d", status)
+	}
+
+	for _, id := range []string{"sealed", "plain"} {
+		reader, _, err := b.Get(id)
+		if err != nil {
+			t.Fatalf("getting rekeyed %s message failed: %v", id, err)
+		}
+		if !bytes.Equal([]byte(read(t, reader)), content) {
+			t.Errorf("rekeyed %s message has different content", id)
+		}
+		reader.Close()
+	}
+	listed, _ := inner.List()
+	if len(listed) != 2 {
+		t.Errorf("%d messages are stored after rekeying, expected 2", len(listed))
+	}
+	for _, name := range []string{oldName, "plain"} {
+		if _, err := inner.Stat(name); err != ErrNotFound {
+			t.Errorf("%s is still stored after rekeying, error %v", name, err)
+		}
+	}
+
+	//Without the old key, messages rekeyed to the new key can still be read
+	useKeys(t, newKey)
+	reader, _, err := newEncryptedBackend(inner).Get("sealed")
+	if err != nil {
+		t.Fatalf("getting rekeyed message without the old key failed: %v", err)
+	}
+	defer reader.Close()
+	if !bytes.Equal([]byte(read(t, reader)), content) {
+		t.Errorf("rekeyed message has different content without the old key")
+	}
+}
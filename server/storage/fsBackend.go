@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"subframe/server/database"
+	"subframe/server/keyring"
+	. "subframe/status"
+)
+
+//Incomplete uploads are written to hidden files, which are neither listed nor served
+const uploadPrefix = ".upload-"
+
+//fsBackend stores every message as a file named by the base32 encoding of its ID, fanned out into two levels of directories
+//by the first four hex digits of the SHA-256 digest of the ID, e.g. ab/cd/nvsxg43bm5sq. The encoding keeps arbitrary IDs from
+//colliding or escaping the directory, even on case-insensitive filesystems, and is reversed to list the stored messages
+type fsBackend struct {
+	path string
+}
+
+func newFSBackend(path string) (*fsBackend, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	//Uploads interrupted by a crash can never complete
+	leftovers, _ := filepath.Glob(filepath.Join(path, uploadPrefix+"*"))
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+	if flat, _ := flatMessageFiles(path); len(flat) > 0 {
+		log.Warn(StorageLayoutOutdated, strconv.Itoa(len(flat))+" messages in "+path+" are stored in the flat layout of previous versions and cannot be served. Run the migrate-layout command to move them.")
+	}
+	return &fsBackend{path: path}, nil
+}
+
+//Put writes content to a temporary file while hashing it, syncs it and links it to its final name, which fails if the message exists
+func (b *fsBackend) Put(id string, content io.Reader) (ObjectInfo, error) {
+	if _, err := os.Lstat(b.file(id)); err == nil {
+		return ObjectInfo{}, ErrExists
+	}
+	tmp, err := ioutil.TempFile(b.path, uploadPrefix)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(b.file(id)), 0755); err != nil {
+		return ObjectInfo{}, err
+	}
+	if err = os.Link(tmp.Name(), b.file(id)); os.IsExist(err) {
+		return ObjectInfo{}, ErrExists
+	} else if err != nil {
+		return ObjectInfo{}, err
+	}
+	if err = syncDir(filepath.Dir(b.file(id))); err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := b.Stat(id)
+	info.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return info, err
+}
+
+func (b *fsBackend) Get(id string) (io.ReadSeekCloser, ObjectInfo, error) {
+	file, err := os.Open(b.file(id))
+	if os.IsNotExist(err) {
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, ObjectInfo{}, err
+	}
+	return file, fileInfo(id, stat), nil
+}
+
+func (b *fsBackend) Delete(id string) error {
+	err := os.Remove(b.file(id))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (b *fsBackend) Stat(id string) (ObjectInfo, error) {
+	stat, err := os.Stat(b.file(id))
+	if os.IsNotExist(err) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return fileInfo(id, stat), nil
+}
+
+//List decodes the names of the files in the shard directories. Incomplete uploads are kept outside of them
+func (b *fsBackend) List() ([]string, error) {
+	shards, err := filepath.Glob(filepath.Join(b.path, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, shard := range shards {
+		id, err := fileNameEncoding.DecodeString(filepath.Base(shard))
+		//Files which are not where their name places them were not written by Put
+		if err != nil || filepath.Join(b.path, shardPath(string(id))) != shard {
+			continue
+		}
+		ids = append(ids, string(id))
+	}
+	return ids, nil
+}
+
+func (b *fsBackend) Usage() (int64, error) {
+	var size int64
+	err := filepath.Walk(b.path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return err
+	})
+	return size, err
+}
+
+//Close syncs the directory, so all created and removed shard directories persist
+func (b *fsBackend) Close() error {
+	return syncDir(b.path)
+}
+
+func (b *fsBackend) file(id string) string {
+	return filepath.Join(b.path, shardPath(id))
+}
+
+//fileNameEncoding is unpadded, lowercase base32, like the text form of MessageIDs, so file names do not depend on case
+var fileNameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+//shardPath returns the path of a message relative to the messages directory
+func shardPath(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	digest := hex.EncodeToString(sum[:])
+	return filepath.Join(digest[0:2], digest[2:4], fileNameEncoding.EncodeToString([]byte(id)))
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+//flatMessageFiles returns the names of messages stored directly in path, as written by previous versions
+func flatMessageFiles(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+//flatName is the name previous versions gave the file of a message: its ID with every character but letters and digits replaced by a dash
+var flatName = regexp.MustCompile("[^A-Za-z0-9]")
+
+//MigrateLayout moves messages stored directly in the messages directory below dataPath into the sharded layout.
+//Files are named by a sanitized form of their message ID, so the ID of each is looked up among the messages in messages.
+//Each file is linked to the path derived from its ID before the original is removed. Files matching no or several stored
+//messages and messages already present in the sharded layout are left in place and reported
+func MigrateLayout(dataPath string, messages database.MessageStore) (moved int, status int) {
+	path := dataPath + "/messages"
+	names, err := flatMessageFiles(path)
+	if os.IsNotExist(err) {
+		return 0, OK
+	}
+	if err != nil {
+		log.Error(StorageReadError, "Error listing "+path+": "+err.Error())
+		return 0, StorageReadError
+	}
+	if len(names) == 0 {
+		return 0, OK
+	}
+	status, ids := messages.GetStoredMessages()
+	if status != OK {
+		log.Error(status, "Error getting stored Messages to resolve the files in "+path+".")
+		return 0, status
+	}
+	candidates := make(map[string][]string, len(ids))
+	for _, id := range ids {
+		name := flatName.ReplaceAllString(id, "-")
+		candidates[name] = append(candidates[name], id)
+	}
+
+	b := &fsBackend{path: path}
+	for _, name := range names {
+		source := filepath.Join(path, name)
+		if len(candidates[name]) != 1 {
+			log.Warn(StorageLayoutUnresolved, "File "+source+" matches "+strconv.Itoa(len(candidates[name]))+" stored Messages instead of one, keeping it.")
+			status = StorageLayoutUnresolved
+			continue
+		}
+		id := candidates[name][0]
+		target := b.file(id)
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = os.Link(source, target)
+		}
+		if os.IsExist(err) {
+			log.Warn(StorageIdConflict, "Message "+keyring.Index(id)+" already exists at "+target+", keeping "+source+".")
+			status = StorageIdConflict
+			continue
+		}
+		if err == nil {
+			err = syncDir(filepath.Dir(target))
+		}
+		if err == nil {
+			err = os.Remove(source)
+		}
+		if err != nil {
+			log.Error(StorageWriteError, "Error moving Message "+keyring.Index(id)+": "+err.Error())
+			return moved, StorageWriteError
+		}
+		moved++
+	}
+	if err = b.Close(); err != nil {
+		log.Error(StorageWriteError, "Error syncing "+path+": "+err.Error())
+		return moved, StorageWriteError
+	}
+	return moved, status
+}
+
+//fileInfo derives the ETag from modification time and size, as message files are never modified after being written
+func fileInfo(id string, stat os.FileInfo) ObjectInfo {
+	etag := "\"" + strconv.FormatInt(stat.ModTime().UnixNano(), 16) + "-" + strconv.FormatInt(stat.Size(), 16) + "\""
+	return ObjectInfo{ID: id, Size: stat.Size(), StoredSize: stat.Size(), ModTime: stat.ModTime(), ETag: etag}
+}
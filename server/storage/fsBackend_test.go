@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"subframe/server/database"
+	. "subframe/status"
+	"subframe/structs/message"
+	"testing"
+)
+
+func TestMigrateLayout(t *testing.T) {
+	dataPath := t.TempDir()
+	path := filepath.Join(dataPath, "messages")
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	messages := database.NewMemory()
+	for _, id := range []string{"legacy.message_1", "a.b", "a_b"} {
+		if status := messages.LogMessageStorage(id, message.Metadata{}); status != OK {
+			t.Fatalf("logging message failed with status %d", status)
+		}
+	}
+	//Previous versions named files by the ID with everything but letters and digits replaced by a dash.
+	//a-b matches two stored messages, orphan none
+	for _, name := range []string{"legacy-message-1", "a-b", "orphan"} {
+		if err := ioutil.WriteFile(filepath.Join(path, name), []byte("content of "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, status := MigrateLayout(dataPath, messages)
+	if moved != 1 || status != StorageLayoutUnresolved {
+		t.Errorf("moved %d messages with status %d, expected 1 with status %d", moved, status, StorageLayoutUnresolved)
+	}
+	b, err := newFSBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, _, err := b.Get("legacy.message_1")
+	if err != nil {
+		t.Fatalf("migrated message cannot be read by its ID: %v", err)
+	}
+	defer reader.Close()
+	if content := read(t, reader); content != "content of legacy-message-1" {
+		t.Errorf("migrated message contains %q", content)
+	}
+	for _, name := range []string{"a-b", "orphan"} {
+		if _, err = os.Stat(filepath.Join(path, name)); err != nil {
+			t.Errorf("unresolved file %s was not kept: %v", name, err)
+		}
+	}
+
+	//Running the migration again only reports the files left in place
+	if moved, status = MigrateLayout(dataPath, messages); moved != 0 || status != StorageLayoutUnresolved {
+		t.Errorf("moved %d messages with status %d on the second run", moved, status)
+	}
+}
@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	. "subframe/status"
+)
+
+var identityKey ed25519.PrivateKey
+
+//loadIdentity reads the node's identity key from the data directory, generating a new one on first start
+func loadIdentity(path string) {
+	log.Info(InProgress, "Loading node identity from "+path+"...")
+	encoded, err := ioutil.ReadFile(path)
+	if err == nil {
+		seed, err := base64.StdEncoding.DecodeString(string(encoded))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Fatal(StorageReadError, "Identity key at "+path+" is corrupted.")
+		}
+		identityKey = ed25519.NewKeyFromSeed(seed)
+		log.Info(OK, "Loaded node identity "+IdentityPublicKey())
+		return
+	}
+	if !os.IsNotExist(err) {
+		log.Fatal(StorageReadError, "Failed to read identity key: "+err.Error())
+	}
+
+	log.Warn(StorageReadError, "No identity key found. Generating new node identity...")
+	_, identityKey, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(GenericInternalError, "Failed to generate identity key: "+err.Error())
+	}
+	err = ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(identityKey.Seed())), 0600)
+	if err != nil {
+		log.Fatal(StorageWriteError, "Failed to write identity key: "+err.Error())
+	}
+	log.Info(OK, "Generated node identity "+IdentityPublicKey())
+}
+
+//IdentityPublicKey returns the base64-encoded public identity key of the local node
+func IdentityPublicKey() string {
+	return base64.StdEncoding.EncodeToString(identityKey.Public().(ed25519.PublicKey))
+}
+
+//Sign signs data with the identity key of the local node, so other nodes can attribute requests to it
+func Sign(data []byte) []byte {
+	return ed25519.Sign(identityKey, data)
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+//memoryBackend keeps messages in memory. They are lost when the process exits
+type memoryBackend struct {
+	mutex    sync.RWMutex
+	messages map[string]memoryObject
+}
+
+type memoryObject struct {
+	content []byte
+	info    ObjectInfo
+}
+
+//memoryReader serves a message from memory. Messages are never modified, so readers can share their content
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{messages: make(map[string]memoryObject)}
+}
+
+func (b *memoryBackend) Put(id string, content io.Reader) (ObjectInfo, error) {
+	data, err := ioutil.ReadAll(content)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	info := ObjectInfo{ID: id, Size: int64(len(data)), StoredSize: int64(len(data)), ModTime: time.Now(), ETag: "\"" + hash + "\"", SHA256: hash}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.messages[id]; ok {
+		return ObjectInfo{}, ErrExists
+	}
+	b.messages[id] = memoryObject{content: data, info: info}
+	return info, nil
+}
+
+func (b *memoryBackend) Get(id string) (io.ReadSeekCloser, ObjectInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	object, ok := b.messages[id]
+	if !ok {
+		return nil, ObjectInfo{}, ErrNotFound
+	}
+	return memoryReader{bytes.NewReader(object.content)}, object.info, nil
+}
+
+func (b *memoryBackend) Delete(id string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.messages[id]; !ok {
+		return ErrNotFound
+	}
+	delete(b.messages, id)
+	return nil
+}
+
+func (b *memoryBackend) Stat(id string) (ObjectInfo, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	object, ok := b.messages[id]
+	if !ok {
+		return ObjectInfo{}, ErrNotFound
+	}
+	return object.info, nil
+}
+
+func (b *memoryBackend) List() ([]string, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	ids := make([]string, 0, len(b.messages))
+	for id := range b.messages {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (b *memoryBackend) Usage() (int64, error) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	var size int64
+	for _, object := range b.messages {
+		size += object.info.Size
+	}
+	return size, nil
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
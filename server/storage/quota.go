@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"subframe/server/metrics"
+	"subframe/server/settings"
+	. "subframe/status"
+	"time"
+)
+
+//Quota describes the space used for message storage, as limited by settings.DiskSpace
+type Quota struct {
+	Limit        int64         `json:"limit"`
+	Used         int64         `json:"used"`
+	Reserved     int64         `json:"reserved"`
+	Free         int64         `json:"free"`
+	Reservations []Reservation `json:"reservations"`
+}
+
+//Reservation is space set aside for a message while it is received
+type Reservation struct {
+	MessageID string    `json:"messageId"`
+	Bytes     int64     `json:"bytes"`
+	Since     time.Time `json:"since"`
+}
+
+//reservation is released once it is committed or released, later calls do nothing
+type reservation struct {
+	messageID string
+	bytes     int64
+	since     time.Time
+	released  bool
+	storage   *Storage
+}
+
+//errQuotaExceeded is returned by quotaReader if a message outgrows the remaining space
+var errQuotaExceeded = errors.New("message exceeds the remaining storage space")
+
+//quotaStep is the amount by which reservations of messages of unknown size grow
+const quotaStep = 1 << 20
+
+//initQuota loads the recorded usage and reconciles it against the Backend, which is only listed once at startup
+func (s *Storage) initQuota() {
+	_, recorded := s.usage.GetStorageUsage()
+	actual, err := s.backend.Usage()
+	if err != nil {
+		log.Error(StorageReadError, "Failed to reconcile storage usage, keeping recorded usage of "+strconv.FormatInt(recorded, 10)+" bytes: "+err.Error())
+		actual = recorded
+	} else {
+		if actual != recorded {
+			log.Warn(StorageQuotaMismatch, "Recorded storage usage of "+strconv.FormatInt(recorded, 10)+" bytes differs from "+strconv.FormatInt(actual, 10)+" bytes in storage backend. Correcting...")
+		}
+		s.usage.SetStorageUsage(actual)
+	}
+
+	s.quotaMutex.Lock()
+	s.usedBytes = actual
+	s.quotaMutex.Unlock()
+	metrics.StorageBytesUsed.Set(float64(actual))
+	metrics.StorageBytesLimit.Set(float64(settings.Get().DiskSpace))
+	log.Info(OK, "Storage usage is "+strconv.FormatInt(actual, 10)+" of "+settings.Get().DiskSpace.String()+".")
+}
+
+//reserve sets aside size bytes for message id, if they fit into settings.DiskSpace next to stored messages and other reservations
+func (s *Storage) reserve(id string, size int64) (r *reservation, ok bool) {
+	//Expired uploads must not hold on to their reservations
+	s.sweepUploads()
+	s.quotaMutex.Lock()
+	defer s.quotaMutex.Unlock()
+	if !s.fits(size) {
+		return nil, false
+	}
+	r = &reservation{messageID: id, bytes: size, since: time.Now(), storage: s}
+	s.reservations[r] = true
+	s.reservedBytes += size
+	metrics.StorageBytesReserved.Set(float64(s.reservedBytes))
+	return r, true
+}
+
+//ensure grows the reservation to at least size bytes, if the remaining space allows for it
+func (r *reservation) ensure(size int64) bool {
+	s := r.storage
+	s.quotaMutex.Lock()
+	defer s.quotaMutex.Unlock()
+	if r.released {
+		return false
+	}
+	if size <= r.bytes {
+		return true
+	}
+	if !s.fits(size - r.bytes) {
+		return false
+	}
+	s.reservedBytes += size - r.bytes
+	r.bytes = size
+	metrics.StorageBytesReserved.Set(float64(s.reservedBytes))
+	return true
+}
+
+//commit turns the reservation into size bytes of used space, once the message has been stored
+func (r *reservation) commit(size int64) {
+	s := r.storage
+	s.quotaMutex.Lock()
+	if r.released {
+		s.quotaMutex.Unlock()
+		return
+	}
+	r.released = true
+	delete(s.reservations, r)
+	s.reservedBytes -= r.bytes
+	s.usedBytes += size
+	metrics.StorageBytesReserved.Set(float64(s.reservedBytes))
+	metrics.StorageBytesUsed.Set(float64(s.usedBytes))
+	s.quotaMutex.Unlock()
+	s.usage.AddStorageUsage(size)
+}
+
+//release frees the reservation, after the message could not be stored
+func (r *reservation) release() {
+	s := r.storage
+	s.quotaMutex.Lock()
+	defer s.quotaMutex.Unlock()
+	if r.released {
+		return
+	}
+	r.released = true
+	delete(s.reservations, r)
+	s.reservedBytes -= r.bytes
+	metrics.StorageBytesReserved.Set(float64(s.reservedBytes))
+}
+
+//addUsage records that size bytes, which may be negative, have been added to the Backend outside of a reservation
+func (s *Storage) addUsage(size int64) {
+	s.quotaMutex.Lock()
+	s.usedBytes += size
+	if s.usedBytes < 0 {
+		s.usedBytes = 0
+	}
+	metrics.StorageBytesUsed.Set(float64(s.usedBytes))
+	s.quotaMutex.Unlock()
+	s.usage.AddStorageUsage(size)
+}
+
+//fits returns whether another size bytes can be reserved. quotaMutex has to be held
+func (s *Storage) fits(size int64) bool {
+	return s.usedBytes+s.reservedBytes+size <= int64(settings.Get().DiskSpace)
+}
+
+//QuotaStatus returns the current usage and all active reservations
+func (s *Storage) QuotaStatus() Quota {
+	s.sweepUploads()
+	s.quotaMutex.Lock()
+	defer s.quotaMutex.Unlock()
+	quota := Quota{
+		Limit:        int64(settings.Get().DiskSpace),
+		Used:         s.usedBytes,
+		Reserved:     s.reservedBytes,
+		Reservations: []Reservation{},
+	}
+	quota.Free = quota.Limit - quota.Used - quota.Reserved
+	if quota.Free < 0 {
+		quota.Free = 0
+	}
+	for r := range s.reservations {
+		quota.Reservations = append(quota.Reservations, Reservation{MessageID: r.messageID, Bytes: r.bytes, Since: r.since})
+	}
+	return quota
+}
+
+//quotaReader grows reservation while content is read, and fails once it cannot grow any further.
+//read starts at the number of bytes already written within the reservation
+type quotaReader struct {
+	reader      io.Reader
+	reservation *reservation
+	read        int64
+	covered     int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.reader.Read(p)
+	q.read += int64(n)
+	if q.read > q.covered {
+		//Growing in steps keeps the lock from being taken on every read, the exact size may still fit if a whole step does not
+		switch {
+		case q.reservation.ensure(q.read + quotaStep):
+			q.covered = q.read + quotaStep
+		case q.reservation.ensure(q.read):
+			q.covered = q.read
+		default:
+			return 0, errQuotaExceeded
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"subframe/server/settings"
+	"sync"
+	"testing"
+)
+
+//usageFailingBackend fails to report its usage, like a Backend which cannot be listed
+type usageFailingBackend struct {
+	Backend
+}
+
+func (b usageFailingBackend) Usage() (int64, error) {
+	return 0, errors.New("listing failed")
+}
+
+func TestConcurrentReservations(t *testing.T) {
+	for _, size := range []int64{1000, -1} {
+		s, _ := newTestStorage(t, func(config *settings.Config) { config.DiskSpace = 10000 })
+		content := strings.Repeat("x", 1000)
+
+		var wait sync.WaitGroup
+		var mutex sync.Mutex
+		statuses := map[int]int{}
+		for i := 0; i < 50; i++ {
+			wait.Add(1)
+			go func(id string) {
+				defer wait.Done()
+				_, status := s.Put(id, strings.NewReader(content), size, "")
+				mutex.Lock()
+				statuses[status]++
+				mutex.Unlock()
+			}(fmt.Sprint("message", i))
+		}
+		wait.Wait()
+
+		if statuses[http.StatusOK] != 10 || statuses[http.StatusInsufficientStorage] != 40 {
+			t.Errorf("concurrent puts of announced size %d returned %v, expected 10 stored and 40 rejected", size, statuses)
+		}
+		if quota := s.QuotaStatus(); quota.Used != 10000 || quota.Reserved != 0 || quota.Free != 0 {
+			t.Errorf("quota after concurrent puts of announced size %d is %+v", size, quota)
+		}
+		if usage, _ := s.backend.Usage(); usage != 10000 {
+			t.Errorf("%d bytes stored by concurrent puts of announced size %d, expected 10000", usage, size)
+		}
+	}
+}
+
+func TestReservation(t *testing.T) {
+	s, _ := newTestStorage(t, func(config *settings.Config) { config.DiskSpace = 1000 })
+	first, ok := s.reserve("first", 600)
+	if !ok {
+		t.Fatal("reserving free space failed")
+	}
+	if _, ok = s.reserve("second", 500); ok {
+		t.Errorf("reserving more than the free space succeeded")
+	}
+	second, ok := s.reserve("second", 0)
+	if !ok {
+		t.Fatal("reserving empty space failed")
+	}
+	if second.ensure(500) || !second.ensure(400) {
+		t.Errorf("growing reservation is not limited by the free space")
+	}
+
+	first.commit(550)
+	first.release()
+	second.release()
+	if second.ensure(1) {
+		t.Errorf("released reservation grows")
+	}
+	if quota := s.QuotaStatus(); quota.Used != 550 || quota.Reserved != 0 || quota.Free != 450 || len(quota.Reservations) != 0 {
+		t.Errorf("quota after committing 550 bytes is %+v", quota)
+	}
+	if _, used := s.usage.GetStorageUsage(); used != 550 {
+		t.Errorf("%d bytes used are recorded, expected 550", used)
+	}
+}
+
+func TestInitQuota(t *testing.T) {
+	s, db := newTestStorage(t, nil)
+	//Messages written while the recorded usage was not updated, e.g. before a crash
+	put(t, s.backend, "message", "content")
+	db.SetStorageUsage(12345)
+
+	s.initQuota()
+	if used := s.QuotaStatus().Used; used != int64(len("content")) {
+		t.Errorf("%d bytes used after reconciling, expected %d", used, len("content"))
+	}
+	if _, recorded := db.GetStorageUsage(); recorded != int64(len("content")) {
+		t.Errorf("%d bytes used are recorded after reconciling, expected %d", recorded, len("content"))
+	}
+
+	//The recorded usage is kept if the Backend cannot report its usage
+	db.SetStorageUsage(12345)
+	s.backend = usageFailingBackend{s.backend}
+	s.initQuota()
+	if used := s.QuotaStatus().Used; used != 12345 {
+		t.Errorf("%d bytes used after failing to reconcile, expected the recorded 12345", used)
+	}
+	if _, recorded := db.GetStorageUsage(); recorded != 12345 {
+		t.Errorf("%d bytes used are recorded after failing to reconcile, expected 12345", recorded)
+	}
+}
@@ -0,0 +1,348 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//s3Backend stores every message as an object in an S3-compatible object storage, using path-style requests signed with AWS Signature Version 4
+type s3Backend struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+//s3ListResult is the part of a ListObjectsV2 response used by List and Usage
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+var emptyPayloadHash = hashHex(nil)
+
+func newS3Backend(endpoint string, region string, bucket string, prefix string, accessKey string, secretKey string) (*s3Backend, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Backend{
+		endpoint:  parsed,
+		region:    region,
+		bucket:    bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+//Put spools content to a temporary file first, as the size and hash of the payload have to be known before signing the request
+func (b *s3Backend) Put(id string, content io.Reader) (ObjectInfo, error) {
+	spool, err := ioutil.TempFile("", "subframe-s3-upload-")
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, hash), content)
+	if err == nil {
+		_, err = spool.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	sha := hex.EncodeToString(hash.Sum(nil))
+
+	//If-None-Match makes the object storage refuse to overwrite an existing message
+	headers := map[string]string{"If-None-Match": "*", "X-Amz-Meta-Sha256": sha}
+	resp, err := b.do("PUT", b.prefix+id, nil, spool, size, sha, headers)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return ObjectInfo{}, ErrExists
+	}
+	if err = checkS3Response(resp); err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{ID: id, Size: size, StoredSize: size, ModTime: time.Now(), ETag: resp.Header.Get("ETag"), SHA256: sha}, nil
+}
+
+func (b *s3Backend) Get(id string) (io.ReadSeekCloser, ObjectInfo, error) {
+	info, err := b.Stat(id)
+	if err != nil {
+		return nil, ObjectInfo{}, err
+	}
+	return &s3Object{backend: b, key: b.prefix + id, size: info.Size, etag: info.ETag}, info, nil
+}
+
+func (b *s3Backend) Delete(id string) error {
+	//S3 reports success for missing objects, so existence is checked first
+	if _, err := b.Stat(id); err != nil {
+		return err
+	}
+	resp, err := b.do("DELETE", b.prefix+id, nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkS3Response(resp)
+}
+
+func (b *s3Backend) Stat(id string) (ObjectInfo, error) {
+	resp, err := b.do("HEAD", b.prefix+id, nil, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	defer resp.Body.Close()
+	if err = checkS3Response(resp); err != nil {
+		return ObjectInfo{}, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{ID: id, Size: resp.ContentLength, StoredSize: resp.ContentLength, ModTime: modTime, ETag: resp.Header.Get("ETag"), SHA256: resp.Header.Get("X-Amz-Meta-Sha256")}, nil
+}
+
+func (b *s3Backend) List() ([]string, error) {
+	var ids []string
+	err := b.list(func(key string, size int64) {
+		ids = append(ids, strings.TrimPrefix(key, b.prefix))
+	})
+	return ids, err
+}
+
+func (b *s3Backend) Usage() (int64, error) {
+	var usage int64
+	err := b.list(func(key string, size int64) {
+		usage += size
+	})
+	return usage, err
+}
+
+func (b *s3Backend) Close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+//list calls found for every object with the configured prefix, following continuation tokens
+func (b *s3Backend) list(found func(key string, size int64)) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {b.prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.do("GET", "", query, nil, 0, emptyPayloadHash, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = checkS3Response(resp)
+		if err == nil {
+			err = xml.NewDecoder(resp.Body).Decode(&result)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			found(object.Key, object.Size)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+//do sends a signed request for key in the bucket. An empty key addresses the bucket itself
+func (b *s3Backend) do(method string, key string, query url.Values, body io.Reader, size int64, payloadHash string, headers map[string]string) (*http.Response, error) {
+	path := strings.TrimSuffix(b.endpoint.EscapedPath(), "/") + "/" + s3Escape(b.bucket, false)
+	if key != "" {
+		path += "/" + s3Escape(key, false)
+	}
+	rawQuery := canonicalQuery(query)
+	target := b.endpoint.Scheme + "://" + b.endpoint.Host + path
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	b.sign(req, path, rawQuery, payloadHash, time.Now().UTC())
+	return b.client.Do(req)
+}
+
+//sign adds an AWS Signature Version 4 Authorization header to req
+func (b *s3Backend) sign(req *http.Request, path string, rawQuery string, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	//The host and all x-amz-* headers have to be signed
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+			values[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + values[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{req.Method, path, rawQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+
+	scope := date + "/" + b.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.secretKey), date)
+	key = hmacSHA256(key, b.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+b.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func checkS3Response(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return errors.New("object storage responded " + strconv.Itoa(resp.StatusCode) + ": " + strings.TrimSpace(string(message)))
+}
+
+//s3Object reads a message from the object storage. After seeking, the remainder of the message is requested with a Range header
+type s3Object struct {
+	backend *s3Backend
+	key     string
+	size    int64
+	etag    string
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		//If-Match fails the request if the message has been replaced since it was opened
+		headers := map[string]string{"Range": "bytes=" + strconv.FormatInt(o.offset, 10) + "-", "If-Match": o.etag}
+		resp, err := o.backend.do("GET", o.key, nil, nil, 0, emptyPayloadHash, headers)
+		if err != nil {
+			return 0, err
+		}
+		if err = checkS3Response(resp); err != nil {
+			resp.Body.Close()
+			return 0, err
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return o.offset, errors.New("seek before start of message")
+	}
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	return o.body.Close()
+}
+
+//canonicalQuery encodes query sorted by key, as required for signing
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+//s3Escape percent-encodes everything except unreserved characters, and slashes unless escapeSlash is set
+func s3Escape(value string, escapeSlash bool) string {
+	var escaped strings.Builder
+	for _, c := range []byte(value) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			escaped.WriteByte(c)
+			continue
+		}
+		escaped.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return escaped.String()
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
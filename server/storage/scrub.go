@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"subframe/server/keyring"
+	"subframe/server/lifecycle"
+	. "subframe/status"
+	"time"
+)
+
+//Hash re-reads a message from the Backend and returns its hex encoded SHA-256 hash.
+//rate limits reading to rate bytes per second, 0 does not limit it
+func (s *Storage) Hash(id string, rate int64) (sha string, status int) {
+	content, _, err := s.backend.Get(id)
+	if err != nil {
+		log.Error(StorageReadError, "Error hashing Message "+keyring.Index(id)+": "+err.Error())
+		return "", StorageReadError
+	}
+	defer content.Close()
+
+	var reader io.Reader = content
+	if rate > 0 {
+		reader = &throttledReader{reader: content, rate: rate, start: time.Now()}
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(hash, reader); err != nil {
+		log.Error(StorageReadError, "Error hashing Message "+keyring.Index(id)+": "+err.Error())
+		return "", StorageReadError
+	}
+	return hex.EncodeToString(hash.Sum(nil)), OK
+}
+
+//Exists returns whether a message is in the Backend, even if it cannot be read anymore
+func (s *Storage) Exists(id string) (exists bool, status int) {
+	_, err := s.backend.Stat(id)
+	if err == ErrNotFound {
+		return false, OK
+	}
+	if err != nil {
+		log.Error(StorageReadError, "Error looking up Message "+keyring.Index(id)+": "+err.Error())
+		return false, StorageReadError
+	}
+	return true, OK
+}
+
+//Quarantine moves a corrupted message out of the Backend into the quarantine directory, where it is kept for inspection.
+//Encrypted messages stay sealed and are named by their blind index
+func (s *Storage) Quarantine(id string) (status int) {
+	s.activeWrites.Add(1)
+	defer s.activeWrites.Done()
+
+	content, info, err := s.rawGet(id)
+	if err != nil {
+		log.Error(StorageQuarantineError, "Error quarantining Message "+keyring.Index(id)+": "+err.Error())
+		return StorageQuarantineError
+	}
+	defer content.Close()
+
+	target := filepath.Join(s.quarantinePath, keyring.Index(id)+"."+strconv.FormatInt(time.Now().UnixNano(), 36))
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err == nil {
+		_, err = io.Copy(file, content)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = s.backend.Delete(id)
+	}
+	if err != nil {
+		log.Error(StorageQuarantineError, "Error quarantining Message "+keyring.Index(id)+": "+err.Error())
+		os.Remove(target)
+		return StorageQuarantineError
+	}
+	//Quarantined messages do not count against settings.DiskSpace
+	s.addUsage(-info.StoredSize)
+	log.Warn(StorageChecksumMismatch, "Quarantined Message "+keyring.Index(id)+" to "+target)
+	return OK
+}
+
+//Restore stores a copy of a quarantined message, e.g. fetched from another StorageNode. The copy is only kept if it matches sha256
+func (s *Storage) Restore(id string, content io.Reader, sha256 string) (status int) {
+	s.activeWrites.Add(1)
+	defer s.activeWrites.Done()
+
+	info, err := s.backend.Put(id, content)
+	if err != nil {
+		log.Error(StorageWriteError, "Error restoring Message "+keyring.Index(id)+": "+err.Error())
+		return StorageWriteError
+	}
+	if info.SHA256 != sha256 {
+		log.Warn(StorageChecksumMismatch, "Copy of Message "+keyring.Index(id)+" does not match its hash. Discarding...")
+		if err = s.backend.Delete(id); err != nil {
+			log.Error(StorageWriteError, "Error removing corrupted copy of Message "+keyring.Index(id)+": "+err.Error())
+		}
+		return StorageChecksumMismatch
+	}
+	s.addUsage(info.StoredSize)
+	log.Info(OK, "Restored Message "+keyring.Index(id))
+	return OK
+}
+
+//throttledReader delays reads, so that on average no more than rate bytes are read per second
+type throttledReader struct {
+	reader io.Reader
+	rate   int64
+	start  time.Time
+	read   int64
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.rate {
+		p = p[:r.rate]
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	wait := time.Duration(float64(r.read)/float64(r.rate)*float64(time.Second)) - time.Since(r.start)
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-lifecycle.Context().Done():
+			return n, lifecycle.Context().Err()
+		}
+	}
+	return n, err
+}
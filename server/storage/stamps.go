@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"subframe/server/settings"
+	"subframe/structs/stamp"
+	"time"
+)
+
+//StampRules returns the postage stamps this node currently requires to store messages.
+//The required bits increase with the share of settings.DiskSpace used or reserved
+func (s *Storage) StampRules() stamp.Rules {
+	config := settings.Get()
+	rules := coordinatorStampRules(config)
+	s.quotaMutex.Lock()
+	used := s.usedBytes + s.reservedBytes
+	s.quotaMutex.Unlock()
+	if used > 0 && config.DiskSpace > 0 {
+		rules.LoadBits = int(int64(config.StampLoadBits) * min(used, int64(config.DiskSpace)) / int64(config.DiskSpace))
+	}
+	return rules
+}
+
+//CoordinatorStampRules returns the postage stamps required for announcements. Announcing StorageNodes checked their own
+//load when accepting the message, so announcements only have to satisfy the rules of an empty node
+func CoordinatorStampRules() stamp.Rules {
+	return coordinatorStampRules(settings.Get())
+}
+
+func coordinatorStampRules(config settings.Config) stamp.Rules {
+	return stamp.Rules{
+		Version:     stamp.Version,
+		BaseBits:    config.StampBits,
+		SizeStep:    int64(config.StampSizeStep),
+		MaxLoadBits: config.StampLoadBits,
+		MaxAge:      int64(time.Duration(config.StampMaxAge) / time.Second),
+	}
+}
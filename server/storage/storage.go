@@ -1,108 +1,304 @@
 package storage
 
 import (
-	"io/ioutil"
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"subframe/server/database"
+	"subframe/server/keyring"
 	"subframe/server/logger"
+	"subframe/server/metrics"
 	"subframe/server/settings"
 	. "subframe/status"
 	"subframe/structs/message"
+	"sync"
+	"time"
 )
 
-var messagesPath string
-var databasePath string
-var logPath string
 var log = logger.Logger{Prefix: "storage/Main"}
 
-//Init initializes the data directory
-func Init() {
-	log.Info(InProgress, "Initializing Storage Directories...")
-	createDirIfNotExist(settings.DataPath)
-	log.Info(OK, "Initialized "+settings.DataPath)
+//Storage keeps messages in a Backend. Its MessageStore keeps track of the stored messages, its UsageStore of the space they take up
+type Storage struct {
+	messages       database.MessageStore
+	usage          database.UsageStore
+	backend        Backend
+	activeWrites   sync.WaitGroup
+	quarantinePath string
+
+	quotaMutex    sync.Mutex
+	usedBytes     int64
+	reservedBytes int64
+	reservations  map[*reservation]bool
 
-	messagesPath = settings.DataPath + "/messages"
-	createDirIfNotExist(messagesPath)
-	log.Info(OK, "Initialized "+messagesPath)
+	uploadsPath  string
+	uploads      map[string]*uploadSession
+	uploadsMutex sync.Mutex
+
+	writableMutex   sync.Mutex
+	writableStatus  int
+	writableChecked time.Time
+}
+
+//writableCheckInterval is how long the result of CheckWritable is reused, as probing remote backends is billed per request
+const writableCheckInterval = 15 * time.Second
+
+//New initializes the data directory and returns a Storage keeping messages in backend. messages keeps track of the stored messages,
+//usage of the space they take up
+func New(messages database.MessageStore, usage database.UsageStore, backend Backend) *Storage {
+	s := &Storage{
+		messages:     messages,
+		usage:        usage,
+		backend:      backend,
+		reservations: map[*reservation]bool{},
+		uploads:      map[string]*uploadSession{},
+	}
+	log.Info(InProgress, "Initializing Storage Directories...")
+	dataPath := settings.Get().DataPath
+	createDirIfNotExist(dataPath)
+	log.Info(OK, "Initialized "+dataPath)
 
-	databasePath = settings.DataPath + "/databases"
+	databasePath := dataPath + "/databases"
 	createDirIfNotExist(databasePath)
 	log.Info(OK, "Initialized "+databasePath)
 
-	logPath = settings.DataPath + "/logs"
+	logPath := dataPath + "/logs"
 	createDirIfNotExist(logPath)
 	logger.LogPath = logPath
 
 	log.Info(OK, "Initialized "+logPath)
+
+	loadIdentity(dataPath + "/identity.key")
+
+	s.initUploads(dataPath + "/uploads")
+
+	s.quarantinePath = dataPath + "/quarantine"
+	createDirIfNotExist(s.quarantinePath)
+
+	s.initQuota()
+	return s
 }
 
-//Finish might do something soon
-func Finish() {
+//Finish waits for active writes to complete, until ctx is done, and closes the Backend
+func (s *Storage) Finish(ctx context.Context) {
 	log.Info(InProgress, "Finishing Storage...")
+	finished := make(chan bool)
+	go func() {
+		s.activeWrites.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Warn(StorageWriteError, "Timed out waiting for active writes to complete.")
+	}
 
+	if err := s.backend.Close(); err != nil {
+		log.Error(StorageWriteError, "Failed to close storage backend: "+err.Error())
+	}
 	log.Info(OK, "Finished Storage.")
 }
 
-//Get loads a message from local disk
-func Get(id string) (msg message.Message, status int) {
-	//Read message from disk and return
-	log.Info("Getting Message " + id + "...")
+//Get opens a message for reading. The caller has to close content
+func (s *Storage) Get(id string) (content io.ReadSeekCloser, info ObjectInfo, status int) {
+	defer metrics.ObserveStorage("get", time.Now())
+	log.Info(InProgress, "Getting Message "+keyring.Index(id)+"...")
 
-	if !database.CheckMessageStorage(id) {
-		log.Warn("Error getting Message " + id + ": Not in database")
-		return message.Message{}, http.StatusNotFound
+	if _, stored := s.messages.CheckMessageStorage(id); !stored {
+		log.Warn(StorageReadError, "Error getting Message "+keyring.Index(id)+": Not in database")
+		metrics.StorageGets.WithLabelValues("not_found").Inc()
+		return nil, ObjectInfo{}, http.StatusNotFound
 	}
 
-	dat, err := ioutil.ReadFile(messagesPath + "/" + id)
+	content, info, err := s.backend.Get(id)
+	if err == ErrNotFound {
+		log.Warn(StorageReadError, "Error getting Message "+keyring.Index(id)+": "+err.Error())
+		metrics.StorageGets.WithLabelValues("not_found").Inc()
+		return nil, ObjectInfo{}, http.StatusNotFound
+	}
 	if err != nil {
-		log.Warn("Error getting Message " + id + ": " + err.Error())
-		return message.Message{}, http.StatusNotFound
+		log.Error(StorageReadError, "Error getting Message "+keyring.Index(id)+": "+err.Error())
+		metrics.StorageGets.WithLabelValues("error").Inc()
+		return nil, ObjectInfo{}, http.StatusInternalServerError
+	}
+	//The hash recorded when the message was stored is authoritative, the Backend may not keep one
+	if _, sha256 := s.messages.GetMessageHash(id); sha256 != "" {
+		info.SHA256 = sha256
 	}
-	log.Info("Got Message " + id)
-	return message.Message{
-		ID:      id,
-		Content: string(dat),
-	}, http.StatusOK
+	log.Info(OK, "Got Message "+keyring.Index(id))
+	metrics.StorageGets.WithLabelValues("ok").Inc()
+	metrics.StorageMessageSize.WithLabelValues("get").Observe(float64(info.Size))
+	return content, info, http.StatusOK
 }
 
-//Put writes a message to local disk
-func Put(msg message.Message) (status int) {
-	id := msg.ID
-	content := []byte(msg.Content)
+//Put streams a message from content to the Backend. size is the announced size of the message, or -1 if unknown.
+//If sha256 is set, the message is only kept if its hex encoded SHA-256 hash matches
+func (s *Storage) Put(id string, content io.Reader, size int64, sha256 string) (info ObjectInfo, status int) {
+	defer metrics.ObserveStorage("put", time.Now())
+	s.activeWrites.Add(1)
+	defer s.activeWrites.Done()
 
-	log.Info("Putting Message " + id)
+	log.Info(InProgress, "Putting Message "+keyring.Index(id))
 
-	if database.CheckMessageStorage(id) {
-		log.Error("Error storing Message " + id + ": Already in database")
-		return http.StatusConflict
+	if _, stored := s.messages.CheckMessageStorage(id); stored {
+		log.Error(StorageIdConflict, "Error storing Message "+keyring.Index(id)+": Already in database")
+		metrics.StoragePuts.WithLabelValues("conflict").Inc()
+		return ObjectInfo{}, http.StatusConflict
 	}
 
-	if !checkStorageSpace(len(content)) {
-		log.Warn("Could not store Message " + id + ": Insufficient Storage.")
-		return http.StatusInsufficientStorage
+	//Messages of unknown size reserve space while they are received
+	reserved, ok := s.reserve(id, max(size, 0))
+	if !ok {
+		log.Warn(StorageInsufficientSpace, "Could not store Message "+keyring.Index(id)+": Insufficient Storage.")
+		metrics.StoragePuts.WithLabelValues("insufficient_storage").Inc()
+		return ObjectInfo{}, http.StatusInsufficientStorage
 	}
+	info, status = s.store(id, content, reserved, sha256)
+	if status != http.StatusOK {
+		reserved.release()
+	}
+	return info, status
+}
 
-	if _, err := os.Stat(messagesPath + "/" + id); os.IsNotExist(err) {
-		err = ioutil.WriteFile(messagesPath+"/"+id, content, 0600)
-		if err != nil {
-			log.Error("Error storing Message " + id + ": " + err.Error())
-			return http.StatusInternalServerError
+//store streams a message from content to the Backend within reserved, and commits the reservation once the message is stored
+//and matches sha256, if set
+func (s *Storage) store(id string, content io.Reader, reserved *reservation, sha256 string) (info ObjectInfo, status int) {
+	reader := &errorRecordingReader{reader: &quotaReader{reader: content, reservation: reserved, covered: reserved.bytes}}
+	info, err := s.backend.Put(id, reader)
+	if err == ErrExists {
+		log.Error(StorageIdConflict, "Error storing Message "+keyring.Index(id)+": File exists")
+		metrics.StoragePuts.WithLabelValues("conflict").Inc()
+		return ObjectInfo{}, http.StatusConflict
+	}
+	if err != nil && reader.err != nil {
+		if reader.err == errQuotaExceeded {
+			log.Warn(StorageInsufficientSpace, "Could not store Message "+keyring.Index(id)+": Insufficient Storage.")
+			metrics.StoragePuts.WithLabelValues("insufficient_storage").Inc()
+			return ObjectInfo{}, http.StatusInsufficientStorage
+		}
+		//The message could not be received completely, which is not a storage failure
+		status = http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(reader.err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		log.Warn(StorageWriteError, "Error receiving Message "+keyring.Index(id)+": "+reader.err.Error())
+		metrics.StoragePuts.WithLabelValues("receive_error").Inc()
+		return ObjectInfo{}, status
+	}
+	if err != nil {
+		log.Error(StorageWriteError, "Error storing Message "+keyring.Index(id)+": "+err.Error())
+		metrics.StoragePuts.WithLabelValues("error").Inc()
+		return ObjectInfo{}, http.StatusInternalServerError
+	}
+
+	if sha256 != "" && !strings.EqualFold(sha256, info.SHA256) {
+		log.Warn(StorageContentHashMismatch, "Discarding Message "+keyring.Index(id)+": Hash does not match.")
+		if err = s.backend.Delete(id); err != nil {
+			log.Error(StorageWriteError, "Error removing Message "+keyring.Index(id)+": "+err.Error())
+		}
+		metrics.StoragePuts.WithLabelValues("hash_mismatch").Inc()
+		return ObjectInfo{}, http.StatusUnprocessableEntity
+	}
+
+	reserved.commit(info.StoredSize)
+	log.Info(OK, "Successfully stored Message "+keyring.Index(id)+" (SHA-256 "+info.SHA256+")")
+	metrics.StoragePuts.WithLabelValues("ok").Inc()
+	metrics.StorageMessageSize.WithLabelValues("put").Observe(float64(info.Size))
+	return info, http.StatusOK
+}
+
+//Discard removes a message described by info from the Backend and frees the space it took up, e.g. if it was stored by Put
+//or FinishUpload, but could not be recorded afterwards
+func (s *Storage) Discard(id string, info ObjectInfo) (status int) {
+	s.activeWrites.Add(1)
+	defer s.activeWrites.Done()
+
+	if err := s.backend.Delete(id); err != nil && err != ErrNotFound {
+		log.Error(StorageWriteError, "Error discarding Message "+keyring.Index(id)+": "+err.Error())
+		return StorageWriteError
+	}
+	s.addUsage(-info.StoredSize)
+	log.Info(OK, "Discarded Message "+keyring.Index(id)+".")
+	return OK
+}
+
+//Delete removes an expired or received message from the Backend and the MessageStore, and frees the space it took up.
+//Messages already missing from the Backend are only removed from the MessageStore
+func (s *Storage) Delete(id string) (status int) {
+	info, err := s.backend.Stat(id)
+	if err != nil && err != ErrNotFound {
+		log.Error(StorageReadError, "Error deleting Message "+keyring.Index(id)+": "+err.Error())
+		return StorageReadError
+	}
+	if err == nil {
+		if status = s.Discard(id, info); status != OK {
+			return status
 		}
+	}
+	return s.messages.RemoveMessageStorage(id)
+}
 
-		log.Info("Successfully stored Message " + id)
-		return http.StatusOK
+//ApplySettings updates the storage quota after settings.DiskSpace changed
+func ApplySettings(previous settings.Config, next settings.Config) {
+	if previous.DiskSpace != next.DiskSpace {
+		log.Info(OK, "Storage quota changed from "+previous.DiskSpace.String()+" to "+next.DiskSpace.String()+".")
+		metrics.StorageBytesLimit.Set(float64(next.DiskSpace))
 	}
-	log.Error("Error storing Message " + id + ": File exists")
-	return http.StatusConflict
 }
 
-//Delete removes a message from local disk
-func Delete(id string) (status int) {
-	//Delete message from disk
-	log.Fatal("Method DELETE not yet implemented")
-	return http.StatusOK
+//Expiry returns the time a message described by metadata is removed. The TTL requested by the sender is counted from the
+//time it created the message and clamped to settings.MessageMinStoreTime and settings.MessageMaxStoreTime from now
+func Expiry(metadata message.Metadata, now time.Time) time.Time {
+	config := settings.Get()
+	created := metadata.CreatedOn
+	if created.IsZero() || created.After(now) {
+		created = now
+	}
+	expiresOn := now.Add(config.MessageMaxStoreTime.Std())
+	if metadata.TTL > 0 && created.Add(metadata.TTL).Before(expiresOn) {
+		expiresOn = created.Add(metadata.TTL)
+	}
+	if earliest := now.Add(config.MessageMinStoreTime.Std()); expiresOn.Before(earliest) {
+		expiresOn = earliest
+	}
+	return expiresOn.UTC()
+}
+
+//FreeSpace returns the remaining space in bytes for message storage, as limited by settings.DiskSpace
+func (s *Storage) FreeSpace() int64 {
+	return s.QuotaStatus().Free
+}
+
+//CheckWritable checks whether messages can be written to the Backend, by writing and removing a probe.
+//The result is reused for writableCheckInterval, so frequent readiness probes do not each write to the Backend
+func (s *Storage) CheckWritable() (status int) {
+	s.writableMutex.Lock()
+	defer s.writableMutex.Unlock()
+	if time.Since(s.writableChecked) < writableCheckInterval {
+		return s.writableStatus
+	}
+	s.writableStatus = s.probeWritable()
+	s.writableChecked = time.Now()
+	return s.writableStatus
+}
+
+//probeWritable writes and removes a probe in the Backend
+func (s *Storage) probeWritable() (status int) {
+	//Message IDs never start with a dot, so the probe cannot collide with a message
+	probe := ".writecheck-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	if _, err := s.backend.Put(probe, strings.NewReader("")); err != nil {
+		log.Error(StorageWriteError, "Storage backend is not writable: "+err.Error())
+		return StorageWriteError
+	}
+	if err := s.backend.Delete(probe); err != nil {
+		log.Error(StorageWriteError, "Failed to remove write probe "+probe+": "+err.Error())
+		return StorageWriteError
+	}
+	return OK
 }
 
 //Creates Directory if it does not yet exist
@@ -110,32 +306,24 @@ func createDirIfNotExist(dir string) {
 	//TODO: Fix error on windows reporting directories exists when they do not
 	_, err := os.Stat(dir)
 	if os.IsNotExist(err) {
-		log.Warn("Directory " + dir + " does not exist. Creating...")
+		log.Warn(StorageDirectoryError, "Directory "+dir+" does not exist. Creating...")
 		err = os.MkdirAll(dir, 0755)
 		if err != nil {
-			log.Fatal("Directory " + dir + " could not be created: " + err.Error())
+			log.Fatal(StorageDirectoryError, "Directory "+dir+" could not be created: "+err.Error())
 		}
 	}
 }
 
-//Check whether Size of Data Directory exceeds size limit set in settings.DiskSpace
-func checkStorageSpace(size int) bool {
-	dirsize, _ := dirSize(messagesPath)
-	dirsize += int64(size)
-	return dirsize/1024/1024 < int64(settings.DiskSpace)
+//errorRecordingReader keeps the error of the underlying reader, to tell failed transmissions from failed writes
+type errorRecordingReader struct {
+	reader io.Reader
+	err    error
 }
 
-//Get Size of Directory
-func dirSize(path string) (int64, error) {
-	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
-		return err
-	})
-	return size, err
+func (r *errorRecordingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
 }
@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"subframe/server/database"
+	"subframe/server/settings"
+	. "subframe/status"
+	"subframe/structs/message"
+	"testing"
+	"time"
+)
+
+//newTestStorage returns a Storage keeping messages in memory, within a new data directory. configure may adjust the settings
+func newTestStorage(t *testing.T, configure func(config *settings.Config)) (*Storage, *database.Memory) {
+	t.Helper()
+	previous := settings.Get()
+	t.Cleanup(func() { settings.Set(previous) })
+	config := settings.DefaultConfig()
+	config.DataPath = t.TempDir()
+	config.StorageBackend = "memory"
+	if configure != nil {
+		configure(&config)
+	}
+	settings.Set(config)
+
+	db := database.NewMemory()
+	return New(db, db, newMemoryBackend()), db
+}
+
+//storeMessage puts a message and records it, as the StorageNode API does
+func storeMessage(t *testing.T, s *Storage, db *database.Memory, id string, content string) ObjectInfo {
+	t.Helper()
+	info, status := s.Put(id, strings.NewReader(content), int64(len(content)), "")
+	if status != http.StatusOK {
+		t.Fatalf("putting %s failed with status %d", id, status)
+	}
+	if status := db.LogMessageStorage(id, message.Metadata{ExpiresOn: time.Now().Add(time.Hour)}); status != OK {
+		t.Fatalf("logging %s failed with status %d", id, status)
+	}
+	return info
+}
+
+func TestDelete(t *testing.T) {
+	s, db := newTestStorage(t, nil)
+	storeMessage(t, s, db, "message", "content")
+	if used := s.QuotaStatus().Used; used != int64(len("content")) {
+		t.Fatalf("%d bytes used after storing, expected %d", used, len("content"))
+	}
+
+	if status := s.Delete("message"); status != OK {
+		t.Fatalf("deleting failed with status %d", status)
+	}
+	if _, stored := db.CheckMessageStorage("message"); stored {
+		t.Errorf("deleted message is still recorded")
+	}
+	if _, err := s.backend.Stat("message"); err != ErrNotFound {
+		t.Errorf("deleted message is still in the backend, error %v", err)
+	}
+	if used := s.QuotaStatus().Used; used != 0 {
+		t.Errorf("%d bytes used after deleting, expected 0", used)
+	}
+
+	//Messages lost from the backend are still removed from the database
+	if status := db.LogMessageStorage("lost", message.Metadata{ExpiresOn: time.Now()}); status != OK {
+		t.Fatalf("logging lost message failed with status %d", status)
+	}
+	if status := s.Delete("lost"); status != OK {
+		t.Errorf("deleting lost message failed with status %d", status)
+	}
+	if _, stored := db.CheckMessageStorage("lost"); stored {
+		t.Errorf("lost message is still recorded")
+	}
+}
+
+//putCountingBackend counts the messages written to its Backend
+type putCountingBackend struct {
+	Backend
+	puts int
+}
+
+func (b *putCountingBackend) Put(id string, content io.Reader) (ObjectInfo, error) {
+	b.puts++
+	return b.Backend.Put(id, content)
+}
+
+func TestCheckWritable(t *testing.T) {
+	s, _ := newTestStorage(t, nil)
+	backend := &putCountingBackend{Backend: s.backend}
+	s.backend = backend
+	for i := 0; i < 3; i++ {
+		if status := s.CheckWritable(); status != OK {
+			t.Fatalf("checking writable backend returned status %d", status)
+		}
+	}
+	if backend.puts != 1 {
+		t.Errorf("%d probes written for consecutive checks, expected 1", backend.puts)
+	}
+	//The probe is removed again
+	if listed, _ := backend.List(); len(listed) != 0 {
+		t.Errorf("probes %v are kept", listed)
+	}
+
+	s.writableChecked = time.Now().Add(-writableCheckInterval)
+	s.CheckWritable()
+	if backend.puts != 2 {
+		t.Errorf("%d probes written after the check interval, expected 2", backend.puts)
+	}
+}
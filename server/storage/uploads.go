@@ -0,0 +1,340 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"subframe/server/keyring"
+	"subframe/server/metrics"
+	"subframe/server/settings"
+	. "subframe/status"
+	"time"
+)
+
+//UploadStatus describes the progress of a resumable upload
+type UploadStatus struct {
+	Session   string
+	MessageID string
+	Offset    int64
+	Size      int64
+	Chunks    int
+	ExpiresOn time.Time
+}
+
+//uploadSession keeps the partial data of a resumable upload. All fields but file and reserved are guarded by s.uploadsMutex,
+//busy is set while a chunk is written or the upload is finished, so neither is used concurrently
+type uploadSession struct {
+	id        string
+	messageID string
+	file      *os.File
+	reserved  *reservation
+	size      int64
+	offset    int64
+	chunks    []uploadChunk
+	expiresOn time.Time
+	busy      bool
+}
+
+type uploadChunk struct {
+	offset int64
+	size   int64
+	sha256 string
+}
+
+//initUploads removes partial data left over from previous runs, as sessions are not kept across restarts
+func (s *Storage) initUploads(path string) {
+	s.uploadsPath = path
+	if err := os.RemoveAll(s.uploadsPath); err != nil {
+		log.Error(StorageDirectoryError, "Failed to remove stale uploads in "+s.uploadsPath+": "+err.Error())
+	}
+	createDirIfNotExist(s.uploadsPath)
+	log.Info(OK, "Initialized "+s.uploadsPath)
+}
+
+//BeginUpload starts a resumable upload of message id. size is the announced size of the message, or -1 if unknown
+func (s *Storage) BeginUpload(id string, size int64) (upload UploadStatus, status int) {
+	log.Info(InProgress, "Starting Upload of Message "+keyring.Index(id)+"...")
+	s.sweepUploads()
+
+	if _, stored := s.messages.CheckMessageStorage(id); stored {
+		log.Error(StorageIdConflict, "Error starting Upload of Message "+keyring.Index(id)+": Already in database")
+		return UploadStatus{}, http.StatusConflict
+	}
+	if size > int64(settings.Get().MessageMaxSize) {
+		log.Warn(StorageInsufficientSpace, "Could not start Upload of Message "+keyring.Index(id)+": Message exceeds settings.MessageMaxSize.")
+		return UploadStatus{}, http.StatusRequestEntityTooLarge
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		log.Error(StorageWriteError, "Error generating Upload Session ID: "+err.Error())
+		return UploadStatus{}, http.StatusInternalServerError
+	}
+	//Uploads of unknown size reserve space as chunks arrive
+	reserved, ok := s.reserve(id, max(size, 0))
+	if !ok {
+		log.Warn(StorageInsufficientSpace, "Could not start Upload of Message "+keyring.Index(id)+": Insufficient Storage.")
+		return UploadStatus{}, http.StatusInsufficientStorage
+	}
+	session := &uploadSession{
+		id:        hex.EncodeToString(random),
+		messageID: id,
+		reserved:  reserved,
+		size:      size,
+		expiresOn: time.Now().Add(settings.Get().UploadSessionTimeout.Std()),
+	}
+	file, err := os.OpenFile(filepath.Join(s.uploadsPath, session.id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Error(StorageWriteError, "Error creating Upload of Message "+keyring.Index(id)+": "+err.Error())
+		reserved.release()
+		return UploadStatus{}, http.StatusInternalServerError
+	}
+	session.file = file
+
+	s.uploadsMutex.Lock()
+	s.uploads[session.id] = session
+	upload = session.status()
+	s.uploadsMutex.Unlock()
+	log.Info(OK, "Started Upload "+session.id+" of Message "+keyring.Index(id))
+	return upload, http.StatusOK
+}
+
+//WriteChunk appends chunk number at offset to an upload. hash is the hex encoded SHA-256 of the chunk, length its announced size or -1 if unknown.
+//Sending the last received chunk again is accepted without writing it, so clients can retry chunks whose response got lost
+func (s *Storage) WriteChunk(id string, sessionID string, number int, offset int64, hash string, content io.Reader, length int64) (upload UploadStatus, status int) {
+	s.activeWrites.Add(1)
+	defer s.activeWrites.Done()
+
+	hash = strings.ToLower(hash)
+	session, status := s.acquireUpload(id, sessionID)
+	if status != http.StatusOK {
+		return UploadStatus{}, status
+	}
+	defer s.releaseUpload(session)
+
+	s.uploadsMutex.Lock()
+	upload = session.status()
+	received := len(session.chunks)
+	retransmit := number >= 0 && number < received && session.chunks[number].offset == offset && session.chunks[number].sha256 == hash
+	s.uploadsMutex.Unlock()
+	if retransmit {
+		log.Info(OK, "Chunk "+strconv.Itoa(number)+" of Upload "+sessionID+" has already been received.")
+		return upload, http.StatusOK
+	}
+	if number != received || offset != upload.Offset {
+		log.Warn(StorageUploadInvalidChunk, "Rejecting Chunk "+strconv.Itoa(number)+" at offset "+strconv.FormatInt(offset, 10)+" of Upload "+sessionID+": Expected Chunk "+strconv.Itoa(received)+" at offset "+strconv.FormatInt(upload.Offset, 10))
+		return upload, http.StatusConflict
+	}
+
+	remaining := int64(settings.Get().MessageMaxSize) - offset
+	if upload.Size >= 0 {
+		remaining = upload.Size - offset
+	}
+	if length > remaining {
+		log.Warn(StorageUploadInvalidChunk, "Rejecting Chunk "+strconv.Itoa(number)+" of Upload "+sessionID+": Chunk exceeds the size of the message.")
+		return upload, http.StatusRequestEntityTooLarge
+	}
+	if length >= 0 && !session.reserved.ensure(offset+length) {
+		log.Warn(StorageInsufficientSpace, "Rejecting Chunk "+strconv.Itoa(number)+" of Upload "+sessionID+": Insufficient Storage.")
+		return upload, http.StatusInsufficientStorage
+	}
+
+	//Reading one byte more than allowed tells oversized chunks of unknown length apart
+	digest := sha256.New()
+	if _, err := session.file.Seek(offset, io.SeekStart); err != nil {
+		log.Error(StorageWriteError, "Error writing Chunk of Upload "+sessionID+": "+err.Error())
+		return upload, http.StatusInternalServerError
+	}
+	reader := &errorRecordingReader{reader: &quotaReader{reader: io.LimitReader(content, remaining+1), reservation: session.reserved, read: offset, covered: offset}}
+	written, err := io.Copy(io.MultiWriter(session.file, digest), reader)
+
+	status = http.StatusOK
+	switch {
+	case reader.err == errQuotaExceeded:
+		log.Warn(StorageInsufficientSpace, "Rejecting Chunk "+strconv.Itoa(number)+" of Upload "+sessionID+": Insufficient Storage.")
+		status = http.StatusInsufficientStorage
+	case err != nil && reader.err != nil:
+		log.Warn(StorageWriteError, "Error receiving Chunk of Upload "+sessionID+": "+reader.err.Error())
+		status = http.StatusBadRequest
+	case err != nil:
+		log.Error(StorageWriteError, "Error writing Chunk of Upload "+sessionID+": "+err.Error())
+		status = http.StatusInternalServerError
+	case written == 0:
+		log.Warn(StorageUploadInvalidChunk, "Rejecting empty Chunk of Upload "+sessionID)
+		status = http.StatusBadRequest
+	case written > remaining:
+		log.Warn(StorageUploadInvalidChunk, "Rejecting Chunk "+strconv.Itoa(number)+" of Upload "+sessionID+": Chunk exceeds the size of the message.")
+		status = http.StatusRequestEntityTooLarge
+	case hex.EncodeToString(digest.Sum(nil)) != hash:
+		log.Warn(StorageUploadHashMismatch, "Rejecting Chunk "+strconv.Itoa(number)+" of Upload "+sessionID+": Hash does not match.")
+		status = http.StatusUnprocessableEntity
+	}
+	if status != http.StatusOK {
+		//Drop whatever was written of the rejected chunk, so it is retried from the same offset
+		if err = session.file.Truncate(offset); err != nil {
+			log.Error(StorageWriteError, "Error discarding Chunk of Upload "+sessionID+": "+err.Error())
+		}
+		return upload, status
+	}
+
+	s.uploadsMutex.Lock()
+	session.chunks = append(session.chunks, uploadChunk{offset: offset, size: written, sha256: hash})
+	session.offset += written
+	session.expiresOn = time.Now().Add(settings.Get().UploadSessionTimeout.Std())
+	upload = session.status()
+	s.uploadsMutex.Unlock()
+	log.Info(OK, "Received Chunk "+strconv.Itoa(number)+" of Upload "+sessionID+" ("+strconv.FormatInt(upload.Offset, 10)+" bytes received)")
+	return upload, http.StatusOK
+}
+
+//UploadProgress returns the progress of an upload
+func (s *Storage) UploadProgress(id string, sessionID string) (upload UploadStatus, status int) {
+	s.uploadsMutex.Lock()
+	defer s.uploadsMutex.Unlock()
+	session := s.uploads[sessionID]
+	if session == nil || session.messageID != id || session.expired(time.Now()) {
+		return UploadStatus{}, http.StatusNotFound
+	}
+	return session.status(), http.StatusOK
+}
+
+//FinishUpload checks the received data against hash, the hex encoded SHA-256 of the whole message, and stores it like Put
+//within the space reserved for the upload. The session is kept if the message could not be stored, unless it has been stored in the meantime
+func (s *Storage) FinishUpload(id string, sessionID string, hash string) (info ObjectInfo, status int) {
+	defer metrics.ObserveStorage("put", time.Now())
+	s.activeWrites.Add(1)
+	defer s.activeWrites.Done()
+
+	session, status := s.acquireUpload(id, sessionID)
+	if status != http.StatusOK {
+		return ObjectInfo{}, status
+	}
+	defer s.releaseUpload(session)
+
+	s.uploadsMutex.Lock()
+	upload := session.status()
+	s.uploadsMutex.Unlock()
+	if upload.Offset == 0 || (upload.Size >= 0 && upload.Offset != upload.Size) {
+		log.Warn(StorageUploadInvalidChunk, "Cannot finish Upload "+sessionID+": Received "+strconv.FormatInt(upload.Offset, 10)+" of "+strconv.FormatInt(upload.Size, 10)+" bytes")
+		return ObjectInfo{}, http.StatusConflict
+	}
+
+	digest := sha256.New()
+	_, err := session.file.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(digest, session.file, upload.Offset)
+	}
+	if err == nil {
+		_, err = session.file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.Error(StorageReadError, "Error reading Upload "+sessionID+": "+err.Error())
+		return ObjectInfo{}, http.StatusInternalServerError
+	}
+	if hex.EncodeToString(digest.Sum(nil)) != strings.ToLower(hash) {
+		log.Warn(StorageUploadHashMismatch, "Cannot finish Upload "+sessionID+": Hash does not match.")
+		return ObjectInfo{}, http.StatusUnprocessableEntity
+	}
+
+	if _, stored := s.messages.CheckMessageStorage(id); stored {
+		log.Error(StorageIdConflict, "Error storing Message "+keyring.Index(id)+": Already in database")
+		metrics.StoragePuts.WithLabelValues("conflict").Inc()
+		status = http.StatusConflict
+	} else {
+		info, status = s.store(id, io.LimitReader(session.file, upload.Offset), session.reserved, "")
+	}
+	if status != http.StatusOK && status != http.StatusConflict {
+		return ObjectInfo{}, status
+	}
+	s.uploadsMutex.Lock()
+	delete(s.uploads, sessionID)
+	s.uploadsMutex.Unlock()
+	session.remove()
+	log.Info(OK, "Finished Upload "+sessionID+" of Message "+keyring.Index(id))
+	return info, status
+}
+
+//AbortUpload discards an upload and its partial data
+func (s *Storage) AbortUpload(id string, sessionID string) (status int) {
+	session, status := s.acquireUpload(id, sessionID)
+	if status != http.StatusOK {
+		return status
+	}
+	s.uploadsMutex.Lock()
+	delete(s.uploads, sessionID)
+	s.uploadsMutex.Unlock()
+	session.remove()
+	log.Info(OK, "Aborted Upload "+sessionID+" of Message "+keyring.Index(id))
+	return http.StatusOK
+}
+
+//sweepUploads discards expired uploads and their partial data
+func (s *Storage) sweepUploads() {
+	now := time.Now()
+	var expired []*uploadSession
+	s.uploadsMutex.Lock()
+	for id, session := range s.uploads {
+		if !session.busy && session.expired(now) {
+			delete(s.uploads, id)
+			expired = append(expired, session)
+		}
+	}
+	s.uploadsMutex.Unlock()
+
+	for _, session := range expired {
+		log.Info(OK, "Upload "+session.id+" of Message "+keyring.Index(session.messageID)+" expired.")
+		session.remove()
+	}
+}
+
+//acquireUpload marks an active upload of message id as busy. It has to be released with releaseUpload
+func (s *Storage) acquireUpload(id string, sessionID string) (session *uploadSession, status int) {
+	s.uploadsMutex.Lock()
+	defer s.uploadsMutex.Unlock()
+	session = s.uploads[sessionID]
+	if session == nil || session.messageID != id || session.expired(time.Now()) {
+		log.Warn(StorageUploadUnknownSession, "Upload "+sessionID+" of Message "+keyring.Index(id)+" does not exist or has expired.")
+		return nil, http.StatusNotFound
+	}
+	if session.busy {
+		log.Warn(StorageUploadInvalidChunk, "Upload "+sessionID+" is busy.")
+		return nil, http.StatusConflict
+	}
+	session.busy = true
+	return session, http.StatusOK
+}
+
+func (s *Storage) releaseUpload(session *uploadSession) {
+	s.uploadsMutex.Lock()
+	session.busy = false
+	s.uploadsMutex.Unlock()
+}
+
+func (s *uploadSession) status() UploadStatus {
+	return UploadStatus{
+		Session:   s.id,
+		MessageID: s.messageID,
+		Offset:    s.offset,
+		Size:      s.size,
+		Chunks:    len(s.chunks),
+		ExpiresOn: s.expiresOn,
+	}
+}
+
+func (s *uploadSession) expired(now time.Time) bool {
+	return now.After(s.expiresOn)
+}
+
+func (s *uploadSession) remove() {
+	s.reserved.release()
+	s.file.Close()
+	if err := os.Remove(s.file.Name()); err != nil {
+		log.Error(StorageWriteError, "Failed to remove Upload "+s.id+": "+err.Error())
+	}
+}
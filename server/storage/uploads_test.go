@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//hashOf returns the hex encoded SHA-256 hash of content, as sent with chunks
+func hashOf(content string) string {
+	digest := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(digest[:])
+}
+
+//uploadedSize returns the size of the partial data kept for an upload
+func uploadedSize(t *testing.T, s *Storage, sessionID string) int64 {
+	t.Helper()
+	stat, err := os.Stat(filepath.Join(s.uploadsPath, sessionID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Size()
+}
+
+func TestUploadChunks(t *testing.T) {
+	s, _ := newTestStorage(t, nil)
+	upload, status := s.BeginUpload("message", 10)
+	if status != http.StatusOK {
+		t.Fatalf("beginning upload failed with status %d", status)
+	}
+	session := upload.Session
+	if reserved := s.QuotaStatus().Reserved; reserved != 10 {
+		t.Errorf("%d bytes reserved for the upload, expected 10", reserved)
+	}
+
+	write := func(number int, offset int64, hash string, content string, length int64) (UploadStatus, int) {
+		return s.WriteChunk("message", session, number, offset, hash, strings.NewReader(content), length)
+	}
+	if upload, status = write(0, 0, hashOf("hello"), "hello", 5); status != http.StatusOK || upload.Offset != 5 {
+		t.Fatalf("writing first chunk returned %+v, status %d", upload, status)
+	}
+	//A chunk whose response got lost is sent again
+	if upload, status = write(0, 0, strings.ToUpper(hashOf("hello")), "hello", 5); status != http.StatusOK || upload.Offset != 5 || upload.Chunks != 1 {
+		t.Errorf("retransmitting first chunk returned %+v, status %d", upload, status)
+	}
+
+	for _, test := range []struct {
+		name    string
+		number  int
+		offset  int64
+		hash    string
+		content string
+		length  int64
+		status  int
+	}{
+		{"skipped chunk", 2, 5, hashOf("world"), "world", 5, http.StatusConflict},
+		{"overlapping chunk", 1, 3, hashOf("loworld"), "loworld", 7, http.StatusConflict},
+		{"first chunk with different content", 0, 0, hashOf("jello"), "jello", 5, http.StatusConflict},
+		{"mismatching hash", 1, 5, hashOf("world"), "wordl", 5, http.StatusUnprocessableEntity},
+		{"announced oversized chunk", 1, 5, hashOf("world!"), "world!", 6, http.StatusRequestEntityTooLarge},
+		{"oversized chunk of unknown length", 1, 5, hashOf("world!"), "world!", -1, http.StatusRequestEntityTooLarge},
+		{"empty chunk", 1, 5, hashOf(""), "", -1, http.StatusBadRequest},
+	} {
+		if upload, status = write(test.number, test.offset, test.hash, test.content, test.length); status != test.status {
+			t.Errorf("writing %s returned status %d, expected %d", test.name, status, test.status)
+		}
+		//Rejected chunks are discarded, so they can be retried from the same offset
+		if upload.Offset != 5 || uploadedSize(t, s, session) != 5 {
+			t.Errorf("%s is kept: offset %d, %d bytes stored", test.name, upload.Offset, uploadedSize(t, s, session))
+		}
+	}
+
+	if _, status = s.FinishUpload("message", session, hashOf("hello")); status != http.StatusConflict {
+		t.Errorf("finishing incomplete upload returned status %d, expected %d", status, http.StatusConflict)
+	}
+	if upload, status = write(1, 5, hashOf("world"), "world", -1); status != http.StatusOK || upload.Offset != 10 {
+		t.Fatalf("writing second chunk returned %+v, status %d", upload, status)
+	}
+	if upload, status = s.UploadProgress("message", session); status != http.StatusOK || upload.Offset != 10 || upload.Chunks != 2 {
+		t.Errorf("progress of complete upload is %+v, status %d", upload, status)
+	}
+	if _, status = s.FinishUpload("message", session, hashOf("helloworle")); status != http.StatusUnprocessableEntity {
+		t.Errorf("finishing upload with a mismatching hash returned status %d, expected %d", status, http.StatusUnprocessableEntity)
+	}
+	//The session is kept after a failed attempt
+	info, status := s.FinishUpload("message", session, hashOf("helloworld"))
+	if status != http.StatusOK || info.Size != 10 {
+		t.Fatalf("finishing upload returned %+v, status %d", info, status)
+	}
+
+	content, _, err := s.backend.Get("message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	if stored := read(t, content); stored != "helloworld" {
+		t.Errorf("upload stored %q, expected %q", stored, "helloworld")
+	}
+	if quota := s.QuotaStatus(); quota.Used != 10 || quota.Reserved != 0 {
+		t.Errorf("quota after finishing upload is %+v, expected 10 bytes used and none reserved", quota)
+	}
+	if _, status = s.UploadProgress("message", session); status != http.StatusNotFound {
+		t.Errorf("progress of finished upload returned status %d, expected %d", status, http.StatusNotFound)
+	}
+	if _, err = os.Stat(filepath.Join(s.uploadsPath, session)); !os.IsNotExist(err) {
+		t.Errorf("partial data of finished upload is kept, error %v", err)
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	s, _ := newTestStorage(t, nil)
+	upload, status := s.BeginUpload("message", 100)
+	if status != http.StatusOK {
+		t.Fatalf("beginning upload failed with status %d", status)
+	}
+	if _, status = s.WriteChunk("message", upload.Session, 0, 0, hashOf("hello"), strings.NewReader("hello"), 5); status != http.StatusOK {
+		t.Fatalf("writing chunk failed with status %d", status)
+	}
+	if _, status = s.UploadProgress("other message", upload.Session); status != http.StatusNotFound {
+		t.Errorf("progress of upload requested for a different message returned status %d, expected %d", status, http.StatusNotFound)
+	}
+
+	s.uploadsMutex.Lock()
+	s.uploads[upload.Session].expiresOn = time.Now().Add(-time.Second)
+	s.uploadsMutex.Unlock()
+
+	if _, status = s.UploadProgress("message", upload.Session); status != http.StatusNotFound {
+		t.Errorf("progress of expired upload returned status %d, expected %d", status, http.StatusNotFound)
+	}
+	if _, status = s.WriteChunk("message", upload.Session, 1, 5, hashOf("world"), strings.NewReader("world"), 5); status != http.StatusNotFound {
+		t.Errorf("writing chunk of expired upload returned status %d, expected %d", status, http.StatusNotFound)
+	}
+	//Sweeping the expired upload releases its reservation and removes its partial data
+	if quota := s.QuotaStatus(); quota.Reserved != 0 || len(quota.Reservations) != 0 {
+		t.Errorf("expired upload still holds a reservation: %+v", quota)
+	}
+	if _, err := os.Stat(filepath.Join(s.uploadsPath, upload.Session)); !os.IsNotExist(err) {
+		t.Errorf("partial data of expired upload is kept, error %v", err)
+	}
+}
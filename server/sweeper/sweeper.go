@@ -0,0 +1,111 @@
+package sweeper
+
+import (
+	"context"
+	"strconv"
+	"subframe/server/database"
+	"subframe/server/keyring"
+	"subframe/server/lifecycle"
+	"subframe/server/logger"
+	"subframe/server/metrics"
+	"subframe/server/networking"
+	"subframe/server/settings"
+	"subframe/server/storage"
+	. "subframe/status"
+	"time"
+)
+
+var log = logger.Logger{Prefix: "sweeper/Main"}
+
+//batchSize is the number of messages fetched from the database at once
+const batchSize = 100
+
+//sweepInterval is the time between sweeps
+const sweepInterval = time.Minute
+
+//Sweeper removes expired and received messages from a Storage in the background. The status of the stored messages is checked
+//against the CoordinatorNetwork every settings.MessageMinCheckDelay, in case the notification of their receipt was missed
+type Sweeper struct {
+	messages database.MessageStore
+	storage  *storage.Storage
+	node     *networking.Node
+	stopped  chan bool
+}
+
+//New returns a Sweeper for the messages in messageStorage, which are kept track of in messages. Their status is checked through node
+func New(messages database.MessageStore, messageStorage *storage.Storage, node *networking.Node) *Sweeper {
+	return &Sweeper{messages: messages, storage: messageStorage, node: node, stopped: make(chan bool)}
+}
+
+//Start starts sweeping in the background
+func (s *Sweeper) Start() {
+	log.Info(OK, "Starting Sweeper...")
+	go s.run()
+}
+
+//Stop waits for the sweeper to notice the shutdown, until ctx is done
+func (s *Sweeper) Stop(ctx context.Context) {
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		log.Warn(ShutdownDeadlineExceeded, "Timed out waiting for Sweeper to stop.")
+	}
+}
+
+func (s *Sweeper) run() {
+	defer close(s.stopped)
+	ctx := lifecycle.Context()
+	for ctx.Err() == nil {
+		s.checkStatus(ctx)
+		s.sweep(ctx, time.Now())
+		select {
+		case <-time.After(sweepInterval):
+		case <-ctx.Done():
+		}
+	}
+}
+
+//checkStatus updates the status of the messages which have not been checked for settings.MessageMinCheckDelay
+func (s *Sweeper) checkStatus(ctx context.Context) {
+	for ctx.Err() == nil {
+		_, ids := s.messages.CheckDueMessageStatusStorage(time.Now().Add(-settings.Get().MessageMinCheckDelay.Std()), batchSize)
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				return
+			}
+			//Inconclusive results are ignored, the message is checked again after settings.MessageMinCheckDelay
+			if status := s.node.GetMessageStatus(id); status > -1 {
+				s.messages.UpdateMessageStatusStorage(id, status)
+			}
+		}
+		if len(ids) < batchSize {
+			return
+		}
+	}
+}
+
+//sweep removes all messages which expired before now or have been received
+func (s *Sweeper) sweep(ctx context.Context, now time.Time) {
+	removed := 0
+	for ctx.Err() == nil {
+		_, ids := s.messages.GetExpiredMessagesStorage(now, batchSize)
+		failed := 0
+		for _, id := range ids {
+			if s.storage.Delete(id) != OK {
+				log.Error(StorageWriteError, "Failed to remove Message "+keyring.Index(id)+".")
+				metrics.RemovedMessages.WithLabelValues("error").Inc()
+				failed++
+				continue
+			}
+			metrics.RemovedMessages.WithLabelValues("ok").Inc()
+			removed++
+		}
+		//Messages which could not be removed are returned again, so they are retried on the next sweep
+		if len(ids) < batchSize || failed == len(ids) {
+			break
+		}
+	}
+	if removed > 0 {
+		log.Info(OK, "Removed "+strconv.Itoa(removed)+" expired or received Messages.")
+	}
+}
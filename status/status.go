@@ -27,7 +27,7 @@ Status codes always have 4 characters:
 	'6': Networking: StorageNode
 	'7': Networking: CoordinatorNode
 	'8': JobQueue
-	'9': -- unused --
+	'9': Logging
 
 3. & 4.: Status ID
 */
@@ -38,10 +38,38 @@ const InProgress int = 2000
 
 const GenericInputError int = 3000
 
+const StorageUploadUnknownSession int = 3110
+const StorageUploadInvalidChunk int = 3111
+const StorageUploadHashMismatch int = 3112
+const StorageContentHashMismatch int = 3113
+
 const GenericInternalError int = 4000
+const ShutdownDeadlineExceeded int = 4001
 
 const SettingsReadError int = 4100
 const SettingsWriteError int = 4101
+const SettingsValidationError int = 4102
+const SettingsPendingRestart int = 4103
+
+const StorageReadError int = 4110
+const StorageWriteError int = 4111
+const StorageIdConflict int = 4112
+const StorageInsufficientSpace int = 4113
+const StorageDirectoryError int = 4114
+const StorageChecksumMismatch int = 4115
+const StorageQuarantineError int = 4116
+const StorageQuotaMismatch int = 4117
+const StorageLayoutOutdated int = 4118
+const StorageLayoutUnresolved int = 4119
+
+const SnapshotWriteError int = 4120
+const SnapshotReadError int = 4121
+const SnapshotChecksumMismatch int = 4122
+const SnapshotTargetNotEmpty int = 4123
+
+const EncryptionKeyError int = 4130
+const EncryptionDecryptError int = 4131
+const EncryptionRekeyRequired int = 4132
 
 const DBPrepareError int = 4200
 const DBWriteError int = 4201
@@ -50,6 +78,9 @@ const DBIdConflict int = 4203
 const DBOpenError int = 4204
 const DBCloseError int = 4205
 const DBStructureError int = 4206
+const DBMigrationError int = 4207
+const DBSchemaTooNew int = 4208
+const DBSnapshotError int = 4209
 
 const SNDBPrepareError int = 4300
 const SNDBWriteError int = 4301
@@ -63,11 +94,42 @@ const CNDBIdConflict int = 4410
 
 const NetworkingBadNodeType int = 4501
 
+const SNNetworkingBadRequest int = 3600
+const SNNetworkingMessageTooLarge int = 3601
+const SNNetworkingStampRejected int = 3602
+const SNNetworkingRateLimited int = 3603
+const SNNetworkingBanned int = 3604
+const SNNetworkingTooManyUploads int = 3605
+const SNNetworkingMalformedID int = 3606
+
 const SNNetworkingOutgoingRequestError int = 4601
 const SNNetworkingReadingResponseError int = 4602
+const SNNetworkingStorageError int = 4603
+const SNNetworkingEncodingError int = 4604
+const SNNetworkingServerError int = 4605
+const SNNetworkingAnnounceError int = 4606
+const SNNetworkingJobError int = 4607
+const SNNetworkingRedistributeError int = 4608
+
+const SNNetworkingForbidden int = 5600
+
+const CNNetworkingBadRequest int = 3700
+const CNNetworkingStampRejected int = 3701
+const CNNetworkingVerificationFailed int = 3702
+const CNNetworkingMalformedID int = 3703
+const CNNetworkingTooManySubscriptions int = 3704
 
 const CNNetworkingOutgoingRequestError int = 4701
 const CNNetworkingReadingResponseError int = 4702
+const CNNetworkingOutOfSync int = 4703
+const CNNetworkingReplicationError int = 4704
+const CNNetworkingSubscriptionError int = 4705
 
 const JQTooManyWorkers int = 4800
 const JQQueueTooLong int = 4801
+const JQDrainTimeout int = 4802
+const JQQueueClosed int = 4803
+
+const LogSinkOpenError int = 4900
+const LogSinkWriteError int = 4901
+const LogSinkConfigError int = 4902
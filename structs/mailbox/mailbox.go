@@ -0,0 +1,162 @@
+package mailbox
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"subframe/structs/messageid"
+)
+
+//MaxDevices is the maximum number of devices of a mailbox
+const MaxDevices = 16
+
+//Prefixes of signed data, so signatures of registrations and confirmations cannot be mistaken for each other
+const (
+	registrationContext = "subframe-mailbox\n"
+	confirmationContext = "subframe-confirmation\n"
+)
+
+//deviceID restricts device IDs, as they are passed in URLs
+var deviceID = regexp.MustCompile("^[a-z0-9-]{1,32}$")
+
+//ErrSignature is returned by Open if a registration is not signed by the identity key of its mailbox
+var ErrSignature = errors.New("registration is not signed by the identity key of the mailbox")
+
+//Mailbox lists the devices a recipient receives messages on. Messages to the fingerprint of IdentityKey count as received
+//once Quorum devices presented the confirmation key, or all of them if Quorum is 0
+type Mailbox struct {
+	//IdentityKey is the Ed25519 public key of the recipient. Its fingerprint is the one contained in MessageIDs
+	IdentityKey ed25519.PublicKey `json:"identityKey"`
+	Devices     []Device          `json:"devices"`
+	Quorum      int               `json:"quorum"`
+	//Version increases with every change, newer registrations replace older ones
+	Version int64 `json:"version"`
+}
+
+//Device is a device of a mailbox
+type Device struct {
+	ID string `json:"id"`
+	//SigningKey is the Ed25519 public key the device signs its confirmations with
+	SigningKey ed25519.PublicKey `json:"signingKey"`
+	//SealingKey is the public key senders seal envelopes to the device with. Nodes do not use it, and it may be omitted
+	//if the devices share the private key of the recipient
+	SealingKey []byte `json:"sealingKey,omitempty"`
+}
+
+//Registration is a mailbox signed by the identity key of the recipient. The mailbox is kept JSON encoded exactly as signed
+type Registration struct {
+	Mailbox   []byte `json:"mailbox"`
+	Signature []byte `json:"signature"`
+}
+
+//Sign returns the registration of mailbox, signed with the private identity key of the recipient
+func Sign(mailbox Mailbox, identityKey ed25519.PrivateKey) (Registration, error) {
+	if err := mailbox.Validate(); err != nil {
+		return Registration{}, err
+	}
+	encoded, err := json.Marshal(mailbox)
+	if err != nil {
+		return Registration{}, err
+	}
+	return Registration{Mailbox: encoded, Signature: ed25519.Sign(identityKey, append([]byte(registrationContext), encoded...))}, nil
+}
+
+//Open returns the mailbox of a registration, if it is valid and signed by the identity key of the mailbox
+func (r Registration) Open() (Mailbox, error) {
+	var mailbox Mailbox
+	if err := json.Unmarshal(r.Mailbox, &mailbox); err != nil {
+		return Mailbox{}, errors.New("malformed mailbox: " + err.Error())
+	}
+	if err := mailbox.Validate(); err != nil {
+		return Mailbox{}, err
+	}
+	if !ed25519.Verify(mailbox.IdentityKey, append([]byte(registrationContext), r.Mailbox...), r.Signature) {
+		return Mailbox{}, ErrSignature
+	}
+	return mailbox, nil
+}
+
+//Validate checks the keys and devices of m
+func (m Mailbox) Validate() error {
+	if len(m.IdentityKey) != ed25519.PublicKeySize {
+		return errors.New("identity key has to be an Ed25519 public key")
+	}
+	if len(m.Devices) == 0 || len(m.Devices) > MaxDevices {
+		return errors.New("mailboxes require 1 to " + strconv.Itoa(MaxDevices) + " devices")
+	}
+	if m.Quorum < 0 || m.Quorum > len(m.Devices) {
+		return errors.New("quorum has to be between 0 and the number of devices")
+	}
+	if m.Version < 1 {
+		return errors.New("version has to be at least 1")
+	}
+	seen := make(map[string]bool)
+	for _, device := range m.Devices {
+		if !deviceID.MatchString(device.ID) {
+			return errors.New("device ID " + strconv.Quote(device.ID) + " has to consist of 1 to 32 lowercase letters, digits and dashes")
+		}
+		if seen[device.ID] {
+			return errors.New("duplicate device ID " + device.ID)
+		}
+		seen[device.ID] = true
+		if len(device.SigningKey) != ed25519.PublicKeySize {
+			return errors.New("signing key of device " + device.ID + " has to be an Ed25519 public key")
+		}
+	}
+	return nil
+}
+
+//Recipient returns the hex encoded fingerprint of the identity key of m, which identifies the mailbox
+func (m Mailbox) Recipient() string {
+	fingerprint := messageid.Fingerprint(m.IdentityKey)
+	return hex.EncodeToString(fingerprint[:])
+}
+
+//RecipientOf returns the hex encoded recipient fingerprint of id, which identifies the mailbox of the recipient
+func RecipientOf(id messageid.ID) string {
+	return hex.EncodeToString(id.Recipient[:])
+}
+
+//Required returns the number of devices which have to confirm a message before it counts as received
+func (m Mailbox) Required() int {
+	if m.Quorum == 0 {
+		return len(m.Devices)
+	}
+	return m.Quorum
+}
+
+//Device returns the device of m with id
+func (m Mailbox) Device(id string) (Device, bool) {
+	for _, device := range m.Devices {
+		if device.ID == id {
+			return device, true
+		}
+	}
+	return Device{}, false
+}
+
+//DeviceIDs returns the IDs of the devices of m
+func (m Mailbox) DeviceIDs() []string {
+	ids := make([]string, len(m.Devices))
+	for i, device := range m.Devices {
+		ids[i] = device.ID
+	}
+	return ids
+}
+
+//SignConfirmation returns the signature of a device confirming that it received the message with messageID and confirmation key
+func SignConfirmation(signingKey ed25519.PrivateKey, messageID string, key string) []byte {
+	return ed25519.Sign(signingKey, confirmationData(messageID, key))
+}
+
+//Confirms returns whether signature is the confirmation of the message with messageID and confirmation key by d
+func (d Device) Confirms(messageID string, key string, signature []byte) bool {
+	return ed25519.Verify(d.SigningKey, confirmationData(messageID, key), signature)
+}
+
+func confirmationData(messageID string, key string) []byte {
+	return []byte(confirmationContext + messageID + "\n" + key)
+}
@@ -0,0 +1,153 @@
+package mailbox
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//testMailbox returns a valid mailbox with the given devices, along with the private identity key and the signing keys of its devices
+func testMailbox(t *testing.T, devices ...string) (Mailbox, ed25519.PrivateKey, map[string]ed25519.PrivateKey) {
+	t.Helper()
+	identityPublic, identityKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox := Mailbox{IdentityKey: identityPublic, Version: 1}
+	signingKeys := map[string]ed25519.PrivateKey{}
+	for _, id := range devices {
+		signingPublic, signingKey, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signingKeys[id] = signingKey
+		mailbox.Devices = append(mailbox.Devices, Device{ID: id, SigningKey: signingPublic})
+	}
+	return mailbox, identityKey, signingKeys
+}
+
+func TestValidate(t *testing.T) {
+	valid, _, _ := testMailbox(t, "phone", "laptop")
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("valid mailbox is rejected: %v", err)
+	}
+	tooMany, _, _ := testMailbox(t)
+	for i := 0; i <= MaxDevices; i++ {
+		tooMany.Devices = append(tooMany.Devices, Device{ID: "device-" + strconv.Itoa(i), SigningKey: valid.Devices[0].SigningKey})
+	}
+
+	for _, test := range []struct {
+		name   string
+		modify func(m *Mailbox)
+	}{
+		{"short identity key", func(m *Mailbox) { m.IdentityKey = m.IdentityKey[:16] }},
+		{"no devices", func(m *Mailbox) { m.Devices = nil }},
+		{"too many devices", func(m *Mailbox) { m.Devices = tooMany.Devices }},
+		{"negative quorum", func(m *Mailbox) { m.Quorum = -1 }},
+		{"quorum above the number of devices", func(m *Mailbox) { m.Quorum = 3 }},
+		{"version 0", func(m *Mailbox) { m.Version = 0 }},
+		{"empty device ID", func(m *Mailbox) { m.Devices[0].ID = "" }},
+		{"uppercase device ID", func(m *Mailbox) { m.Devices[0].ID = "Phone" }},
+		{"device ID with a slash", func(m *Mailbox) { m.Devices[0].ID = "phone/1" }},
+		{"too long device ID", func(m *Mailbox) { m.Devices[0].ID = strings.Repeat("a", 33) }},
+		{"duplicate device ID", func(m *Mailbox) { m.Devices[1].ID = m.Devices[0].ID }},
+		{"short signing key", func(m *Mailbox) { m.Devices[1].SigningKey = nil }},
+	} {
+		mailbox := valid
+		mailbox.Devices = append([]Device(nil), valid.Devices...)
+		test.modify(&mailbox)
+		if err := mailbox.Validate(); err == nil {
+			t.Errorf("mailbox with %s is accepted", test.name)
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	mailbox, identityKey, _ := testMailbox(t, "phone", "laptop")
+	mailbox.Quorum = 1
+	registration, err := Sign(mailbox, identityKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := registration.Open()
+	if err != nil {
+		t.Fatalf("opening signed registration failed: %v", err)
+	}
+	if opened.Recipient() != mailbox.Recipient() || opened.Quorum != 1 || len(opened.Devices) != 2 || opened.Devices[1].ID != "laptop" {
+		t.Errorf("opened registration contains %+v, expected %+v", opened, mailbox)
+	}
+
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	otherMailbox := mailbox
+	otherMailbox.Version = 2
+	otherEncoded, _ := json.Marshal(otherMailbox)
+	invalid := mailbox
+	invalid.Quorum = 3
+	invalidEncoded, _ := json.Marshal(invalid)
+	for _, test := range []struct {
+		name         string
+		registration Registration
+		err          error
+	}{
+		{"signed by another key", Registration{Mailbox: registration.Mailbox, Signature: ed25519.Sign(otherKey, append([]byte(registrationContext), registration.Mailbox...))}, ErrSignature},
+		{"signed without context", Registration{Mailbox: registration.Mailbox, Signature: ed25519.Sign(identityKey, registration.Mailbox)}, ErrSignature},
+		{"with a modified mailbox", Registration{Mailbox: otherEncoded, Signature: registration.Signature}, ErrSignature},
+		{"without signature", Registration{Mailbox: registration.Mailbox}, ErrSignature},
+		{"of an invalid mailbox", Registration{Mailbox: invalidEncoded, Signature: ed25519.Sign(identityKey, append([]byte(registrationContext), invalidEncoded...))}, nil},
+		{"of a malformed mailbox", Registration{Mailbox: []byte("{"), Signature: registration.Signature}, nil},
+	} {
+		_, err := test.registration.Open()
+		if err == nil || (test.err != nil && err != test.err) {
+			t.Errorf("opening registration %s returned %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	if _, err = Sign(invalid, identityKey); err == nil {
+		t.Errorf("invalid mailbox is signed")
+	}
+}
+
+func TestConfirmation(t *testing.T) {
+	mailbox, _, signingKeys := testMailbox(t, "phone", "laptop")
+	phone, ok := mailbox.Device("phone")
+	if !ok {
+		t.Fatal("device of mailbox is not found")
+	}
+	if _, ok = mailbox.Device("tablet"); ok {
+		t.Errorf("unknown device is found")
+	}
+
+	signature := SignConfirmation(signingKeys["phone"], "message", "key")
+	if !phone.Confirms("message", "key", signature) {
+		t.Errorf("confirmation of the device is rejected")
+	}
+	for _, test := range []struct {
+		name      string
+		messageID string
+		key       string
+		signature []byte
+	}{
+		{"of another message", "other message", "key", signature},
+		{"with another key", "message", "other key", signature},
+		{"of another device", "message", "key", SignConfirmation(signingKeys["laptop"], "message", "key")},
+	} {
+		if phone.Confirms(test.messageID, test.key, test.signature) {
+			t.Errorf("confirmation %s is accepted", test.name)
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	mailbox, _, _ := testMailbox(t, "phone", "laptop", "tablet")
+	for quorum, required := range []int{3, 1, 2, 3} {
+		mailbox.Quorum = quorum
+		if mailbox.Required() != required {
+			t.Errorf("quorum %d requires %d devices, expected %d", quorum, mailbox.Required(), required)
+		}
+	}
+	if ids := mailbox.DeviceIDs(); strings.Join(ids, ",") != "phone,laptop,tablet" {
+		t.Errorf("mailbox has devices %v", ids)
+	}
+}
@@ -0,0 +1,11 @@
+package message
+
+//InboxEntry is a message returned by an inbox query to a CoordinatorNode
+type InboxEntry struct {
+	ID string `json:"id"`
+	//StorageNodes are the addresses of the StorageNodes which announced to store the message
+	StorageNodes []string `json:"storageNodes"`
+	Metadata     Metadata `json:"metadata"`
+	//Cursor orders entries by their first announcement. Inbox queries continue after the cursor of the last entry received
+	Cursor int64 `json:"cursor"`
+}
@@ -1,5 +1,184 @@
 package message
 
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"subframe/structs/stamp"
+	"time"
+)
+
+//Message is an envelope as stored by StorageNodes. Content holds the raw, usually encrypted, bytes of the envelope
 type Message struct {
-	ID, Content string
+	ID       string
+	Content  []byte
+	Metadata Metadata
+}
+
+//Statuses of a message in the CoordinatorNetwork
+const (
+	//StatusUnknown is returned for messages neither announced nor received
+	StatusUnknown = -1
+	//StatusStored is returned for messages announced by StorageNodes, but not yet received
+	StatusStored = 0
+	//StatusReceived is returned for messages whose recipient presented the confirmation key
+	StatusReceived = 1
+)
+
+//MaxPriority is the highest priority a sender can request. Messages without a priority have priority 0
+const MaxPriority = 9
+
+//Metadata describes an envelope without revealing its content. It is sent along with the envelope as HTTP headers,
+//and along with announcements to CoordinatorNodes as query parameters
+type Metadata struct {
+	//TTL is the time after CreatedOn the sender wants the message to be kept. 0 requests the longest time nodes allow.
+	//It is encoded as seconds in JSON, like in headers
+	TTL time.Duration `json:"-"`
+	//Size is the size of the envelope in bytes
+	Size int64 `json:"size"`
+	//CreatedOn is the time the sender created the message. Nodes use the time they received the message if it is not set
+	CreatedOn time.Time `json:"createdOn"`
+	//SHA256 is the hex encoded SHA-256 hash of the envelope
+	SHA256 string `json:"sha256"`
+	//Priority ranges from 0 to MaxPriority, higher priorities are more important
+	Priority int `json:"priority"`
+	//ExpiresOn is the time the message is removed, as determined by the node from TTL and its own limits. It is never set by senders
+	ExpiresOn time.Time `json:"expiresOn"`
+	//Stamp is the postage stamp paying for the message, see structs/stamp. It is passed on, but not stored
+	Stamp string `json:"-"`
+}
+
+//Header and query parameter names of the fields of Metadata. Size is sent as Content-Length or Upload-Length with envelopes
+const (
+	HeaderTTL       = "X-Message-TTL"
+	HeaderCreatedOn = "X-Message-Created"
+	HeaderHash      = "X-Content-Hash"
+	HeaderPriority  = "X-Message-Priority"
+	HeaderExpiresOn = "X-Message-Expires"
+	HeaderStamp     = stamp.Header
+)
+
+var queryNames = map[string]string{
+	HeaderTTL:       "ttl",
+	HeaderCreatedOn: "created",
+	HeaderHash:      "sha256",
+	HeaderPriority:  "priority",
+	HeaderExpiresOn: "expires",
+	HeaderStamp:     "stamp",
+}
+
+//ParseHeader reads the Metadata sent by a client. TTL is given in seconds, times as unix timestamps
+func ParseHeader(header http.Header) (Metadata, error) {
+	return parse(header.Get)
+}
+
+//WriteHeader sets the headers for all fields of m, except Size
+func (m Metadata) WriteHeader(header http.Header) {
+	m.encode(header.Set)
+}
+
+//ParseQuery reads Metadata from query parameters, as sent with announcements
+func ParseQuery(query url.Values) (Metadata, error) {
+	metadata, err := parse(func(name string) string { return query.Get(queryNames[name]) })
+	if err != nil {
+		return metadata, err
+	}
+	if size := query.Get("size"); size != "" {
+		if metadata.Size, err = strconv.ParseInt(size, 10, 64); err != nil || metadata.Size < 0 {
+			return metadata, errors.New("invalid size")
+		}
+	}
+	return metadata, nil
+}
+
+//Query returns m as query parameters
+func (m Metadata) Query() url.Values {
+	query := url.Values{}
+	m.encode(func(name string, value string) { query.Set(queryNames[name], value) })
+	query.Set("size", strconv.FormatInt(m.Size, 10))
+	return query
+}
+
+//MarshalJSON encodes m with TTL given in seconds
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	type fields Metadata
+	return json.Marshal(struct {
+		TTL int64 `json:"ttl"`
+		fields
+	}{int64(m.TTL / time.Second), fields(m)})
+}
+
+//UnmarshalJSON decodes metadata encoded by MarshalJSON
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	type fields Metadata
+	decoded := struct {
+		TTL int64 `json:"ttl"`
+		*fields
+	}{fields: (*fields)(m)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	m.TTL = time.Duration(decoded.TTL) * time.Second
+	return nil
+}
+
+func parse(get func(name string) string) (metadata Metadata, err error) {
+	if ttl := get(HeaderTTL); ttl != "" {
+		seconds, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil || seconds < 0 || seconds > int64(1<<62/time.Second) {
+			return metadata, errors.New("invalid " + HeaderTTL + ", expected seconds")
+		}
+		metadata.TTL = time.Duration(seconds) * time.Second
+	}
+	if metadata.CreatedOn, err = parseTime(get(HeaderCreatedOn)); err != nil {
+		return metadata, errors.New("invalid " + HeaderCreatedOn + ", expected a unix timestamp")
+	}
+	if metadata.ExpiresOn, err = parseTime(get(HeaderExpiresOn)); err != nil {
+		return metadata, errors.New("invalid " + HeaderExpiresOn + ", expected a unix timestamp")
+	}
+	if priority := get(HeaderPriority); priority != "" {
+		if metadata.Priority, err = strconv.Atoi(priority); err != nil || metadata.Priority < 0 || metadata.Priority > MaxPriority {
+			return metadata, errors.New("invalid " + HeaderPriority + ", expected 0 to " + strconv.Itoa(MaxPriority))
+		}
+	}
+	metadata.Stamp = get(HeaderStamp)
+	metadata.SHA256 = get(HeaderHash)
+	if len(metadata.SHA256) != 0 && len(metadata.SHA256) != 64 {
+		return metadata, errors.New("invalid " + HeaderHash + ", expected a hex encoded SHA-256 hash")
+	}
+	return metadata, nil
+}
+
+func (m Metadata) encode(set func(name string, value string)) {
+	if m.TTL > 0 {
+		set(HeaderTTL, strconv.FormatInt(int64(m.TTL/time.Second), 10))
+	}
+	if !m.CreatedOn.IsZero() {
+		set(HeaderCreatedOn, strconv.FormatInt(m.CreatedOn.Unix(), 10))
+	}
+	if m.SHA256 != "" {
+		set(HeaderHash, m.SHA256)
+	}
+	if m.Priority != 0 {
+		set(HeaderPriority, strconv.Itoa(m.Priority))
+	}
+	if m.Stamp != "" {
+		set(HeaderStamp, m.Stamp)
+	}
+	if !m.ExpiresOn.IsZero() {
+		set(HeaderExpiresOn, strconv.FormatInt(m.ExpiresOn.Unix(), 10))
+	}
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, 0).UTC(), nil
 }
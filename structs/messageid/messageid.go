@@ -0,0 +1,170 @@
+package messageid
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"strconv"
+)
+
+//Version is the version of the MessageID format written by String
+const Version = 1
+
+//FingerprintSize is the size of the fingerprint of the recipient's public key
+const FingerprintSize = sha256.Size
+
+//HashSize is the size of the hash of the confirmation key
+const HashSize = sha256.Size
+
+//MaxNonceSize is the maximum size of the optional nonce, which tells apart messages with the same recipient and confirmation key
+const MaxNonceSize = 16
+
+//MaxLength is the maximum length of a MessageID in text form
+var MaxLength = encoding.EncodedLen(1 + FingerprintSize + HashSize + MaxNonceSize)
+
+//encoding is the text form of MessageIDs: unpadded, lowercase base32, which is safe in URLs and file names and does not depend on case
+var encoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+//ErrMalformed is returned by Parse if a MessageID is not valid base32 in canonical form
+var ErrMalformed = errors.New("MessageID is not lowercase, unpadded base32")
+
+//ErrVersion is returned by Validate if a MessageID has an unknown version
+var ErrVersion = errors.New("unsupported MessageID version")
+
+//ErrLength is returned by Validate if a MessageID is too short, or its nonce too long
+var ErrLength = errors.New("invalid MessageID length")
+
+//ID is a MessageID. In binary form it consists of the version, the fingerprint of the recipient, the hash of the
+//confirmation key and the nonce, in this order. The text form is the binary form encoded as lowercase base32 without padding
+type ID struct {
+	Version byte
+	//Recipient is the SHA-256 fingerprint of the recipient's public key
+	Recipient [FingerprintSize]byte
+	//ConfirmationHash is the SHA-256 hash of the confirmation key, which only the recipient learns by decrypting the envelope
+	ConfirmationHash [HashSize]byte
+	//Nonce is optional, and up to MaxNonceSize bytes long
+	Nonce []byte
+}
+
+//New returns the MessageID of a message to the owner of recipientKey, confirmed with confirmationKey
+func New(recipientKey []byte, confirmationKey string, nonce []byte) (ID, error) {
+	id := ID{Version: Version, Recipient: Fingerprint(recipientKey), ConfirmationHash: sha256.Sum256([]byte(confirmationKey)), Nonce: nonce}
+	return id, id.Validate()
+}
+
+//Fingerprint returns the fingerprint of a recipient's public key, as contained in MessageIDs
+func Fingerprint(recipientKey []byte) [FingerprintSize]byte {
+	return sha256.Sum256(recipientKey)
+}
+
+//Parse reads a MessageID in text form. Only the canonical encoding is accepted, so every message has exactly one MessageID
+func Parse(value string) (ID, error) {
+	if len(value) > MaxLength {
+		return ID{}, ErrLength
+	}
+	raw, err := encoding.DecodeString(value)
+	if err != nil || encoding.EncodeToString(raw) != value {
+		return ID{}, ErrMalformed
+	}
+	if len(raw) < 1+FingerprintSize+HashSize {
+		return ID{}, ErrLength
+	}
+	id := ID{Version: raw[0]}
+	copy(id.Recipient[:], raw[1:])
+	copy(id.ConfirmationHash[:], raw[1+FingerprintSize:])
+	if nonce := raw[1+FingerprintSize+HashSize:]; len(nonce) > 0 {
+		id.Nonce = nonce
+	}
+	return id, id.Validate()
+}
+
+//Validate checks whether id can be written in the current format
+func (id ID) Validate() error {
+	if id.Version != Version {
+		return errors.New(ErrVersion.Error() + " " + strconv.Itoa(int(id.Version)))
+	}
+	if len(id.Nonce) > MaxNonceSize {
+		return ErrLength
+	}
+	return nil
+}
+
+//String returns the text form of id
+func (id ID) String() string {
+	raw := make([]byte, 0, 1+FingerprintSize+HashSize+len(id.Nonce))
+	raw = append(raw, id.Version)
+	raw = append(raw, id.Recipient[:]...)
+	raw = append(raw, id.ConfirmationHash[:]...)
+	raw = append(raw, id.Nonce...)
+	return encoding.EncodeToString(raw)
+}
+
+//Confirms returns whether key is the confirmation key of the message. The hashes are compared in constant time
+func (id ID) Confirms(key string) bool {
+	hash := sha256.Sum256([]byte(key))
+	return subtle.ConstantTimeCompare(hash[:], id.ConfirmationHash[:]) == 1
+}
+
+//BucketBits is the number of leading bits of recipient fingerprints CoordinatorNodes index messages by
+const BucketBits = 16
+
+//ErrPrefix is returned by ParsePrefix if a prefix is not a string of up to BucketBits zeros and ones
+var ErrPrefix = errors.New("prefix has to consist of up to " + strconv.Itoa(BucketBits) + " binary digits")
+
+//Bucket returns the bucket of id, the first BucketBits bits of its recipient fingerprint
+func (id ID) Bucket() int {
+	return int(id.Recipient[0])<<8 | int(id.Recipient[1])
+}
+
+//Prefix selects the buckets of all recipient fingerprints starting with its Bits leading bits, which are held by Value.
+//Shorter prefixes select more buckets, so inbox queries reveal less about the recipient
+type Prefix struct {
+	Bits  int
+	Value int
+}
+
+//PrefixOf returns the prefix of length bits of the fingerprint of id
+func PrefixOf(id ID, bits int) Prefix {
+	bits = max(0, min(bits, BucketBits))
+	return Prefix{Bits: bits, Value: id.Bucket() >> (BucketBits - bits)}
+}
+
+//ParsePrefix reads a prefix written as binary digits, e.g. "0110". The empty prefix selects all buckets
+func ParsePrefix(value string) (Prefix, error) {
+	if len(value) > BucketBits {
+		return Prefix{}, ErrPrefix
+	}
+	prefix := Prefix{Bits: len(value)}
+	for _, digit := range value {
+		if digit != '0' && digit != '1' {
+			return Prefix{}, ErrPrefix
+		}
+		prefix.Value = prefix.Value<<1 | int(digit-'0')
+	}
+	return prefix, nil
+}
+
+//String returns the prefix as binary digits
+func (p Prefix) String() string {
+	if p.Bits == 0 {
+		return ""
+	}
+	digits := strconv.FormatInt(int64(p.Value), 2)
+	for len(digits) < p.Bits {
+		digits = "0" + digits
+	}
+	return digits
+}
+
+//Buckets returns the first and last bucket selected by p
+func (p Prefix) Buckets() (first int, last int) {
+	shift := BucketBits - p.Bits
+	return p.Value << shift, (p.Value+1)<<shift - 1
+}
+
+//Matches returns whether id is in one of the buckets selected by p
+func (p Prefix) Matches(id ID) bool {
+	first, last := p.Buckets()
+	return id.Bucket() >= first && id.Bucket() <= last
+}
@@ -0,0 +1,142 @@
+package messageid
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, nonce := range [][]byte{nil, {1}, bytes.Repeat([]byte{0xff}, MaxNonceSize)} {
+		id, err := New([]byte("recipient"), "key", nonce)
+		if err != nil {
+			t.Fatalf("creating MessageID with a nonce of %d bytes failed: %v", len(nonce), err)
+		}
+		text := id.String()
+		if len(text) > MaxLength || strings.ToLower(text) != text {
+			t.Errorf("MessageID %q is too long or not lowercase", text)
+		}
+		parsed, err := Parse(text)
+		if err != nil {
+			t.Fatalf("parsing %q failed: %v", text, err)
+		}
+		if parsed.Version != Version || parsed.Recipient != Fingerprint([]byte("recipient")) || parsed.ConfirmationHash != id.ConfirmationHash || !bytes.Equal(parsed.Nonce, nonce) {
+			t.Errorf("parsing %q returned %+v, expected %+v", text, parsed, id)
+		}
+		if parsed.String() != text {
+			t.Errorf("parsed MessageID is written as %q, expected %q", parsed.String(), text)
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	id, err := New([]byte("recipient"), "key", []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := id.String()
+	//The nonce of one byte leaves unused bits in the last character, which must be zero
+	last := strings.IndexByte("abcdefghijklmnopqrstuvwxyz234567", valid[len(valid)-1])
+	nonCanonical := valid[:len(valid)-1] + string("abcdefghijklmnopqrstuvwxyz234567"[last^1])
+
+	for _, test := range []struct {
+		name  string
+		value string
+		err   error
+	}{
+		{"uppercase", strings.ToUpper(valid), ErrMalformed},
+		{"padded", valid + "======", ErrMalformed},
+		{"non-canonical", nonCanonical, ErrMalformed},
+		{"invalid character", valid[:len(valid)-1] + "1", ErrMalformed},
+		{"too short", ID{}.String()[:20], ErrLength},
+		{"too long nonce", ID{Version: Version, Nonce: make([]byte, MaxNonceSize+1)}.String(), ErrLength},
+		{"empty", "", ErrLength},
+	} {
+		if _, err := Parse(test.value); err != test.err {
+			t.Errorf("parsing %s MessageID returned %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	if _, err := Parse(ID{Version: Version + 1}.String()); err == nil || !strings.HasPrefix(err.Error(), ErrVersion.Error()) {
+		t.Errorf("parsing MessageID of an unknown version returned %v, expected %v", err, ErrVersion)
+	}
+	if _, err := New([]byte("recipient"), "key", make([]byte, MaxNonceSize+1)); err != ErrLength {
+		t.Errorf("creating MessageID with too long nonce returned %v, expected %v", err, ErrLength)
+	}
+}
+
+func TestConfirms(t *testing.T) {
+	id, err := New([]byte("recipient"), "key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !id.Confirms("key") {
+		t.Errorf("confirmation key does not confirm the message")
+	}
+	for _, key := range []string{"", "Key", "key "} {
+		if id.Confirms(key) {
+			t.Errorf("%q confirms the message", key)
+		}
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		first int
+		last  int
+	}{
+		{"", 0, 1<<BucketBits - 1},
+		{"1", 1 << (BucketBits - 1), 1<<BucketBits - 1},
+		{"0110", 0x6000, 0x6fff},
+		{"0000000000000000", 0, 0},
+		{"1111111111111111", 1<<BucketBits - 1, 1<<BucketBits - 1},
+	} {
+		prefix, err := ParsePrefix(test.value)
+		if err != nil {
+			t.Fatalf("parsing prefix %q failed: %v", test.value, err)
+		}
+		if prefix.Bits != len(test.value) || prefix.String() != test.value {
+			t.Errorf("prefix %q has %d bits and is written as %q", test.value, prefix.Bits, prefix.String())
+		}
+		if first, last := prefix.Buckets(); first != test.first || last != test.last {
+			t.Errorf("prefix %q selects buckets %d to %d, expected %d to %d", test.value, first, last, test.first, test.last)
+		}
+	}
+
+	for _, value := range []string{"2", "01a", " 1", strings.Repeat("0", BucketBits+1)} {
+		if _, err := ParsePrefix(value); err != ErrPrefix {
+			t.Errorf("parsing prefix %q returned %v, expected %v", value, err, ErrPrefix)
+		}
+	}
+}
+
+func TestPrefixOf(t *testing.T) {
+	id := ID{Version: Version, Recipient: [FingerprintSize]byte{0xa5, 0x3c}}
+	other := ID{Version: Version, Recipient: [FingerprintSize]byte{0xa5, 0x3d}}
+	if id.Bucket() != 0xa53c {
+		t.Errorf("MessageID is in bucket %x, expected a53c", id.Bucket())
+	}
+	for _, test := range []struct {
+		bits         int
+		prefix       string
+		matchesOther bool
+	}{
+		{0, "", true},
+		{-1, "", true},
+		{4, "1010", true},
+		{BucketBits, "1010010100111100", false},
+		{BucketBits + 4, "1010010100111100", false},
+	} {
+		prefix := PrefixOf(id, test.bits)
+		if prefix.String() != test.prefix {
+			t.Errorf("prefix of %d bits is %q, expected %q", test.bits, prefix.String(), test.prefix)
+		}
+		if !prefix.Matches(id) {
+			t.Errorf("prefix %q does not match its MessageID", prefix.String())
+		}
+		if prefix.Matches(other) != test.matchesOther {
+			t.Errorf("prefix %q matches the neighbouring bucket: %t, expected %t", prefix.String(), prefix.Matches(other), test.matchesOther)
+		}
+	}
+}
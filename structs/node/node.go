@@ -6,4 +6,6 @@ type Node struct {
 	Address  string    `json:"address"`
 	LastPing time.Time `json:"lastPing"`
 	Ping     int       `json:"ping"`
+	//IdentityKey is the base64 encoded public identity key of the node, empty if unknown
+	IdentityKey string `json:"identityKey,omitempty"`
 }
@@ -0,0 +1,169 @@
+package stamp
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Header is the HTTP header, and the name of the query parameter, stamps are sent in
+const Header = "X-Postage-Stamp"
+
+//RequiredHeader is set on responses rejecting a stamp, to the number of bits the node requires
+const RequiredHeader = "X-Postage-Bits"
+
+//Version is the version of the stamp format
+const Version = 1
+
+//MaxSkew is how far stamps may be timestamped in the future, to allow for clocks out of sync
+const MaxSkew = 5 * time.Minute
+
+//ErrMissing is returned by Check if a node requires a stamp, but none was sent
+var ErrMissing = errors.New("stamp required")
+
+//ErrMalformed is returned by Parse if a stamp is not in the expected format
+var ErrMalformed = errors.New("malformed stamp")
+
+//ErrInsufficient is returned by Check if a stamp proves less work than required
+var ErrInsufficient = errors.New("stamp has too few bits")
+
+//ErrInvalid is returned by Check if a stamp does not match the message or its hash misses the claimed bits
+var ErrInvalid = errors.New("stamp does not match the message")
+
+//ErrExpired is returned by Check if a stamp is too old, or timestamped too far in the future
+var ErrExpired = errors.New("stamp is expired")
+
+//Stamp is a hashcash-style proof of work, which senders attach to every message to make flooding nodes expensive.
+//A stamp is valid for a message if the SHA-256 hash of the stamp, the MessageID and the size of the message starts
+//with at least Bits zero bits. It is written as "<version>:<bits>:<unix timestamp>:<hex nonce>"
+type Stamp struct {
+	Bits      int
+	Timestamp time.Time
+	Nonce     uint64
+}
+
+//Parse reads a stamp as written by String
+func Parse(value string) (Stamp, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 || parts[0] != strconv.Itoa(Version) {
+		return Stamp{}, ErrMalformed
+	}
+	claimed, err := strconv.Atoi(parts[1])
+	if err != nil || claimed < 0 || claimed > sha256.Size*8 {
+		return Stamp{}, ErrMalformed
+	}
+	timestamp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return Stamp{}, ErrMalformed
+	}
+	nonce, err := strconv.ParseUint(parts[3], 16, 64)
+	if err != nil {
+		return Stamp{}, ErrMalformed
+	}
+	return Stamp{Bits: claimed, Timestamp: time.Unix(timestamp, 0).UTC(), Nonce: nonce}, nil
+}
+
+func (s Stamp) String() string {
+	return strconv.Itoa(Version) + ":" + strconv.Itoa(s.Bits) + ":" + strconv.FormatInt(s.Timestamp.Unix(), 10) + ":" + strconv.FormatUint(s.Nonce, 16)
+}
+
+//Valid returns whether s is a stamp for the message id of size bytes, and its hash starts with the claimed number of zero bits
+func (s Stamp) Valid(id string, size int64) bool {
+	return zeroBits(s.digest(id, size)) >= s.Bits
+}
+
+//digest hashes everything a stamp is bound to
+func (s Stamp) digest(id string, size int64) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strconv.Itoa(Version) + ":" + strconv.Itoa(s.Bits) + ":" + strconv.FormatInt(s.Timestamp.Unix(), 10) + ":" +
+		strconv.FormatInt(size, 10) + ":" + id + ":" + strconv.FormatUint(s.Nonce, 16)))
+}
+
+//zeroBits returns the number of leading zero bits of digest
+func zeroBits(digest [sha256.Size]byte) int {
+	count := 0
+	for _, b := range digest {
+		count += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return count
+}
+
+//Mint computes a stamp with the given number of bits for the message id of size bytes. Every additional bit doubles the
+//expected work, so the required bits should be taken from the Rules of the node the message is sent to.
+//Minting stops with the error of ctx once it is done
+func Mint(ctx context.Context, id string, size int64, required int) (Stamp, error) {
+	s := Stamp{Bits: required, Timestamp: time.Now().UTC().Truncate(time.Second)}
+	for ; ; s.Nonce++ {
+		if s.Valid(id, size) {
+			return s, nil
+		}
+		if s.Nonce&0xffff == 0 {
+			if err := ctx.Err(); err != nil {
+				return Stamp{}, err
+			}
+		}
+	}
+}
+
+//Rules describe the stamps a node accepts, as advertised by the node
+type Rules struct {
+	//Version is the stamp format version the node expects
+	Version int `json:"version"`
+	//BaseBits are required for messages up to SizeStep bytes. 0 means that the node does not require stamps
+	BaseBits int `json:"baseBits"`
+	//SizeStep is the size up to which BaseBits suffice. Every doubling of the size beyond requires another bit
+	SizeStep int64 `json:"sizeStep"`
+	//LoadBits are currently required in addition, as the node is filling up. They change with the load of the node
+	LoadBits int `json:"loadBits"`
+	//MaxLoadBits is the highest value of LoadBits, reached when the node is full
+	MaxLoadBits int `json:"maxLoadBits"`
+	//MaxAge is the time in seconds after their timestamp stamps are accepted
+	MaxAge int64 `json:"maxAge"`
+}
+
+//Enabled returns whether r requires stamps at all
+func (r Rules) Enabled() bool {
+	return r.BaseBits > 0
+}
+
+//Required returns the number of bits required for a message of size bytes
+func (r Rules) Required(size int64) int {
+	if !r.Enabled() {
+		return 0
+	}
+	required := r.BaseBits + r.LoadBits
+	for step := max(r.SizeStep, 1); step < size && step > 0; step *= 2 {
+		required++
+	}
+	return required
+}
+
+//Check returns nil if value is a stamp for the message id of size bytes, which satisfies r at now
+func (r Rules) Check(value string, id string, size int64, now time.Time) error {
+	if !r.Enabled() {
+		return nil
+	}
+	if value == "" {
+		return ErrMissing
+	}
+	s, err := Parse(value)
+	if err != nil {
+		return err
+	}
+	if s.Bits < r.Required(size) {
+		return ErrInsufficient
+	}
+	if s.Timestamp.After(now.Add(MaxSkew)) || now.Sub(s.Timestamp) > time.Duration(r.MaxAge)*time.Second {
+		return ErrExpired
+	}
+	if !s.Valid(id, size) {
+		return ErrInvalid
+	}
+	return nil
+}
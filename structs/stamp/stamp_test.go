@@ -0,0 +1,99 @@
+package stamp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+//minted is the timestamp of the stamps minted by mint, so their nonces and the outcome of every check are fixed
+var minted = time.Unix(1700000000, 0).UTC()
+
+//mint computes a stamp with the given number of bits like Mint, but with a fixed timestamp
+func mint(id string, size int64, bits int) Stamp {
+	s := Stamp{Bits: bits, Timestamp: minted}
+	for !s.Valid(id, size) {
+		s.Nonce++
+	}
+	return s
+}
+
+func TestMint(t *testing.T) {
+	s, err := Mint(context.Background(), "message", 100, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Valid("message", 100) || s.Bits != 8 || time.Since(s.Timestamp) > time.Minute {
+		t.Errorf("minted invalid stamp %+v", s)
+	}
+	parsed, err := Parse(s.String())
+	if err != nil || parsed != s {
+		t.Errorf("stamp %q is parsed as %+v, %v", s.String(), parsed, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = Mint(ctx, "message", 100, 64); err != context.Canceled {
+		t.Errorf("minting with a cancelled context returned %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	rules := Rules{Version: Version, BaseBits: 8, SizeStep: 1000, MaxAge: 3600}
+	stamp := mint("message", 500, 8).String()
+	for _, test := range []struct {
+		name  string
+		value string
+		id    string
+		size  int64
+		now   time.Time
+		err   error
+	}{
+		{"valid", stamp, "message", 500, minted.Add(time.Minute), nil},
+		{"missing", "", "message", 500, minted, ErrMissing},
+		{"malformed", "1:8:now:0", "message", 500, minted, ErrMalformed},
+		{"unknown version", "2" + stamp[1:], "message", 500, minted, ErrMalformed},
+		{"insufficient", mint("message", 500, 7).String(), "message", 500, minted, ErrInsufficient},
+		{"too small for the size", stamp, "message", 1500, minted, ErrInsufficient},
+		{"expired", stamp, "message", 500, minted.Add(time.Hour + time.Second), ErrExpired},
+		{"within skew", stamp, "message", 500, minted.Add(-MaxSkew), nil},
+		{"beyond skew", stamp, "message", 500, minted.Add(-MaxSkew - time.Second), ErrExpired},
+		{"different ID", stamp, "other message", 500, minted, ErrInvalid},
+		{"different size", stamp, "message", 501, minted, ErrInvalid},
+		{"claiming more bits", Stamp{Bits: 9, Timestamp: minted, Nonce: mint("message", 500, 8).Nonce}.String(), "message", 500, minted, ErrInvalid},
+	} {
+		if err := rules.Check(test.value, test.id, test.size, test.now); err != test.err {
+			t.Errorf("checking %s stamp returned %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	if err := (Rules{}).Check("", "message", 500, minted); err != nil {
+		t.Errorf("checking missing stamp against disabled rules returned %v", err)
+	}
+}
+
+func TestRequired(t *testing.T) {
+	rules := Rules{Version: Version, BaseBits: 8, SizeStep: 1000, MaxLoadBits: 4}
+	for _, test := range []struct {
+		size     int64
+		load     int
+		required int
+	}{
+		{0, 0, 8},
+		{1000, 0, 8},
+		{1001, 0, 9},
+		{2000, 0, 9},
+		{2001, 0, 10},
+		{8001, 0, 12},
+		{1000, 2, 10},
+		{2001, 4, 14},
+	} {
+		rules.LoadBits = test.load
+		if required := rules.Required(test.size); required != test.required {
+			t.Errorf("%d bytes require %d bits at %d load bits, expected %d", test.size, required, test.load, test.required)
+		}
+	}
+	if required := (Rules{SizeStep: 1000, LoadBits: 4}).Required(5000); required != 0 {
+		t.Errorf("disabled rules require %d bits", required)
+	}
+}